@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"swiflet-backend/internal/config"
 	"swiflet-backend/internal/database"
 	"swiflet-backend/internal/handlers"
 	"swiflet-backend/internal/middleware"
 	"swiflet-backend/internal/services"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 )
@@ -29,8 +35,40 @@ func main() {
 	}
 	defer db.Close()
 
+	// Keep raw sensor data and rollups only as long as configured
+	if err := services.ApplyRetentionPolicies(db, cfg.Retention); err != nil {
+		log.Printf("Warning: Failed to apply retention policies: %v", err)
+	}
+
+	// Give readings stored before devices reported their house a house and floor
+	if err := services.BackfillSensorContext(db); err != nil {
+		log.Printf("Warning: Failed to backfill sensor context: %v", err)
+	}
+
+	// Initialize device registry used by sensor ingestion
+	deviceRegistry := services.NewDeviceRegistry(db, cfg.Ingest.RegistryResync)
+	if err := deviceRegistry.Load(); err != nil {
+		log.Printf("Warning: Failed to load device registry: %v", err)
+	}
+	deviceRegistry.Start()
+	defer deviceRegistry.Stop()
+
+	// Track device last-seen times and online/offline status
+	presenceTracker := services.NewPresenceTracker(db, cfg.Presence.OfflineAfter, cfg.Presence.CheckInterval)
+	if err := presenceTracker.Load(); err != nil {
+		log.Printf("Warning: Failed to load device presence: %v", err)
+	}
+	presenceTracker.Start()
+	defer presenceTracker.Stop()
+
+	// Latest value of every device, kept up to date by ingestion
+	liveCache := services.NewLiveCache()
+	if err := liveCache.Load(db); err != nil {
+		log.Printf("Warning: Failed to load latest readings: %v", err)
+	}
+
 	// Initialize MQTT service
-	mqttService, err := services.NewMQTTService(cfg, db)
+	mqttService, err := services.NewMQTTService(cfg, db, deviceRegistry, presenceTracker)
 	if err != nil {
 		log.Printf("Warning: Failed to initialize MQTT service: %v", err)
 		log.Println("Server will continue without MQTT functionality")
@@ -40,43 +78,183 @@ func main() {
 		if err := mqttService.ConnectWithRetry(5); err != nil {
 			log.Printf("Warning: Failed to connect to MQTT broker after retries: %v", err)
 			log.Println("Server will continue without MQTT functionality")
+			mqttService.Disconnect()
+			mqttService = nil
+		}
+	}
+
+	// Disconnect flushes buffered readings to storage. It runs explicitly once
+	// the server has shut down, or on return when startup fails.
+	disconnectMQTT := func() {
+		if mqttService != nil {
+			mqttService.Disconnect()
 			mqttService = nil
-		} else {
-			defer mqttService.Disconnect()
 		}
 	}
+	defer disconnectMQTT()
+
+	// Fan readings and alerts out to stream subscribers
+	hub := services.NewHub()
+
+	if mqttService != nil {
+		mqttService.AddReadingObserver(liveCache)
+		mqttService.AddReadingObserver(hub)
+	}
+
+	// Evaluate automation rules against ingested readings
+	var commandSender services.CommandSender
+	if mqttService != nil {
+		commandSender = mqttService
+	}
+	automationEngine := services.NewAutomationEngine(db, deviceRegistry, commandSender)
+	if err := automationEngine.Load(); err != nil {
+		log.Printf("Warning: Failed to load automation rules: %v", err)
+	}
+	automationEngine.Start()
+	defer automationEngine.Stop()
+	if mqttService != nil {
+		mqttService.AddReadingObserver(automationEngine)
+	}
+
+	// Raise and resolve threshold alerts from ingested readings
+	alertEngine := services.NewAlertEngine(db, hub)
+	if err := alertEngine.Load(); err != nil {
+		log.Printf("Warning: Failed to load alert rules: %v", err)
+	}
+	alertEngine.Start()
+	defer alertEngine.Stop()
+	if mqttService != nil {
+		mqttService.AddReadingObserver(alertEngine)
+	}
 
 	// Initialize S3 service
 	s3Service, err := services.NewS3Service(cfg)
 	if err != nil {
-		log.Fatal("Failed to create S3 service:", err)
+		log.Printf("Failed to create S3 service: %v", err)
+		return
+	}
+
+	// Score the climate of every house floor per day
+	climateScorer, err := services.NewClimateScorer(db, cfg.Climate)
+	if err != nil {
+		log.Printf("Failed to create climate scorer: %v", err)
+		return
 	}
+	climateScorer.Start()
+	defer climateScorer.Stop()
+
+	// Flag devices whose sensors look stuck, drift from their siblings or went silent
+	faultDetector, err := services.NewFaultDetector(db, deviceRegistry, cfg.Faults)
+	if err != nil {
+		log.Printf("Failed to create sensor fault detector: %v", err)
+		return
+	}
+	faultDetector.Start()
+	defer faultDetector.Stop()
+
+	// Backfills readings uploaded through the import endpoint
+	sensorImporter := services.NewSensorImporter(db, deviceRegistry, cfg.Ingest)
+	sensorImporter.AddObserver(climateScorer)
+
+	// Issues install codes and per-device MQTT credentials
+	provisioner, err := services.NewProvisioner(db, cfg.MQTT)
+	if err != nil {
+		log.Printf("Failed to create device provisioner: %v", err)
+		return
+	}
+
+	// Stages firmware updates of gateways and tracks the version they report
+	firmwareRollouts := services.NewFirmwareRollouts(db, deviceRegistry, commandSender, s3Service, cfg.Firmware)
+	firmwareRollouts.Start()
+	defer firmwareRollouts.Stop()
+	if mqttService != nil {
+		mqttService.AddFirmwareObserver(firmwareRollouts)
+	}
+
+	// Shares houses with managers, workers and viewers invited by email
+	mailer := services.NewMailer(cfg.Mail)
+	memberships := services.NewMemberships(db, mailer, cfg.Invitations)
+
+	// Moves, decommissions and deletes devices and houses
+	deviceLifecycle := services.NewDeviceLifecycle(db, deviceRegistry, presenceTracker, liveCache,
+		automationEngine, alertEngine)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(db, cfg)
 	userHandler := handlers.NewUserHandler(db)
 	articleHandler := handlers.NewArticleHandler(db)
-	iotHandler := handlers.NewIoTHandler(db)
+	iotHandler := handlers.NewIoTHandler(db, deviceRegistry, presenceTracker, liveCache, sensorImporter, provisioner,
+		deviceLifecycle, cfg.Retention)
 	tagHandler := handlers.NewTagHandler(db)
 	commentHandler := handlers.NewCommentHandler(db)
 	ebookHandler := handlers.NewEBookHandler(db)
 	uploadHandler := handlers.NewUploadHandler(db, s3Service)
+	ingestionHandler := handlers.NewIngestionHandler(db, mqttService)
+	metricHandler := handlers.NewMetricHandler(db, deviceRegistry)
+	commandHandler := handlers.NewCommandHandler(db, mqttService)
+	automationHandler := handlers.NewAutomationHandler(db, automationEngine)
+	alertHandler := handlers.NewAlertHandler(db, alertEngine)
+	streamHandler := handlers.NewStreamHandler(db, deviceRegistry, hub)
+	climateHandler := handlers.NewClimateHandler(db, climateScorer)
+	provisioningHandler := handlers.NewProvisioningHandler(db, deviceRegistry, provisioner, cfg.MQTT.AuthHookToken)
+	faultHandler := handlers.NewFaultHandler(db)
+	harvestHandler := handlers.NewHarvestHandler(db)
+	requestHandler := handlers.NewRequestHandler(db)
+	memberHandler := handlers.NewMemberHandler(db, memberships)
+	firmwareHandler := handlers.NewFirmwareHandler(db, s3Service, firmwareRollouts)
 
 	// Setup router
-	router := setupRouter(cfg, authHandler, userHandler, articleHandler, iotHandler, tagHandler, commentHandler, ebookHandler, uploadHandler)
+	router := setupRouter(cfg, db, authHandler, userHandler, articleHandler, iotHandler, tagHandler, commentHandler, ebookHandler, uploadHandler, ingestionHandler, metricHandler, commandHandler, automationHandler, alertHandler, streamHandler, climateHandler, faultHandler, provisioningHandler, harvestHandler, requestHandler, memberHandler, firmwareHandler)
 
 	// Start server
 	serverAddr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	log.Printf("Starting server on %s", serverAddr)
-	
-	if err := router.Run(serverAddr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := &http.Server{
+		Addr:    serverAddr,
+		Handler: router,
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting server on %s", serverAddr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to start server: %v", err)
+			return
+		}
+	case <-ctx.Done():
+		stop()
+		log.Println("Shutting down server...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Server shutdown did not complete: %v", err)
+		}
+	}
+
+	// No request can publish or read MQTT anymore, so flush ingestion before
+	// the engines fed by it are stopped
+	disconnectMQTT()
+	log.Println("Server stopped")
 }
 
-func setupRouter(cfg *config.Config, authHandler *handlers.AuthHandler, userHandler *handlers.UserHandler, 
+func setupRouter(cfg *config.Config, db *database.DB, authHandler *handlers.AuthHandler, userHandler *handlers.UserHandler, 
 	articleHandler *handlers.ArticleHandler, iotHandler *handlers.IoTHandler, tagHandler *handlers.TagHandler, 
-	commentHandler *handlers.CommentHandler, ebookHandler *handlers.EBookHandler, uploadHandler *handlers.UploadHandler) *gin.Engine {
+	commentHandler *handlers.CommentHandler, ebookHandler *handlers.EBookHandler, uploadHandler *handlers.UploadHandler,
+	ingestionHandler *handlers.IngestionHandler, metricHandler *handlers.MetricHandler,
+	commandHandler *handlers.CommandHandler, automationHandler *handlers.AutomationHandler,
+	alertHandler *handlers.AlertHandler, streamHandler *handlers.StreamHandler,
+	climateHandler *handlers.ClimateHandler, faultHandler *handlers.FaultHandler,
+	provisioningHandler *handlers.ProvisioningHandler, harvestHandler *handlers.HarvestHandler,
+	requestHandler *handlers.RequestHandler, memberHandler *handlers.MemberHandler,
+	firmwareHandler *handlers.FirmwareHandler) *gin.Engine {
 	router := gin.New()
 
 	// Add middleware
@@ -120,6 +298,16 @@ func setupRouter(cfg *config.Config, authHandler *handlers.AuthHandler, userHand
 			auth.POST("/login", authHandler.Login)
 		}
 
+		// Broker authentication hooks, protected by MQTT_AUTH_HOOK_TOKEN
+		if cfg.MQTT.AuthHookToken != "" {
+			mqttHooks := v1.Group("/mqtt")
+			{
+				mqttHooks.POST("/auth", provisioningHandler.MQTTAuth)
+				mqttHooks.POST("/superuser", provisioningHandler.MQTTSuperuser)
+				mqttHooks.POST("/acl", provisioningHandler.MQTTACL)
+			}
+		}
+
 		// Protected routes
 		protected := v1.Group("/")
 		protected.Use(middleware.AuthMiddleware(cfg))
@@ -207,13 +395,11 @@ func setupRouter(cfg *config.Config, authHandler *handlers.AuthHandler, userHand
 					c.JSON(201, gin.H{"message": "Weekly price created"})
 				})
 
-			protected.Group("/harvests").
-				GET("", func(c *gin.Context) {
-					c.JSON(200, gin.H{"data": []interface{}{}})
-				}).
-				POST("", func(c *gin.Context) {
-					c.JSON(201, gin.H{"message": "Harvest created"})
-				})
+			harvests := protected.Group("/harvests")
+			{
+				harvests.GET("", harvestHandler.ListHarvests)
+				harvests.POST("", harvestHandler.CreateHarvest)
+			}
 
 			protected.Group("/harvest-sales").
 				GET("", func(c *gin.Context) {
@@ -228,43 +414,152 @@ func setupRouter(cfg *config.Config, authHandler *handlers.AuthHandler, userHand
 			{
 				houses.GET("", iotHandler.ListSwifletHouses)
 				houses.POST("", iotHandler.CreateSwifletHouse)
+				houses.GET("/:id", iotHandler.GetSwifletHouse)
+				houses.PATCH("/:id", iotHandler.UpdateSwifletHouse)
+				houses.DELETE("/:id", iotHandler.DeleteSwifletHouse)
+				houses.GET("/:id/live", iotHandler.GetHouseLive)
+				houses.GET("/:id/climate", climateHandler.GetHouseClimate)
+				houses.GET("/:id/harvest-climate", climateHandler.GetHarvestClimate)
+				houses.GET("/:id/members", memberHandler.ListHouseMembers)
+				houses.PATCH("/:id/members/:user_id", memberHandler.UpdateHouseMember)
+				houses.DELETE("/:id/members/:user_id", memberHandler.RemoveHouseMember)
+				houses.GET("/:id/invitations", memberHandler.ListHouseInvitations)
+				houses.POST("/:id/invitations", memberHandler.InviteHouseMember)
+				houses.DELETE("/:id/invitations/:invitation_id", memberHandler.RevokeHouseInvitation)
 			}
 
+			protected.POST("/invitations/accept", memberHandler.AcceptInvitation)
+
 			devices := protected.Group("/iot-devices")
 			{
 				devices.GET("", iotHandler.ListIoTDevices)
 				devices.POST("", iotHandler.CreateIoTDevice)
+				devices.POST("/claim", provisioningHandler.ClaimDevice)
+				devices.GET("/:id", iotHandler.GetIoTDevice)
+				devices.PATCH("/:id", iotHandler.UpdateIoTDevice)
+				devices.DELETE("/:id", iotHandler.DeleteIoTDevice)
+				devices.POST("/:id/decommission", iotHandler.DecommissionIoTDevice)
+				devices.GET("/:id/assignments", iotHandler.ListDeviceAssignments)
+				devices.POST("/:id/credentials", provisioningHandler.RotateDeviceCredentials)
+				devices.GET("/:id/status-history", iotHandler.GetDeviceStatusHistory)
+				devices.GET("/:id/commands", commandHandler.ListCommands)
+				devices.POST("/:id/commands", commandHandler.SendCommand)
+				devices.GET("/:id/commands/:command_id", commandHandler.GetCommand)
+				devices.GET("/:id/metrics", metricHandler.GetDeviceMetrics)
+				devices.PUT("/:id/metrics", metricHandler.SetDeviceMetrics)
 			}
 
 			sensors := protected.Group("/sensors")
 			{
 				sensors.GET("", iotHandler.ListSensors)
+				sensors.GET("/measurements", iotHandler.ListSensorMeasurements)
+				sensors.GET("/aggregate", iotHandler.GetSensorAggregates)
+				sensors.GET("/export", iotHandler.ExportSensors)
+				sensors.POST("/import", iotHandler.ImportSensors)
 			}
 
-			// Request routes (placeholder)
-			protected.Group("/installation-requests").
-				GET("", func(c *gin.Context) {
-					c.JSON(200, gin.H{"data": []interface{}{}})
-				}).
-				POST("", func(c *gin.Context) {
-					c.JSON(201, gin.H{"message": "Installation request created"})
-				})
+			deviceFaults := protected.Group("/device-faults")
+			{
+				deviceFaults.GET("", faultHandler.ListDeviceFaults)
+				deviceFaults.GET("/:id", faultHandler.GetDeviceFault)
+				deviceFaults.POST("/:id/resolve", faultHandler.ResolveDeviceFault)
+			}
 
-			protected.Group("/maintenance-requests").
-				GET("", func(c *gin.Context) {
-					c.JSON(200, gin.H{"data": []interface{}{}})
-				}).
-				POST("", func(c *gin.Context) {
-					c.JSON(201, gin.H{"message": "Maintenance request created"})
-				})
+			automationRules := protected.Group("/automation-rules")
+			{
+				automationRules.GET("", automationHandler.ListAutomationRules)
+				automationRules.POST("", automationHandler.CreateAutomationRule)
+				automationRules.GET("/:id", automationHandler.GetAutomationRule)
+				automationRules.PUT("/:id", automationHandler.UpdateAutomationRule)
+				automationRules.DELETE("/:id", automationHandler.DeleteAutomationRule)
+				automationRules.GET("/:id/audit-log", automationHandler.GetAutomationAuditLog)
+			}
 
-			protected.Group("/uninstallation-requests").
-				GET("", func(c *gin.Context) {
-					c.JSON(200, gin.H{"data": []interface{}{}})
-				}).
-				POST("", func(c *gin.Context) {
-					c.JSON(201, gin.H{"message": "Uninstallation request created"})
-				})
+			alertRules := protected.Group("/alert-rules")
+			{
+				alertRules.GET("", alertHandler.ListAlertRules)
+				alertRules.POST("", alertHandler.CreateAlertRule)
+				alertRules.GET("/:id", alertHandler.GetAlertRule)
+				alertRules.PUT("/:id", alertHandler.UpdateAlertRule)
+				alertRules.DELETE("/:id", alertHandler.DeleteAlertRule)
+			}
+
+			alerts := protected.Group("/alerts")
+			{
+				alerts.GET("", alertHandler.ListAlerts)
+				alerts.GET("/:id", alertHandler.GetAlert)
+				alerts.POST("/:id/acknowledge", alertHandler.AcknowledgeAlert)
+				alerts.POST("/:id/resolve", alertHandler.ResolveAlert)
+			}
+
+			protected.GET("/stream", streamHandler.Stream)
+
+			metricTypes := protected.Group("/metric-types")
+			{
+				metricTypes.GET("", metricHandler.ListMetricTypes)
+				metricTypes.POST("", middleware.AdminMiddleware(db), metricHandler.CreateMetricType)
+				metricTypes.PATCH("/:key", middleware.AdminMiddleware(db), metricHandler.UpdateMetricType)
+			}
+
+			provisioning := protected.Group("/device-provisioning")
+			provisioning.Use(middleware.AdminMiddleware(db))
+			{
+				provisioning.GET("", provisioningHandler.ListProvisions)
+				provisioning.POST("", provisioningHandler.ProvisionDevices)
+				provisioning.POST("/:id/revoke", provisioningHandler.RevokeProvision)
+			}
+
+			firmware := protected.Group("/firmware")
+			firmware.Use(middleware.AdminMiddleware(db))
+			{
+				firmware.GET("", firmwareHandler.ListFirmware)
+				firmware.POST("", firmwareHandler.UploadFirmware)
+				firmware.GET("/:id", firmwareHandler.GetFirmware)
+			}
+
+			rollouts := protected.Group("/firmware-rollouts")
+			rollouts.Use(middleware.AdminMiddleware(db))
+			{
+				rollouts.GET("", firmwareHandler.ListFirmwareRollouts)
+				rollouts.POST("", firmwareHandler.CreateFirmwareRollout)
+				rollouts.GET("/:id", firmwareHandler.GetFirmwareRollout)
+				rollouts.GET("/:id/devices", firmwareHandler.ListFirmwareRolloutDevices)
+				rollouts.POST("/:id/pause", firmwareHandler.PauseFirmwareRollout)
+				rollouts.POST("/:id/resume", firmwareHandler.ResumeFirmwareRollout)
+				rollouts.POST("/:id/cancel", firmwareHandler.CancelFirmwareRollout)
+			}
+
+			ingestion := protected.Group("/ingestion")
+			ingestion.Use(middleware.AdminMiddleware(db))
+			{
+				ingestion.GET("/stats", ingestionHandler.GetStats)
+				ingestion.GET("/dead-letters", ingestionHandler.ListDeadLetters)
+				ingestion.DELETE("/dead-letters", ingestionHandler.PurgeDeadLetters)
+				ingestion.GET("/dead-letters/:id", ingestionHandler.GetDeadLetter)
+				ingestion.POST("/dead-letters/:id/replay", ingestionHandler.ReplayDeadLetter)
+				ingestion.DELETE("/dead-letters/:id", ingestionHandler.DeleteDeadLetter)
+				ingestion.GET("/quarantine", ingestionHandler.ListQuarantine)
+				ingestion.GET("/quarantine/devices", ingestionHandler.GetQuarantineCounts)
+			}
+
+			// Request routes
+			installationRequests := protected.Group("/installation-requests")
+			{
+				installationRequests.GET("", requestHandler.ListInstallationRequests)
+				installationRequests.POST("", requestHandler.CreateInstallationRequest)
+			}
+
+			maintenanceRequests := protected.Group("/maintenance-requests")
+			{
+				maintenanceRequests.GET("", requestHandler.ListMaintenanceRequests)
+				maintenanceRequests.POST("", requestHandler.CreateMaintenanceRequest)
+			}
+
+			uninstallationRequests := protected.Group("/uninstallation-requests")
+			{
+				uninstallationRequests.GET("", requestHandler.ListUninstallationRequests)
+				uninstallationRequests.POST("", requestHandler.CreateUninstallationRequest)
+			}
 
 			// Transaction routes (placeholder)
 			protected.Group("/transactions").
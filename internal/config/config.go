@@ -9,13 +9,21 @@ import (
 )
 
 type Config struct {
-	Database   DatabaseConfig
+	Database    DatabaseConfig
 	TimescaleDB TimescaleConfig
-	JWT        JWTConfig
-	Server     ServerConfig
-	MQTT       MQTTConfig
-	Redis      RedisConfig
-	S3         S3Config
+	JWT         JWTConfig
+	Server      ServerConfig
+	MQTT        MQTTConfig
+	Ingest      IngestConfig
+	Presence    PresenceConfig
+	Retention   RetentionConfig
+	Climate     ClimateConfig
+	Faults      FaultConfig
+	Mail        MailConfig
+	Invitations InvitationConfig
+	Firmware    FirmwareConfig
+	Redis       RedisConfig
+	S3          S3Config
 }
 
 type DatabaseConfig struct {
@@ -45,6 +53,9 @@ type ServerConfig struct {
 	Host string
 	Port int
 	Mode string
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// once the server is asked to stop
+	ShutdownTimeout time.Duration
 }
 
 type MQTTConfig struct {
@@ -54,6 +65,104 @@ type MQTTConfig struct {
 	Password     string
 	TopicSensor  string
 	TopicControl string
+	// DecoderRoutes maps topic filters to payload decoders, e.g. "sensors/+/batch=json-batch;sensors/+/cbor=cbor"
+	DecoderRoutes string
+	// TopicHeartbeat carries device heartbeats; the + level is the install_code
+	TopicHeartbeat string
+	// TopicCommandAck carries command acknowledgements; the + level is the install_code
+	TopicCommandAck   string
+	CommandAckTimeout time.Duration
+	// TopicFirmware carries the firmware version reported by devices; the + level is the install_code
+	TopicFirmware string
+	// AuthHookToken protects the broker authentication hooks; they are
+	// disabled while it is empty
+	AuthHookToken string
+}
+
+type PresenceConfig struct {
+	// OfflineAfter is how long a device may be silent before it is marked offline
+	OfflineAfter  time.Duration
+	CheckInterval time.Duration
+}
+
+// RetentionConfig controls how long sensor data is kept in TimescaleDB. A
+// zero duration keeps data forever.
+type RetentionConfig struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+	// RollupAfter is the time range above which aggregates are read from the rollups
+	RollupAfter time.Duration
+}
+
+type IngestConfig struct {
+	Workers        int
+	QueueSize      int
+	BatchSize      int
+	FlushInterval  time.Duration
+	EnqueueTimeout time.Duration
+	// RegistryResync is how often the install_code cache is reloaded from PostgreSQL
+	RegistryResync time.Duration
+	// SpikeWindow is how old a device's last value may be to be used for spike detection
+	SpikeWindow time.Duration
+	// DedupWindow is how long accepted readings are remembered to drop redeliveries
+	DedupWindow time.Duration
+}
+
+// ClimateConfig controls the daily climate suitability scoring
+type ClimateConfig struct {
+	// Bands lists the optimal band of each scored metric, "metric:min-max" or
+	// "metric:min-max:tolerance" separated by commas
+	Bands    string
+	Timezone string
+	// Bucket is the resolution at which readings are compared with the bands
+	Bucket       time.Duration
+	Interval     time.Duration
+	BackfillDays int
+}
+
+// FaultConfig controls the detection of stuck, drifting and silent sensors
+type FaultConfig struct {
+	CheckInterval time.Duration
+	// Window is the period of readings examined for flat-lines and drift
+	Window time.Duration
+	// MinSamples is how many readings of a metric the window needs to be judged
+	MinSamples int
+	// FlatLineRange is the largest spread of values still considered flat
+	FlatLineRange float64
+	// DriftThresholds lists how far a device's mean may be from its floor
+	// siblings per metric, "metric:threshold" separated by commas
+	DriftThresholds string
+	// GapAfter is how long a device may send no readings
+	GapAfter time.Duration
+}
+
+// MailConfig is the SMTP server used to send email. Mail is disabled while
+// Host is empty.
+type MailConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// InvitationConfig controls the email invitations to swiflet houses
+type InvitationConfig struct {
+	TTL time.Duration
+	// AcceptURL is the app page that accepts an invitation; the token is
+	// added as the token query parameter
+	AcceptURL string
+}
+
+// FirmwareConfig controls over-the-air firmware rollouts
+type FirmwareConfig struct {
+	CheckInterval time.Duration
+	// UpdateTimeout is how long a device may take to report the new version
+	// after the update command was sent
+	UpdateTimeout time.Duration
+	// URLTTL is how long the download link sent to devices stays valid
+	URLTTL time.Duration
 }
 
 type RedisConfig struct {
@@ -97,17 +206,75 @@ func Load() (*Config, error) {
 			Expiry: getEnvAsDuration("JWT_EXPIRY", 24*time.Hour),
 		},
 		Server: ServerConfig{
-			Host: getEnv("SERVER_HOST", "0.0.0.0"),
-			Port: getEnvAsInt("SERVER_PORT", 8080),
-			Mode: getEnv("GIN_MODE", "debug"),
+			Host:            getEnv("SERVER_HOST", "0.0.0.0"),
+			Port:            getEnvAsInt("SERVER_PORT", 8080),
+			Mode:            getEnv("GIN_MODE", "debug"),
+			ShutdownTimeout: getEnvAsDuration("SERVER_SHUTDOWN_TIMEOUT", 15*time.Second),
 		},
 		MQTT: MQTTConfig{
-			Broker:       getEnv("MQTT_BROKER", "tcp://localhost:1883"),
-			ClientID:     getEnv("MQTT_CLIENT_ID", "swiflet-backend"),
-			Username:     getEnv("MQTT_USERNAME", ""),
-			Password:     getEnv("MQTT_PASSWORD", ""),
-			TopicSensor:  getEnv("MQTT_TOPIC_SENSOR", "sensors/+/data"),
-			TopicControl: getEnv("MQTT_TOPIC_CONTROL", "control/+/command"),
+			Broker:            getEnv("MQTT_BROKER", "tcp://localhost:1883"),
+			ClientID:          getEnv("MQTT_CLIENT_ID", "swiflet-backend"),
+			Username:          getEnv("MQTT_USERNAME", ""),
+			Password:          getEnv("MQTT_PASSWORD", ""),
+			TopicSensor:       getEnv("MQTT_TOPIC_SENSOR", "sensors/+/data"),
+			TopicControl:      getEnv("MQTT_TOPIC_CONTROL", "control/+/command"),
+			DecoderRoutes:     getEnv("MQTT_DECODER_ROUTES", "sensors/+/batch=json-batch;sensors/+/cbor=cbor"),
+			TopicHeartbeat:    getEnv("MQTT_TOPIC_HEARTBEAT", "devices/+/heartbeat"),
+			TopicCommandAck:   getEnv("MQTT_TOPIC_COMMAND_ACK", "control/+/ack"),
+			CommandAckTimeout: getEnvAsDuration("MQTT_COMMAND_ACK_TIMEOUT", 2*time.Minute),
+			AuthHookToken:     getEnv("MQTT_AUTH_HOOK_TOKEN", ""),
+			TopicFirmware:     getEnv("MQTT_TOPIC_FIRMWARE", "devices/+/firmware"),
+		},
+		Ingest: IngestConfig{
+			Workers:        getEnvAsInt("INGEST_WORKERS", 2),
+			QueueSize:      getEnvAsInt("INGEST_QUEUE_SIZE", 10000),
+			BatchSize:      getEnvAsInt("INGEST_BATCH_SIZE", 500),
+			FlushInterval:  getEnvAsDuration("INGEST_FLUSH_INTERVAL", time.Second),
+			EnqueueTimeout: getEnvAsDuration("INGEST_ENQUEUE_TIMEOUT", 2*time.Second),
+			RegistryResync: getEnvAsDuration("DEVICE_REGISTRY_RESYNC_INTERVAL", 5*time.Minute),
+			SpikeWindow:    getEnvAsDuration("INGEST_SPIKE_WINDOW", 30*time.Minute),
+			DedupWindow:    getEnvAsDuration("INGEST_DEDUP_WINDOW", 10*time.Minute),
+		},
+		Presence: PresenceConfig{
+			OfflineAfter:  getEnvAsDuration("DEVICE_OFFLINE_AFTER", 5*time.Minute),
+			CheckInterval: getEnvAsDuration("DEVICE_PRESENCE_CHECK_INTERVAL", 30*time.Second),
+		},
+		Retention: RetentionConfig{
+			Raw:         getEnvAsDuration("SENSOR_RAW_RETENTION", 365*24*time.Hour),
+			Hourly:      getEnvAsDuration("SENSOR_HOURLY_RETENTION", 3*365*24*time.Hour),
+			Daily:       getEnvAsDuration("SENSOR_DAILY_RETENTION", 0),
+			RollupAfter: getEnvAsDuration("SENSOR_ROLLUP_AFTER", 48*time.Hour),
+		},
+		Climate: ClimateConfig{
+			Bands:        getEnv("CLIMATE_BANDS", "suhu:26-29,kelembaban:80-95"),
+			Timezone:     getEnv("CLIMATE_TIMEZONE", "Asia/Jakarta"),
+			Bucket:       getEnvAsDuration("CLIMATE_SCORE_BUCKET", 5*time.Minute),
+			Interval:     getEnvAsDuration("CLIMATE_SCORE_INTERVAL", time.Hour),
+			BackfillDays: getEnvAsInt("CLIMATE_SCORE_BACKFILL_DAYS", 7),
+		},
+		Faults: FaultConfig{
+			CheckInterval:   getEnvAsDuration("FAULT_CHECK_INTERVAL", 15*time.Minute),
+			Window:          getEnvAsDuration("FAULT_WINDOW", 24*time.Hour),
+			MinSamples:      getEnvAsInt("FAULT_MIN_SAMPLES", 12),
+			FlatLineRange:   getEnvAsFloat("FAULT_FLATLINE_RANGE", 0.01),
+			DriftThresholds: getEnv("FAULT_DRIFT_THRESHOLDS", "suhu:2,kelembaban:8"),
+			GapAfter:        getEnvAsDuration("FAULT_GAP_AFTER", 2*time.Hour),
+		},
+		Mail: MailConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     getEnvAsInt("SMTP_PORT", 587),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", "Swiftlead <no-reply@swiftlead.id>"),
+		},
+		Invitations: InvitationConfig{
+			TTL:       getEnvAsDuration("HOUSE_INVITATION_TTL", 7*24*time.Hour),
+			AcceptURL: getEnv("HOUSE_INVITATION_URL", "http://localhost:3000/invitations/accept"),
+		},
+		Firmware: FirmwareConfig{
+			CheckInterval: getEnvAsDuration("FIRMWARE_ROLLOUT_INTERVAL", 30*time.Second),
+			UpdateTimeout: getEnvAsDuration("FIRMWARE_UPDATE_TIMEOUT", 30*time.Minute),
+			URLTTL:        getEnvAsDuration("FIRMWARE_URL_TTL", 6*time.Hour),
 		},
 		Redis: RedisConfig{
 			Host:     getEnv("REDIS_HOST", "localhost"),
@@ -143,6 +310,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -150,4 +326,4 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isAdmin reports whether a user has the admin role
+func isAdmin(db *database.DB, userID int) (bool, error) {
+	var role sql.NullInt64
+	err := db.PostgreSQL.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	return role.Valid && role.Int64 == models.RoleAdmin, nil
+}
+
+// authorizeHouse checks that the swiflet house exists, was not deleted and
+// that the authenticated user has at least the given role in it (owner,
+// manager, worker or viewer), or is an admin. It writes the error response
+// and returns false otherwise.
+func authorizeHouse(c *gin.Context, db *database.DB, houseID int, role string) bool {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return false
+	}
+
+	userRole, err := services.HouseRole(db, houseID, userID.(int))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Swiflet house not found",
+			})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return false
+	}
+
+	if services.HouseRoleAtLeast(userRole, role) {
+		return true
+	}
+
+	admin, err := isAdmin(db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return false
+	}
+	if admin {
+		return true
+	}
+
+	if userRole != "" {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error:   "Your role in this swiflet house does not allow this",
+			Details: map[string]string{"role": userRole, "required": role},
+		})
+		return false
+	}
+	c.JSON(http.StatusForbidden, models.ErrorResponse{
+		Error: "Access to this swiflet house denied",
+	})
+	return false
+}
+
+// canAccessHouse reports whether the user has at least the given role in the
+// swiflet house, or is an admin. Unknown and deleted houses are not
+// accessible.
+func canAccessHouse(db *database.DB, houseID, userID int, role string) (bool, error) {
+	userRole, err := services.HouseRole(db, houseID, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if services.HouseRoleAtLeast(userRole, role) {
+		return true, nil
+	}
+	return isAdmin(db, userID)
+}
+
+// houseVisible is a condition on swiflet_houses h that holds for houses the
+// user in placeholder user owns or is a member of, or for every house when
+// placeholder admin is true
+func houseVisible(admin, user int) string {
+	return fmt.Sprintf(`($%d OR h.id_user = $%d OR EXISTS (
+		SELECT 1 FROM house_members hm WHERE hm.id_swiflet_house = h.id AND hm.id_user = $%d))`, admin, user, user)
+}
+
+// accessibleHouses returns the ids of the houses the authenticated user owns
+// or is a member of.
+// all is true for admins, who may access every house. It writes the error
+// response and returns false otherwise.
+func accessibleHouses(c *gin.Context, db *database.DB) (houseIDs []int64, all bool, ok bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return nil, false, false
+	}
+
+	admin, err := isAdmin(db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return nil, false, false
+	}
+	if admin {
+		return nil, true, true
+	}
+
+	rows, err := db.PostgreSQL.Query(`
+		SELECT h.id FROM swiflet_houses h WHERE h.deleted_at IS NULL AND `+houseVisible(1, 2), false, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return nil, false, false
+	}
+	defer rows.Close()
+
+	houseIDs = []int64{}
+	for rows.Next() {
+		var houseID int64
+		if err := rows.Scan(&houseID); err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return nil, false, false
+		}
+		houseIDs = append(houseIDs, houseID)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return nil, false, false
+	}
+	return houseIDs, false, true
+}
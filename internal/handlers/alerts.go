@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type AlertHandler struct {
+	db       *database.DB
+	engine   *services.AlertEngine
+	validate *validator.Validate
+}
+
+func NewAlertHandler(db *database.DB, engine *services.AlertEngine) *AlertHandler {
+	return &AlertHandler{
+		db:       db,
+		engine:   engine,
+		validate: validator.New(),
+	}
+}
+
+// alertRuleRequest is the body of create and update requests
+type alertRuleRequest struct {
+	SwifletHouseID    int     `json:"id_swiflet_house" validate:"required"`
+	Floor             *int    `json:"floor"`
+	Name              string  `json:"name" validate:"required,max=255"`
+	Metric            string  `json:"metric" validate:"required"`
+	Operator          string  `json:"operator" validate:"required,oneof=below above"`
+	WarningThreshold  float64 `json:"warning_threshold"`
+	CriticalThreshold float64 `json:"critical_threshold"`
+	Hysteresis        float64 `json:"hysteresis" validate:"min=0"`
+	Enabled           *bool   `json:"enabled"`
+}
+
+const alertRuleColumns = `id, id_user, id_swiflet_house, floor, name, metric, operator, warning_threshold,
+	critical_threshold, hysteresis, enabled, created_at, updated_at`
+
+func scanAlertRule(row interface{ Scan(...interface{}) error }) (models.AlertRule, error) {
+	var rule models.AlertRule
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.SwifletHouseID, &rule.Floor, &rule.Name, &rule.Metric,
+		&rule.Operator, &rule.WarningThreshold, &rule.CriticalThreshold, &rule.Hysteresis, &rule.Enabled,
+		&rule.CreatedAt, &rule.UpdatedAt)
+	return rule, err
+}
+
+// bindAlertRule reads and checks a rule request. The metric must be registered
+// and the critical threshold must lie beyond the warning threshold.
+func (h *AlertHandler) bindAlertRule(c *gin.Context) (alertRuleRequest, bool) {
+	var request alertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return request, false
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed: " + err.Error(),
+		})
+		return request, false
+	}
+
+	if request.CriticalThreshold != request.WarningThreshold &&
+		!(request.Operator == models.OperatorBelow && request.CriticalThreshold < request.WarningThreshold) &&
+		!(request.Operator == models.OperatorAbove && request.CriticalThreshold > request.WarningThreshold) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Critical threshold must not be less severe than the warning threshold",
+			Details: map[string]string{
+				"warning_threshold":  strconv.FormatFloat(request.WarningThreshold, 'g', -1, 64),
+				"critical_threshold": strconv.FormatFloat(request.CriticalThreshold, 'g', -1, 64),
+			},
+		})
+		return request, false
+	}
+
+	if !authorizeHouse(c, h.db, request.SwifletHouseID, models.HouseRoleManager) {
+		return request, false
+	}
+
+	var count int
+	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM metric_types WHERE key = $1", request.Metric).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return request, false
+	}
+
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unknown metric type: " + request.Metric,
+		})
+		return request, false
+	}
+
+	return request, true
+}
+
+// loadAlertRule reads the rule from the :id path parameter and checks the
+// caller has at least role in its house
+func (h *AlertHandler) loadAlertRule(c *gin.Context, role string) (models.AlertRule, bool) {
+	ruleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid alert rule ID",
+		})
+		return models.AlertRule{}, false
+	}
+
+	rule, err := scanAlertRule(h.db.PostgreSQL.QueryRow(
+		"SELECT "+alertRuleColumns+" FROM alert_rules WHERE id = $1", ruleID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Alert rule not found",
+			})
+			return rule, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return rule, false
+	}
+
+	if !authorizeHouse(c, h.db, rule.SwifletHouseID, role) {
+		return rule, false
+	}
+
+	return rule, true
+}
+
+// loadAlert reads the alert from the :id path parameter and checks the caller
+// has at least role in its house
+func (h *AlertHandler) loadAlert(c *gin.Context, role string) (models.Alert, bool) {
+	alertID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid alert ID",
+		})
+		return models.Alert{}, false
+	}
+
+	alert, err := services.ScanAlert(h.db.PostgreSQL.QueryRow(
+		"SELECT "+services.AlertColumns+" FROM alerts WHERE id = $1", alertID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Alert not found",
+			})
+			return alert, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return alert, false
+	}
+
+	if !authorizeHouse(c, h.db, alert.SwifletHouseID, role) {
+		return alert, false
+	}
+
+	return alert, true
+}
+
+func (h *AlertHandler) reloadEngine() {
+	if err := h.engine.Load(); err != nil {
+		log.Printf("Failed to reload alert rules: %v", err)
+	}
+}
+
+// ListAlertRules returns the alert rules of the caller's houses, or of every
+// house for admins, optionally filtered by id_swiflet_house
+func (h *AlertHandler) ListAlertRules(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	houseID, _ := strconv.Atoi(c.Query("id_swiflet_house"))
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT r.id, r.id_user, r.id_swiflet_house, r.floor, r.name, r.metric, r.operator, r.warning_threshold,
+			r.critical_threshold, r.hysteresis, r.enabled, r.created_at, r.updated_at
+		FROM alert_rules r
+		JOIN swiflet_houses h ON h.id = r.id_swiflet_house
+		WHERE ($1 = 0 OR r.id_swiflet_house = $1) AND `+houseVisible(2, 3)+`
+		ORDER BY r.id_swiflet_house, r.floor NULLS FIRST, r.name
+	`, houseID, admin, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	rules := []models.AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// CreateAlertRule creates an alert rule for a house the caller owns
+func (h *AlertHandler) CreateAlertRule(c *gin.Context) {
+	request, ok := h.bindAlertRule(c)
+	if !ok {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	enabled := request.Enabled == nil || *request.Enabled
+
+	now := time.Now()
+	rule, err := scanAlertRule(h.db.PostgreSQL.QueryRow(`
+		INSERT INTO alert_rules (id_user, id_swiflet_house, floor, name, metric, operator, warning_threshold,
+			critical_threshold, hysteresis, enabled, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING `+alertRuleColumns,
+		userID, request.SwifletHouseID, request.Floor, request.Name, request.Metric, request.Operator,
+		request.WarningThreshold, request.CriticalThreshold, request.Hysteresis, enabled, now, now))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create alert rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// GetAlertRule returns a single alert rule
+func (h *AlertHandler) GetAlertRule(c *gin.Context) {
+	rule, ok := h.loadAlertRule(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// UpdateAlertRule replaces an alert rule. Alerts it already raised stay as they are.
+func (h *AlertHandler) UpdateAlertRule(c *gin.Context) {
+	existing, ok := h.loadAlertRule(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	request, ok := h.bindAlertRule(c)
+	if !ok {
+		return
+	}
+
+	enabled := existing.Enabled
+	if request.Enabled != nil {
+		enabled = *request.Enabled
+	}
+
+	rule, err := scanAlertRule(h.db.PostgreSQL.QueryRow(`
+		UPDATE alert_rules
+		SET id_swiflet_house = $1, floor = $2, name = $3, metric = $4, operator = $5, warning_threshold = $6,
+			critical_threshold = $7, hysteresis = $8, enabled = $9, updated_at = $10
+		WHERE id = $11
+		RETURNING `+alertRuleColumns,
+		request.SwifletHouseID, request.Floor, request.Name, request.Metric, request.Operator,
+		request.WarningThreshold, request.CriticalThreshold, request.Hysteresis, enabled, time.Now(), existing.ID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Alert rule not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update alert rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAlertRule removes an alert rule together with its alerts
+func (h *AlertHandler) DeleteAlertRule(c *gin.Context) {
+	rule, ok := h.loadAlertRule(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if _, err := h.db.PostgreSQL.Exec("DELETE FROM alert_rules WHERE id = $1", rule.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete alert rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListAlerts returns paginated alerts of the caller's houses, or of every house
+// for admins, optionally filtered by id_swiflet_house, status and severity
+func (h *AlertHandler) ListAlerts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	houseID, _ := strconv.Atoi(c.Query("id_swiflet_house"))
+	status := c.Query("status")
+	severity := c.Query("severity")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	where := `
+		WHERE ($1 = 0 OR a.id_swiflet_house = $1) AND ($2 = '' OR a.status = $2)
+			AND ($3 = '' OR a.severity = $3) AND ` + houseVisible(4, 5)
+
+	var total int
+	err = h.db.PostgreSQL.QueryRow(`
+		SELECT COUNT(*) FROM alerts a
+		JOIN swiflet_houses h ON h.id = a.id_swiflet_house`+where,
+		houseID, status, severity, admin, userID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT a.id, a.id_rule, a.id_swiflet_house, a.floor, a.metric, a.severity, a.status, a.value,
+			a.peak_value, a.opened_at, a.acknowledged_at, a.acknowledged_by, a.resolved_at, a.created_at, a.updated_at
+		FROM alerts a
+		JOIN swiflet_houses h ON h.id = a.id_swiflet_house`+where+`
+		ORDER BY a.opened_at DESC
+		LIMIT $6 OFFSET $7
+	`, houseID, status, severity, admin, userID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	alerts := []models.Alert{}
+	for rows.Next() {
+		alert, err := services.ScanAlert(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		alerts = append(alerts, alert)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.Alert]{
+		Data:       alerts,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// GetAlert returns a single alert
+func (h *AlertHandler) GetAlert(c *gin.Context) {
+	alert, ok := h.loadAlert(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, alert)
+}
+
+// AcknowledgeAlert marks an open alert as acknowledged by the caller. The
+// alert still resolves automatically once readings return to normal.
+func (h *AlertHandler) AcknowledgeAlert(c *gin.Context) {
+	alert, ok := h.loadAlert(c, models.HouseRoleWorker)
+	if !ok {
+		return
+	}
+
+	if alert.Status != models.AlertOpen {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Only open alerts can be acknowledged",
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	now := time.Now()
+	alert, err := services.ScanAlert(h.db.PostgreSQL.QueryRow(`
+		UPDATE alerts SET status = $1, acknowledged_at = $2, acknowledged_by = $3, updated_at = $2
+		WHERE id = $4 AND status = $5
+		RETURNING `+services.AlertColumns,
+		models.AlertAcknowledged, now, userID, alert.ID, models.AlertOpen))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Only open alerts can be acknowledged",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to acknowledge alert",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, alert)
+}
+
+// ResolveAlert closes an alert manually, e.g. after the rule's sensors were
+// removed. The rule opens a new alert if its threshold is crossed again.
+func (h *AlertHandler) ResolveAlert(c *gin.Context) {
+	alert, ok := h.loadAlert(c, models.HouseRoleWorker)
+	if !ok {
+		return
+	}
+
+	if alert.Status == models.AlertResolved {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Alert is already resolved",
+		})
+		return
+	}
+
+	now := time.Now()
+	alert, err := services.ScanAlert(h.db.PostgreSQL.QueryRow(`
+		UPDATE alerts SET status = $1, resolved_at = $2, updated_at = $2
+		WHERE id = $3 AND status <> $1
+		RETURNING `+services.AlertColumns,
+		models.AlertResolved, now, alert.ID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Alert is already resolved",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to resolve alert",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.JSON(http.StatusOK, alert)
+}
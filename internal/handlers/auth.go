@@ -79,14 +79,15 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	// Insert user
+	// Insert user; accounts always start as plain users, only an admin can
+	// grant the admin role
 	var user models.User
 	err = h.db.PostgreSQL.QueryRow(`
 		INSERT INTO users (email, name, location, no_telp, password, img_profile, status, role, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id, email, name, location, no_telp, img_profile, status, role, created_at
 	`, req.Email, req.Name, req.Location, req.NoTelp, hashedPassword, req.ImgProfile, 
-	   getIntValue(req.Status, 0), getIntValue(req.Role, 0), time.Now()).Scan(
+	   getIntValue(req.Status, 0), models.RoleUser, time.Now()).Scan(
 		&user.ID, &user.Email, &user.Name, &user.Location, &user.NoTelp, 
 		&user.ImgProfile, &user.Status, &user.Role, &user.CreatedAt,
 	)
@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type AutomationHandler struct {
+	db       *database.DB
+	engine   *services.AutomationEngine
+	validate *validator.Validate
+}
+
+func NewAutomationHandler(db *database.DB, engine *services.AutomationEngine) *AutomationHandler {
+	return &AutomationHandler{
+		db:       db,
+		engine:   engine,
+		validate: validator.New(),
+	}
+}
+
+// automationRuleRequest is the body of create and update requests
+type automationRuleRequest struct {
+	SwifletHouseID  int             `json:"id_swiflet_house" validate:"required"`
+	Floor           *int            `json:"floor"`
+	Name            string          `json:"name" validate:"required,max=255"`
+	Metric          string          `json:"metric" validate:"required"`
+	Operator        string          `json:"operator" validate:"required,oneof=below above"`
+	Threshold       float64         `json:"threshold"`
+	DurationSeconds int             `json:"duration_seconds" validate:"min=0"`
+	Hysteresis      float64         `json:"hysteresis" validate:"min=0"`
+	CooldownSeconds int             `json:"cooldown_seconds" validate:"min=0"`
+	DeviceID        int             `json:"id_device" validate:"required"`
+	Command         string          `json:"command" validate:"required,max=100"`
+	Params          json.RawMessage `json:"params"`
+	Enabled         *bool           `json:"enabled"`
+}
+
+const automationRuleColumns = `id, id_user, id_swiflet_house, floor, name, metric, operator, threshold,
+	duration_seconds, hysteresis, cooldown_seconds, id_device, command, params, enabled, last_triggered_at,
+	created_at, updated_at`
+
+func scanAutomationRule(row interface{ Scan(...interface{}) error }) (models.AutomationRule, error) {
+	var rule models.AutomationRule
+	var params []byte
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.SwifletHouseID, &rule.Floor, &rule.Name, &rule.Metric,
+		&rule.Operator, &rule.Threshold, &rule.DurationSeconds, &rule.Hysteresis, &rule.CooldownSeconds,
+		&rule.DeviceID, &rule.Command, &params, &rule.Enabled, &rule.LastTriggeredAt,
+		&rule.CreatedAt, &rule.UpdatedAt)
+	rule.Params = params
+	return rule, err
+}
+
+// bindRule reads and checks a rule request. The metric must be registered and
+// the target device must be installed in the rule's house.
+func (h *AutomationHandler) bindRule(c *gin.Context) (automationRuleRequest, bool) {
+	var request automationRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return request, false
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed: " + err.Error(),
+		})
+		return request, false
+	}
+
+	if !authorizeHouse(c, h.db, request.SwifletHouseID, models.HouseRoleManager) {
+		return request, false
+	}
+
+	var count int
+	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM metric_types WHERE key = $1", request.Metric).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return request, false
+	}
+
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unknown metric type: " + request.Metric,
+		})
+		return request, false
+	}
+
+	var deviceHouseID int
+	err = h.db.PostgreSQL.QueryRow("SELECT id_swiflet_house FROM iot_devices WHERE id = $1", request.DeviceID).Scan(&deviceHouseID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return request, false
+	}
+
+	if err == sql.ErrNoRows || deviceHouseID != request.SwifletHouseID {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Target device must be installed in the swiflet house",
+		})
+		return request, false
+	}
+
+	return request, true
+}
+
+// loadRule reads the rule from the :id path parameter and checks the caller
+// has at least role in its house
+func (h *AutomationHandler) loadRule(c *gin.Context, role string) (models.AutomationRule, bool) {
+	ruleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid automation rule ID",
+		})
+		return models.AutomationRule{}, false
+	}
+
+	rule, err := scanAutomationRule(h.db.PostgreSQL.QueryRow(
+		"SELECT "+automationRuleColumns+" FROM automation_rules WHERE id = $1", ruleID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Automation rule not found",
+			})
+			return rule, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return rule, false
+	}
+
+	if !authorizeHouse(c, h.db, rule.SwifletHouseID, role) {
+		return rule, false
+	}
+
+	return rule, true
+}
+
+func (h *AutomationHandler) reloadEngine() {
+	if err := h.engine.Load(); err != nil {
+		log.Printf("Failed to reload automation rules: %v", err)
+	}
+}
+
+// ListAutomationRules returns the automation rules of the caller's houses, or
+// of every house for admins, optionally filtered by id_swiflet_house
+func (h *AutomationHandler) ListAutomationRules(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	houseID, _ := strconv.Atoi(c.Query("id_swiflet_house"))
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT r.id, r.id_user, r.id_swiflet_house, r.floor, r.name, r.metric, r.operator, r.threshold,
+			r.duration_seconds, r.hysteresis, r.cooldown_seconds, r.id_device, r.command, r.params, r.enabled,
+			r.last_triggered_at, r.created_at, r.updated_at
+		FROM automation_rules r
+		JOIN swiflet_houses h ON h.id = r.id_swiflet_house
+		WHERE ($1 = 0 OR r.id_swiflet_house = $1) AND `+houseVisible(2, 3)+`
+		ORDER BY r.id_swiflet_house, r.floor NULLS FIRST, r.name
+	`, houseID, admin, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	rules := []models.AutomationRule{}
+	for rows.Next() {
+		rule, err := scanAutomationRule(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// CreateAutomationRule creates a rule for a house the caller owns
+func (h *AutomationHandler) CreateAutomationRule(c *gin.Context) {
+	request, ok := h.bindRule(c)
+	if !ok {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	enabled := request.Enabled == nil || *request.Enabled
+
+	var params interface{}
+	if len(request.Params) > 0 {
+		params = []byte(request.Params)
+	}
+
+	now := time.Now()
+	rule, err := scanAutomationRule(h.db.PostgreSQL.QueryRow(`
+		INSERT INTO automation_rules (id_user, id_swiflet_house, floor, name, metric, operator, threshold,
+			duration_seconds, hysteresis, cooldown_seconds, id_device, command, params, enabled, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING `+automationRuleColumns,
+		userID, request.SwifletHouseID, request.Floor, request.Name, request.Metric, request.Operator, request.Threshold,
+		request.DurationSeconds, request.Hysteresis, request.CooldownSeconds, request.DeviceID, request.Command,
+		params, enabled, now, now))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create automation rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// GetAutomationRule returns a single automation rule
+func (h *AutomationHandler) GetAutomationRule(c *gin.Context) {
+	rule, ok := h.loadRule(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// UpdateAutomationRule replaces an automation rule. Its evaluation state is reset.
+func (h *AutomationHandler) UpdateAutomationRule(c *gin.Context) {
+	existing, ok := h.loadRule(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	request, ok := h.bindRule(c)
+	if !ok {
+		return
+	}
+
+	enabled := existing.Enabled
+	if request.Enabled != nil {
+		enabled = *request.Enabled
+	}
+
+	var params interface{}
+	if len(request.Params) > 0 {
+		params = []byte(request.Params)
+	}
+
+	rule, err := scanAutomationRule(h.db.PostgreSQL.QueryRow(`
+		UPDATE automation_rules
+		SET id_swiflet_house = $1, floor = $2, name = $3, metric = $4, operator = $5, threshold = $6,
+			duration_seconds = $7, hysteresis = $8, cooldown_seconds = $9, id_device = $10, command = $11,
+			params = $12, enabled = $13, updated_at = $14
+		WHERE id = $15
+		RETURNING `+automationRuleColumns,
+		request.SwifletHouseID, request.Floor, request.Name, request.Metric, request.Operator, request.Threshold,
+		request.DurationSeconds, request.Hysteresis, request.CooldownSeconds, request.DeviceID, request.Command,
+		params, enabled, time.Now(), existing.ID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Automation rule not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update automation rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAutomationRule removes an automation rule together with its audit log
+func (h *AutomationHandler) DeleteAutomationRule(c *gin.Context) {
+	rule, ok := h.loadRule(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if _, err := h.db.PostgreSQL.Exec("DELETE FROM automation_rules WHERE id = $1", rule.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete automation rule",
+		})
+		return
+	}
+
+	h.reloadEngine()
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetAutomationAuditLog returns paginated triggers of an automation rule
+func (h *AutomationHandler) GetAutomationAuditLog(c *gin.Context) {
+	rule, ok := h.loadRule(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM automation_audit_log WHERE id_rule = $1", rule.ID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT id, id_rule, id_device, id_command, metric, value, threshold, status, error, triggered_at
+		FROM automation_audit_log
+		WHERE id_rule = $1
+		ORDER BY triggered_at DESC
+		LIMIT $2 OFFSET $3
+	`, rule.ID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AutomationAuditEntry{}
+	for rows.Next() {
+		var entry models.AutomationAuditEntry
+		err := rows.Scan(&entry.ID, &entry.RuleID, &entry.DeviceID, &entry.CommandID, &entry.Metric,
+			&entry.Value, &entry.Threshold, &entry.Status, &entry.Error, &entry.TriggeredAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.AutomationAuditEntry]{
+		Data:       entries,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
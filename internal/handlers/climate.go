@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// defaultClimateDays is the range of a climate report without from
+const defaultClimateDays = 30
+
+// maxClimateDays bounds the range of a climate report
+const maxClimateDays = 366
+
+// maxReportExcursions is how many of the worst excursions a report lists
+const maxReportExcursions = 5
+
+type ClimateHandler struct {
+	db     *database.DB
+	scorer *services.ClimateScorer
+}
+
+func NewClimateHandler(db *database.DB, scorer *services.ClimateScorer) *ClimateHandler {
+	return &ClimateHandler{
+		db:     db,
+		scorer: scorer,
+	}
+}
+
+// GetHouseClimate returns the daily climate scores of a house and its floors
+// between from and to (dates in the scoring timezone, default the last 30
+// days), with a summary and the worst excursions of the range. The floor
+// parameter limits the report to one floor.
+func (h *ClimateHandler) GetHouseClimate(c *gin.Context) {
+	houseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid swiflet house ID",
+		})
+		return
+	}
+
+	location := h.scorer.Location()
+	now := time.Now().In(location)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	if value := c.Query("to"); value != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, value, location); err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid to",
+				Details: map[string]string{"to": "must be a date (YYYY-MM-DD)"},
+			})
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -(defaultClimateDays - 1))
+	if value := c.Query("from"); value != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, value, location); err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid from",
+				Details: map[string]string{"from": "must be a date (YYYY-MM-DD)"},
+			})
+			return
+		}
+	}
+	if from.After(to) || from.AddDate(0, 0, maxClimateDays).Before(to) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid date range",
+			Details: map[string]string{"from": "must be on or before to and at most 366 days earlier"},
+		})
+		return
+	}
+
+	query := `SELECT ` + services.ClimateScoreColumns + `
+		FROM climate_scores
+		WHERE id_swiflet_house = $1 AND day BETWEEN $2::date AND $3::date`
+	args := []interface{}{houseID, from.Format(time.DateOnly), to.Format(time.DateOnly)}
+	if value := c.Query("floor"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid floor",
+			})
+			return
+		}
+		query += " AND floor = $4"
+		args = append(args, floor)
+	}
+	query += " ORDER BY day ASC, floor ASC"
+
+	if !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	report := models.HouseClimateReport{
+		SwifletHouseID:  houseID,
+		Timezone:        location.String(),
+		From:            from.Format(time.DateOnly),
+		To:              to.Format(time.DateOnly),
+		Bands:           h.scorer.Bands(),
+		Days:            []models.HouseClimateDay{},
+		WorstExcursions: []models.ClimateExcursion{},
+	}
+
+	// Rows come ordered by day
+	for rows.Next() {
+		score, err := services.ScanClimateScore(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		if len(report.Days) == 0 || report.Days[len(report.Days)-1].Day != score.Day {
+			report.Days = append(report.Days, models.HouseClimateDay{Floors: []models.ClimateScore{}})
+		}
+		day := &report.Days[len(report.Days)-1]
+		day.Floors = append(day.Floors, score)
+		report.WorstExcursions = append(report.WorstExcursions, score.Excursions...)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	for i := range report.Days {
+		day := &report.Days[i]
+		day.HouseClimateScore = services.HouseClimate(day.Floors[0].Day, day.Floors)
+		report.Summary.Score += day.Score
+		report.Summary.TimeInBand += day.TimeInBand
+		report.Summary.Coverage += day.Coverage
+	}
+	if days := float64(len(report.Days)); days > 0 {
+		report.Summary.Score = roundClimate(report.Summary.Score / days)
+		report.Summary.TimeInBand = roundClimate(report.Summary.TimeInBand / days)
+		report.Summary.Coverage = roundClimate(report.Summary.Coverage / days)
+	}
+
+	// Rank excursions by their peak deviation relative to the band tolerance
+	// times their duration
+	tolerance := make(map[string]float64)
+	for _, band := range report.Bands {
+		tolerance[band.Metric] = band.Tolerance
+	}
+	severity := func(excursion models.ClimateExcursion) float64 {
+		if tolerance[excursion.Metric] <= 0 {
+			return 0
+		}
+		return excursion.PeakDeviation / tolerance[excursion.Metric] * excursion.DurationMinutes
+	}
+	sort.SliceStable(report.WorstExcursions, func(i, j int) bool {
+		return severity(report.WorstExcursions[i]) > severity(report.WorstExcursions[j])
+	})
+	report.WorstExcursions = report.WorstExcursions[:min(len(report.WorstExcursions), maxReportExcursions)]
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetHarvestClimate relates the yield of each harvest of a house to the climate
+// of its floor since the previous harvest, scored from the hourly rollups
+// against the climate bands. The floor parameter limits the report to one
+// floor. The first harvest of a floor has no period and no climate.
+func (h *ClimateHandler) GetHarvestClimate(c *gin.Context) {
+	houseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid swiflet house ID",
+		})
+		return
+	}
+
+	query := `
+		SELECT ` + harvestColumns + `
+		FROM harvests
+		WHERE id_swiflet_house = $1`
+	args := []interface{}{houseID}
+	if value := c.Query("floor"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid floor",
+			})
+			return
+		}
+		query += " AND floor = $2"
+		args = append(args, floor)
+	}
+	query += " ORDER BY floor ASC, created_at ASC"
+
+	if !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	harvests := []models.Harvest{}
+	for rows.Next() {
+		harvest, err := scanHarvest(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		harvests = append(harvests, harvest)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	periods := services.HarvestPeriods(harvests)
+	for i := range periods {
+		period := &periods[i]
+		if period.PeriodStart == nil {
+			continue
+		}
+		score, err := h.scorer.ScorePeriod(houseID, period.Floor, *period.PeriodStart, period.PeriodEnd)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to load climate data",
+			})
+			return
+		}
+		period.Climate = services.HarvestClimateFromScore(score)
+	}
+
+	c.JSON(http.StatusOK, models.HarvestClimateReport{
+		SwifletHouseID: houseID,
+		Bands:          h.scorer.Bands(),
+		Periods:        periods,
+		Correlations:   services.HarvestCorrelations(periods),
+	})
+}
+
+func roundClimate(value float64) float64 {
+	return math.Round(value*10) / 10
+}
+
+// latestHouseClimate returns the score of the last final day of each house
+func latestHouseClimate(db *database.DB, houseIDs []int64) (map[int]*models.HouseClimateScore, error) {
+	rows, err := db.PostgreSQL.Query(`
+		SELECT `+services.ClimateScoreColumns+`
+		FROM climate_scores c
+		WHERE final AND id_swiflet_house = ANY($1)
+			AND day = (SELECT MAX(day) FROM climate_scores WHERE final AND id_swiflet_house = c.id_swiflet_house)
+		ORDER BY id_swiflet_house, floor
+	`, pq.Array(houseIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	floors := make(map[int][]models.ClimateScore)
+	for rows.Next() {
+		score, err := services.ScanClimateScore(rows)
+		if err != nil {
+			return nil, err
+		}
+		floors[score.SwifletHouseID] = append(floors[score.SwifletHouseID], score)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	climate := make(map[int]*models.HouseClimateScore, len(floors))
+	for houseID, scores := range floors {
+		house := services.HouseClimate(scores[0].Day, scores)
+		climate[houseID] = &house
+	}
+	return climate, nil
+}
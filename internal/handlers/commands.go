@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type CommandHandler struct {
+	db          *database.DB
+	mqttService *services.MQTTService
+	commands    *services.CommandStore
+	validate    *validator.Validate
+}
+
+func NewCommandHandler(db *database.DB, mqttService *services.MQTTService) *CommandHandler {
+	return &CommandHandler{
+		db:          db,
+		mqttService: mqttService,
+		commands:    services.NewCommandStore(db),
+		validate:    validator.New(),
+	}
+}
+
+// loadDevice reads the device from the :id path parameter, checks the caller
+// has at least role in its house and writes the error response when it is
+// invalid, missing or denied
+func (h *CommandHandler) loadDevice(c *gin.Context, role string) (services.DeviceInfo, bool) {
+	var device services.DeviceInfo
+
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid device ID",
+		})
+		return device, false
+	}
+
+	err = h.db.PostgreSQL.QueryRow(`
+		SELECT id, install_code, id_swiflet_house, floor
+		FROM iot_devices WHERE id = $1
+	`, deviceID).Scan(&device.ID, &device.InstallCode, &device.SwifletHouseID, &device.Floor)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return device, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return device, false
+	}
+
+	if !authorizeHouse(c, h.db, device.SwifletHouseID, role) {
+		return device, false
+	}
+
+	return device, true
+}
+
+// SendCommand stores a control command and publishes it to the device
+func (h *CommandHandler) SendCommand(c *gin.Context) {
+	// Get user ID from context (set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var request struct {
+		Command string          `json:"command" validate:"required,max=100"`
+		Params  json.RawMessage `json:"params"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed: " + err.Error(),
+		})
+		return
+	}
+
+	device, ok := h.loadDevice(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if h.mqttService == nil {
+		c.JSON(http.StatusServiceUnavailable, models.ErrorResponse{
+			Error: "MQTT service unavailable",
+		})
+		return
+	}
+
+	sender := userID.(int)
+	command, err := h.mqttService.SendCommand(device, &sender, request.Command, request.Params)
+	if err != nil {
+		if errors.Is(err, services.ErrCommandPublish) {
+			c.JSON(http.StatusBadGateway, models.ErrorResponse{
+				Error:   "Failed to publish command",
+				Details: map[string]string{"id": strconv.Itoa(command.ID), "status": command.Status},
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to send command",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, command)
+}
+
+// ListCommands returns paginated commands sent to a device, optionally filtered by status
+func (h *CommandHandler) ListCommands(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	status := c.Query("status")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	err := h.db.PostgreSQL.QueryRow(`
+		SELECT COUNT(*) FROM device_commands
+		WHERE id_device = $1 AND ($2 = '' OR status = $2)
+	`, device.ID, status).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT id, id_device, install_code, id_user, command, params, status, error,
+			sent_at, acked_at, created_at, updated_at
+		FROM device_commands
+		WHERE id_device = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4
+	`, device.ID, status, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	commands := []models.DeviceCommand{}
+	for rows.Next() {
+		var command models.DeviceCommand
+		var params []byte
+		err := rows.Scan(&command.ID, &command.DeviceID, &command.InstallCode, &command.UserID, &command.Command,
+			&params, &command.Status, &command.Error, &command.SentAt, &command.AckedAt,
+			&command.CreatedAt, &command.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		command.Params = params
+		commands = append(commands, command)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.DeviceCommand]{
+		Data:       commands,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// GetCommand returns a single command of a device
+func (h *CommandHandler) GetCommand(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	commandID, err := strconv.Atoi(c.Param("command_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid command ID",
+		})
+		return
+	}
+
+	command, err := h.commands.Get(commandID)
+	if err == nil && command.DeviceID != device.ID {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Command not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, command)
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FaultHandler struct {
+	db *database.DB
+}
+
+func NewFaultHandler(db *database.DB) *FaultHandler {
+	return &FaultHandler{
+		db: db,
+	}
+}
+
+// faultColumns selects a fault with its device, from device_faults f joined
+// with iot_devices d
+const faultColumns = `f.id, f.id_device, d.install_code, d.id_swiflet_house, d.floor, f.kind, f.metric, f.status,
+	f.value, f.detail, f.detected_at, f.last_detected_at, f.resolved_at, f.resolved_by, f.created_at, f.updated_at`
+
+func scanFault(row interface{ Scan(...interface{}) error }) (models.DeviceFault, error) {
+	var fault models.DeviceFault
+	err := row.Scan(&fault.ID, &fault.DeviceID, &fault.InstallCode, &fault.SwifletHouseID, &fault.Floor,
+		&fault.Kind, &fault.Metric, &fault.Status, &fault.Value, &fault.Detail, &fault.DetectedAt,
+		&fault.LastDetectedAt, &fault.ResolvedAt, &fault.ResolvedBy, &fault.CreatedAt, &fault.UpdatedAt)
+	return fault, err
+}
+
+// ListDeviceFaults returns the sensor faults of the caller's houses (every
+// house for admins), newest first, filtered by id_swiflet_house, id_device,
+// kind and status
+func (h *FaultHandler) ListDeviceFaults(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	houseID, _ := strconv.Atoi(c.Query("id_swiflet_house"))
+	deviceID, _ := strconv.Atoi(c.Query("id_device"))
+	kind := c.Query("kind")
+	status := c.Query("status")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	from := `
+		FROM device_faults f
+		JOIN iot_devices d ON d.id = f.id_device
+		JOIN swiflet_houses h ON h.id = d.id_swiflet_house
+		WHERE ($1 = 0 OR d.id_swiflet_house = $1) AND ($2 = 0 OR f.id_device = $2)
+			AND ($3 = '' OR f.kind = $3) AND ($4 = '' OR f.status = $4) AND ` + houseVisible(5, 6)
+
+	var total int
+	err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from,
+		houseID, deviceID, kind, status, admin, userID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+faultColumns+from+`
+		ORDER BY f.detected_at DESC
+		LIMIT $7 OFFSET $8
+	`, houseID, deviceID, kind, status, admin, userID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	faults := []models.DeviceFault{}
+	for rows.Next() {
+		fault, err := scanFault(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		faults = append(faults, fault)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.DeviceFault]{
+		Data:       faults,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// loadFault reads the fault in the id parameter and checks the caller has at
+// least role in its house. It writes the error response and returns false otherwise.
+func (h *FaultHandler) loadFault(c *gin.Context, role string) (models.DeviceFault, bool) {
+	faultID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid fault ID",
+		})
+		return models.DeviceFault{}, false
+	}
+
+	fault, err := scanFault(h.db.PostgreSQL.QueryRow(`
+		SELECT `+faultColumns+`
+		FROM device_faults f
+		JOIN iot_devices d ON d.id = f.id_device
+		WHERE f.id = $1
+	`, faultID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Device fault not found",
+			})
+			return fault, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return fault, false
+	}
+
+	if !authorizeHouse(c, h.db, fault.SwifletHouseID, role) {
+		return fault, false
+	}
+
+	return fault, true
+}
+
+// GetDeviceFault returns a single fault
+func (h *FaultHandler) GetDeviceFault(c *gin.Context) {
+	fault, ok := h.loadFault(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, fault)
+}
+
+// ResolveDeviceFault closes an open fault after maintenance and clears the
+// device's maintenance flag when no other fault is open. The detector does
+// not reopen it from readings taken before the resolution.
+func (h *FaultHandler) ResolveDeviceFault(c *gin.Context) {
+	fault, ok := h.loadFault(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if fault.Status == models.FaultResolved {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Fault is already resolved",
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	now := time.Now()
+	result, err := h.db.PostgreSQL.Exec(`
+		UPDATE device_faults SET status = $1, resolved_at = $2, resolved_by = $3, updated_at = $2
+		WHERE id = $4 AND status = $5
+	`, models.FaultResolved, now, userID, fault.ID, models.FaultOpen)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to resolve fault",
+		})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Fault is already resolved",
+		})
+		return
+	}
+
+	if err := services.SyncMaintenanceFlag(h.db, fault.DeviceID); err != nil {
+		log.Printf("Failed to clear maintenance flag: %v", err)
+	}
+
+	fault.Status = models.FaultResolved
+	fault.ResolvedAt = &now
+	resolvedBy := userID.(int)
+	fault.ResolvedBy = &resolvedBy
+	fault.UpdatedAt = now
+	c.JSON(http.StatusOK, fault)
+}
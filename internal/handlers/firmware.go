@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// firmwareLinkTTL is how long the download link of GetFirmware stays valid
+const firmwareLinkTTL = 15 * time.Minute
+
+type FirmwareHandler struct {
+	db        *database.DB
+	s3Service *services.S3Service
+	rollouts  *services.FirmwareRollouts
+	validate  *validator.Validate
+}
+
+func NewFirmwareHandler(db *database.DB, s3Service *services.S3Service, rollouts *services.FirmwareRollouts) *FirmwareHandler {
+	return &FirmwareHandler{
+		db:        db,
+		s3Service: s3Service,
+		rollouts:  rollouts,
+		validate:  validator.New(),
+	}
+}
+
+// ListFirmware returns the uploaded firmware releases, newest first
+func (h *FirmwareHandler) ListFirmware(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	if err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM firmware_releases").Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+services.ReleaseColumns+`
+		FROM firmware_releases
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1 OFFSET $2
+	`, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	releases := []models.FirmwareRelease{}
+	for rows.Next() {
+		release, err := services.ScanRelease(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		releases = append(releases, release)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.FirmwareRelease]{
+		Data:       releases,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// UploadFirmware stores a firmware image in S3 under a new version. When the
+// form carries a sha256 the upload is rejected unless it matches.
+func (h *FirmwareHandler) UploadFirmware(c *gin.Context) {
+	version := strings.TrimSpace(c.PostForm("version"))
+	if !services.ValidFirmwareVersion(version) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Validation failed",
+			Details: map[string]string{"version": "must be up to 50 letters, digits, dots, dashes, underscores or plus signs"},
+		})
+		return
+	}
+
+	var expected string
+	if checksum := c.PostForm("sha256"); checksum != "" {
+		var ok bool
+		if expected, ok = services.ParseSHA256(checksum); !ok {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Validation failed",
+				Details: map[string]string{"sha256": "must be a hex encoded SHA-256 checksum"},
+			})
+			return
+		}
+	}
+
+	var notes *string
+	if value := strings.TrimSpace(c.PostForm("notes")); value != "" {
+		notes = &value
+	}
+
+	var exists bool
+	if err := h.db.PostgreSQL.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM firmware_releases WHERE version = $1)", version).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Firmware version already exists",
+		})
+		return
+	}
+
+	file, header, err := c.Request.FormFile("firmware")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "No file uploaded",
+		})
+		return
+	}
+	defer file.Close()
+
+	result, checksum, err := h.s3Service.UploadFirmware(file, header, version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to upload file: " + err.Error(),
+		})
+		return
+	}
+
+	if expected != "" && expected != checksum {
+		h.s3Service.DeleteFile(result.Key)
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Checksum mismatch",
+			Details: map[string]string{"sha256": "the uploaded file has checksum " + checksum},
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	release, err := services.ScanRelease(h.db.PostgreSQL.QueryRow(`
+		INSERT INTO firmware_releases (version, s3_key, size, sha256, notes, uploaded_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+services.ReleaseColumns,
+		version, result.Key, result.Size, checksum, notes, userID.(int), time.Now()))
+	if err != nil {
+		// If the database insert fails, try to delete the uploaded file
+		h.s3Service.DeleteFile(result.Key)
+		log.Printf("Failed to store firmware release %s: %v", version, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create firmware release",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, release)
+}
+
+// GetFirmware returns a firmware release with a short-lived download link
+func (h *FirmwareHandler) GetFirmware(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid firmware ID",
+		})
+		return
+	}
+
+	release, err := services.ScanRelease(h.db.PostgreSQL.QueryRow(
+		"SELECT "+services.ReleaseColumns+" FROM firmware_releases WHERE id = $1", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Firmware release not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	if release.DownloadURL, err = h.s3Service.GeneratePresignedURL(release.S3Key, firmwareLinkTTL); err != nil {
+		log.Printf("Failed to sign download link of firmware %s: %v", release.Version, err)
+	}
+
+	c.JSON(http.StatusOK, release)
+}
+
+// ListFirmwareRollouts returns rollouts, newest first, filtered by status and
+// id_firmware
+func (h *FirmwareHandler) ListFirmwareRollouts(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	firmwareID, _ := strconv.Atoi(c.Query("id_firmware"))
+	status := c.Query("status")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	from := `
+		FROM firmware_rollouts r
+		JOIN firmware_releases f ON f.id = r.id_firmware
+		WHERE ($1 = 0 OR r.id_firmware = $1) AND ($2 = '' OR r.status = $2)`
+
+	var total int
+	if err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from, firmwareID, status).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+services.RolloutColumns+from+`
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $3 OFFSET $4
+	`, firmwareID, status, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	rollouts := []models.FirmwareRollout{}
+	for rows.Next() {
+		rollout, err := services.ScanRollout(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		rollouts = append(rollouts, rollout)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.FirmwareRollout]{
+		Data:       rollouts,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// CreateFirmwareRollout schedules a staged rollout of a firmware release to
+// the devices of a house or a list of devices
+func (h *FirmwareHandler) CreateFirmwareRollout(c *gin.Context) {
+	var request models.CreateFirmwareRolloutRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+			Details: map[string]string{
+				"id_firmware":      "is required",
+				"id_swiflet_house": "id_swiflet_house or device_ids is required",
+				"batch_size":       "must be at least 1",
+				"max_failures":     "must not be negative",
+			},
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	rollout, err := h.rollouts.Create(request, userID.(int))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrFirmwareNotFound), errors.Is(err, services.ErrRolloutHouseNotFound),
+			errors.Is(err, services.ErrRolloutDevicesNotFound), errors.Is(err, services.ErrRolloutNoDevices):
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		case errors.Is(err, services.ErrRolloutDevicesBusy):
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		default:
+			log.Printf("Failed to create firmware rollout: %v", err)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to create firmware rollout",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, rollout)
+}
+
+// rolloutParam reads the rollout ID parameter
+func rolloutParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid rollout ID",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// rolloutResponse writes a rollout, or the error of reading or changing it
+func rolloutResponse(c *gin.Context, rollout models.FirmwareRollout, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, rollout)
+	case errors.Is(err, services.ErrRolloutNotFound):
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Firmware rollout not found",
+		})
+	case errors.Is(err, services.ErrRolloutState):
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+	}
+}
+
+// GetFirmwareRollout returns a rollout with the count of its devices per status
+func (h *FirmwareHandler) GetFirmwareRollout(c *gin.Context) {
+	id, ok := rolloutParam(c)
+	if !ok {
+		return
+	}
+	rollout, err := h.rollouts.Get(id)
+	rolloutResponse(c, rollout, err)
+}
+
+// ListFirmwareRolloutDevices returns the devices of a rollout by stage,
+// filtered by status
+func (h *FirmwareHandler) ListFirmwareRolloutDevices(c *gin.Context) {
+	id, ok := rolloutParam(c)
+	if !ok {
+		return
+	}
+	if _, err := h.rollouts.Get(id); err != nil {
+		rolloutResponse(c, models.FirmwareRollout{}, err)
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	status := c.Query("status")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	if err := h.db.PostgreSQL.QueryRow(`
+		SELECT COUNT(*) FROM firmware_rollout_devices WHERE id_rollout = $1 AND ($2 = '' OR status = $2)
+	`, id, status).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+services.RolloutDeviceColumns+`
+		FROM firmware_rollout_devices
+		WHERE id_rollout = $1 AND ($2 = '' OR status = $2)
+		ORDER BY stage, id
+		LIMIT $3 OFFSET $4
+	`, id, status, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	devices := []models.FirmwareRolloutDevice{}
+	for rows.Next() {
+		device, err := services.ScanRolloutDevice(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		devices = append(devices, device)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.FirmwareRolloutDevice]{
+		Data:       devices,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// PauseFirmwareRollout stops a scheduled or running rollout from sending
+// further updates
+func (h *FirmwareHandler) PauseFirmwareRollout(c *gin.Context) {
+	id, ok := rolloutParam(c)
+	if !ok {
+		return
+	}
+	rollout, err := h.rollouts.Pause(id)
+	rolloutResponse(c, rollout, err)
+}
+
+// ResumeFirmwareRollout continues a paused rollout
+func (h *FirmwareHandler) ResumeFirmwareRollout(c *gin.Context) {
+	id, ok := rolloutParam(c)
+	if !ok {
+		return
+	}
+	rollout, err := h.rollouts.Resume(id)
+	rolloutResponse(c, rollout, err)
+}
+
+// CancelFirmwareRollout ends a rollout and cancels its unsent updates
+func (h *FirmwareHandler) CancelFirmwareRollout(c *gin.Context) {
+	id, ok := rolloutParam(c)
+	if !ok {
+		return
+	}
+	rollout, err := h.rollouts.Cancel(id)
+	rolloutResponse(c, rollout, err)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// harvestColumns selects a harvest for scanHarvest
+const harvestColumns = `id, id_user, id_swiflet_house, floor, COALESCE(bowl_weight, 0), COALESCE(bowl_pieces, 0),
+	COALESCE(oval_weight, 0), COALESCE(oval_pieces, 0), COALESCE(corner_weight, 0), COALESCE(corner_pieces, 0),
+	COALESCE(broken_weight, 0), COALESCE(broken_pieces, 0), created_at`
+
+func scanHarvest(row interface{ Scan(...interface{}) error }) (models.Harvest, error) {
+	var harvest models.Harvest
+	err := row.Scan(&harvest.ID, &harvest.UserID, &harvest.SwifletHouseID, &harvest.Floor,
+		&harvest.BowlWeight, &harvest.BowlPieces, &harvest.OvalWeight, &harvest.OvalPieces,
+		&harvest.CornerWeight, &harvest.CornerPieces, &harvest.BrokenWeight, &harvest.BrokenPieces,
+		&harvest.CreatedAt)
+	return harvest, err
+}
+
+type HarvestHandler struct {
+	db       *database.DB
+	validate *validator.Validate
+}
+
+func NewHarvestHandler(db *database.DB) *HarvestHandler {
+	return &HarvestHandler{
+		db:       db,
+		validate: validator.New(),
+	}
+}
+
+// ListHarvests returns paginated harvests of the houses the caller owns or is
+// a member of (every house for admins), newest first, filtered by
+// id_swiflet_house and floor
+func (h *HarvestHandler) ListHarvests(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	houseID, _ := strconv.Atoi(c.Query("id_swiflet_house"))
+	floor, _ := strconv.Atoi(c.Query("floor"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	if houseID != 0 && !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return
+	}
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	from := `
+		FROM harvests
+		WHERE ($1 = 0 OR id_swiflet_house = $1) AND ($2 = 0 OR floor = $2) AND id_swiflet_house IN (
+			SELECT h.id FROM swiflet_houses h WHERE h.deleted_at IS NULL AND ` + houseVisible(3, 4) + `)`
+
+	var total int
+	err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from, houseID, floor, admin, userID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+harvestColumns+from+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT $5 OFFSET $6
+	`, houseID, floor, admin, userID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	harvests := []models.Harvest{}
+	for rows.Next() {
+		harvest, err := scanHarvest(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		harvests = append(harvests, harvest)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.Harvest]{
+		Data:       harvests,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// CreateHarvest logs a harvest of a floor. Workers, managers and the owner
+// of the house may log harvests; the caller is recorded as id_user.
+func (h *HarvestHandler) CreateHarvest(c *gin.Context) {
+	var harvest models.Harvest
+	if err := c.ShouldBindJSON(&harvest); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(harvest); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, harvest.SwifletHouseID, models.HouseRoleWorker) {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	harvest, err := scanHarvest(h.db.PostgreSQL.QueryRow(`
+		INSERT INTO harvests (id_user, id_swiflet_house, floor, bowl_weight, bowl_pieces, oval_weight, oval_pieces,
+			corner_weight, corner_pieces, broken_weight, broken_pieces, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING `+harvestColumns,
+		userID, harvest.SwifletHouseID, harvest.Floor, harvest.BowlWeight, harvest.BowlPieces, harvest.OvalWeight,
+		harvest.OvalPieces, harvest.CornerWeight, harvest.CornerPieces, harvest.BrokenWeight, harvest.BrokenPieces,
+		time.Now()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create harvest",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, harvest)
+}
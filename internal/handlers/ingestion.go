@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+type IngestionHandler struct {
+	db          *database.DB
+	mqttService *services.MQTTService
+	deadLetters *services.DeadLetterStore
+}
+
+func NewIngestionHandler(db *database.DB, mqttService *services.MQTTService) *IngestionHandler {
+	return &IngestionHandler{
+		db:          db,
+		mqttService: mqttService,
+		deadLetters: services.NewDeadLetterStore(db),
+	}
+}
+
+// GetStats returns queue depth and counters of the sensor ingestion pipeline
+func (h *IngestionHandler) GetStats(c *gin.Context) {
+	if h.mqttService == nil {
+		c.JSON(http.StatusServiceUnavailable, models.ErrorResponse{
+			Error: "MQTT service unavailable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": h.mqttService.IngestStats()})
+}
+
+// ListDeadLetters returns paginated list of rejected sensor messages
+func (h *IngestionHandler) ListDeadLetters(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	reason := c.Query("reason")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	err := h.db.PostgreSQL.QueryRow(`
+		SELECT COUNT(*) FROM mqtt_dead_letters
+		WHERE ($1 = '' OR reason = $1)
+	`, reason).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT id, topic, payload, reason, error, replay_count, received_at, created_at
+		FROM mqtt_dead_letters
+		WHERE ($1 = '' OR reason = $1)
+		ORDER BY received_at DESC
+		LIMIT $2 OFFSET $3
+	`, reason, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	letters := []models.DeadLetter{}
+	for rows.Next() {
+		var letter models.DeadLetter
+		err := rows.Scan(&letter.ID, &letter.Topic, &letter.Payload, &letter.Reason, &letter.Error,
+			&letter.ReplayCount, &letter.ReceivedAt, &letter.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		letters = append(letters, withPayloadText(letter))
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.DeadLetter]{
+		Data:       letters,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// GetDeadLetter returns a single rejected sensor message
+func (h *IngestionHandler) GetDeadLetter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid dead letter ID",
+		})
+		return
+	}
+
+	letter, err := h.deadLetters.Get(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Dead letter not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, withPayloadText(*letter))
+}
+
+// ReplayDeadLetter runs a rejected sensor message through ingestion again
+func (h *IngestionHandler) ReplayDeadLetter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid dead letter ID",
+		})
+		return
+	}
+
+	if h.mqttService == nil {
+		c.JSON(http.StatusServiceUnavailable, models.ErrorResponse{
+			Error: "MQTT service unavailable",
+		})
+		return
+	}
+
+	err = h.mqttService.ReplayDeadLetter(id)
+	if err != nil {
+		var rejectErr *services.RejectError
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Dead letter not found",
+			})
+		case errors.As(err, &rejectErr):
+			c.JSON(http.StatusUnprocessableEntity, models.ErrorResponse{
+				Error:   "Message rejected again",
+				Details: map[string]string{"reason": rejectErr.Reason, "error": rejectErr.Err.Error()},
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to replay dead letter",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter replayed successfully"})
+}
+
+// DeleteDeadLetter removes a single rejected sensor message
+func (h *IngestionHandler) DeleteDeadLetter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid dead letter ID",
+		})
+		return
+	}
+
+	if err := h.deadLetters.Delete(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Dead letter not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete dead letter",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PurgeDeadLetters removes rejected sensor messages, optionally filtered by
+// reason and by a received_at cut-off
+func (h *IngestionHandler) PurgeDeadLetters(c *gin.Context) {
+	reason := c.Query("reason")
+
+	before := time.Now()
+	if value := c.Query("before"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid before timestamp, expected RFC3339",
+			})
+			return
+		}
+		before = parsed
+	}
+
+	result, err := h.db.PostgreSQL.Exec(`
+		DELETE FROM mqtt_dead_letters
+		WHERE received_at < $1 AND ($2 = '' OR reason = $2)
+	`, before, reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to purge dead letters",
+		})
+		return
+	}
+
+	deleted, _ := result.RowsAffected()
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Dead letters purged successfully",
+		"deleted": deleted,
+	})
+}
+
+// withPayloadText exposes the payload as text when it is valid UTF-8
+func withPayloadText(letter models.DeadLetter) models.DeadLetter {
+	if utf8.Valid(letter.Payload) {
+		text := string(letter.Payload)
+		letter.PayloadText = &text
+	}
+	return letter
+}
+
+// ListQuarantine returns paginated sensor values rejected by validation,
+// filtered like the sensor endpoints and by reason
+func (h *IngestionHandler) ListQuarantine(c *gin.Context) {
+	filter, err := parseSensorFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	where, args := filter.where(nil)
+	if reason := c.Query("reason"); reason != "" {
+		args = append(args, reason)
+		if where == "" {
+			where = fmt.Sprintf("WHERE reason = $%d", len(args))
+		} else {
+			where += fmt.Sprintf(" AND reason = $%d", len(args))
+		}
+	}
+
+	var total int
+	err = h.db.TimescaleDB.QueryRow("SELECT COUNT(*) FROM sensor_quarantine "+where, args...).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	args = append(args, perPage, offset)
+	rows, err := h.db.TimescaleDB.Query(fmt.Sprintf(`
+		SELECT install_code, id_swiflet_house, floor, metric, value, reason, detail, timestamp, received_at
+		FROM sensor_quarantine
+		%s
+		ORDER BY timestamp DESC
+		LIMIT $%d OFFSET $%d
+	`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	values := []models.QuarantinedValue{}
+	for rows.Next() {
+		var value models.QuarantinedValue
+		err := rows.Scan(&value.InstallCode, &value.SwifletHouseID, &value.Floor, &value.Metric, &value.Value,
+			&value.Reason, &value.Detail, &value.Timestamp, &value.ReceivedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		values = append(values, value)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.QuarantinedValue]{
+		Data:       values,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// GetQuarantineCounts returns the number of quarantined values per device
+func (h *IngestionHandler) GetQuarantineCounts(c *gin.Context) {
+	filter, err := parseSensorFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	where, args := filter.where([]interface{}{models.QuarantineOutOfRange, models.QuarantineSpike})
+	rows, err := h.db.TimescaleDB.Query(`
+		SELECT install_code, MAX(id_swiflet_house), MAX(floor), COUNT(*),
+			COUNT(*) FILTER (WHERE reason = $1), COUNT(*) FILTER (WHERE reason = $2),
+			MAX(timestamp)
+		FROM sensor_quarantine
+		`+where+`
+		GROUP BY install_code
+		ORDER BY COUNT(*) DESC
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	counts := []models.DeviceQuarantineCount{}
+	for rows.Next() {
+		var count models.DeviceQuarantineCount
+		err := rows.Scan(&count.InstallCode, &count.SwifletHouseID, &count.Floor, &count.Total,
+			&count.OutOfRange, &count.Spike, &count.LastQuarantined)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		counts = append(counts, count)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": counts})
+}
@@ -1,36 +1,80 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"swiflet-backend/internal/config"
 	"swiflet-backend/internal/database"
 	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/lib/pq"
 )
 
 type IoTHandler struct {
-	db       *database.DB
-	validate *validator.Validate
+	db          *database.DB
+	registry    *services.DeviceRegistry
+	presence    *services.PresenceTracker
+	live        *services.LiveCache
+	importer    *services.SensorImporter
+	provisioner *services.Provisioner
+	lifecycle   *services.DeviceLifecycle
+	retention   config.RetentionConfig
+	validate    *validator.Validate
 }
 
-func NewIoTHandler(db *database.DB) *IoTHandler {
+func NewIoTHandler(db *database.DB, registry *services.DeviceRegistry, presence *services.PresenceTracker,
+	live *services.LiveCache, importer *services.SensorImporter, provisioner *services.Provisioner,
+	lifecycle *services.DeviceLifecycle, retention config.RetentionConfig) *IoTHandler {
 	return &IoTHandler{
-		db:       db,
-		validate: validator.New(),
+		db:          db,
+		registry:    registry,
+		presence:    presence,
+		live:        live,
+		importer:    importer,
+		provisioner: provisioner,
+		lifecycle:   lifecycle,
+		retention:   retention,
+		validate:    validator.New(),
 	}
 }
 
-// ListSwifletHouses returns paginated list of swiflet houses
+// ListSwifletHouses returns paginated list of the swiflet houses the caller
+// owns or is a member of (every house for admins), with the caller's role
 func (h *IoTHandler) ListSwifletHouses(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
 	perPage := 10
 	offset := (page - 1) * perPage
 
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
 	var total int
-	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM swiflet_houses").Scan(&total)
+	err = h.db.PostgreSQL.QueryRow(
+		"SELECT COUNT(*) FROM swiflet_houses h WHERE h.deleted_at IS NULL AND "+houseVisible(1, 2),
+		admin, userID).Scan(&total)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -39,11 +83,12 @@ func (h *IoTHandler) ListSwifletHouses(c *gin.Context) {
 	}
 
 	rows, err := h.db.PostgreSQL.Query(`
-		SELECT id, id_user, name, location, created_at
-		FROM swiflet_houses
+		SELECT `+houseColumns+`
+		FROM swiflet_houses h
+		WHERE h.deleted_at IS NULL AND `+houseVisible(1, 2)+`
 		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
-	`, perPage, offset)
+		LIMIT $3 OFFSET $4
+	`, admin, userID, perPage, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -54,8 +99,7 @@ func (h *IoTHandler) ListSwifletHouses(c *gin.Context) {
 
 	var houses []models.SwifletHouse
 	for rows.Next() {
-		var house models.SwifletHouse
-		err := rows.Scan(&house.ID, &house.UserID, &house.Name, &house.Location, &house.CreatedAt)
+		house, err := scanHouse(rows)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 				Error: "Database error",
@@ -65,11 +109,42 @@ func (h *IoTHandler) ListSwifletHouses(c *gin.Context) {
 		houses = append(houses, house)
 	}
 
+	houseIDs := make([]int64, len(houses))
+	for i, house := range houses {
+		houseIDs[i] = int64(house.ID)
+	}
+	climate, err := latestHouseClimate(h.db, houseIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	for i := range houses {
+		houses[i].Climate = climate[houses[i].ID]
+	}
+
+	if err := applyHouseRoles(h.db, userID.(int), houses); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"data": houses})
 }
 
-// CreateSwifletHouse creates a new swiflet house
+// CreateSwifletHouse creates a new swiflet house owned by the caller. Only
+// admins may create houses for another user with id_user.
 func (h *IoTHandler) CreateSwifletHouse(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
 	var house models.SwifletHouse
 	if err := c.ShouldBindJSON(&house); err != nil {
 		c.JSON(http.StatusBadRequest, models.ErrorResponse{
@@ -85,10 +160,46 @@ func (h *IoTHandler) CreateSwifletHouse(c *gin.Context) {
 		return
 	}
 
-	_, err := h.db.PostgreSQL.Exec(`
-		INSERT INTO swiflet_houses (id_user, name, location, created_at)
-		VALUES ($1, $2, $3, $4)
-	`, house.UserID, house.Name, house.Location, time.Now())
+	if house.UserID == 0 {
+		house.UserID = userID.(int)
+	}
+	if house.UserID != userID.(int) {
+		admin, err := isAdmin(h.db, userID.(int))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		if !admin {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Cannot create swiflet houses for other users",
+			})
+			return
+		}
+
+		var count int
+		err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM users WHERE id = $1", house.UserID).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Validation failed",
+				Details: map[string]string{"id_user": "user does not exist"},
+			})
+			return
+		}
+	}
+
+	now := time.Now()
+	house, err := scanHouse(h.db.PostgreSQL.QueryRow(`
+		INSERT INTO swiflet_houses (id_user, name, location, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING `+houseColumns, house.UserID, house.Name, house.Location, now))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
@@ -97,17 +208,49 @@ func (h *IoTHandler) CreateSwifletHouse(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Swiflet house created successfully"})
+	if house.UserID == userID.(int) {
+		house.Role = models.HouseRoleOwner
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Swiflet house created successfully",
+		"house":   house,
+	})
 }
 
-// ListIoTDevices returns paginated list of IoT devices
+// ListIoTDevices returns paginated list of the IoT devices in the houses the
+// caller owns or is a member of (every device for admins)
 func (h *IoTHandler) ListIoTDevices(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
 	perPage := 10
 	offset := (page - 1) * perPage
 
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	from := `
+		FROM iot_devices d
+		JOIN swiflet_houses h ON h.id = d.id_swiflet_house
+		WHERE d.deleted_at IS NULL AND ` + houseVisible(1, 2)
+
 	var total int
-	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM iot_devices").Scan(&total)
+	err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from, admin, userID).Scan(&total)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -116,11 +259,10 @@ func (h *IoTHandler) ListIoTDevices(c *gin.Context) {
 	}
 
 	rows, err := h.db.PostgreSQL.Query(`
-		SELECT id, id_swiflet_house, floor, install_code, status, created_at, updated_at
-		FROM iot_devices
-		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
-	`, perPage, offset)
+		SELECT `+deviceColumnsOf("d")+from+`
+		ORDER BY d.created_at DESC
+		LIMIT $3 OFFSET $4
+	`, admin, userID, perPage, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -131,15 +273,14 @@ func (h *IoTHandler) ListIoTDevices(c *gin.Context) {
 
 	var devices []models.IoTDevice
 	for rows.Next() {
-		var device models.IoTDevice
-		err := rows.Scan(&device.ID, &device.SwifletHouseID, &device.Floor, 
-			&device.InstallCode, &device.Status, &device.CreatedAt, &device.UpdatedAt)
+		device, err := scanDevice(rows)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 				Error: "Database error",
 			})
 			return
 		}
+		h.applyPresence(&device)
 		devices = append(devices, device)
 	}
 
@@ -163,29 +304,75 @@ func (h *IoTHandler) CreateIoTDevice(c *gin.Context) {
 		return
 	}
 
-	_, err := h.db.PostgreSQL.Exec(`
-		INSERT INTO iot_devices (id_swiflet_house, floor, install_code, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, device.SwifletHouseID, device.Floor, device.InstallCode, device.Status, time.Now(), time.Now())
+	if !authorizeHouse(c, h.db, device.SwifletHouseID, models.HouseRoleManager) {
+		return
+	}
+
+	// Install codes are generated; only admins may register hardware that
+	// already has one
+	userID, _ := c.Get("user_id")
+	if device.InstallCode != "" {
+		admin, err := isAdmin(h.db, userID.(int))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		if !admin {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Validation failed",
+				Details: map[string]string{"install_code": "is generated by the server; claim provisioned gateways instead"},
+			})
+			return
+		}
+	}
 
+	device, credentials, err := h.provisioner.Register(device, userID.(int))
 	if err != nil {
+		if errors.Is(err, services.ErrInstallCodeTaken) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to create IoT device",
 		})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "IoT device created successfully"})
+	// Make the new device known to sensor ingestion right away
+	if err := h.registry.Refresh(device.InstallCode); err != nil {
+		log.Printf("Failed to refresh device registry: %v", err)
+	}
+
+	// The secret is only returned once
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "IoT device created successfully",
+		"device":      device,
+		"credentials": credentials,
+	})
 }
 
-// ListSensors returns paginated list of sensor data
+// ListSensors returns paginated list of sensor data of the houses the caller
+// owns or is a member of (every house for admins)
 func (h *IoTHandler) ListSensors(c *gin.Context) {
+	houseIDs, all, ok := accessibleHouses(c, h.db)
+	if !ok {
+		return
+	}
+
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
 	perPage := 10
 	offset := (page - 1) * perPage
 
 	var total int
-	err := h.db.TimescaleDB.QueryRow("SELECT COUNT(*) FROM sensors").Scan(&total)
+	err := h.db.TimescaleDB.QueryRow("SELECT COUNT(*) FROM sensors WHERE $1 OR id_swiflet_house = ANY($2)",
+		all, pq.Array(houseIDs)).Scan(&total)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -194,11 +381,12 @@ func (h *IoTHandler) ListSensors(c *gin.Context) {
 	}
 
 	rows, err := h.db.TimescaleDB.Query(`
-		SELECT id, install_code, suhu, kelembaban, timestamp
+		SELECT id, install_code, id_swiflet_house, floor, suhu, kelembaban, timestamp
 		FROM sensors
+		WHERE $1 OR id_swiflet_house = ANY($2)
 		ORDER BY timestamp DESC
-		LIMIT $1 OFFSET $2
-	`, perPage, offset)
+		LIMIT $3 OFFSET $4
+	`, all, pq.Array(houseIDs), perPage, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Database error",
@@ -210,8 +398,8 @@ func (h *IoTHandler) ListSensors(c *gin.Context) {
 	var sensors []models.Sensor
 	for rows.Next() {
 		var sensor models.Sensor
-		err := rows.Scan(&sensor.ID, &sensor.InstallCode, &sensor.Suhu, 
-			&sensor.Kelembaban, &sensor.Timestamp)
+		err := rows.Scan(&sensor.ID, &sensor.InstallCode, &sensor.SwifletHouseID, &sensor.Floor,
+			&sensor.Suhu, &sensor.Kelembaban, &sensor.Timestamp)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 				Error: "Database error",
@@ -222,4 +410,163 @@ func (h *IoTHandler) ListSensors(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{"data": sensors})
-}
\ No newline at end of file
+}
+
+// ListSensorMeasurements returns paginated sensor values of every metric,
+// filtered by install_code, house, floor, metric and time range. Only
+// readings of the caller's houses are returned unless they are an admin.
+func (h *IoTHandler) ListSensorMeasurements(c *gin.Context) {
+	filter, err := parseSensorFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if !scopeSensorFilter(c, h.db, &filter) {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "50"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 500 {
+		perPage = 50
+	}
+
+	offset := (page - 1) * perPage
+
+	where, args := filter.where(nil)
+
+	var total int
+	err = h.db.TimescaleDB.QueryRow("SELECT COUNT(*) FROM sensor_readings "+where, args...).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	args = append(args, perPage, offset)
+	rows, err := h.db.TimescaleDB.Query(fmt.Sprintf(`
+		SELECT install_code, id_swiflet_house, floor, metric, value, timestamp
+		FROM sensor_readings
+		%s
+		ORDER BY timestamp DESC, metric ASC
+		LIMIT $%d OFFSET $%d
+	`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	measurements := []models.SensorMeasurement{}
+	for rows.Next() {
+		var measurement models.SensorMeasurement
+		err := rows.Scan(&measurement.InstallCode, &measurement.SwifletHouseID, &measurement.Floor,
+			&measurement.Metric, &measurement.Value, &measurement.Timestamp)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		measurements = append(measurements, measurement)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.SensorMeasurement]{
+		Data:       measurements,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// applyPresence replaces the stored last-seen time and status with the live
+// state of the presence tracker, which is ahead of the database
+func (h *IoTHandler) applyPresence(device *models.IoTDevice) {
+	presence := h.presence.Get(device.InstallCode)
+	if presence.LastSeen.IsZero() {
+		return
+	}
+	lastSeen := presence.LastSeen
+	device.LastSeenAt = &lastSeen
+	device.ConnectionStatus = presence.Status
+}
+
+// GetDeviceStatusHistory returns the online/offline transitions of a device
+func (h *IoTHandler) GetDeviceStatusHistory(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+	deviceID := device.ID
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM device_status_history WHERE id_device = $1", deviceID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT id, id_device, previous_status, status, last_seen_at, changed_at
+		FROM device_status_history
+		WHERE id_device = $1
+		ORDER BY changed_at DESC
+		LIMIT $2 OFFSET $3
+	`, deviceID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	changes := []models.DeviceStatusChange{}
+	for rows.Next() {
+		var change models.DeviceStatusChange
+		err := rows.Scan(&change.ID, &change.DeviceID, &change.PreviousStatus, &change.Status,
+			&change.LastSeenAt, &change.ChangedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		changes = append(changes, change)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.DeviceStatusChange]{
+		Data:       changes,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
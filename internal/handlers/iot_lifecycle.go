@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// houseColumns selects a swiflet house for scanHouse
+const houseColumns = `id, id_user, name, location, created_at, COALESCE(updated_at, created_at)`
+
+func scanHouse(row interface{ Scan(...interface{}) error }) (models.SwifletHouse, error) {
+	var house models.SwifletHouse
+	err := row.Scan(&house.ID, &house.UserID, &house.Name, &house.Location, &house.CreatedAt, &house.UpdatedAt)
+	return house, err
+}
+
+// deviceColumns selects an IoT device for scanDevice
+const deviceColumns = `id, id_swiflet_house, floor, install_code, status, last_seen_at, connection_status,
+	maintenance_needed, decommissioned_at, firmware_version, firmware_updated_at, created_at, updated_at`
+
+// deviceColumnsOf is deviceColumns qualified with a table alias
+func deviceColumnsOf(alias string) string {
+	columns := strings.Split(deviceColumns, ",")
+	for i, column := range columns {
+		columns[i] = alias + "." + strings.TrimSpace(column)
+	}
+	return strings.Join(columns, ", ")
+}
+
+func scanDevice(row interface{ Scan(...interface{}) error }) (models.IoTDevice, error) {
+	var device models.IoTDevice
+	err := row.Scan(&device.ID, &device.SwifletHouseID, &device.Floor, &device.InstallCode, &device.Status,
+		&device.LastSeenAt, &device.ConnectionStatus, &device.MaintenanceNeeded, &device.DecommissionedAt,
+		&device.FirmwareVersion, &device.FirmwareUpdatedAt, &device.CreatedAt, &device.UpdatedAt)
+	return device, err
+}
+
+// applyHouseRoles sets the role of a user in each house. Houses the user is
+// not a member of, as an admin, get none.
+func applyHouseRoles(db *database.DB, userID int, houses []models.SwifletHouse) error {
+	houseIDs := make([]int64, len(houses))
+	for i, house := range houses {
+		houseIDs[i] = int64(house.ID)
+	}
+
+	rows, err := db.PostgreSQL.Query(`
+		SELECT id_swiflet_house, role FROM house_members WHERE id_user = $1 AND id_swiflet_house = ANY($2)
+	`, userID, pq.Array(houseIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	roles := make(map[int]string)
+	for rows.Next() {
+		var houseID int
+		var role string
+		if err := rows.Scan(&houseID, &role); err != nil {
+			return err
+		}
+		roles[houseID] = role
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range houses {
+		if houses[i].UserID == userID {
+			houses[i].Role = models.HouseRoleOwner
+		} else {
+			houses[i].Role = roles[houses[i].ID]
+		}
+	}
+	return nil
+}
+
+// loadHouse reads the house in the id parameter and checks the caller has at
+// least role in it. It writes the error response and returns false otherwise.
+func (h *IoTHandler) loadHouse(c *gin.Context, role string) (models.SwifletHouse, bool) {
+	houseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid swiflet house ID",
+		})
+		return models.SwifletHouse{}, false
+	}
+
+	if !authorizeHouse(c, h.db, houseID, role) {
+		return models.SwifletHouse{}, false
+	}
+
+	house, err := scanHouse(h.db.PostgreSQL.QueryRow(`
+		SELECT `+houseColumns+` FROM swiflet_houses WHERE id = $1
+	`, houseID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return house, false
+	}
+	return house, true
+}
+
+// GetSwifletHouse returns a house with the climate score of its last scored day
+func (h *IoTHandler) GetSwifletHouse(c *gin.Context) {
+	house, ok := h.loadHouse(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	climate, err := latestHouseClimate(h.db, []int64{int64(house.ID)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	house.Climate = climate[house.ID]
+
+	userID, _ := c.Get("user_id")
+	houses := []models.SwifletHouse{house}
+	if err := applyHouseRoles(h.db, userID.(int), houses); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, houses[0])
+}
+
+// UpdateSwifletHouse changes the name or location of a house
+func (h *IoTHandler) UpdateSwifletHouse(c *gin.Context) {
+	var request struct {
+		Name     *string `json:"name" validate:"omitempty,max=255"`
+		Location *string `json:"location" validate:"omitempty,max=255"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+
+	details := make(map[string]string)
+	if request.Name != nil && strings.TrimSpace(*request.Name) == "" {
+		details["name"] = "must not be empty"
+	}
+	if request.Location != nil && strings.TrimSpace(*request.Location) == "" {
+		details["location"] = "must not be empty"
+	}
+	if len(details) > 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Validation failed",
+			Details: details,
+		})
+		return
+	}
+
+	house, ok := h.loadHouse(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	house, err := scanHouse(h.db.PostgreSQL.QueryRow(`
+		UPDATE swiflet_houses SET name = COALESCE($1, name), location = COALESCE($2, location), updated_at = $3
+		WHERE id = $4 AND deleted_at IS NULL
+		RETURNING `+houseColumns, request.Name, request.Location, time.Now(), house.ID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Swiflet house not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update swiflet house",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, house)
+}
+
+// DeleteSwifletHouse soft-deletes a house and its devices. Sensor readings,
+// climate scores and harvests are kept.
+func (h *IoTHandler) DeleteSwifletHouse(c *gin.Context) {
+	house, ok := h.loadHouse(c, models.HouseRoleOwner)
+	if !ok {
+		return
+	}
+
+	if err := h.lifecycle.DeleteHouse(house.ID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Swiflet house not found",
+			})
+			return
+		}
+		log.Printf("Failed to delete swiflet house %d: %v", house.ID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete swiflet house",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Swiflet house deleted successfully"})
+}
+
+// loadDevice reads the device in the id parameter and checks the caller has
+// at least role in its house. Deleted devices are not found. It writes the
+// error response and returns false otherwise.
+func (h *IoTHandler) loadDevice(c *gin.Context, role string) (models.IoTDevice, bool) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid device ID",
+		})
+		return models.IoTDevice{}, false
+	}
+
+	device, err := scanDevice(h.db.PostgreSQL.QueryRow(`
+		SELECT `+deviceColumns+` FROM iot_devices WHERE id = $1 AND deleted_at IS NULL
+	`, deviceID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return device, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return device, false
+	}
+
+	if !authorizeHouse(c, h.db, device.SwifletHouseID, role) {
+		return device, false
+	}
+
+	h.applyPresence(&device)
+	return device, true
+}
+
+// GetIoTDevice returns a single device
+func (h *IoTHandler) GetIoTDevice(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+// UpdateIoTDevice changes the status of a device or moves it to another floor
+// or house. A move is kept in the assignment history so readings stay
+// attributed to the house and floor they were taken on.
+func (h *IoTHandler) UpdateIoTDevice(c *gin.Context) {
+	var request struct {
+		SwifletHouseID *int `json:"id_swiflet_house" validate:"omitempty,min=1"`
+		Floor          *int `json:"floor" validate:"omitempty,min=1"`
+		Status         *int `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+
+	device, ok := h.loadDevice(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	houseID, floor := device.SwifletHouseID, device.Floor
+	if request.SwifletHouseID != nil {
+		houseID = *request.SwifletHouseID
+	}
+	if request.Floor != nil {
+		floor = *request.Floor
+	}
+
+	// Moving to another house needs access to that house too
+	if houseID != device.SwifletHouseID && !authorizeHouse(c, h.db, houseID, models.HouseRoleManager) {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	device, err := h.lifecycle.Move(device, houseID, floor, userID.(int))
+	if err != nil {
+		if errors.Is(err, services.ErrDeviceRetired) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+			return
+		}
+		log.Printf("Failed to move device %d: %v", device.ID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update IoT device",
+		})
+		return
+	}
+
+	if request.Status != nil && *request.Status != device.Status {
+		device.UpdatedAt = time.Now()
+		_, err := h.db.PostgreSQL.Exec("UPDATE iot_devices SET status = $1, updated_at = $2 WHERE id = $3",
+			*request.Status, device.UpdatedAt, device.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to update IoT device",
+			})
+			return
+		}
+		device.Status = *request.Status
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+// DecommissionIoTDevice retires a device: its readings are rejected and its
+// credentials revoked, but it stays listed with its history
+func (h *IoTHandler) DecommissionIoTDevice(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if device.DecommissionedAt != nil {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Device is already decommissioned",
+		})
+		return
+	}
+
+	if err := h.lifecycle.Retire(device, models.AssignmentDecommissioned); err != nil {
+		log.Printf("Failed to decommission device %d: %v", device.ID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to decommission IoT device",
+		})
+		return
+	}
+
+	now := time.Now()
+	device.DecommissionedAt = &now
+	device.UpdatedAt = now
+	c.JSON(http.StatusOK, device)
+}
+
+// DeleteIoTDevice soft-deletes a device. Its readings are kept, attributed to
+// the houses and floors they were taken on.
+func (h *IoTHandler) DeleteIoTDevice(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	if err := h.lifecycle.Retire(device, models.AssignmentDeleted); err != nil {
+		log.Printf("Failed to delete device %d: %v", device.ID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete IoT device",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "IoT device deleted successfully"})
+}
+
+// ListDeviceAssignments returns where a device was installed over time, oldest first
+func (h *IoTHandler) ListDeviceAssignments(c *gin.Context) {
+	device, ok := h.loadDevice(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	assignments, err := services.LoadAssignments(h.db, device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": assignments})
+}
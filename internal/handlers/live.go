@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetHouseLive returns the latest reading of every device of a house grouped
+// by floor, with the age of each value and the device's online status. It is
+// served from the in-memory live cache and presence tracker, not TimescaleDB.
+func (h *IoTHandler) GetHouseLive(c *gin.Context) {
+	houseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid swiflet house ID",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return
+	}
+
+	now := time.Now()
+	snapshot := models.HouseLiveSnapshot{
+		SwifletHouseID: houseID,
+		GeneratedAt:    now,
+		Floors:         []models.FloorLiveReading{},
+	}
+
+	// Devices come ordered by floor
+	var sums map[string]float64
+	var counts map[string]int
+	for _, device := range h.registry.HouseDevices(houseID) {
+		if len(snapshot.Floors) == 0 || snapshot.Floors[len(snapshot.Floors)-1].Floor != device.Floor {
+			snapshot.Floors = append(snapshot.Floors, models.FloorLiveReading{
+				Floor:   device.Floor,
+				Values:  make(map[string]float64),
+				Devices: []models.DeviceLiveReading{},
+			})
+			sums = make(map[string]float64)
+			counts = make(map[string]int)
+		}
+		floor := &snapshot.Floors[len(snapshot.Floors)-1]
+
+		reading := models.DeviceLiveReading{
+			DeviceID:         device.ID,
+			InstallCode:      device.InstallCode,
+			Floor:            device.Floor,
+			ConnectionStatus: models.DeviceStatusUnknown,
+			Values:           make(map[string]models.LiveValue),
+		}
+
+		presence := h.presence.Get(device.InstallCode)
+		if presence.Status != "" {
+			reading.ConnectionStatus = presence.Status
+		}
+		if !presence.LastSeen.IsZero() {
+			lastSeen := presence.LastSeen
+			reading.LastSeenAt = &lastSeen
+		}
+
+		if live, ok := h.live.Device(device.InstallCode); ok {
+			timestamp := live.Timestamp
+			age := int64(now.Sub(timestamp) / time.Second)
+			reading.Timestamp = &timestamp
+			reading.AgeSeconds = &age
+
+			for metric, value := range live.Values {
+				reading.Values[metric] = models.LiveValue{
+					Value:      value.Value,
+					Timestamp:  value.Timestamp,
+					AgeSeconds: int64(now.Sub(value.Timestamp) / time.Second),
+				}
+				if reading.ConnectionStatus != models.DeviceStatusOffline {
+					sums[metric] += value.Value
+					counts[metric]++
+					floor.Values[metric] = sums[metric] / float64(counts[metric])
+				}
+			}
+		}
+
+		floor.Devices = append(floor.Devices, reading)
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type MemberHandler struct {
+	db          *database.DB
+	memberships *services.Memberships
+	validate    *validator.Validate
+}
+
+func NewMemberHandler(db *database.DB, memberships *services.Memberships) *MemberHandler {
+	return &MemberHandler{
+		db:          db,
+		memberships: memberships,
+		validate:    validator.New(),
+	}
+}
+
+// authorizeHouseParam reads the house in the id parameter and checks the
+// caller has at least role in it. It writes the error response and returns
+// false otherwise.
+func (h *MemberHandler) authorizeHouseParam(c *gin.Context, role string) (int, bool) {
+	houseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid swiflet house ID",
+		})
+		return 0, false
+	}
+	return houseID, authorizeHouse(c, h.db, houseID, role)
+}
+
+// memberParam reads the user_id parameter of a member route
+func memberParam(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return 0, false
+	}
+	return userID, true
+}
+
+// ListHouseMembers returns the owner and members of a house with their roles
+func (h *MemberHandler) ListHouseMembers(c *gin.Context) {
+	houseID, ok := h.authorizeHouseParam(c, models.HouseRoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := h.memberships.ListMembers(houseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": members})
+}
+
+// UpdateHouseMember changes the role of a member. Only the owner may.
+func (h *MemberHandler) UpdateHouseMember(c *gin.Context) {
+	var request struct {
+		Role string `json:"role" validate:"required,oneof=manager worker viewer"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Validation failed",
+			Details: map[string]string{"role": "must be one of manager, worker, viewer"},
+		})
+		return
+	}
+
+	houseID, ok := h.authorizeHouseParam(c, models.HouseRoleOwner)
+	if !ok {
+		return
+	}
+	userID, ok := memberParam(c)
+	if !ok {
+		return
+	}
+
+	member, err := h.memberships.UpdateRole(houseID, userID, request.Role)
+	if err != nil {
+		if errors.Is(err, services.ErrMemberNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "House member not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update house member",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// RemoveHouseMember takes away a member's access. The owner may remove
+// anyone but themselves; members may remove themselves to leave a house.
+func (h *MemberHandler) RemoveHouseMember(c *gin.Context) {
+	userID, ok := memberParam(c)
+	if !ok {
+		return
+	}
+
+	callerID, _ := c.Get("user_id")
+	role := models.HouseRoleOwner
+	if userID == callerID.(int) {
+		role = models.HouseRoleViewer
+	}
+	houseID, ok := h.authorizeHouseParam(c, role)
+	if !ok {
+		return
+	}
+
+	if err := h.memberships.RemoveMember(houseID, userID); err != nil {
+		if errors.Is(err, services.ErrMemberNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "House member not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to remove house member",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "House member removed successfully"})
+}
+
+// ListHouseInvitations returns the invitations of a house, newest first,
+// filtered by status
+func (h *MemberHandler) ListHouseInvitations(c *gin.Context) {
+	houseID, ok := h.authorizeHouseParam(c, models.HouseRoleOwner)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+services.InvitationColumns+`
+		FROM house_invitations
+		WHERE id_swiflet_house = $1
+		ORDER BY created_at DESC, id DESC
+	`, houseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	// Expiry is only known after scanning, so the status is filtered here
+	invitations := []models.HouseInvitation{}
+	for rows.Next() {
+		invitation, err := services.ScanInvitation(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		if status == "" || invitation.Status == status {
+			invitations = append(invitations, invitation)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": invitations})
+}
+
+// InviteHouseMember invites an email address to a house as manager, worker
+// or viewer. Only the owner may invite. When mail is disabled the token is
+// returned so the owner can share the link.
+func (h *MemberHandler) InviteHouseMember(c *gin.Context) {
+	var request models.InviteMemberRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+			Details: map[string]string{
+				"email": "must be a valid email address",
+				"role":  "must be one of manager, worker, viewer",
+			},
+		})
+		return
+	}
+
+	houseID, ok := h.authorizeHouseParam(c, models.HouseRoleOwner)
+	if !ok {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	invitation, token, err := h.memberships.Invite(houseID, request, userID.(int))
+	if err != nil {
+		if errors.Is(err, services.ErrAlreadyMember) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+			return
+		}
+		log.Printf("Failed to invite %s to swiflet house %d: %v", request.Email, houseID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to send invitation",
+		})
+		return
+	}
+
+	if h.memberships.MailEnabled() {
+		c.JSON(http.StatusCreated, invitation)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"invitation": invitation,
+		"token":      token,
+	})
+}
+
+// RevokeHouseInvitation cancels a pending invitation
+func (h *MemberHandler) RevokeHouseInvitation(c *gin.Context) {
+	houseID, ok := h.authorizeHouseParam(c, models.HouseRoleOwner)
+	if !ok {
+		return
+	}
+
+	invitationID, err := strconv.Atoi(c.Param("invitation_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid invitation ID",
+		})
+		return
+	}
+
+	invitation, err := h.memberships.RevokeInvitation(houseID, invitationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvitationNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Invitation not found",
+			})
+		case errors.Is(err, services.ErrInvitationClosed):
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to revoke invitation",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, invitation)
+}
+
+// AcceptInvitation joins the house of an invitation with the token from its
+// email. The caller's account email must be the invited address.
+func (h *MemberHandler) AcceptInvitation(c *gin.Context) {
+	var request models.AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	member, err := h.memberships.Accept(request.Token, userID.(int))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvitationNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Invitation not found",
+			})
+		case errors.Is(err, services.ErrInvitationEmail):
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		case errors.Is(err, services.ErrInvitationExpired), errors.Is(err, services.ErrInvitationClosed),
+			errors.Is(err, services.ErrAlreadyMember):
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		default:
+			log.Printf("Failed to accept invitation: %v", err)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to accept invitation",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
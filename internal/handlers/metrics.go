@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type MetricHandler struct {
+	db       *database.DB
+	registry *services.DeviceRegistry
+	validate *validator.Validate
+}
+
+func NewMetricHandler(db *database.DB, registry *services.DeviceRegistry) *MetricHandler {
+	return &MetricHandler{
+		db:       db,
+		registry: registry,
+		validate: validator.New(),
+	}
+}
+
+// ListMetricTypes returns all registered sensor metric types
+func (h *MetricHandler) ListMetricTypes(c *gin.Context) {
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT id, key, name, unit, min_value, max_value, max_change_per_minute, created_at, updated_at
+		FROM metric_types
+		ORDER BY key ASC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	metricTypes := []models.MetricType{}
+	for rows.Next() {
+		var metricType models.MetricType
+		err := rows.Scan(&metricType.ID, &metricType.Key, &metricType.Name, &metricType.Unit,
+			&metricType.MinValue, &metricType.MaxValue, &metricType.MaxChangePerMinute, &metricType.CreatedAt, &metricType.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		metricTypes = append(metricTypes, metricType)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": metricTypes})
+}
+
+// CreateMetricType registers a new sensor metric type
+func (h *MetricHandler) CreateMetricType(c *gin.Context) {
+	var metricType models.MetricType
+	if err := c.ShouldBindJSON(&metricType); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	metricType.Key = strings.ToLower(strings.TrimSpace(metricType.Key))
+	if err := h.validate.Struct(metricType); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed: " + err.Error(),
+		})
+		return
+	}
+
+	// Check if metric type already exists
+	var count int
+	err := h.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM metric_types WHERE key = $1", metricType.Key).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	if count > 0 {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Metric type already exists",
+		})
+		return
+	}
+
+	now := time.Now()
+	err = h.db.PostgreSQL.QueryRow(`
+		INSERT INTO metric_types (key, name, unit, min_value, max_value, max_change_per_minute, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at
+	`, metricType.Key, metricType.Name, metricType.Unit, metricType.MinValue, metricType.MaxValue,
+		metricType.MaxChangePerMinute, now, now).Scan(
+		&metricType.ID, &metricType.CreatedAt, &metricType.UpdatedAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create metric type",
+		})
+		return
+	}
+
+	h.reloadRegistry()
+
+	c.JSON(http.StatusCreated, metricType)
+}
+
+// UpdateMetricType changes the name, unit, valid range or change limit of a metric type
+func (h *MetricHandler) UpdateMetricType(c *gin.Context) {
+	key := c.Param("key")
+
+	var request struct {
+		Name     string  `json:"name" validate:"required"`
+		Unit     string  `json:"unit" validate:"required"`
+		MinValue float64 `json:"min_value"`
+		MaxValue float64 `json:"max_value" validate:"gtfield=MinValue"`
+		// MaxChangePerMinute may be omitted to disable spike detection
+		MaxChangePerMinute *float64 `json:"max_change_per_minute" validate:"omitempty,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed: " + err.Error(),
+		})
+		return
+	}
+
+	var metricType models.MetricType
+	err := h.db.PostgreSQL.QueryRow(`
+		UPDATE metric_types
+		SET name = $1, unit = $2, min_value = $3, max_value = $4, max_change_per_minute = $5, updated_at = $6
+		WHERE key = $7
+		RETURNING id, key, name, unit, min_value, max_value, max_change_per_minute, created_at, updated_at
+	`, request.Name, request.Unit, request.MinValue, request.MaxValue, request.MaxChangePerMinute, time.Now(), key).Scan(
+		&metricType.ID, &metricType.Key, &metricType.Name, &metricType.Unit,
+		&metricType.MinValue, &metricType.MaxValue, &metricType.MaxChangePerMinute, &metricType.CreatedAt, &metricType.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Metric type not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update metric type",
+		})
+		return
+	}
+
+	h.reloadRegistry()
+
+	c.JSON(http.StatusOK, metricType)
+}
+
+// GetDeviceMetrics returns the metric types registered for a device
+func (h *MetricHandler) GetDeviceMetrics(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid device ID",
+		})
+		return
+	}
+
+	var houseID int
+	err = h.db.PostgreSQL.QueryRow("SELECT id_swiflet_house FROM iot_devices WHERE id = $1", deviceID).Scan(&houseID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT mt.id, mt.key, mt.name, mt.unit, mt.min_value, mt.max_value, mt.max_change_per_minute, mt.created_at, mt.updated_at
+		FROM device_metrics dm
+		JOIN metric_types mt ON mt.key = dm.metric_key
+		WHERE dm.id_device = $1
+		ORDER BY mt.key ASC
+	`, deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	metricTypes := []models.MetricType{}
+	for rows.Next() {
+		var metricType models.MetricType
+		err := rows.Scan(&metricType.ID, &metricType.Key, &metricType.Name, &metricType.Unit,
+			&metricType.MinValue, &metricType.MaxValue, &metricType.MaxChangePerMinute, &metricType.CreatedAt, &metricType.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		metricTypes = append(metricTypes, metricType)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": metricTypes})
+}
+
+// SetDeviceMetrics replaces the metric types a device is allowed to report.
+// An empty list falls back to temperature and humidity only.
+func (h *MetricHandler) SetDeviceMetrics(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid device ID",
+		})
+		return
+	}
+
+	var request struct {
+		Metrics []string `json:"metrics"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	var installCode string
+	var houseID int
+	err = h.db.PostgreSQL.QueryRow("SELECT install_code, id_swiflet_house FROM iot_devices WHERE id = $1",
+		deviceID).Scan(&installCode, &houseID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, houseID, models.HouseRoleManager) {
+		return
+	}
+
+	for _, metric := range request.Metrics {
+		if _, ok := h.registry.MetricType(metric); !ok {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Unknown metric type: " + metric,
+			})
+			return
+		}
+	}
+
+	tx, err := h.db.PostgreSQL.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM device_metrics WHERE id_device = $1", deviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update device metrics",
+		})
+		return
+	}
+
+	for _, metric := range request.Metrics {
+		_, err := tx.Exec(`
+			INSERT INTO device_metrics (id_device, metric_key, created_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, deviceID, metric, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to update device metrics",
+			})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update device metrics",
+		})
+		return
+	}
+
+	if err := h.registry.Refresh(installCode); err != nil {
+		log.Printf("Failed to refresh device registry: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device metrics updated successfully"})
+}
+
+func (h *MetricHandler) reloadRegistry() {
+	if err := h.registry.Load(); err != nil {
+		log.Printf("Failed to reload device registry: %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Access levels of a mosquitto-go-auth ACL check
+const (
+	mqttAccRead      = 1
+	mqttAccWrite     = 2
+	mqttAccReadWrite = 3
+	mqttAccSubscribe = 4
+)
+
+type ProvisioningHandler struct {
+	db          *database.DB
+	registry    *services.DeviceRegistry
+	provisioner *services.Provisioner
+	hookToken   string
+	validate    *validator.Validate
+}
+
+func NewProvisioningHandler(db *database.DB, registry *services.DeviceRegistry, provisioner *services.Provisioner,
+	hookToken string) *ProvisioningHandler {
+	return &ProvisioningHandler{
+		db:          db,
+		registry:    registry,
+		provisioner: provisioner,
+		hookToken:   hookToken,
+		validate:    validator.New(),
+	}
+}
+
+// ProvisionDevices creates a batch of unclaimed gateways with generated
+// install codes, MQTT secrets and claim codes. The secrets and claim codes
+// are only returned here.
+func (h *ProvisioningHandler) ProvisionDevices(c *gin.Context) {
+	var request models.ProvisionDevicesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Validation failed",
+			Details: map[string]string{"count": "must be between 1 and 100"},
+		})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	devices, err := h.provisioner.Provision(request.Count, userID.(int))
+	if err != nil {
+		log.Printf("Failed to provision devices: %v", err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to provision devices",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": devices})
+}
+
+// ListProvisions returns provisioned devices, newest first, filtered by status
+func (h *ProvisioningHandler) ListProvisions(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	status := c.Query("status")
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	offset := (page - 1) * perPage
+
+	var total int
+	err := h.db.PostgreSQL.QueryRow(
+		"SELECT COUNT(*) FROM device_provisions WHERE ($1 = '' OR status = $1)", status).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT `+services.ProvisionColumns+`
+		FROM device_provisions
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, status, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	provisions := []models.DeviceProvision{}
+	for rows.Next() {
+		provision, err := services.ScanProvision(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		provisions = append(provisions, provision)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.DeviceProvision]{
+		Data:       provisions,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// RevokeProvision disables the MQTT credentials of a gateway, e.g. after it
+// was lost or stolen
+func (h *ProvisioningHandler) RevokeProvision(c *gin.Context) {
+	provisionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid provision ID",
+		})
+		return
+	}
+
+	provision, err := h.provisioner.Revoke(provisionID)
+	if err != nil {
+		if errors.Is(err, services.ErrProvisionNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Provisioned device not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke device",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, provision)
+}
+
+// ClaimDevice binds a provisioned gateway to a floor of one of the caller's
+// houses using the claim code printed on its label
+func (h *ProvisioningHandler) ClaimDevice(c *gin.Context) {
+	var request models.ClaimDeviceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+	request.InstallCode = strings.TrimSpace(request.InstallCode)
+
+	if !authorizeHouse(c, h.db, request.SwifletHouseID, models.HouseRoleManager) {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	device, err := h.provisioner.Claim(request, userID.(int))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrProvisionNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Provisioned device not found",
+			})
+		case errors.Is(err, services.ErrInvalidClaimCode):
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Invalid claim code",
+			})
+		case errors.Is(err, services.ErrAlreadyClaimed), errors.Is(err, services.ErrProvisionRevoked),
+			errors.Is(err, services.ErrInstallCodeTaken):
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+		default:
+			log.Printf("Failed to claim device %s: %v", request.InstallCode, err)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to claim device",
+			})
+		}
+		return
+	}
+
+	// Make the claimed device known to sensor ingestion right away
+	if err := h.registry.Refresh(device.InstallCode); err != nil {
+		log.Printf("Failed to refresh device registry: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, device)
+}
+
+// RotateDeviceCredentials issues a new MQTT secret for a device. Devices
+// registered before provisioning get their first secret this way. Deleted
+// devices are not found.
+func (h *ProvisioningHandler) RotateDeviceCredentials(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid device ID",
+		})
+		return
+	}
+
+	var device models.IoTDevice
+	err = h.db.PostgreSQL.QueryRow(`
+		SELECT id, id_swiflet_house, floor, install_code FROM iot_devices WHERE id = $1 AND deleted_at IS NULL
+	`, deviceID).Scan(&device.ID, &device.SwifletHouseID, &device.Floor, &device.InstallCode)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, device.SwifletHouseID, models.HouseRoleManager) {
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	credentials, err := h.provisioner.RotateSecret(device, userID.(int))
+	if err != nil {
+		if errors.Is(err, services.ErrProvisionRevoked) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to rotate device credentials",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// mqttHookRequest is the body of a broker authentication or ACL check, in
+// the field names of mosquitto-go-auth and EMQX
+type mqttHookRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	ClientID string `json:"clientid" form:"clientid"`
+	Topic    string `json:"topic" form:"topic"`
+	Acc      int    `json:"acc" form:"acc"`
+	Action   string `json:"action" form:"action"`
+}
+
+// bindHook checks the hook token and reads the request. It writes the error
+// response and returns false otherwise.
+func (h *ProvisioningHandler) bindHook(c *gin.Context) (mqttHookRequest, bool) {
+	var request mqttHookRequest
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if h.hookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.hookToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Invalid hook token",
+		})
+		return request, false
+	}
+
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return request, false
+	}
+	return request, true
+}
+
+// hookResult answers a hook with a status code for mosquitto-go-auth and a
+// result for EMQX
+func hookResult(c *gin.Context, allow bool, superuser bool) {
+	if !allow {
+		c.JSON(http.StatusForbidden, gin.H{"result": "deny"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "allow", "is_superuser": superuser})
+}
+
+// MQTTAuth is the broker's authentication hook for connecting clients
+func (h *ProvisioningHandler) MQTTAuth(c *gin.Context) {
+	request, ok := h.bindHook(c)
+	if !ok {
+		return
+	}
+
+	allow, err := h.provisioner.Authenticate(request.Username, request.Password)
+	if err != nil {
+		log.Printf("Failed to authenticate MQTT client %s: %v", request.Username, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	if !allow {
+		log.Printf("Rejected MQTT login of %q (client %q)", request.Username, request.ClientID)
+	}
+
+	hookResult(c, allow, allow && h.provisioner.IsSuperuser(request.Username))
+}
+
+// MQTTSuperuser is the broker's superuser hook; only the backend is one
+func (h *ProvisioningHandler) MQTTSuperuser(c *gin.Context) {
+	request, ok := h.bindHook(c)
+	if !ok {
+		return
+	}
+
+	superuser := h.provisioner.IsSuperuser(request.Username)
+	hookResult(c, superuser, superuser)
+}
+
+// MQTTACL is the broker's authorization hook for publishes and subscriptions
+func (h *ProvisioningHandler) MQTTACL(c *gin.Context) {
+	request, ok := h.bindHook(c)
+	if !ok {
+		return
+	}
+
+	var allow bool
+	switch {
+	case request.Action == "publish" || request.Acc == mqttAccWrite:
+		allow = h.provisioner.Authorize(request.Username, request.Topic, true)
+	case request.Action == "subscribe" || request.Acc == mqttAccRead || request.Acc == mqttAccSubscribe:
+		allow = h.provisioner.Authorize(request.Username, request.Topic, false)
+	case request.Acc == mqttAccReadWrite:
+		allow = h.provisioner.Authorize(request.Username, request.Topic, true) &&
+			h.provisioner.Authorize(request.Username, request.Topic, false)
+	}
+
+	hookResult(c, allow, false)
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Service requests sent by farmers: installing devices in a house, and
+// maintaining or removing a device. Maintenance and uninstallation requests
+// share their table layout.
+
+// Tables of the device service requests
+const (
+	maintenanceRequestsTable    = "maintenance_requests"
+	uninstallationRequestsTable = "uninstallation_requests"
+)
+
+type RequestHandler struct {
+	db       *database.DB
+	validate *validator.Validate
+}
+
+func NewRequestHandler(db *database.DB) *RequestHandler {
+	return &RequestHandler{
+		db:       db,
+		validate: validator.New(),
+	}
+}
+
+// requestPage reads the page, per_page, id_swiflet_house and status
+// parameters of the request lists. A house filter is authorized for viewers.
+// It writes the error response and returns false otherwise.
+func (h *RequestHandler) requestPage(c *gin.Context) (page, perPage, houseID int, status *int, ok bool) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	perPage, _ = strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	houseID, _ = strconv.Atoi(c.Query("id_swiflet_house"))
+
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 100 {
+		perPage = 20
+	}
+
+	if value := c.Query("status"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid status",
+			})
+			return page, perPage, houseID, nil, false
+		}
+		status = &parsed
+	}
+
+	if houseID != 0 && !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+		return page, perPage, houseID, status, false
+	}
+	return page, perPage, houseID, status, true
+}
+
+// ListInstallationRequests returns paginated installation requests of the
+// houses the caller owns or is a member of (every house for admins), newest
+// first, filtered by id_swiflet_house and status
+func (h *RequestHandler) ListInstallationRequests(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	page, perPage, houseID, status, ok := h.requestPage(c)
+	if !ok {
+		return
+	}
+	offset := (page - 1) * perPage
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	from := `
+		FROM installation_requests r
+		JOIN swiflet_houses h ON h.id = r.id_swiflet_house
+		WHERE h.deleted_at IS NULL AND ($1 = 0 OR r.id_swiflet_house = $1)
+			AND ($2::INTEGER IS NULL OR r.status = $2) AND ` + houseVisible(3, 4)
+
+	var total int
+	err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from, houseID, status, admin, userID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT r.id, r.id_swiflet_house, r.floors, r.sensor_count, r.appointment_date, COALESCE(r.status, 0),
+			r.created_at, r.updated_at`+from+`
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $5 OFFSET $6
+	`, houseID, status, admin, userID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	requests := []models.InstallationRequest{}
+	for rows.Next() {
+		var request models.InstallationRequest
+		err := rows.Scan(&request.ID, &request.SwifletHouseID, &request.Floors, &request.SensorCount,
+			&request.AppointmentDate, &request.Status, &request.CreatedAt, &request.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		requests = append(requests, request)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.InstallationRequest]{
+		Data:       requests,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	})
+}
+
+// CreateInstallationRequest asks for devices to be installed in a house.
+// Managers and the owner may request installations.
+func (h *RequestHandler) CreateInstallationRequest(c *gin.Context) {
+	var request models.InstallationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return
+	}
+
+	if !authorizeHouse(c, h.db, request.SwifletHouseID, models.HouseRoleManager) {
+		return
+	}
+
+	now := time.Now()
+	err := h.db.PostgreSQL.QueryRow(`
+		INSERT INTO installation_requests (id_swiflet_house, floors, sensor_count, appointment_date, status,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $5)
+		RETURNING id
+	`, request.SwifletHouseID, request.Floors, request.SensorCount, request.AppointmentDate, now).Scan(&request.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create installation request",
+		})
+		return
+	}
+
+	request.Status = 0
+	request.CreatedAt = now
+	request.UpdatedAt = now
+	c.JSON(http.StatusCreated, request)
+}
+
+// listDeviceRequests lists the maintenance or uninstallation requests of the
+// devices in the houses the caller owns or is a member of
+func (h *RequestHandler) listDeviceRequests(c *gin.Context, table string) (models.PaginatedResponse[models.MaintenanceRequest], bool) {
+	var response models.PaginatedResponse[models.MaintenanceRequest]
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return response, false
+	}
+
+	page, perPage, houseID, status, ok := h.requestPage(c)
+	if !ok {
+		return response, false
+	}
+	offset := (page - 1) * perPage
+
+	admin, err := isAdmin(h.db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return response, false
+	}
+
+	from := `
+		FROM ` + table + ` r
+		JOIN iot_devices d ON d.id = r.id_device
+		JOIN swiflet_houses h ON h.id = d.id_swiflet_house
+		WHERE h.deleted_at IS NULL AND ($1 = 0 OR d.id_swiflet_house = $1)
+			AND ($2::INTEGER IS NULL OR r.status = $2) AND ` + houseVisible(3, 4)
+
+	var total int
+	err = h.db.PostgreSQL.QueryRow("SELECT COUNT(*)"+from, houseID, status, admin, userID).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return response, false
+	}
+
+	rows, err := h.db.PostgreSQL.Query(`
+		SELECT r.id, r.id_device, r.reason, r.appointment_date, COALESCE(r.status, 0), r.created_at, r.updated_at`+from+`
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $5 OFFSET $6
+	`, houseID, status, admin, userID, perPage, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return response, false
+	}
+	defer rows.Close()
+
+	requests := []models.MaintenanceRequest{}
+	for rows.Next() {
+		var request models.MaintenanceRequest
+		err := rows.Scan(&request.ID, &request.DeviceID, &request.Reason, &request.AppointmentDate,
+			&request.Status, &request.CreatedAt, &request.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return response, false
+		}
+		requests = append(requests, request)
+	}
+
+	totalPages := (total + perPage - 1) / perPage
+	return models.PaginatedResponse[models.MaintenanceRequest]{
+		Data:       requests,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: totalPages,
+	}, true
+}
+
+// createDeviceRequest stores a maintenance or uninstallation request of a
+// device after checking the caller has at least role in its house
+func (h *RequestHandler) createDeviceRequest(c *gin.Context, table, role string) (models.MaintenanceRequest, bool) {
+	var request models.MaintenanceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return request, false
+	}
+
+	if err := h.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Validation failed",
+		})
+		return request, false
+	}
+
+	var houseID int
+	err := h.db.PostgreSQL.QueryRow(`
+		SELECT id_swiflet_house FROM iot_devices WHERE id = $1 AND deleted_at IS NULL
+	`, request.DeviceID).Scan(&houseID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "IoT device not found",
+			})
+			return request, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return request, false
+	}
+
+	if !authorizeHouse(c, h.db, houseID, role) {
+		return request, false
+	}
+
+	now := time.Now()
+	err = h.db.PostgreSQL.QueryRow(`
+		INSERT INTO `+table+` (id_device, reason, appointment_date, status, created_at, updated_at)
+		VALUES ($1, $2, $3, 0, $4, $4)
+		RETURNING id
+	`, request.DeviceID, request.Reason, request.AppointmentDate, now).Scan(&request.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create request",
+		})
+		return request, false
+	}
+
+	request.Status = 0
+	request.CreatedAt = now
+	request.UpdatedAt = now
+	return request, true
+}
+
+// ListMaintenanceRequests returns paginated maintenance requests of the
+// devices the caller may access, filtered by id_swiflet_house and status
+func (h *RequestHandler) ListMaintenanceRequests(c *gin.Context) {
+	response, ok := h.listDeviceRequests(c, maintenanceRequestsTable)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// CreateMaintenanceRequest reports a device that needs service. Workers may
+// report, so caretakers can flag broken sensors.
+func (h *RequestHandler) CreateMaintenanceRequest(c *gin.Context) {
+	request, ok := h.createDeviceRequest(c, maintenanceRequestsTable, models.HouseRoleWorker)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// ListUninstallationRequests returns paginated uninstallation requests of the
+// devices the caller may access, filtered by id_swiflet_house and status
+func (h *RequestHandler) ListUninstallationRequests(c *gin.Context) {
+	response, ok := h.listDeviceRequests(c, uninstallationRequestsTable)
+	if !ok {
+		return
+	}
+
+	data := make([]models.UninstallationRequest, len(response.Data))
+	for i, request := range response.Data {
+		data[i] = models.UninstallationRequest(request)
+	}
+	c.JSON(http.StatusOK, models.PaginatedResponse[models.UninstallationRequest]{
+		Data:       data,
+		Page:       response.Page,
+		PerPage:    response.PerPage,
+		Total:      response.Total,
+		TotalPages: response.TotalPages,
+	})
+}
+
+// CreateUninstallationRequest asks for a device to be removed. Managers and
+// the owner may request removals.
+func (h *RequestHandler) CreateUninstallationRequest(c *gin.Context) {
+	request, ok := h.createDeviceRequest(c, uninstallationRequestsTable, models.HouseRoleManager)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.UninstallationRequest(request))
+}
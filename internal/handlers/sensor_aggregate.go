@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aggregateBucket is a bucket width accepted by the aggregation endpoint
+type aggregateBucket struct {
+	Interval     string // PostgreSQL interval passed to time_bucket
+	Width        time.Duration
+	DefaultRange time.Duration // range used when from is omitted
+	Rollup       string        // continuous aggregate view with buckets of this width, if any
+}
+
+var aggregateBuckets = map[string]aggregateBucket{
+	"5m": {Interval: "5 minutes", Width: 5 * time.Minute, DefaultRange: 24 * time.Hour},
+	"1h": {Interval: "1 hour", Width: time.Hour, DefaultRange: 7 * 24 * time.Hour, Rollup: "sensor_readings_hourly"},
+	"1d": {Interval: "1 day", Width: 24 * time.Hour, DefaultRange: 30 * 24 * time.Hour, Rollup: "sensor_readings_daily"},
+}
+
+// maxAggregateBuckets caps the buckets per metric a single request may return
+const maxAggregateBuckets = 2000
+
+// GetSensorAggregates returns min, max, avg and count per time bucket and
+// metric, filtered like ListSensorMeasurements. Without install_code the
+// values of every matching device are combined, e.g. for a whole floor.
+// Ranges longer than SENSOR_ROLLUP_AFTER, or reaching past the raw data
+// retention, are read from the hourly or daily rollups.
+func (h *IoTHandler) GetSensorAggregates(c *gin.Context) {
+	filter, err := parseSensorFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if !scopeSensorFilter(c, h.db, &filter) {
+		return
+	}
+
+	bucketName := c.DefaultQuery("bucket", "1h")
+	bucket, ok := aggregateBuckets[bucketName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid bucket",
+			Details: map[string]string{"bucket": "must be one of 5m, 1h, 1d"},
+		})
+		return
+	}
+
+	if filter.To == nil {
+		to := time.Now()
+		filter.To = &to
+	}
+	if filter.From == nil {
+		from := filter.To.Add(-bucket.DefaultRange)
+		filter.From = &from
+	}
+	if !filter.From.Before(*filter.To) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "from must be before to",
+		})
+		return
+	}
+
+	if filter.To.Sub(*filter.From)/bucket.Width > maxAggregateBuckets {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: fmt.Sprintf("Time range too long for %s buckets", bucketName),
+			Details: map[string]string{
+				"max_buckets": fmt.Sprint(maxAggregateBuckets),
+			},
+		})
+		return
+	}
+
+	source := "raw"
+	query := `
+		SELECT time_bucket($1::interval, timestamp) AS bucket, metric,
+			MIN(value), MAX(value), AVG(value), COUNT(*)
+		FROM sensor_readings`
+
+	expired := h.retention.Raw > 0 && filter.From.Before(time.Now().Add(-h.retention.Raw))
+	if bucket.Rollup != "" && (filter.To.Sub(*filter.From) > h.retention.RollupAfter || expired) {
+		source = bucket.Rollup
+		query = `
+		SELECT time_bucket($1::interval, timestamp) AS bucket, metric,
+			MIN(min_value), MAX(max_value), SUM(avg_value * sample_count) / SUM(sample_count), SUM(sample_count)
+		FROM ` + bucket.Rollup
+	}
+
+	where, args := filter.where([]interface{}{bucket.Interval})
+	rows, err := h.db.TimescaleDB.Query(query+`
+		`+where+`
+		GROUP BY bucket, metric
+		ORDER BY bucket ASC, metric ASC
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	aggregates := []models.SensorAggregate{}
+	for rows.Next() {
+		var aggregate models.SensorAggregate
+		err := rows.Scan(&aggregate.Bucket, &aggregate.Metric, &aggregate.Min, &aggregate.Max,
+			&aggregate.Avg, &aggregate.Count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bucket": bucketName,
+		"source": source,
+		"from":   filter.From,
+		"to":     filter.To,
+		"data":   aggregates,
+	})
+}
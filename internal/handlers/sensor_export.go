@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/gin-gonic/gin"
+)
+
+// exportFlushRows is how many rows are written between flushes to the client
+const exportFlushRows = 1000
+
+// exportRowGroupRows bounds the rows a Parquet export buffers before writing a row group
+const exportRowGroupRows = 50000
+
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// exportParquetSchema is the schema of exported readings in Parquet files
+var exportParquetSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "timestamp", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+	{Name: "install_code", Type: arrow.BinaryTypes.String},
+	{Name: "id_swiflet_house", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "floor", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "metric", Type: arrow.BinaryTypes.String},
+	{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+// ExportSensors streams readings of every metric, filtered like
+// ListSensorMeasurements, as csv, ndjson or parquet (format parameter). Rows
+// are written while they are read from TimescaleDB.
+func (h *IoTHandler) ExportSensors(c *gin.Context) {
+	filter, err := parseSensorFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if !scopeSensorFilter(c, h.db, &filter) {
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid format",
+			Details: map[string]string{"format": "must be one of csv, ndjson, parquet"},
+		})
+		return
+	}
+
+	where, args := filter.where(nil)
+	rows, err := h.db.TimescaleDB.QueryContext(c.Request.Context(), `
+		SELECT install_code, id_swiflet_house, floor, metric, value, timestamp
+		FROM sensor_readings
+		`+where+`
+		ORDER BY timestamp ASC, install_code ASC, metric ASC
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("sensors-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+
+	// The status is sent already, so failures can only end the stream early
+	var written int
+	switch format {
+	case "csv":
+		written, err = exportCSV(c, rows)
+	case "ndjson":
+		written, err = exportNDJSON(c, rows)
+	case "parquet":
+		written, err = exportParquet(c, rows)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		log.Printf("Sensor export aborted after %d rows: %v", written, err)
+	}
+}
+
+func scanExportRow(rows *sql.Rows) (models.SensorMeasurement, error) {
+	var measurement models.SensorMeasurement
+	err := rows.Scan(&measurement.InstallCode, &measurement.SwifletHouseID, &measurement.Floor,
+		&measurement.Metric, &measurement.Value, &measurement.Timestamp)
+	return measurement, err
+}
+
+func formatOptionalInt(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+func exportCSV(c *gin.Context, rows *sql.Rows) (int, error) {
+	w := csv.NewWriter(c.Writer)
+	if err := w.Write([]string{"timestamp", "install_code", "id_swiflet_house", "floor", "metric", "value"}); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for rows.Next() {
+		measurement, err := scanExportRow(rows)
+		if err != nil {
+			return written, err
+		}
+		err = w.Write([]string{
+			measurement.Timestamp.UTC().Format(time.RFC3339Nano),
+			measurement.InstallCode,
+			formatOptionalInt(measurement.SwifletHouseID),
+			formatOptionalInt(measurement.Floor),
+			measurement.Metric,
+			strconv.FormatFloat(measurement.Value, 'f', -1, 64),
+		})
+		if err != nil {
+			return written, err
+		}
+		written++
+		if written%exportFlushRows == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+
+	w.Flush()
+	c.Writer.Flush()
+	return written, w.Error()
+}
+
+func exportNDJSON(c *gin.Context, rows *sql.Rows) (int, error) {
+	buffered := bufio.NewWriter(c.Writer)
+	encoder := json.NewEncoder(buffered)
+
+	written := 0
+	for rows.Next() {
+		measurement, err := scanExportRow(rows)
+		if err != nil {
+			return written, err
+		}
+		if err := encoder.Encode(measurement); err != nil {
+			return written, err
+		}
+		written++
+		if written%exportFlushRows == 0 {
+			if err := buffered.Flush(); err != nil {
+				return written, err
+			}
+			c.Writer.Flush()
+		}
+	}
+
+	err := buffered.Flush()
+	c.Writer.Flush()
+	return written, err
+}
+
+func exportParquet(c *gin.Context, rows *sql.Rows) (int, error) {
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Snappy),
+		parquet.WithMaxRowGroupLength(exportRowGroupRows),
+	)
+	pw, err := pqarrow.NewFileWriter(exportParquetSchema, c.Writer, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return 0, err
+	}
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, exportParquetSchema)
+	defer builder.Release()
+	timestamps := builder.Field(0).(*array.TimestampBuilder)
+	installCodes := builder.Field(1).(*array.StringBuilder)
+	houses := builder.Field(2).(*array.Int32Builder)
+	floors := builder.Field(3).(*array.Int32Builder)
+	metrics := builder.Field(4).(*array.StringBuilder)
+	values := builder.Field(5).(*array.Float64Builder)
+
+	appendOptionalInt := func(b *array.Int32Builder, value *int) {
+		if value == nil {
+			b.AppendNull()
+			return
+		}
+		b.Append(int32(*value))
+	}
+
+	// Each record of buffered rows is written as one row group
+	writeRowGroup := func() error {
+		record := builder.NewRecord()
+		defer record.Release()
+		if err := pw.Write(record); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	written := 0
+	for rows.Next() {
+		measurement, err := scanExportRow(rows)
+		if err != nil {
+			return written, err
+		}
+		timestamps.Append(arrow.Timestamp(measurement.Timestamp.UnixMilli()))
+		installCodes.Append(measurement.InstallCode)
+		appendOptionalInt(houses, measurement.SwifletHouseID)
+		appendOptionalInt(floors, measurement.Floor)
+		metrics.Append(measurement.Metric)
+		values.Append(measurement.Value)
+		written++
+
+		if written%exportRowGroupRows == 0 {
+			if err := writeRowGroup(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	if written%exportRowGroupRows != 0 {
+		if err := writeRowGroup(); err != nil {
+			return written, err
+		}
+	}
+
+	// Close writes the footer
+	err = pw.Close()
+	c.Writer.Flush()
+	return written, err
+}
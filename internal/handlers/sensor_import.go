@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImportSize bounds the size of an uploaded sensor import
+const maxImportSize = 64 << 20
+
+// importFormats maps content types and file extensions to import formats
+var importFormats = map[string]string{
+	"text/csv":             services.ImportCSV,
+	"application/x-ndjson": services.ImportNDJSON,
+	"application/jsonl":    services.ImportNDJSON,
+	".csv":                 services.ImportCSV,
+	".ndjson":              services.ImportNDJSON,
+	".jsonl":               services.ImportNDJSON,
+}
+
+// ImportSensors backfills readings of one device (install_code parameter)
+// from a CSV or NDJSON file, sent as the request body or as the file field of
+// a multipart form. The format parameter overrides the format taken from the
+// content type or file name. Rows are validated like live readings and the
+// response reports every row or value that was not stored.
+func (h *IoTHandler) ImportSensors(c *gin.Context) {
+	installCode := c.Query("install_code")
+	if installCode == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "install_code is required",
+		})
+		return
+	}
+
+	device, ok := h.registry.Lookup(installCode)
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "IoT device not found",
+		})
+		return
+	}
+
+	houses, ok := importHouses(c, h.db, device)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	var file io.Reader = c.Request.Body
+	format := importFormats[c.ContentType()]
+	if c.ContentType() == "multipart/form-data" {
+		upload, header, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "No file uploaded",
+			})
+			return
+		}
+		defer upload.Close()
+		file = upload
+		format = importFormats[strings.ToLower(filepath.Ext(header.Filename))]
+	}
+	if requested := c.Query("format"); requested != "" {
+		format = requested
+	}
+	if format != services.ImportCSV && format != services.ImportNDJSON {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid format",
+			Details: map[string]string{"format": "must be csv or ndjson"},
+		})
+		return
+	}
+
+	report, err := h.importer.Import(device, format, file, houses)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		inserted := strconv.FormatInt(report.Inserted, 10)
+		switch {
+		case errors.As(err, &tooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse{
+				Error:   "Import file too large",
+				Details: map[string]string{"max_bytes": strconv.Itoa(maxImportSize), "inserted": inserted},
+			})
+		case errors.Is(err, services.ErrInvalidImportFile):
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid import file",
+				Details: map[string]string{"file": err.Error(), "inserted": inserted},
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error:   "Failed to import readings",
+				Details: map[string]string{"inserted": inserted},
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// importHouses returns the swiflet houses the authenticated user may import
+// readings of the device into: the houses the device was assigned to that the
+// user manages. Non-admins must manage the device's current house. Admins may
+// import into any house, also for unassigned devices, and get nil. It writes
+// the error response and returns false otherwise.
+func importHouses(c *gin.Context, db *database.DB, device services.DeviceInfo) (map[int]bool, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return nil, false
+	}
+
+	admin, err := isAdmin(db, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return nil, false
+	}
+	if admin {
+		return nil, true
+	}
+
+	if !authorizeHouse(c, db, device.SwifletHouseID, models.HouseRoleManager) {
+		return nil, false
+	}
+
+	// Rows are attributed to the house the device was in when they were
+	// taken, which may be a house the user does not manage
+	assignments, err := services.LoadAssignments(db, device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return nil, false
+	}
+	houses := map[int]bool{device.SwifletHouseID: true}
+	for _, assignment := range assignments {
+		if _, checked := houses[assignment.SwifletHouseID]; checked {
+			continue
+		}
+		allowed, err := canAccessHouse(db, assignment.SwifletHouseID, userID.(int), models.HouseRoleManager)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Database error",
+			})
+			return nil, false
+		}
+		houses[assignment.SwifletHouseID] = allowed
+	}
+	return houses, true
+}
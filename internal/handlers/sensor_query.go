@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// sensorFilter holds the common filters of the sensor query endpoints
+type sensorFilter struct {
+	InstallCode string
+	HouseID     *int
+	Floor       *int
+	Metric      string
+	From        *time.Time
+	To          *time.Time
+	// HouseIDs limits readings to these houses when not nil
+	HouseIDs []int64
+}
+
+// parseSensorFilter reads install_code, id_swiflet_house, floor, metric,
+// from and to (RFC3339) from the query string
+func parseSensorFilter(c *gin.Context) (sensorFilter, error) {
+	filter := sensorFilter{
+		InstallCode: c.Query("install_code"),
+		Metric:      c.Query("metric"),
+	}
+
+	if value := c.Query("id_swiflet_house"); value != "" {
+		houseID, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid id_swiflet_house")
+		}
+		filter.HouseID = &houseID
+	}
+
+	if value := c.Query("floor"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid floor")
+		}
+		filter.Floor = &floor
+	}
+
+	if value := c.Query("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from timestamp, expected RFC3339")
+		}
+		filter.From = &from
+	}
+
+	if value := c.Query("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to timestamp, expected RFC3339")
+		}
+		filter.To = &to
+	}
+
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		return filter, fmt.Errorf("from must be before to")
+	}
+
+	return filter, nil
+}
+
+// scopeSensorFilter limits the filter to the houses the caller may access. A
+// house filter is authorized like the house endpoints; without one the
+// filter is narrowed to the caller's houses unless they are an admin. It
+// writes the error response and returns false otherwise.
+func scopeSensorFilter(c *gin.Context, db *database.DB, filter *sensorFilter) bool {
+	if filter.HouseID != nil {
+		return authorizeHouse(c, db, *filter.HouseID, models.HouseRoleViewer)
+	}
+
+	houseIDs, all, ok := accessibleHouses(c, db)
+	if !ok {
+		return false
+	}
+	if !all {
+		filter.HouseIDs = houseIDs
+	}
+	return true
+}
+
+// where builds a WHERE clause for the filter. Placeholders continue after
+// the given args, which are returned with the filter values appended.
+func (f sensorFilter) where(args []interface{}) (string, []interface{}) {
+	var conditions []string
+
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.InstallCode != "" {
+		add("install_code = $%d", f.InstallCode)
+	}
+	if f.HouseID != nil {
+		add("id_swiflet_house = $%d", *f.HouseID)
+	}
+	if f.HouseIDs != nil {
+		add("id_swiflet_house = ANY($%d)", pq.Array(f.HouseIDs))
+	}
+	if f.Floor != nil {
+		add("floor = $%d", *f.Floor)
+	}
+	if f.Metric != "" {
+		add("metric = $%d", f.Metric)
+	}
+	if f.From != nil {
+		add("timestamp >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("timestamp < $%d", *f.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
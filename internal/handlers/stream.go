@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"swiflet-backend/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamKeepAlive is how often an idle stream sends a comment so proxies do
+// not close the connection
+const streamKeepAlive = 25 * time.Second
+
+type StreamHandler struct {
+	db       *database.DB
+	registry *services.DeviceRegistry
+	hub      *services.Hub
+}
+
+func NewStreamHandler(db *database.DB, registry *services.DeviceRegistry, hub *services.Hub) *StreamHandler {
+	return &StreamHandler{
+		db:       db,
+		registry: registry,
+		hub:      hub,
+	}
+}
+
+// Stream sends readings and alerts of a house, or the readings of one device
+// and the alerts of its house, as Server-Sent Events. Subscribe with
+// id_swiflet_house or install_code; the caller needs at least the viewer role
+// in the house, or to be an admin.
+func (h *StreamHandler) Stream(c *gin.Context) {
+	var filter services.StreamFilter
+
+	if installCode := c.Query("install_code"); installCode != "" {
+		// Unknown devices and devices of houses the caller cannot see get the
+		// same answer, so install codes cannot be probed
+		userID, _ := c.Get("user_id")
+		device, found := h.registry.Lookup(installCode)
+		allowed := false
+		if found {
+			var err error
+			allowed, err = canAccessHouse(h.db, device.SwifletHouseID, userID.(int), models.HouseRoleViewer)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+					Error: "Database error",
+				})
+				return
+			}
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Access to this IoT device denied",
+			})
+			return
+		}
+		filter.InstallCode = device.InstallCode
+		filter.SwifletHouseID = device.SwifletHouseID
+	} else {
+		houseID, err := strconv.Atoi(c.Query("id_swiflet_house"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "id_swiflet_house or install_code is required",
+			})
+			return
+		}
+		if !authorizeHouse(c, h.db, houseID, models.HouseRoleViewer) {
+			return
+		}
+		filter.SwifletHouseID = houseID
+	}
+
+	subscription := h.hub.Subscribe(filter)
+	defer h.hub.Unsubscribe(subscription)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	// An initial comment tells the client the subscription is active
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Status(http.StatusOK)
+	_, _ = io.WriteString(c.Writer, ": subscribed\n\n")
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event.Data)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -117,7 +117,9 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-// UpdateUser updates user information
+// UpdateUser updates user information. Users may only update their own
+// account; admins may update any account and are the only ones who can change
+// a role.
 func (h *UserHandler) UpdateUser(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -127,6 +129,21 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	callerID, _ := c.Get("user_id")
+	admin, err := isAdmin(h.db, callerID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Database error",
+		})
+		return
+	}
+	if !admin && id != callerID.(int) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "You can only update your own account",
+		})
+		return
+	}
+
 	var user models.User
 	if err := c.ShouldBindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, models.ErrorResponse{
@@ -152,12 +169,13 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	// Update user
+	// Update user; the role is kept unless an admin changes it
 	_, err = h.db.PostgreSQL.Exec(`
 		UPDATE users 
-		SET name = $1, location = $2, no_telp = $3, img_profile = $4, status = $5, role = $6
+		SET name = $1, location = $2, no_telp = $3, img_profile = $4, status = $5,
+			role = CASE WHEN $8 THEN $6 ELSE role END
 		WHERE id = $7
-	`, user.Name, user.Location, user.NoTelp, user.ImgProfile, user.Status, user.Role, id)
+	`, user.Name, user.Location, user.NoTelp, user.ImgProfile, user.Status, user.Role, id, admin)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
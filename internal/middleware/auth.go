@@ -1,10 +1,13 @@
 package middleware
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
 	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
 	"swiflet-backend/pkg/utils"
 
 	"github.com/gin-gonic/gin"
@@ -58,6 +61,35 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 	}
 }
 
+// AdminMiddleware only lets users with the admin role through. It must run after AuthMiddleware.
+func AdminMiddleware(db *database.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			c.Abort()
+			return
+		}
+
+		var role sql.NullInt64
+		err := db.PostgreSQL.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		if !role.Valid || role.Int64 != models.RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_role", int(role.Int64))
+		c.Next()
+	}
+}
+
 // CORSMiddleware handles CORS
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
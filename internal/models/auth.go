@@ -23,7 +23,6 @@ type RegisterRequest struct {
 	NoTelp     *string `json:"no_telp"`
 	ImgProfile *string `json:"img_profile"`
 	Status     *int    `json:"status"` // 0=pending, 1=approved/active, 2=rejected/suspended
-	Role       *int    `json:"role"`
 }
 
 // LoginRequest represents login request
@@ -14,10 +14,16 @@ type User struct {
 	Password   string    `json:"password,omitempty" db:"password" validate:"required,min=6"`
 	ImgProfile *string   `json:"img_profile" db:"img_profile"`
 	Status     *int      `json:"status" db:"status"` // 0=inactive, 1=active, 2=suspended
-	Role       *int      `json:"role" db:"role"`
+	Role       *int      `json:"role" db:"role"` // 0=user, 1=admin
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
 
+// User roles
+const (
+	RoleUser  = 0
+	RoleAdmin = 1
+)
+
 // Article represents the Article table
 type Article struct {
 	ID         int       `json:"id" db:"id"`
@@ -1,51 +1,715 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // SwifletHouse represents the SwifletHouse table
 type SwifletHouse struct {
 	ID        int       `json:"id" db:"id"`
-	UserID    int       `json:"id_user" db:"id_user" validate:"required"`
+	UserID    int       `json:"id_user" db:"id_user"`
 	Name      string    `json:"name" db:"name" validate:"required"`
 	Location  string    `json:"location" db:"location" validate:"required"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// Role is the caller's role in the house; empty for admins who are not members
+	Role string `json:"role,omitempty"`
+	// Climate is the score of the last fully scored day, if any
+	Climate *HouseClimateScore `json:"climate,omitempty"`
 }
 
 // IoTDevice represents the IoTDevice table
 type IoTDevice struct {
-	ID              int       `json:"id" db:"id"`
-	SwifletHouseID  int       `json:"id_swiflet_house" db:"id_swiflet_house" validate:"required"`
-	Floor           int       `json:"floor" db:"floor" validate:"required"`
-	InstallCode     string    `json:"install_code" db:"install_code" validate:"required"`
-	Status          int       `json:"status" db:"status"`
-	CreatedAt       time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at" db:"updated_at"`
+	ID               int        `json:"id" db:"id"`
+	SwifletHouseID   int        `json:"id_swiflet_house" db:"id_swiflet_house" validate:"required"`
+	Floor            int        `json:"floor" db:"floor" validate:"required"`
+	InstallCode      string     `json:"install_code" db:"install_code" validate:"omitempty,max=255"`
+	Status           int        `json:"status" db:"status"`
+	LastSeenAt       *time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ConnectionStatus string     `json:"connection_status" db:"connection_status"`
+	// MaintenanceNeeded is set while the device has open faults
+	MaintenanceNeeded bool `json:"maintenance_needed" db:"maintenance_needed"`
+	// DecommissionedAt is set once the device is retired; its readings are
+	// then rejected but its history is kept
+	DecommissionedAt *time.Time `json:"decommissioned_at" db:"decommissioned_at"`
+	// FirmwareVersion is the version the device last reported over MQTT
+	FirmwareVersion   *string    `json:"firmware_version" db:"firmware_version"`
+	FirmwareUpdatedAt *time.Time `json:"firmware_updated_at" db:"firmware_updated_at"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Reasons a device assignment ended
+const (
+	AssignmentMoved          = "moved"
+	AssignmentDecommissioned = "decommissioned"
+	AssignmentDeleted        = "deleted"
+)
+
+// DeviceAssignment is a period a device was installed on a floor of a house.
+// Readings are attributed to the assignment in effect when they were taken.
+type DeviceAssignment struct {
+	ID             int        `json:"id" db:"id"`
+	DeviceID       int        `json:"id_device" db:"id_device"`
+	SwifletHouseID int        `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          int        `json:"floor" db:"floor"`
+	AssignedAt     time.Time  `json:"assigned_at" db:"assigned_at"`
+	UnassignedAt   *time.Time `json:"unassigned_at" db:"unassigned_at"`
+	EndReason      *string    `json:"end_reason" db:"end_reason"`
+	AssignedBy     *int       `json:"assigned_by" db:"assigned_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Connection status of an IoT device, derived from its last message
+const (
+	DeviceStatusUnknown = "unknown"
+	DeviceStatusOnline  = "online"
+	DeviceStatusOffline = "offline"
+)
+
+// DeviceStatusChange represents the DeviceStatusHistory table
+type DeviceStatusChange struct {
+	ID             int        `json:"id" db:"id"`
+	DeviceID       int        `json:"id_device" db:"id_device"`
+	PreviousStatus string     `json:"previous_status" db:"previous_status"`
+	Status         string     `json:"status" db:"status"`
+	LastSeenAt     *time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt      time.Time  `json:"changed_at" db:"changed_at"`
 }
 
 // Sensor represents the Sensor table (TimescaleDB)
 type Sensor struct {
-	ID          int       `json:"id" db:"id"`
-	InstallCode string    `json:"install_code" db:"install_code" validate:"required"`
-	Suhu        float64   `json:"suhu" db:"suhu" validate:"required"`
-	Kelembaban  float64   `json:"kelembaban" db:"kelembaban" validate:"required"`
-	Timestamp   time.Time `json:"timestamp" db:"timestamp"`
+	ID             int       `json:"id" db:"id"`
+	InstallCode    string    `json:"install_code" db:"install_code" validate:"required"`
+	SwifletHouseID *int      `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          *int      `json:"floor" db:"floor"`
+	Suhu           float64   `json:"suhu" db:"suhu" validate:"required"`
+	Kelembaban     float64   `json:"kelembaban" db:"kelembaban" validate:"required"`
+	Timestamp      time.Time `json:"timestamp" db:"timestamp"`
 }
 
 // Harvest represents the Harvest table
 type Harvest struct {
 	ID             int       `json:"id" db:"id"`
-	UserID         int       `json:"id_user" db:"id_user" validate:"required"`
+	UserID         int       `json:"id_user" db:"id_user"`
 	SwifletHouseID int       `json:"id_swiflet_house" db:"id_swiflet_house" validate:"required"`
-	Floor          int       `json:"floor" db:"floor" validate:"required"`
-	BowlWeight     float64   `json:"bowl_weight" db:"bowl_weight"`
-	BowlPieces     int       `json:"bowl_pieces" db:"bowl_pieces"`
-	OvalWeight     float64   `json:"oval_weight" db:"oval_weight"`
-	OvalPieces     int       `json:"oval_pieces" db:"oval_pieces"`
-	CornerWeight   float64   `json:"corner_weight" db:"corner_weight"`
-	CornerPieces   int       `json:"corner_pieces" db:"corner_pieces"`
-	BrokenWeight   float64   `json:"broken_weight" db:"broken_weight"`
-	BrokenPieces   int       `json:"broken_pieces" db:"broken_pieces"`
+	Floor          int       `json:"floor" db:"floor" validate:"required,min=1"`
+	BowlWeight     float64   `json:"bowl_weight" db:"bowl_weight" validate:"min=0"`
+	BowlPieces     int       `json:"bowl_pieces" db:"bowl_pieces" validate:"min=0"`
+	OvalWeight     float64   `json:"oval_weight" db:"oval_weight" validate:"min=0"`
+	OvalPieces     int       `json:"oval_pieces" db:"oval_pieces" validate:"min=0"`
+	CornerWeight   float64   `json:"corner_weight" db:"corner_weight" validate:"min=0"`
+	CornerPieces   int       `json:"corner_pieces" db:"corner_pieces" validate:"min=0"`
+	BrokenWeight   float64   `json:"broken_weight" db:"broken_weight" validate:"min=0"`
+	BrokenPieces   int       `json:"broken_pieces" db:"broken_pieces" validate:"min=0"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// DeadLetter represents a rejected MQTT sensor message (mqtt_dead_letters table)
+type DeadLetter struct {
+	ID          int       `json:"id" db:"id"`
+	Topic       string    `json:"topic" db:"topic"`
+	Payload     []byte    `json:"payload_base64" db:"payload"`
+	PayloadText *string   `json:"payload,omitempty" db:"-"`
+	Reason      string    `json:"reason" db:"reason"`
+	Error       *string   `json:"error" db:"error"`
+	ReplayCount int       `json:"replay_count" db:"replay_count"`
+	ReceivedAt  time.Time `json:"received_at" db:"received_at"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// Built-in metric keys stored in the sensors table
+const (
+	MetricSuhu       = "suhu"
+	MetricKelembaban = "kelembaban"
+)
+
+// MetricType represents the MetricType table
+type MetricType struct {
+	ID                 int       `json:"id" db:"id"`
+	Key                string    `json:"key" db:"key" validate:"required,max=50"`
+	Name               string    `json:"name" db:"name" validate:"required"`
+	Unit               string    `json:"unit" db:"unit" validate:"required"`
+	MinValue           float64   `json:"min_value" db:"min_value"`
+	MaxValue           float64   `json:"max_value" db:"max_value" validate:"gtfield=MinValue"`
+	MaxChangePerMinute *float64  `json:"max_change_per_minute" db:"max_change_per_minute" validate:"omitempty,gt=0"` // nil disables spike detection
+	CreatedAt          time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// SensorMeasurement is a single metric value of a reading (sensor_readings view, TimescaleDB)
+type SensorMeasurement struct {
+	InstallCode    string    `json:"install_code" db:"install_code"`
+	SwifletHouseID *int      `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          *int      `json:"floor" db:"floor"`
+	Metric         string    `json:"metric" db:"metric"`
+	Value          float64   `json:"value" db:"value"`
+	Timestamp      time.Time `json:"timestamp" db:"timestamp"`
+}
+
+// SensorAggregate summarizes the values of a metric within one time bucket
+type SensorAggregate struct {
+	Bucket time.Time `json:"bucket" db:"bucket"`
+	Metric string    `json:"metric" db:"metric"`
+	Min    float64   `json:"min" db:"min"`
+	Max    float64   `json:"max" db:"max"`
+	Avg    float64   `json:"avg" db:"avg"`
+	Count  int64     `json:"count" db:"count"`
+}
+
+// LiveValue is the latest value of a metric and how old it is
+type LiveValue struct {
+	Value      float64   `json:"value"`
+	Timestamp  time.Time `json:"timestamp"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+// DeviceLiveReading is the latest reading of a device with its online status
+type DeviceLiveReading struct {
+	DeviceID         int                  `json:"id_device"`
+	InstallCode      string               `json:"install_code"`
+	Floor            int                  `json:"floor"`
+	ConnectionStatus string               `json:"connection_status"`
+	LastSeenAt       *time.Time           `json:"last_seen_at"`
+	Timestamp        *time.Time           `json:"timestamp"`
+	AgeSeconds       *int64               `json:"age_seconds"`
+	Values           map[string]LiveValue `json:"values"`
+}
+
+// FloorLiveReading groups the devices of a floor. Values averages the latest
+// values of the floor's devices that are not offline.
+type FloorLiveReading struct {
+	Floor   int                 `json:"floor"`
+	Values  map[string]float64  `json:"values"`
+	Devices []DeviceLiveReading `json:"devices"`
+}
+
+// HouseLiveSnapshot is the current climate of a swiflet house
+type HouseLiveSnapshot struct {
+	SwifletHouseID int                `json:"id_swiflet_house"`
+	GeneratedAt    time.Time          `json:"generated_at"`
+	Floors         []FloorLiveReading `json:"floors"`
+}
+
+// StreamReading is a stored reading as sent to stream subscribers
+type StreamReading struct {
+	InstallCode    string             `json:"install_code"`
+	SwifletHouseID int                `json:"id_swiflet_house"`
+	Floor          int                `json:"floor"`
+	Values         map[string]float64 `json:"values"`
+	Timestamp      time.Time          `json:"timestamp"`
+}
+
+// Reasons a sensor value is quarantined
+const (
+	QuarantineOutOfRange = "out_of_range"
+	QuarantineSpike      = "spike"
+)
+
+// QuarantinedValue is a sensor value rejected by validation (sensor_quarantine table, TimescaleDB)
+type QuarantinedValue struct {
+	InstallCode    string    `json:"install_code" db:"install_code"`
+	SwifletHouseID *int      `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          *int      `json:"floor" db:"floor"`
+	Metric         string    `json:"metric" db:"metric"`
+	Value          float64   `json:"value" db:"value"`
+	Reason         string    `json:"reason" db:"reason"`
+	Detail         *string   `json:"detail" db:"detail"`
+	Timestamp      time.Time `json:"timestamp" db:"timestamp"`
+	ReceivedAt     time.Time `json:"received_at" db:"received_at"`
+}
+
+// DeviceQuarantineCount summarises quarantined values of a device
+type DeviceQuarantineCount struct {
+	InstallCode     string    `json:"install_code"`
+	SwifletHouseID  *int      `json:"id_swiflet_house"`
+	Floor           *int      `json:"floor"`
+	Total           int       `json:"total"`
+	OutOfRange      int       `json:"out_of_range"`
+	Spike           int       `json:"spike"`
+	LastQuarantined time.Time `json:"last_quarantined_at"`
+}
+
+// Status of a control command sent to a device
+const (
+	CommandPending  = "pending"
+	CommandSent     = "sent"
+	CommandAcked    = "acked"
+	CommandFailed   = "failed"
+	CommandTimedOut = "timed_out"
+)
+
+// DeviceCommand represents the DeviceCommand table
+type DeviceCommand struct {
+	ID          int             `json:"id" db:"id"`
+	DeviceID    int             `json:"id_device" db:"id_device"`
+	InstallCode string          `json:"install_code" db:"install_code"`
+	UserID      *int            `json:"id_user" db:"id_user"`
+	Command     string          `json:"command" db:"command"`
+	Params      json.RawMessage `json:"params,omitempty" db:"params"`
+	Status      string          `json:"status" db:"status"`
+	Error       *string         `json:"error" db:"error"`
+	SentAt      *time.Time      `json:"sent_at" db:"sent_at"`
+	AckedAt     *time.Time      `json:"acked_at" db:"acked_at"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// Comparison of an automation or alert rule against its threshold
+const (
+	OperatorBelow = "below"
+	OperatorAbove = "above"
+)
+
+// AutomationRule represents the AutomationRule table. Floor is nil for rules
+// covering the whole house.
+type AutomationRule struct {
+	ID              int             `json:"id" db:"id"`
+	UserID          int             `json:"id_user" db:"id_user"`
+	SwifletHouseID  int             `json:"id_swiflet_house" db:"id_swiflet_house" validate:"required"`
+	Floor           *int            `json:"floor" db:"floor"`
+	Name            string          `json:"name" db:"name" validate:"required,max=255"`
+	Metric          string          `json:"metric" db:"metric" validate:"required"`
+	Operator        string          `json:"operator" db:"operator" validate:"required,oneof=below above"`
+	Threshold       float64         `json:"threshold" db:"threshold"`
+	DurationSeconds int             `json:"duration_seconds" db:"duration_seconds" validate:"min=0"`
+	Hysteresis      float64         `json:"hysteresis" db:"hysteresis" validate:"min=0"`
+	CooldownSeconds int             `json:"cooldown_seconds" db:"cooldown_seconds" validate:"min=0"`
+	DeviceID        int             `json:"id_device" db:"id_device" validate:"required"`
+	Command         string          `json:"command" db:"command" validate:"required,max=100"`
+	Params          json.RawMessage `json:"params,omitempty" db:"params"`
+	Enabled         bool            `json:"enabled" db:"enabled"`
+	LastTriggeredAt *time.Time      `json:"last_triggered_at" db:"last_triggered_at"`
+	CreatedAt       time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// Outcome of an automation rule trigger
+const (
+	AutomationTriggered = "triggered"
+	AutomationFailed    = "failed"
+)
+
+// AutomationAuditEntry represents the AutomationAuditLog table
+type AutomationAuditEntry struct {
+	ID          int       `json:"id" db:"id"`
+	RuleID      int       `json:"id_rule" db:"id_rule"`
+	DeviceID    int       `json:"id_device" db:"id_device"`
+	CommandID   *int      `json:"id_command" db:"id_command"`
+	Metric      string    `json:"metric" db:"metric"`
+	Value       float64   `json:"value" db:"value"`
+	Threshold   float64   `json:"threshold" db:"threshold"`
+	Status      string    `json:"status" db:"status"`
+	Error       *string   `json:"error" db:"error"`
+	TriggeredAt time.Time `json:"triggered_at" db:"triggered_at"`
+}
+
+// AlertRule represents the AlertRule table. Floor is nil for rules covering
+// the whole house.
+type AlertRule struct {
+	ID                int       `json:"id" db:"id"`
+	UserID            int       `json:"id_user" db:"id_user"`
+	SwifletHouseID    int       `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor             *int      `json:"floor" db:"floor"`
+	Name              string    `json:"name" db:"name"`
+	Metric            string    `json:"metric" db:"metric"`
+	Operator          string    `json:"operator" db:"operator"`
+	WarningThreshold  float64   `json:"warning_threshold" db:"warning_threshold"`
+	CriticalThreshold float64   `json:"critical_threshold" db:"critical_threshold"`
+	Hysteresis        float64   `json:"hysteresis" db:"hysteresis"`
+	Enabled           bool      `json:"enabled" db:"enabled"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Alert severities and lifecycle states
+const (
+	AlertWarning  = "warning"
+	AlertCritical = "critical"
+
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// Alert represents the Alert table
+type Alert struct {
+	ID             int        `json:"id" db:"id"`
+	RuleID         int        `json:"id_rule" db:"id_rule"`
+	SwifletHouseID int        `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          *int       `json:"floor" db:"floor"`
+	Metric         string     `json:"metric" db:"metric"`
+	Severity       string     `json:"severity" db:"severity"`
+	Status         string     `json:"status" db:"status"`
+	Value          float64    `json:"value" db:"value"`
+	PeakValue      float64    `json:"peak_value" db:"peak_value"`
+	OpenedAt       time.Time  `json:"opened_at" db:"opened_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at" db:"acknowledged_at"`
+	AcknowledgedBy *int       `json:"acknowledged_by" db:"acknowledged_by"`
+	ResolvedAt     *time.Time `json:"resolved_at" db:"resolved_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// SensorImportRowError describes a row, or a value of a row, that was not
+// stored by a sensor import
+type SensorImportRowError struct {
+	Row    int      `json:"row"`
+	Metric string   `json:"metric,omitempty"`
+	Value  *float64 `json:"value,omitempty"`
+	Reason string   `json:"reason"`
+	Error  string   `json:"error"`
+}
+
+// SensorImportReport summarizes a bulk sensor import. Row numbers are line
+// numbers of the uploaded file.
+type SensorImportReport struct {
+	InstallCode string `json:"install_code"`
+	Format      string `json:"format"`
+	Rows        int    `json:"rows"`
+	Accepted    int    `json:"accepted"`
+	Rejected    int    `json:"rejected"`
+	Quarantined int    `json:"quarantined"`
+	// Inserted and Duplicates count database rows; rows already stored for
+	// the install_code and timestamp are duplicates
+	Inserted        int64                  `json:"inserted"`
+	Duplicates      int64                  `json:"duplicates"`
+	Errors          []SensorImportRowError `json:"errors"`
+	ErrorsTruncated bool                   `json:"errors_truncated"`
+}
+
+// ClimateBand is the optimal range of a metric. A value scores zero once it
+// is Tolerance outside the band.
+type ClimateBand struct {
+	Metric    string  `json:"metric"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+// ClimateMetricScore is the day of one metric compared with its band
+type ClimateMetricScore struct {
+	Metric     string  `json:"metric"`
+	Score      float64 `json:"score"`
+	TimeInBand float64 `json:"time_in_band"`
+	Avg        float64 `json:"avg"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+}
+
+// ClimateExcursion is a period a metric stayed on one side outside its band
+type ClimateExcursion struct {
+	Floor           int       `json:"floor"`
+	Metric          string    `json:"metric"`
+	Direction       string    `json:"direction"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationMinutes float64   `json:"duration_minutes"`
+	PeakValue       float64   `json:"peak_value"`
+	PeakDeviation   float64   `json:"peak_deviation"`
+}
+
+// ClimateScore represents the ClimateScore table: the climate of a floor on
+// one day. Score is 0-100; TimeInBand and Coverage are percentages of the day.
+type ClimateScore struct {
+	SwifletHouseID int                  `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          int                  `json:"floor" db:"floor"`
+	Day            string               `json:"day" db:"day"`
+	Score          float64              `json:"score" db:"score"`
+	TimeInBand     float64              `json:"time_in_band" db:"time_in_band"`
+	Coverage       float64              `json:"coverage" db:"coverage"`
+	SampleCount    int                  `json:"sample_count" db:"sample_count"`
+	Metrics        []ClimateMetricScore `json:"metrics" db:"metrics"`
+	Excursions     []ClimateExcursion   `json:"excursions" db:"excursions"`
+	Final          bool                 `json:"final" db:"final"`
+	ComputedAt     time.Time            `json:"computed_at" db:"computed_at"`
+}
+
+// HouseClimateScore is the climate of a whole house on one day, the
+// sample-weighted mean of its floors
+type HouseClimateScore struct {
+	Day        string  `json:"day,omitempty"`
+	Score      float64 `json:"score"`
+	TimeInBand float64 `json:"time_in_band"`
+	Coverage   float64 `json:"coverage"`
+}
+
+// HouseClimateDay is the climate of a house on one day with its floors
+type HouseClimateDay struct {
+	HouseClimateScore
+	Floors []ClimateScore `json:"floors"`
+}
+
+// HouseClimateReport is the climate of a house over a range of days.
+// Summary averages the days; WorstExcursions are the worst of the range.
+type HouseClimateReport struct {
+	SwifletHouseID  int                `json:"id_swiflet_house"`
+	Timezone        string             `json:"timezone"`
+	From            string             `json:"from"`
+	To              string             `json:"to"`
+	Bands           []ClimateBand      `json:"bands"`
+	Summary         HouseClimateScore  `json:"summary"`
+	Days            []HouseClimateDay  `json:"days"`
+	WorstExcursions []ClimateExcursion `json:"worst_excursions"`
+}
+
+// Kinds of sensor fault and their lifecycle states
+const (
+	FaultFlatLine = "flat_line"
+	FaultDrift    = "drift"
+	FaultGap      = "gap"
+
+	FaultOpen     = "open"
+	FaultResolved = "resolved"
+)
+
+// DeviceFault represents the DeviceFault table: a suspected sensor fault
+// found by the anomaly detector. Metric is empty for faults of the whole
+// device.
+type DeviceFault struct {
+	ID             int        `json:"id" db:"id"`
+	DeviceID       int        `json:"id_device" db:"id_device"`
+	InstallCode    string     `json:"install_code" db:"install_code"`
+	SwifletHouseID int        `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          int        `json:"floor" db:"floor"`
+	Kind           string     `json:"kind" db:"kind"`
+	Metric         string     `json:"metric,omitempty" db:"metric"`
+	Status         string     `json:"status" db:"status"`
+	Value          *float64   `json:"value" db:"value"`
+	Detail         string     `json:"detail" db:"detail"`
+	DetectedAt     time.Time  `json:"detected_at" db:"detected_at"`
+	LastDetectedAt time.Time  `json:"last_detected_at" db:"last_detected_at"`
+	ResolvedAt     *time.Time `json:"resolved_at" db:"resolved_at"`
+	ResolvedBy     *int       `json:"resolved_by" db:"resolved_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// HarvestClimate summarizes the climate of a floor over a harvest period
+type HarvestClimate struct {
+	AvgSuhu       *float64             `json:"avg_suhu"`
+	AvgKelembaban *float64             `json:"avg_kelembaban"`
+	Score         float64              `json:"score"`
+	TimeInBand    float64              `json:"time_in_band"`
+	Coverage      float64              `json:"coverage"`
+	Metrics       []ClimateMetricScore `json:"metrics"`
+}
+
+// HarvestPeriod is a harvest with the period since the previous harvest of
+// the same floor, its yield and the climate of the period. The first harvest
+// of a floor has no period.
+type HarvestPeriod struct {
+	Harvest      Harvest         `json:"harvest"`
+	Floor        int             `json:"floor"`
+	PeriodStart  *time.Time      `json:"period_start"`
+	PeriodEnd    time.Time       `json:"period_end"`
+	Days         *float64        `json:"days"`
+	TotalWeight  float64         `json:"total_weight"`
+	TotalPieces  int             `json:"total_pieces"`
+	WeightPerDay *float64        `json:"weight_per_day"`
+	Climate      *HarvestClimate `json:"climate"`
+}
+
+// HarvestClimateReport relates the yield of each harvest period of a house to
+// its climate. Correlations are Pearson coefficients between weight per day
+// and a climate statistic over the periods, when there are enough of them.
+type HarvestClimateReport struct {
+	SwifletHouseID int                 `json:"id_swiflet_house"`
+	Bands          []ClimateBand       `json:"bands"`
+	Periods        []HarvestPeriod     `json:"periods"`
+	Correlations   map[string]*float64 `json:"correlations"`
+}
+
+// Status of a provisioned device
+const (
+	ProvisionUnclaimed = "unclaimed"
+	ProvisionClaimed   = "claimed"
+	ProvisionRevoked   = "revoked"
+)
+
+// DeviceProvision is a gateway with a generated install code and its own
+// MQTT secret. It is bound to a house when claimed.
+type DeviceProvision struct {
+	ID              int        `json:"id" db:"id"`
+	InstallCode     string     `json:"install_code" db:"install_code"`
+	Status          string     `json:"status" db:"status"`
+	DeviceID        *int       `json:"id_device" db:"id_device"`
+	CreatedBy       *int       `json:"created_by" db:"created_by"`
+	ClaimedBy       *int       `json:"claimed_by" db:"claimed_by"`
+	ClaimedAt       *time.Time `json:"claimed_at" db:"claimed_at"`
+	SecretRotatedAt *time.Time `json:"secret_rotated_at" db:"secret_rotated_at"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// DeviceCredentials are the MQTT username and password of a device. The
+// secret is only returned when it is generated.
+type DeviceCredentials struct {
+	InstallCode string `json:"install_code"`
+	Secret      string `json:"secret"`
+}
+
+// ProvisionedDevice is a newly provisioned gateway with the secrets to flash
+// and print on its label
+type ProvisionedDevice struct {
+	DeviceProvision
+	Secret    string `json:"secret"`
+	ClaimCode string `json:"claim_code"`
+}
+
+// ProvisionDevicesRequest asks for a batch of new gateways
+type ProvisionDevicesRequest struct {
+	Count int `json:"count" validate:"required,min=1,max=100"`
+}
+
+// ClaimDeviceRequest binds a provisioned gateway to a floor of a house
+type ClaimDeviceRequest struct {
+	InstallCode    string `json:"install_code" validate:"required"`
+	ClaimCode      string `json:"claim_code" validate:"required"`
+	SwifletHouseID int    `json:"id_swiflet_house" validate:"required"`
+	Floor          int    `json:"floor" validate:"required"`
+}
+
+// Roles of a user in a swiflet house, from most to least privileged. The
+// owner is the house's id_user; the other roles are granted by invitation.
+const (
+	HouseRoleOwner   = "owner"
+	HouseRoleManager = "manager"
+	HouseRoleWorker  = "worker"
+	HouseRoleViewer  = "viewer"
+)
+
+// Status of a house invitation
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+	// InvitationExpired is reported for pending invitations past expires_at
+	InvitationExpired = "expired"
+)
+
+// HouseMember is a user with access to a swiflet house
+type HouseMember struct {
+	SwifletHouseID int       `json:"id_swiflet_house" db:"id_swiflet_house"`
+	UserID         int       `json:"id_user" db:"id_user"`
+	Name           string    `json:"name" db:"name"`
+	Email          string    `json:"email" db:"email"`
+	Role           string    `json:"role" db:"role"`
+	InvitedBy      *int      `json:"invited_by" db:"invited_by"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
-}
\ No newline at end of file
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// HouseInvitation invites an email address to join a house with a role
+type HouseInvitation struct {
+	ID             int        `json:"id" db:"id"`
+	SwifletHouseID int        `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Email          string     `json:"email" db:"email"`
+	Role           string     `json:"role" db:"role"`
+	Status         string     `json:"status" db:"status"`
+	InvitedBy      *int       `json:"invited_by" db:"invited_by"`
+	ExpiresAt      time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedBy     *int       `json:"accepted_by" db:"accepted_by"`
+	AcceptedAt     *time.Time `json:"accepted_at" db:"accepted_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// InviteMemberRequest invites someone to a house
+type InviteMemberRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+	Role  string `json:"role" validate:"required,oneof=manager worker viewer"`
+}
+
+// AcceptInvitationRequest accepts an invitation with the token from its email
+type AcceptInvitationRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// FirmwareRelease is a firmware image of the Node Gateway stored in S3
+type FirmwareRelease struct {
+	ID         int       `json:"id" db:"id"`
+	Version    string    `json:"version" db:"version"`
+	S3Key      string    `json:"s3_key" db:"s3_key"`
+	Size       int64     `json:"size" db:"size"`
+	SHA256     string    `json:"sha256" db:"sha256"`
+	Notes      *string   `json:"notes" db:"notes"`
+	UploadedBy *int      `json:"uploaded_by" db:"uploaded_by"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	// DownloadURL is a presigned link, only set when a single release is read
+	DownloadURL string `json:"download_url,omitempty" db:"-"`
+}
+
+// Status of a firmware rollout
+const (
+	RolloutScheduled = "scheduled"
+	RolloutRunning   = "running"
+	RolloutPaused    = "paused"
+	RolloutCompleted = "completed"
+	RolloutHalted    = "halted"
+	RolloutCancelled = "cancelled"
+)
+
+// Status of a device in a firmware rollout
+const (
+	RolloutDevicePending   = "pending"
+	RolloutDeviceSent      = "sent"
+	RolloutDeviceSucceeded = "succeeded"
+	RolloutDeviceFailed    = "failed"
+	RolloutDeviceCancelled = "cancelled"
+)
+
+// FirmwareRollout updates a set of devices to a firmware release in stages
+// of BatchSize devices. A stage starts once the previous one has finished,
+// and the rollout halts when more than MaxFailures devices failed.
+type FirmwareRollout struct {
+	ID             int        `json:"id" db:"id"`
+	FirmwareID     int        `json:"id_firmware" db:"id_firmware"`
+	Version        string     `json:"version" db:"version"`
+	SwifletHouseID *int       `json:"id_swiflet_house" db:"id_swiflet_house"`
+	Floor          *int       `json:"floor" db:"floor"`
+	Status         string     `json:"status" db:"status"`
+	BatchSize      int        `json:"batch_size" db:"batch_size"`
+	MaxFailures    int        `json:"max_failures" db:"max_failures"`
+	CurrentStage   int        `json:"current_stage" db:"current_stage"`
+	Error          *string    `json:"error" db:"error"`
+	ScheduledAt    time.Time  `json:"scheduled_at" db:"scheduled_at"`
+	StartedAt      *time.Time `json:"started_at" db:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at" db:"finished_at"`
+	CreatedBy      *int       `json:"created_by" db:"created_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+	// Devices counts the devices of the rollout per status
+	Devices map[string]int `json:"devices,omitempty" db:"-"`
+}
+
+// FirmwareRolloutDevice is the update of one device in a rollout
+type FirmwareRolloutDevice struct {
+	ID          int        `json:"id" db:"id"`
+	RolloutID   int        `json:"id_rollout" db:"id_rollout"`
+	DeviceID    int        `json:"id_device" db:"id_device"`
+	InstallCode string     `json:"install_code" db:"install_code"`
+	Stage       int        `json:"stage" db:"stage"`
+	Status      string     `json:"status" db:"status"`
+	FromVersion *string    `json:"from_version" db:"from_version"`
+	CommandID   *int       `json:"id_command" db:"id_command"`
+	Error       *string    `json:"error" db:"error"`
+	SentAt      *time.Time `json:"sent_at" db:"sent_at"`
+	FinishedAt  *time.Time `json:"finished_at" db:"finished_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// CreateFirmwareRolloutRequest selects the devices of a rollout: the devices
+// of a house (optionally one floor), a list of devices, or the devices of the
+// list in the house
+type CreateFirmwareRolloutRequest struct {
+	FirmwareID     int        `json:"id_firmware" validate:"required"`
+	SwifletHouseID *int       `json:"id_swiflet_house" validate:"required_without=DeviceIDs"`
+	Floor          *int       `json:"floor" validate:"omitempty,min=1"`
+	DeviceIDs      []int      `json:"device_ids" validate:"required_without=SwifletHouseID,omitempty,max=1000"`
+	BatchSize      int        `json:"batch_size" validate:"required,min=1"`
+	MaxFailures    int        `json:"max_failures" validate:"min=0"`
+	ScheduledAt    *time.Time `json:"scheduled_at"`
+}
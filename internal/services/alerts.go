@@ -0,0 +1,297 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// AlertColumns lists the columns of the alerts table in ScanAlert order
+const AlertColumns = `id, id_rule, id_swiflet_house, floor, metric, severity, status, value, peak_value,
+	opened_at, acknowledged_at, acknowledged_by, resolved_at, created_at, updated_at`
+
+// ScanAlert scans a row selected with AlertColumns
+func ScanAlert(row interface{ Scan(...interface{}) error }) (models.Alert, error) {
+	var alert models.Alert
+	err := row.Scan(&alert.ID, &alert.RuleID, &alert.SwifletHouseID, &alert.Floor, &alert.Metric, &alert.Severity,
+		&alert.Status, &alert.Value, &alert.PeakValue, &alert.OpenedAt, &alert.AcknowledgedAt,
+		&alert.AcknowledgedBy, &alert.ResolvedAt, &alert.CreatedAt, &alert.UpdatedAt)
+	return alert, err
+}
+
+// What an alert rule evaluation changes about the rule's alert
+const (
+	alertUnchanged = iota
+	alertOpen
+	alertEscalate
+	alertPeak
+	alertResolve
+)
+
+// alertState tracks the alert a rule currently has open. An alert opens when
+// the warning or critical threshold is crossed, escalates from warning to
+// critical, and resolves once the value clears the warning threshold by the
+// hysteresis.
+type alertState struct {
+	rule models.AlertRule
+
+	values   scopeValues
+	alertID  int
+	active   bool
+	severity string
+	peak     float64
+}
+
+func (s *alertState) matches(reading SensorReading) bool {
+	return s.rule.SwifletHouseID == reading.SwifletHouseID &&
+		(s.rule.Floor == nil || *s.rule.Floor == reading.Floor)
+}
+
+// severityOf returns the severity a value reaches, or an empty string
+func (s *alertState) severityOf(value float64) string {
+	switch {
+	case thresholdCrossed(s.rule.Operator, value, s.rule.CriticalThreshold):
+		return models.AlertCritical
+	case thresholdCrossed(s.rule.Operator, value, s.rule.WarningThreshold):
+		return models.AlertWarning
+	default:
+		return ""
+	}
+}
+
+// evaluate applies a reading and returns the scope value and the change to the alert
+func (s *alertState) evaluate(installCode string, value float64, timestamp time.Time) (float64, int) {
+	current := s.values.update(installCode, value, timestamp)
+	severity := s.severityOf(current)
+
+	if !s.active {
+		if severity == "" {
+			return current, alertUnchanged
+		}
+		s.active = true
+		s.severity = severity
+		s.peak = current
+		return current, alertOpen
+	}
+
+	if thresholdCleared(s.rule.Operator, current, s.rule.WarningThreshold, s.rule.Hysteresis) {
+		s.active = false
+		return current, alertResolve
+	}
+
+	worse := thresholdCrossed(s.rule.Operator, current, s.peak)
+	if worse {
+		s.peak = current
+	}
+	if severity == models.AlertCritical && s.severity == models.AlertWarning {
+		s.severity = models.AlertCritical
+		return current, alertEscalate
+	}
+	if worse {
+		return current, alertPeak
+	}
+	return current, alertUnchanged
+}
+
+// AlertEngine evaluates alert rules against stored readings, keeps the
+// alerts table up to date and publishes alert changes to the stream hub
+type AlertEngine struct {
+	db  *database.DB
+	hub *Hub
+
+	mu    sync.Mutex
+	rules map[int]*alertState
+
+	readings chan []SensorReading
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewAlertEngine(db *database.DB, hub *Hub) *AlertEngine {
+	return &AlertEngine{
+		db:       db,
+		hub:      hub,
+		rules:    make(map[int]*alertState),
+		readings: make(chan []SensorReading, 1000),
+	}
+}
+
+// Load reads all enabled rules and their unresolved alerts. Rules that did not
+// change keep their evaluation state.
+func (e *AlertEngine) Load() error {
+	rows, err := e.db.PostgreSQL.Query(`
+		SELECT r.id, r.id_user, r.id_swiflet_house, r.floor, r.name, r.metric, r.operator,
+			r.warning_threshold, r.critical_threshold, r.hysteresis, r.enabled, r.created_at, r.updated_at,
+			a.id, a.severity, a.peak_value
+		FROM alert_rules r
+		LEFT JOIN alerts a ON a.id_rule = r.id AND a.status <> $1
+		WHERE r.enabled = TRUE
+		ORDER BY a.opened_at ASC
+	`, models.AlertResolved)
+	if err != nil {
+		return fmt.Errorf("failed to load alert rules: %w", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[int]*alertState)
+	for rows.Next() {
+		var rule models.AlertRule
+		var alertID *int
+		var severity *string
+		var peak *float64
+		err := rows.Scan(&rule.ID, &rule.UserID, &rule.SwifletHouseID, &rule.Floor, &rule.Name, &rule.Metric,
+			&rule.Operator, &rule.WarningThreshold, &rule.CriticalThreshold, &rule.Hysteresis, &rule.Enabled,
+			&rule.CreatedAt, &rule.UpdatedAt, &alertID, &severity, &peak)
+		if err != nil {
+			return fmt.Errorf("failed to scan alert rule: %w", err)
+		}
+
+		// The latest unresolved alert wins should a rule have several
+		state := &alertState{rule: rule}
+		if alertID != nil {
+			state.active = true
+			state.alertID = *alertID
+			state.severity = *severity
+			state.peak = *peak
+		}
+		loaded[rule.ID] = state
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load alert rules: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for id, state := range loaded {
+		if existing, ok := e.rules[id]; ok && existing.rule.UpdatedAt.Equal(state.rule.UpdatedAt) {
+			state.values = existing.values
+		}
+	}
+	e.rules = loaded
+
+	return nil
+}
+
+// ObserveReadings queues stored readings for evaluation without blocking ingestion
+func (e *AlertEngine) ObserveReadings(readings []SensorReading) {
+	batch := make([]SensorReading, len(readings))
+	copy(batch, readings)
+
+	select {
+	case e.readings <- batch:
+	default:
+		log.Printf("Alert queue full, skipping %d readings", len(batch))
+	}
+}
+
+// Start evaluates queued readings in the background
+func (e *AlertEngine) Start() {
+	if e.stop != nil {
+		return
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go func() {
+		defer close(e.done)
+
+		for {
+			select {
+			case batch := <-e.readings:
+				e.evaluate(batch, time.Now())
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends evaluation; readings still queued are dropped
+func (e *AlertEngine) Stop() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+	e.stop = nil
+}
+
+func (e *AlertEngine) evaluate(batch []SensorReading, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, reading := range batch {
+		if now.Sub(reading.Timestamp) > maxEvaluationAge {
+			continue
+		}
+		for _, state := range e.rules {
+			value, ok := reading.Values[state.rule.Metric]
+			if !ok || !state.matches(reading) {
+				continue
+			}
+			current, change := state.evaluate(reading.InstallCode, value, reading.Timestamp)
+			if err := e.apply(state, change, current, reading.Timestamp); err != nil {
+				log.Printf("Failed to update alert of rule %d: %v", state.rule.ID, err)
+			}
+		}
+	}
+}
+
+// apply writes an alert change to the database and publishes the alert
+func (e *AlertEngine) apply(state *alertState, change int, value float64, at time.Time) error {
+	rule := state.rule
+
+	var row *sql.Row
+	switch change {
+	case alertOpen:
+		log.Printf("Alert rule %d (%s) opened a %s alert: %s at %g", rule.ID, rule.Name, state.severity, rule.Metric, value)
+		now := time.Now()
+		row = e.db.PostgreSQL.QueryRow(`
+			INSERT INTO alerts (id_rule, id_swiflet_house, floor, metric, severity, status, value, peak_value,
+				opened_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9, $9)
+			RETURNING `+AlertColumns,
+			rule.ID, rule.SwifletHouseID, rule.Floor, rule.Metric, state.severity, models.AlertOpen, value, at, now)
+	case alertEscalate:
+		log.Printf("Alert %d of rule %d escalated to critical: %s at %g", state.alertID, rule.ID, rule.Metric, value)
+		row = e.db.PostgreSQL.QueryRow(`
+			UPDATE alerts SET severity = $1, peak_value = $2, updated_at = $3
+			WHERE id = $4 AND status <> $5
+			RETURNING `+AlertColumns,
+			models.AlertCritical, state.peak, time.Now(), state.alertID, models.AlertResolved)
+	case alertPeak:
+		_, err := e.db.PostgreSQL.Exec(`
+			UPDATE alerts SET peak_value = $1, updated_at = $2
+			WHERE id = $3 AND status <> $4
+		`, state.peak, time.Now(), state.alertID, models.AlertResolved)
+		return err
+	case alertResolve:
+		log.Printf("Alert %d of rule %d resolved: %s back at %g", state.alertID, rule.ID, rule.Metric, value)
+		row = e.db.PostgreSQL.QueryRow(`
+			UPDATE alerts SET status = $1, resolved_at = $2, updated_at = $3
+			WHERE id = $4 AND status <> $1
+			RETURNING `+AlertColumns,
+			models.AlertResolved, at, time.Now(), state.alertID)
+	default:
+		return nil
+	}
+
+	alert, err := ScanAlert(row)
+	if err == sql.ErrNoRows {
+		// Resolved manually in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state.alertID = alert.ID
+	e.hub.Publish(StreamEvent{Type: StreamEventAlert, SwifletHouseID: alert.SwifletHouseID, Data: alert})
+	return nil
+}
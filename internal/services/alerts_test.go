@@ -0,0 +1,66 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestAlertStateLifecycle(t *testing.T) {
+	state := &alertState{rule: models.AlertRule{
+		SwifletHouseID:    1,
+		Metric:            models.MetricSuhu,
+		Operator:          models.OperatorAbove,
+		WarningThreshold:  30,
+		CriticalThreshold: 33,
+		Hysteresis:        1,
+	}}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		value    float64
+		change   int
+		severity string
+	}{
+		{29, alertUnchanged, ""},
+		{31, alertOpen, models.AlertWarning},
+		{32, alertPeak, models.AlertWarning},
+		{31.5, alertUnchanged, models.AlertWarning},
+		{34, alertEscalate, models.AlertCritical},
+		{30, alertUnchanged, models.AlertCritical}, // within hysteresis
+		{29, alertResolve, models.AlertCritical},
+		{29.5, alertUnchanged, models.AlertCritical},
+		{34, alertOpen, models.AlertCritical}, // opens directly as critical
+	}
+
+	for i, step := range steps {
+		_, change := state.evaluate("GW-01", step.value, start.Add(time.Duration(i)*time.Minute))
+		if change != step.change {
+			t.Errorf("step %d value %g: change = %d, want %d", i, step.value, change, step.change)
+		}
+		if step.severity != "" && state.severity != step.severity {
+			t.Errorf("step %d value %g: severity = %s, want %s", i, step.value, state.severity, step.severity)
+		}
+	}
+
+	if state.peak != 34 {
+		t.Errorf("peak = %g, want 34", state.peak)
+	}
+}
+
+func TestAlertStateBelowPeak(t *testing.T) {
+	state := &alertState{rule: models.AlertRule{
+		Metric:            models.MetricKelembaban,
+		Operator:          models.OperatorBelow,
+		WarningThreshold:  75,
+		CriticalThreshold: 70,
+	}}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	state.evaluate("GW-01", 74, now)
+	state.evaluate("GW-01", 72, now.Add(time.Minute))
+	state.evaluate("GW-01", 73, now.Add(2*time.Minute))
+	if state.peak != 72 || state.severity != models.AlertWarning {
+		t.Fatalf("peak = %g, severity = %s; want 72 warning", state.peak, state.severity)
+	}
+}
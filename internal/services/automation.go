@@ -0,0 +1,331 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// Readings older than this are not evaluated, e.g. replayed dead letters or
+// buffered readings a gateway sends after a long outage
+const maxEvaluationAge = 15 * time.Minute
+
+// CommandSender sends control commands to devices, implemented by MQTTService
+type CommandSender interface {
+	SendCommand(device DeviceInfo, userID *int, command string, params json.RawMessage) (*models.DeviceCommand, error)
+}
+
+// scopeValues keeps the latest value of each device in a house or floor. The
+// value of the scope is the mean of devices that reported recently, so a
+// single device does not flip a rule on a floor with several sensors.
+type scopeValues struct {
+	latest map[string]lastValue
+}
+
+func (s *scopeValues) update(installCode string, value float64, timestamp time.Time) float64 {
+	if s.latest == nil {
+		s.latest = make(map[string]lastValue)
+	}
+	if previous, ok := s.latest[installCode]; !ok || !timestamp.Before(previous.timestamp) {
+		s.latest[installCode] = lastValue{value: value, timestamp: timestamp}
+	}
+
+	var sum float64
+	var count int
+	for code, entry := range s.latest {
+		if timestamp.Sub(entry.timestamp) > maxEvaluationAge {
+			delete(s.latest, code)
+			continue
+		}
+		sum += entry.value
+		count++
+	}
+	return sum / float64(count)
+}
+
+// thresholdCrossed reports whether a value is past a threshold
+func thresholdCrossed(operator string, value, threshold float64) bool {
+	if operator == models.OperatorBelow {
+		return value < threshold
+	}
+	return value > threshold
+}
+
+// thresholdCleared reports whether a value moved back past the threshold by
+// at least the hysteresis
+func thresholdCleared(operator string, value, threshold, hysteresis float64) bool {
+	if operator == models.OperatorBelow {
+		return value >= threshold+hysteresis
+	}
+	return value <= threshold-hysteresis
+}
+
+// ruleState tracks the evaluation of one automation rule. A rule triggers once
+// its condition held for the duration, then stays disarmed until the value
+// clears the threshold by the hysteresis, and never triggers twice within the
+// cooldown.
+type ruleState struct {
+	rule models.AutomationRule
+
+	values         scopeValues
+	conditionSince time.Time
+	disarmed       bool
+	lastTriggered  time.Time
+}
+
+func (s *ruleState) matches(reading SensorReading) bool {
+	return s.rule.SwifletHouseID == reading.SwifletHouseID &&
+		(s.rule.Floor == nil || *s.rule.Floor == reading.Floor)
+}
+
+// evaluate applies a reading and returns the scope value and whether the rule fires
+func (s *ruleState) evaluate(installCode string, value float64, timestamp time.Time) (float64, bool) {
+	current := s.values.update(installCode, value, timestamp)
+
+	if s.disarmed {
+		if thresholdCleared(s.rule.Operator, current, s.rule.Threshold, s.rule.Hysteresis) {
+			s.disarmed = false
+			s.conditionSince = time.Time{}
+		}
+		return current, false
+	}
+
+	if !thresholdCrossed(s.rule.Operator, current, s.rule.Threshold) {
+		s.conditionSince = time.Time{}
+		return current, false
+	}
+
+	if s.conditionSince.IsZero() {
+		s.conditionSince = timestamp
+	}
+	if timestamp.Sub(s.conditionSince) < time.Duration(s.rule.DurationSeconds)*time.Second {
+		return current, false
+	}
+	if !s.lastTriggered.IsZero() && timestamp.Sub(s.lastTriggered) < time.Duration(s.rule.CooldownSeconds)*time.Second {
+		return current, false
+	}
+
+	s.lastTriggered = timestamp
+	s.conditionSince = time.Time{}
+	s.disarmed = true
+	return current, true
+}
+
+type ruleTrigger struct {
+	rule      models.AutomationRule
+	value     float64
+	timestamp time.Time
+}
+
+// AutomationEngine evaluates automation rules against stored readings and
+// sends the rule's command when one fires
+type AutomationEngine struct {
+	db       *database.DB
+	registry *DeviceRegistry
+	sender   CommandSender
+
+	mu    sync.Mutex
+	rules map[int]*ruleState
+
+	readings chan []SensorReading
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewAutomationEngine creates the engine. Without a sender rules are still
+// evaluated, but triggers are logged as failed.
+func NewAutomationEngine(db *database.DB, registry *DeviceRegistry, sender CommandSender) *AutomationEngine {
+	return &AutomationEngine{
+		db:       db,
+		registry: registry,
+		sender:   sender,
+		rules:    make(map[int]*ruleState),
+		readings: make(chan []SensorReading, 1000),
+	}
+}
+
+// Load reads all enabled rules. Rules that did not change keep their state.
+func (e *AutomationEngine) Load() error {
+	rows, err := e.db.PostgreSQL.Query(`
+		SELECT id, id_user, id_swiflet_house, floor, name, metric, operator, threshold, duration_seconds,
+			hysteresis, cooldown_seconds, id_device, command, params, enabled, last_triggered_at,
+			created_at, updated_at
+		FROM automation_rules
+		WHERE enabled = TRUE
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to load automation rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []models.AutomationRule
+	for rows.Next() {
+		var rule models.AutomationRule
+		var params []byte
+		err := rows.Scan(&rule.ID, &rule.UserID, &rule.SwifletHouseID, &rule.Floor, &rule.Name, &rule.Metric,
+			&rule.Operator, &rule.Threshold, &rule.DurationSeconds, &rule.Hysteresis, &rule.CooldownSeconds,
+			&rule.DeviceID, &rule.Command, &params, &rule.Enabled, &rule.LastTriggeredAt,
+			&rule.CreatedAt, &rule.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to scan automation rule: %w", err)
+		}
+		rule.Params = params
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load automation rules: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	states := make(map[int]*ruleState, len(rules))
+	for _, rule := range rules {
+		if existing, ok := e.rules[rule.ID]; ok && existing.rule.UpdatedAt.Equal(rule.UpdatedAt) {
+			states[rule.ID] = existing
+			continue
+		}
+		state := &ruleState{rule: rule}
+		if rule.LastTriggeredAt != nil {
+			state.lastTriggered = *rule.LastTriggeredAt
+		}
+		states[rule.ID] = state
+	}
+	e.rules = states
+
+	return nil
+}
+
+// ObserveReadings queues stored readings for evaluation without blocking ingestion
+func (e *AutomationEngine) ObserveReadings(readings []SensorReading) {
+	batch := make([]SensorReading, len(readings))
+	copy(batch, readings)
+
+	select {
+	case e.readings <- batch:
+	default:
+		log.Printf("Automation queue full, skipping %d readings", len(batch))
+	}
+}
+
+// Start evaluates queued readings in the background
+func (e *AutomationEngine) Start() {
+	if e.stop != nil {
+		return
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go func() {
+		defer close(e.done)
+
+		for {
+			select {
+			case batch := <-e.readings:
+				for _, trigger := range e.evaluate(batch, time.Now()) {
+					e.fire(trigger)
+				}
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends evaluation; readings still queued are dropped
+func (e *AutomationEngine) Stop() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+	e.stop = nil
+}
+
+func (e *AutomationEngine) evaluate(batch []SensorReading, now time.Time) []ruleTrigger {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var triggers []ruleTrigger
+	for _, reading := range batch {
+		if now.Sub(reading.Timestamp) > maxEvaluationAge {
+			continue
+		}
+		for _, state := range e.rules {
+			value, ok := reading.Values[state.rule.Metric]
+			if !ok || !state.matches(reading) {
+				continue
+			}
+			if current, fire := state.evaluate(reading.InstallCode, value, reading.Timestamp); fire {
+				triggers = append(triggers, ruleTrigger{rule: state.rule, value: current, timestamp: reading.Timestamp})
+			}
+		}
+	}
+	return triggers
+}
+
+// fire sends the rule's command and writes the audit log entry
+func (e *AutomationEngine) fire(trigger ruleTrigger) {
+	rule := trigger.rule
+	log.Printf("Automation rule %d (%s) fired: %s %s %g at %g", rule.ID, rule.Name, rule.Metric, rule.Operator,
+		rule.Threshold, trigger.value)
+
+	status := models.AutomationTriggered
+	var commandID *int
+	var sendErr error
+
+	device, err := e.targetDevice(rule.DeviceID)
+	switch {
+	case err != nil:
+		sendErr = err
+	case e.sender == nil:
+		sendErr = fmt.Errorf("MQTT service unavailable")
+	default:
+		var command *models.DeviceCommand
+		command, sendErr = e.sender.SendCommand(device, nil, rule.Command, rule.Params)
+		if command != nil {
+			commandID = &command.ID
+		}
+	}
+
+	var errText *string
+	if sendErr != nil {
+		status = models.AutomationFailed
+		text := sendErr.Error()
+		errText = &text
+		log.Printf("Automation rule %d failed to send %s: %v", rule.ID, rule.Command, sendErr)
+	}
+
+	_, err = e.db.PostgreSQL.Exec(`
+		INSERT INTO automation_audit_log (id_rule, id_device, id_command, metric, value, threshold, status, error, triggered_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, rule.ID, rule.DeviceID, commandID, rule.Metric, trigger.value, rule.Threshold, status, errText, time.Now())
+	if err != nil {
+		log.Printf("Failed to write automation audit log of rule %d: %v", rule.ID, err)
+	}
+
+	_, err = e.db.PostgreSQL.Exec("UPDATE automation_rules SET last_triggered_at = $1 WHERE id = $2",
+		trigger.timestamp, rule.ID)
+	if err != nil {
+		log.Printf("Failed to store last trigger of automation rule %d: %v", rule.ID, err)
+	}
+}
+
+func (e *AutomationEngine) targetDevice(deviceID int) (DeviceInfo, error) {
+	var installCode string
+	err := e.db.PostgreSQL.QueryRow("SELECT install_code FROM iot_devices WHERE id = $1", deviceID).Scan(&installCode)
+	if err != nil {
+		return DeviceInfo{}, fmt.Errorf("target device %d: %w", deviceID, err)
+	}
+
+	device, ok := e.registry.Lookup(installCode)
+	if !ok {
+		return DeviceInfo{}, fmt.Errorf("target device %s is not registered", installCode)
+	}
+	return device, nil
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestRuleStateDurationHysteresisCooldown(t *testing.T) {
+	floor := 2
+	state := &ruleState{rule: models.AutomationRule{
+		SwifletHouseID:  1,
+		Floor:           &floor,
+		Metric:          models.MetricKelembaban,
+		Operator:        models.OperatorBelow,
+		Threshold:       75,
+		DurationSeconds: 600,
+		Hysteresis:      3,
+		CooldownSeconds: 3600,
+	}}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		minutes int
+		value   float64
+		fire    bool
+	}{
+		{0, 74, false},  // condition starts
+		{5, 73, false},  // not yet held for 10 minutes
+		{10, 72, true},  // held for 10 minutes
+		{11, 70, false}, // disarmed
+		{15, 77, false}, // above threshold but within hysteresis
+		{20, 79, false}, // cleared, re-armed
+		{25, 74, false}, // condition starts again
+		{36, 74, false}, // held long enough, but within cooldown
+		{75, 74, true},  // cooldown over
+	}
+
+	for _, step := range steps {
+		_, fire := state.evaluate("GW-01", step.value, start.Add(time.Duration(step.minutes)*time.Minute))
+		if fire != step.fire {
+			t.Errorf("minute %d value %g: fire = %v, want %v", step.minutes, step.value, fire, step.fire)
+		}
+	}
+}
+
+func TestRuleStateConditionResets(t *testing.T) {
+	state := &ruleState{rule: models.AutomationRule{
+		Metric:          models.MetricSuhu,
+		Operator:        models.OperatorAbove,
+		Threshold:       30,
+		DurationSeconds: 300,
+	}}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	state.evaluate("GW-01", 31, start)
+	state.evaluate("GW-01", 29, start.Add(3*time.Minute))
+	if _, fire := state.evaluate("GW-01", 31, start.Add(6*time.Minute)); fire {
+		t.Fatal("rule fired although the condition was interrupted")
+	}
+	if _, fire := state.evaluate("GW-01", 31, start.Add(11*time.Minute)); !fire {
+		t.Fatal("rule did not fire after the condition held for the duration")
+	}
+}
+
+func TestRuleStateAveragesDevices(t *testing.T) {
+	state := &ruleState{rule: models.AutomationRule{
+		Metric:    models.MetricKelembaban,
+		Operator:  models.OperatorBelow,
+		Threshold: 75,
+	}}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	state.evaluate("GW-01", 80, now)
+	value, fire := state.evaluate("GW-02", 72, now.Add(time.Minute))
+	if value != 76 || fire {
+		t.Fatalf("value = %g, fire = %v; want mean 76 without firing", value, fire)
+	}
+
+	// Stale devices no longer count
+	value, fire = state.evaluate("GW-02", 72, now.Add(20*time.Minute))
+	if value != 72 || !fire {
+		t.Fatalf("value = %g, fire = %v; want 72 and firing", value, fire)
+	}
+}
+
+func TestRuleStateMatches(t *testing.T) {
+	floor := 2
+	floorRule := &ruleState{rule: models.AutomationRule{SwifletHouseID: 1, Floor: &floor}}
+	houseRule := &ruleState{rule: models.AutomationRule{SwifletHouseID: 1}}
+
+	tests := []struct {
+		state   *ruleState
+		reading SensorReading
+		want    bool
+	}{
+		{floorRule, SensorReading{SwifletHouseID: 1, Floor: 2}, true},
+		{floorRule, SensorReading{SwifletHouseID: 1, Floor: 3}, false},
+		{floorRule, SensorReading{SwifletHouseID: 2, Floor: 2}, false},
+		{houseRule, SensorReading{SwifletHouseID: 1, Floor: 3}, true},
+	}
+
+	for n, tt := range tests {
+		if got := tt.state.matches(tt.reading); got != tt.want {
+			t.Errorf("case %d: matches = %v, want %v", n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+
+	// Timezone data for CLIMATE_TIMEZONE, as the production image has none
+	_ "time/tzdata"
+
+	"github.com/lib/pq"
+)
+
+// Directions of a climate excursion
+const (
+	ExcursionBelow = "below"
+	ExcursionAbove = "above"
+)
+
+// maxClimateExcursions is how many of the worst excursions a day keeps
+const maxClimateExcursions = 3
+
+// climateRescoreDays is how many days, up to today, every run scores again so
+// late readings are included. Days of imported readings are rescored when the
+// import reports them.
+const climateRescoreDays = 2
+
+// ParseClimateBands parses a "metric:min-max" or "metric:min-max:tolerance"
+// list separated by commas. The tolerance defaults to the band width.
+func ParseClimateBands(spec string) ([]models.ClimateBand, error) {
+	var bands []models.ClimateBand
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid climate band %q, expected metric:min-max[:tolerance]", entry)
+		}
+		metric := strings.TrimSpace(parts[0])
+		if metric == "" || seen[metric] {
+			return nil, fmt.Errorf("invalid climate band %q: missing or repeated metric", entry)
+		}
+		seen[metric] = true
+
+		// Skip a leading minus sign when looking for the separator
+		bandRange := strings.TrimSpace(parts[1])
+		sep := -1
+		if len(bandRange) > 1 {
+			sep = strings.Index(bandRange[1:], "-") + 1
+		}
+		if sep < 1 {
+			return nil, fmt.Errorf("invalid climate band %q, expected min-max", entry)
+		}
+		low, errLow := strconv.ParseFloat(strings.TrimSpace(bandRange[:sep]), 64)
+		high, errHigh := strconv.ParseFloat(strings.TrimSpace(bandRange[sep+1:]), 64)
+		if errLow != nil || errHigh != nil || low >= high {
+			return nil, fmt.Errorf("invalid climate band %q, expected min-max with min below max", entry)
+		}
+
+		band := models.ClimateBand{Metric: metric, Min: low, Max: high, Tolerance: high - low}
+		if len(parts) == 3 {
+			tolerance, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+			if err != nil || tolerance <= 0 {
+				return nil, fmt.Errorf("invalid climate band %q, tolerance must be positive", entry)
+			}
+			band.Tolerance = tolerance
+		}
+		bands = append(bands, band)
+	}
+
+	if len(bands) == 0 {
+		return nil, errors.New("no climate bands configured")
+	}
+	return bands, nil
+}
+
+// climateSample is the mean of a metric over one bucket
+type climateSample struct {
+	Bucket time.Time
+	Metric string
+	Value  float64
+}
+
+// bandDeviation returns how far a value is outside the band and on which side
+func bandDeviation(band models.ClimateBand, value float64) (float64, string) {
+	switch {
+	case value < band.Min:
+		return band.Min - value, ExcursionBelow
+	case value > band.Max:
+		return value - band.Max, ExcursionAbove
+	}
+	return 0, ""
+}
+
+type excursionCandidate struct {
+	models.ClimateExcursion
+	// weight integrates the deviation, relative to the band's tolerance, over
+	// time to rank excursions of different metrics
+	weight float64
+}
+
+func round1(value float64) float64 {
+	return math.Round(value*10) / 10
+}
+
+// scoreClimate compares the samples of one floor with the bands. A bucket
+// scores 1 when in band and falls linearly to 0 at the band's tolerance
+// outside it; the score is the mean over buckets and metrics, scaled to 100.
+// expected is the number of buckets in the scored period.
+func scoreClimate(bands []models.ClimateBand, samples []climateSample, bucket time.Duration, expected int) models.ClimateScore {
+	byMetric := make(map[string][]climateSample)
+	for _, sample := range samples {
+		byMetric[sample.Metric] = append(byMetric[sample.Metric], sample)
+	}
+
+	score := models.ClimateScore{
+		Metrics:    []models.ClimateMetricScore{},
+		Excursions: []models.ClimateExcursion{},
+	}
+
+	// Buckets with data, and whether every metric of the bucket was in band
+	inBand := make(map[time.Time]bool)
+	var candidates []excursionCandidate
+	var scoreSum float64
+
+	for _, band := range bands {
+		metricSamples := byMetric[band.Metric]
+		if len(metricSamples) == 0 {
+			continue
+		}
+		sort.Slice(metricSamples, func(i, j int) bool {
+			return metricSamples[i].Bucket.Before(metricSamples[j].Bucket)
+		})
+
+		metric := models.ClimateMetricScore{
+			Metric: band.Metric,
+			Min:    metricSamples[0].Value,
+			Max:    metricSamples[0].Value,
+		}
+		var sum, bucketScores float64
+		var bucketsInBand int
+		var current *excursionCandidate
+		var previous time.Time
+
+		for _, sample := range metricSamples {
+			sum += sample.Value
+			metric.Min = math.Min(metric.Min, sample.Value)
+			metric.Max = math.Max(metric.Max, sample.Value)
+
+			deviation, direction := bandDeviation(band, sample.Value)
+			if direction == "" {
+				bucketsInBand++
+				bucketScores++
+				if _, seen := inBand[sample.Bucket]; !seen {
+					inBand[sample.Bucket] = true
+				}
+			} else {
+				bucketScores += math.Max(0, 1-deviation/band.Tolerance)
+				inBand[sample.Bucket] = false
+			}
+
+			// An excursion continues while consecutive buckets stay out on the same side
+			continues := current != nil && current.Direction == direction && sample.Bucket.Sub(previous) <= bucket
+			if current != nil && !continues {
+				candidates = append(candidates, *current)
+				current = nil
+			}
+			if direction != "" {
+				if current == nil {
+					current = &excursionCandidate{ClimateExcursion: models.ClimateExcursion{
+						Metric:    band.Metric,
+						Direction: direction,
+						Start:     sample.Bucket,
+					}}
+				}
+				current.End = sample.Bucket.Add(bucket)
+				current.weight += deviation / band.Tolerance * bucket.Minutes()
+				if deviation > current.PeakDeviation {
+					current.PeakDeviation = deviation
+					current.PeakValue = sample.Value
+				}
+			}
+			previous = sample.Bucket
+		}
+		if current != nil {
+			candidates = append(candidates, *current)
+		}
+
+		count := float64(len(metricSamples))
+		metric.Avg = round1(sum / count)
+		metric.Score = round1(100 * bucketScores / count)
+		metric.TimeInBand = round1(100 * float64(bucketsInBand) / count)
+		scoreSum += 100 * bucketScores / count
+		score.Metrics = append(score.Metrics, metric)
+	}
+
+	if len(score.Metrics) == 0 {
+		return score
+	}
+
+	var bucketsInBand int
+	for _, ok := range inBand {
+		if ok {
+			bucketsInBand++
+		}
+	}
+	score.SampleCount = len(inBand)
+	score.Score = round1(scoreSum / float64(len(score.Metrics)))
+	score.TimeInBand = round1(100 * float64(bucketsInBand) / float64(len(inBand)))
+	if expected > 0 {
+		score.Coverage = round1(math.Min(100, 100*float64(len(inBand))/float64(expected)))
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+	for _, candidate := range candidates[:min(len(candidates), maxClimateExcursions)] {
+		excursion := candidate.ClimateExcursion
+		excursion.DurationMinutes = excursion.End.Sub(excursion.Start).Minutes()
+		excursion.PeakDeviation = math.Round(excursion.PeakDeviation*100) / 100
+		score.Excursions = append(score.Excursions, excursion)
+	}
+
+	return score
+}
+
+// HouseClimate combines the floor scores of one day into the house score,
+// weighting each floor by its number of buckets with data
+func HouseClimate(day string, floors []models.ClimateScore) models.HouseClimateScore {
+	house := models.HouseClimateScore{Day: day}
+
+	var samples int
+	for _, floor := range floors {
+		weight := float64(floor.SampleCount)
+		house.Score += floor.Score * weight
+		house.TimeInBand += floor.TimeInBand * weight
+		house.Coverage += floor.Coverage
+		samples += floor.SampleCount
+	}
+	if samples > 0 {
+		house.Score = round1(house.Score / float64(samples))
+		house.TimeInBand = round1(house.TimeInBand / float64(samples))
+	}
+	if len(floors) > 0 {
+		house.Coverage = round1(house.Coverage / float64(len(floors)))
+	}
+	return house
+}
+
+// ClimateScorer scores the climate of every house floor per day against the
+// configured bands and stores the results in climate_scores
+type ClimateScorer struct {
+	db           *database.DB
+	bands        []models.ClimateBand
+	location     *time.Location
+	bucket       time.Duration
+	interval     time.Duration
+	backfillDays int
+
+	// Period of imported readings waiting to be rescored; wake tells the
+	// scoring loop about it
+	importedMu    sync.Mutex
+	importedStart time.Time
+	importedEnd   time.Time
+	wake          chan struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewClimateScorer(db *database.DB, cfg config.ClimateConfig) (*ClimateScorer, error) {
+	bands, err := ParseClimateBands(cfg.Bands)
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid climate timezone: %w", err)
+	}
+	if cfg.Bucket <= 0 {
+		cfg.Bucket = 5 * time.Minute
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Hour
+	}
+
+	return &ClimateScorer{
+		db:           db,
+		bands:        bands,
+		location:     location,
+		bucket:       cfg.Bucket,
+		interval:     cfg.Interval,
+		backfillDays: max(cfg.BackfillDays, climateRescoreDays),
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+// Bands returns the configured optimal bands
+func (s *ClimateScorer) Bands() []models.ClimateBand {
+	return s.bands
+}
+
+// Location returns the timezone days are scored in
+func (s *ClimateScorer) Location() *time.Location {
+	return s.location
+}
+
+// Start scores the backfill days, then rescores the last days every interval
+func (s *ClimateScorer) Start() {
+	if s.stop != nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		s.scoreRecent(s.backfillDays)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.scoreRecent(climateRescoreDays)
+			case <-s.wake:
+				s.scoreImported()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the scoring loop
+func (s *ClimateScorer) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *ClimateScorer) scoreRecent(days int) {
+	now := time.Now().In(s.location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.location)
+	s.scoreDays(today.AddDate(0, 0, -(days-1)), today, now)
+}
+
+// ReadingsImported queues the days of imported readings to be scored again
+// by the scoring loop
+func (s *ClimateScorer) ReadingsImported(start, end time.Time) {
+	s.importedMu.Lock()
+	if s.importedStart.IsZero() || start.Before(s.importedStart) {
+		s.importedStart = start
+	}
+	if end.After(s.importedEnd) {
+		s.importedEnd = end
+	}
+	s.importedMu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ClimateScorer) scoreImported() {
+	s.importedMu.Lock()
+	start, end := s.importedStart, s.importedEnd
+	s.importedStart, s.importedEnd = time.Time{}, time.Time{}
+	s.importedMu.Unlock()
+
+	if start.IsZero() {
+		return
+	}
+	now := time.Now().In(s.location)
+	first, last := climateDays(start, end, s.location)
+	s.scoreDays(first, last, now)
+}
+
+// scoreDays scores the days from first to last, both starting at midnight
+func (s *ClimateScorer) scoreDays(first, last, now time.Time) {
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		if err := s.ScoreDay(day, now); err != nil {
+			log.Printf("Failed to score climate of %s: %v", day.Format(time.DateOnly), err)
+		}
+	}
+}
+
+// climateDays returns the midnights, in the location, of the days holding
+// start and end
+func climateDays(start, end time.Time, location *time.Location) (time.Time, time.Time) {
+	midnight := func(t time.Time) time.Time {
+		t = t.In(location)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	}
+	return midnight(start), midnight(end)
+}
+
+// ScoreDay scores every house floor with readings on the day starting at
+// day, up to now for the current day. Scores of finished days are final.
+func (s *ClimateScorer) ScoreDay(day time.Time, now time.Time) error {
+	start := day
+	end := start.AddDate(0, 0, 1)
+	periodEnd := end
+	if now.Before(periodEnd) {
+		periodEnd = now
+	}
+	if !periodEnd.After(start) {
+		return nil
+	}
+	expected := int(math.Ceil(float64(periodEnd.Sub(start)) / float64(s.bucket)))
+
+	metrics := make([]string, len(s.bands))
+	for i, band := range s.bands {
+		metrics[i] = band.Metric
+	}
+
+	rows, err := s.db.TimescaleDB.Query(`
+		SELECT id_swiflet_house, floor, metric, time_bucket($3::interval, timestamp) AS bucket, AVG(value)
+		FROM sensor_readings
+		WHERE timestamp >= $1 AND timestamp < $2 AND metric = ANY($4)
+			AND id_swiflet_house IS NOT NULL AND floor IS NOT NULL
+		GROUP BY id_swiflet_house, floor, metric, bucket
+		ORDER BY id_swiflet_house, floor
+	`, start, periodEnd, fmt.Sprintf("%d seconds", int64(s.bucket/time.Second)), pq.Array(metrics))
+	if err != nil {
+		return fmt.Errorf("failed to query readings: %w", err)
+	}
+	defer rows.Close()
+
+	type floorKey struct{ house, floor int }
+	var keys []floorKey
+	samples := make(map[floorKey][]climateSample)
+	for rows.Next() {
+		var key floorKey
+		var sample climateSample
+		if err := rows.Scan(&key.house, &key.floor, &sample.Metric, &sample.Bucket, &sample.Value); err != nil {
+			return err
+		}
+		if _, ok := samples[key]; !ok {
+			keys = append(keys, key)
+		}
+		samples[key] = append(samples[key], sample)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	final := !now.Before(end)
+	for _, key := range keys {
+		score := scoreClimate(s.bands, samples[key], s.bucket, expected)
+		score.SwifletHouseID = key.house
+		score.Floor = key.floor
+		score.Day = start.Format(time.DateOnly)
+		score.Final = final
+		for i := range score.Excursions {
+			score.Excursions[i].Floor = key.floor
+		}
+		if err := s.save(score); err != nil {
+			return fmt.Errorf("failed to save score of house %d floor %d: %w", key.house, key.floor, err)
+		}
+	}
+	return nil
+}
+
+// ScorePeriod scores one floor over an arbitrary period from the hourly
+// rollups, which outlive the raw readings, so long and old periods such as a
+// harvest cycle can be scored
+func (s *ClimateScorer) ScorePeriod(houseID, floor int, start, end time.Time) (models.ClimateScore, error) {
+	expected := int(math.Ceil(float64(end.Sub(start)) / float64(time.Hour)))
+
+	metrics := make([]string, len(s.bands))
+	for i, band := range s.bands {
+		metrics[i] = band.Metric
+	}
+
+	// Devices of the floor are combined weighting by their sample counts
+	rows, err := s.db.TimescaleDB.Query(`
+		SELECT timestamp, metric, SUM(avg_value * sample_count) / SUM(sample_count)
+		FROM sensor_readings_hourly
+		WHERE id_swiflet_house = $1 AND floor = $2 AND timestamp >= $3 AND timestamp < $4
+			AND metric = ANY($5) AND avg_value IS NOT NULL
+		GROUP BY timestamp, metric
+		ORDER BY timestamp
+	`, houseID, floor, start, end, pq.Array(metrics))
+	if err != nil {
+		return models.ClimateScore{}, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []climateSample
+	for rows.Next() {
+		var sample climateSample
+		if err := rows.Scan(&sample.Bucket, &sample.Metric, &sample.Value); err != nil {
+			return models.ClimateScore{}, err
+		}
+		samples = append(samples, sample)
+	}
+	if err := rows.Err(); err != nil {
+		return models.ClimateScore{}, err
+	}
+
+	score := scoreClimate(s.bands, samples, time.Hour, expected)
+	score.SwifletHouseID = houseID
+	score.Floor = floor
+	for i := range score.Excursions {
+		score.Excursions[i].Floor = floor
+	}
+	return score, nil
+}
+
+// save upserts a floor score; readings of houses deleted since are skipped
+func (s *ClimateScorer) save(score models.ClimateScore) error {
+	metrics, err := json.Marshal(score.Metrics)
+	if err != nil {
+		return err
+	}
+	excursions, err := json.Marshal(score.Excursions)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PostgreSQL.Exec(`
+		INSERT INTO climate_scores (id_swiflet_house, floor, day, score, time_in_band, coverage, sample_count,
+			metrics, excursions, final, computed_at)
+		SELECT $1, $2, $3::date, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP
+		WHERE EXISTS (SELECT 1 FROM swiflet_houses WHERE id = $1 AND deleted_at IS NULL)
+		ON CONFLICT (id_swiflet_house, floor, day) DO UPDATE SET
+			score = EXCLUDED.score, time_in_band = EXCLUDED.time_in_band, coverage = EXCLUDED.coverage,
+			sample_count = EXCLUDED.sample_count, metrics = EXCLUDED.metrics, excursions = EXCLUDED.excursions,
+			final = EXCLUDED.final, computed_at = EXCLUDED.computed_at
+	`, score.SwifletHouseID, score.Floor, score.Day, score.Score, score.TimeInBand, score.Coverage,
+		score.SampleCount, metrics, excursions, score.Final)
+	return err
+}
+
+// ClimateScoreColumns lists the columns of the climate_scores table in ScanClimateScore order
+const ClimateScoreColumns = `id_swiflet_house, floor, day, score, time_in_band, coverage, sample_count,
+	metrics, excursions, final, computed_at`
+
+// ScanClimateScore scans a row selected with ClimateScoreColumns
+func ScanClimateScore(row interface{ Scan(...interface{}) error }) (models.ClimateScore, error) {
+	var score models.ClimateScore
+	var day time.Time
+	var metrics, excursions []byte
+	err := row.Scan(&score.SwifletHouseID, &score.Floor, &day, &score.Score, &score.TimeInBand, &score.Coverage,
+		&score.SampleCount, &metrics, &excursions, &score.Final, &score.ComputedAt)
+	if err != nil {
+		return score, err
+	}
+	score.Day = day.Format(time.DateOnly)
+	if err := json.Unmarshal(metrics, &score.Metrics); err != nil {
+		return score, err
+	}
+	if err := json.Unmarshal(excursions, &score.Excursions); err != nil {
+		return score, err
+	}
+	return score, nil
+}
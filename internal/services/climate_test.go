@@ -0,0 +1,135 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestParseClimateBands(t *testing.T) {
+	bands, err := ParseClimateBands("suhu:26-29, kelembaban:80-95:5 ,nh3:-1.5-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ClimateBand{
+		{Metric: "suhu", Min: 26, Max: 29, Tolerance: 3},
+		{Metric: "kelembaban", Min: 80, Max: 95, Tolerance: 5},
+		{Metric: "nh3", Min: -1.5, Max: 10, Tolerance: 11.5},
+	}
+	if len(bands) != len(want) {
+		t.Fatalf("got %v, want %v", bands, want)
+	}
+	for i := range want {
+		if bands[i] != want[i] {
+			t.Errorf("band %d = %+v, want %+v", i, bands[i], want[i])
+		}
+	}
+
+	for _, spec := range []string{"", "suhu", "suhu:29-26", "suhu:26", "suhu:26-29,suhu:25-30", "suhu:26-29:0", "suhu:a-b"} {
+		if _, err := ParseClimateBands(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestScoreClimate(t *testing.T) {
+	bands := []models.ClimateBand{
+		{Metric: models.MetricSuhu, Min: 26, Max: 29, Tolerance: 2},
+		{Metric: models.MetricKelembaban, Min: 80, Max: 95, Tolerance: 10},
+	}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	bucket := time.Hour
+	at := func(hour int) time.Time { return start.Add(time.Duration(hour) * bucket) }
+
+	samples := []climateSample{
+		{Bucket: at(0), Metric: models.MetricSuhu, Value: 27},
+		{Bucket: at(1), Metric: models.MetricSuhu, Value: 30},
+		{Bucket: at(2), Metric: models.MetricSuhu, Value: 31},
+		{Bucket: at(3), Metric: models.MetricSuhu, Value: 28},
+		{Bucket: at(0), Metric: models.MetricKelembaban, Value: 85},
+		{Bucket: at(1), Metric: models.MetricKelembaban, Value: 85},
+		{Bucket: at(2), Metric: models.MetricKelembaban, Value: 75},
+		{Bucket: at(3), Metric: models.MetricKelembaban, Value: 85},
+		{Bucket: at(1), Metric: "nh3", Value: 50},
+	}
+
+	score := scoreClimate(bands, samples, bucket, 8)
+
+	// suhu: 1 + 0.5 + 0 + 1 over 4 buckets; kelembaban: 1 + 1 + 0.5 + 1
+	if score.Score != 75 {
+		t.Errorf("score = %v, want 75", score.Score)
+	}
+	if len(score.Metrics) != 2 || score.Metrics[0].Score != 62.5 || score.Metrics[1].Score != 87.5 {
+		t.Errorf("metrics = %+v", score.Metrics)
+	}
+	if score.Metrics[0].TimeInBand != 50 || score.Metrics[0].Avg != 29 || score.Metrics[0].Max != 31 {
+		t.Errorf("suhu = %+v", score.Metrics[0])
+	}
+	// Only hours 0 and 3 have every metric in band
+	if score.TimeInBand != 50 || score.Coverage != 50 || score.SampleCount != 4 {
+		t.Errorf("time in band %v, coverage %v, samples %d", score.TimeInBand, score.Coverage, score.SampleCount)
+	}
+
+	if len(score.Excursions) != 2 {
+		t.Fatalf("excursions = %+v", score.Excursions)
+	}
+	// Deviations are ranked relative to the tolerance: 1.5 hours of the
+	// tolerance outweigh 0.5 hours
+	dry := score.Excursions[1]
+	if dry.Metric != models.MetricKelembaban || dry.Direction != ExcursionBelow || dry.PeakDeviation != 5 {
+		t.Errorf("humidity excursion = %+v", dry)
+	}
+	heat := score.Excursions[0]
+	if heat.Metric != models.MetricSuhu || heat.Direction != ExcursionAbove || !heat.Start.Equal(at(1)) ||
+		!heat.End.Equal(at(3)) || heat.DurationMinutes != 120 || heat.PeakValue != 31 {
+		t.Errorf("heat excursion = %+v", heat)
+	}
+}
+
+func TestScoreClimateNoData(t *testing.T) {
+	bands := []models.ClimateBand{{Metric: models.MetricSuhu, Min: 26, Max: 29, Tolerance: 3}}
+	score := scoreClimate(bands, nil, time.Hour, 24)
+	if score.Score != 0 || score.SampleCount != 0 || len(score.Metrics) != 0 || score.Excursions == nil {
+		t.Errorf("score = %+v", score)
+	}
+}
+
+func TestHouseClimate(t *testing.T) {
+	house := HouseClimate("2024-05-01", []models.ClimateScore{
+		{Floor: 1, Score: 90, TimeInBand: 80, Coverage: 100, SampleCount: 300},
+		{Floor: 2, Score: 60, TimeInBand: 40, Coverage: 50, SampleCount: 100},
+	})
+	if house.Day != "2024-05-01" || house.Score != 82.5 || house.TimeInBand != 70 || house.Coverage != 75 {
+		t.Errorf("house = %+v", house)
+	}
+}
+
+func TestClimateDays(t *testing.T) {
+	jakarta := time.FixedZone("WIB", 7*3600)
+	start := time.Date(2024, 3, 9, 18, 0, 0, 0, time.UTC) // 01:00 on the 10th in Jakarta
+	end := time.Date(2024, 3, 12, 16, 59, 0, 0, time.UTC) // 23:59 on the 12th
+
+	first, last := climateDays(start, end, jakarta)
+	if want := time.Date(2024, 3, 10, 0, 0, 0, 0, jakarta); !first.Equal(want) {
+		t.Errorf("first = %v, want %v", first, want)
+	}
+	if want := time.Date(2024, 3, 12, 0, 0, 0, 0, jakarta); !last.Equal(want) {
+		t.Errorf("last = %v, want %v", last, want)
+	}
+}
+
+func TestReadingsImportedMergesPeriods(t *testing.T) {
+	scorer := &ClimateScorer{wake: make(chan struct{}, 1)}
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	scorer.ReadingsImported(day.AddDate(0, 0, 2), day.AddDate(0, 0, 3))
+	scorer.ReadingsImported(day, day.AddDate(0, 0, 1))
+
+	if !scorer.importedStart.Equal(day) || !scorer.importedEnd.Equal(day.AddDate(0, 0, 3)) {
+		t.Errorf("pending period = %v to %v, want %v to %v", scorer.importedStart, scorer.importedEnd,
+			day, day.AddDate(0, 0, 3))
+	}
+	if len(scorer.wake) != 1 {
+		t.Errorf("scoring loop woken %d times, want 1", len(scorer.wake))
+	}
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+// ControlMessage is published on a device's control topic. Devices answer on
+// the ack topic with the same id.
+type ControlMessage struct {
+	ID      int             `json:"id"`
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// CommandAck is sent by a device after it handled a control message. Status
+// is "ok" on success; anything else marks the command as failed.
+type CommandAck struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CommandStore persists control commands and their acknowledgement status
+type CommandStore struct {
+	db *database.DB
+}
+
+func NewCommandStore(db *database.DB) *CommandStore {
+	return &CommandStore{db: db}
+}
+
+const commandColumns = `id, id_device, install_code, id_user, command, params, status, error,
+	sent_at, acked_at, created_at, updated_at`
+
+func scanCommand(row interface{ Scan(...interface{}) error }) (*models.DeviceCommand, error) {
+	var command models.DeviceCommand
+	var params []byte
+	err := row.Scan(&command.ID, &command.DeviceID, &command.InstallCode, &command.UserID, &command.Command,
+		&params, &command.Status, &command.Error, &command.SentAt, &command.AckedAt,
+		&command.CreatedAt, &command.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	command.Params = params
+	return &command, nil
+}
+
+// Create stores a new pending command
+func (s *CommandStore) Create(device DeviceInfo, userID *int, command string, params json.RawMessage) (*models.DeviceCommand, error) {
+	var storedParams interface{}
+	if len(params) > 0 {
+		storedParams = []byte(params)
+	}
+
+	now := time.Now()
+	return scanCommand(s.db.PostgreSQL.QueryRow(`
+		INSERT INTO device_commands (id_device, install_code, id_user, command, params, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+commandColumns,
+		device.ID, device.InstallCode, userID, command, storedParams, models.CommandPending, now, now))
+}
+
+// Get returns a single command
+func (s *CommandStore) Get(id int) (*models.DeviceCommand, error) {
+	return scanCommand(s.db.PostgreSQL.QueryRow(
+		"SELECT "+commandColumns+" FROM device_commands WHERE id = $1", id))
+}
+
+// MarkSent records that a command was published to the broker
+func (s *CommandStore) MarkSent(id int, sentAt time.Time) error {
+	_, err := s.db.PostgreSQL.Exec(`
+		UPDATE device_commands SET status = $1, sent_at = $2, updated_at = $2
+		WHERE id = $3 AND status = $4
+	`, models.CommandSent, sentAt, id, models.CommandPending)
+	return err
+}
+
+// MarkFailed records that a command could not be delivered or was rejected
+func (s *CommandStore) MarkFailed(id int, reason string) error {
+	_, err := s.db.PostgreSQL.Exec(`
+		UPDATE device_commands SET status = $1, error = $2, updated_at = $3
+		WHERE id = $4
+	`, models.CommandFailed, reason, time.Now(), id)
+	return err
+}
+
+// Acknowledge applies an ack from a device. Acks for commands of another
+// install_code are ignored. Late acks still count, since the command reached
+// the device after all.
+func (s *CommandStore) Acknowledge(installCode string, ack CommandAck, ackedAt time.Time) error {
+	status := models.CommandAcked
+	var ackErr *string
+	if ack.Status != "ok" {
+		status = models.CommandFailed
+		reason := ack.Error
+		if reason == "" {
+			reason = fmt.Sprintf("device reported status %q", ack.Status)
+		}
+		ackErr = &reason
+	}
+
+	result, err := s.db.PostgreSQL.Exec(`
+		UPDATE device_commands SET status = $1, error = $2, acked_at = $3, updated_at = $3
+		WHERE id = $4 AND install_code = $5 AND status IN ($6, $7, $8)
+	`, status, ackErr, ackedAt, ack.ID, installCode,
+		models.CommandPending, models.CommandSent, models.CommandTimedOut)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ExpireUnacked marks commands sent before the cut-off without an ack as timed out
+func (s *CommandStore) ExpireUnacked(before time.Time) (int64, error) {
+	result, err := s.db.PostgreSQL.Exec(`
+		UPDATE device_commands SET status = $1, error = $2, updated_at = $3
+		WHERE status = $4 AND sent_at < $5
+	`, models.CommandTimedOut, "no acknowledgement from device", time.Now(), models.CommandSent, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
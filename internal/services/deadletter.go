@@ -0,0 +1,98 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+// Reasons a sensor message is moved to the dead-letter store
+const (
+	RejectInvalidPayload     = "invalid_payload"
+	RejectUnknownInstallCode = "unknown_install_code"
+	// RejectInstallCodeMismatch is a reading whose install_code differs from the device in its topic
+	RejectInstallCodeMismatch = "install_code_mismatch"
+	RejectUnregisteredMetric  = "unregistered_metric"
+	RejectQueueFull           = "queue_full"
+	RejectInsertFailed        = "insert_failed"
+)
+
+// RejectError describes why ingestion refused a message
+type RejectError struct {
+	Reason string
+	Err    error
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+func reject(reason string, err error) *RejectError {
+	return &RejectError{Reason: reason, Err: err}
+}
+
+// DeadLetterStore keeps rejected sensor messages in PostgreSQL so they can be
+// inspected and replayed later
+type DeadLetterStore struct {
+	db *database.DB
+}
+
+func NewDeadLetterStore(db *database.DB) *DeadLetterStore {
+	return &DeadLetterStore{db: db}
+}
+
+// Record stores a rejected message. Failures are only logged since the
+// message has already been rejected by the caller.
+func (s *DeadLetterStore) Record(topic string, payload []byte, rejectErr *RejectError, receivedAt time.Time) {
+	_, err := s.db.PostgreSQL.Exec(`
+		INSERT INTO mqtt_dead_letters (topic, payload, reason, error, received_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, topic, payload, rejectErr.Reason, rejectErr.Err.Error(), receivedAt, time.Now())
+
+	if err != nil {
+		log.Printf("Failed to store dead letter from topic %s (%s): %v", topic, rejectErr.Reason, err)
+	}
+}
+
+// Get returns a single dead letter
+func (s *DeadLetterStore) Get(id int) (*models.DeadLetter, error) {
+	var letter models.DeadLetter
+	err := s.db.PostgreSQL.QueryRow(`
+		SELECT id, topic, payload, reason, error, replay_count, received_at, created_at
+		FROM mqtt_dead_letters WHERE id = $1
+	`, id).Scan(&letter.ID, &letter.Topic, &letter.Payload, &letter.Reason, &letter.Error,
+		&letter.ReplayCount, &letter.ReceivedAt, &letter.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// MarkReplayFailed stores the latest rejection of a replayed dead letter
+func (s *DeadLetterStore) MarkReplayFailed(id int, rejectErr *RejectError) error {
+	_, err := s.db.PostgreSQL.Exec(`
+		UPDATE mqtt_dead_letters
+		SET reason = $1, error = $2, replay_count = replay_count + 1
+		WHERE id = $3
+	`, rejectErr.Reason, rejectErr.Err.Error(), id)
+	return err
+}
+
+// Delete removes a dead letter once it was replayed successfully
+func (s *DeadLetterStore) Delete(id int) error {
+	result, err := s.db.PostgreSQL.Exec("DELETE FROM mqtt_dead_letters WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
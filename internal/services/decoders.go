@@ -0,0 +1,420 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Decoder names, used in MQTT_DECODER_ROUTES and in the content_type payload field
+const (
+	DecoderJSON      = "json"
+	DecoderJSONBatch = "json-batch"
+	DecoderCBOR      = "cbor"
+)
+
+// DecodedReading is a single reading extracted from a sensor payload
+type DecodedReading struct {
+	InstallCode string
+	// Values holds every metric of the reading keyed by metric type, e.g. suhu, kelembaban, nh3
+	Values map[string]float64
+	// Timestamp is zero when the device did not send one
+	Timestamp time.Time
+	// Seq is the optional device message sequence number
+	Seq *uint64
+}
+
+// PayloadDecoder turns a raw MQTT payload into sensor readings
+type PayloadDecoder interface {
+	Name() string
+	Decode(payload []byte) ([]DecodedReading, error)
+}
+
+// SensorTimestamp accepts either an RFC3339 string or epoch milliseconds
+type SensorTimestamp struct {
+	time.Time
+}
+
+func (t *SensorTimestamp) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		return t.parseString(value)
+	}
+
+	var millis float64
+	if err := json.Unmarshal(data, &millis); err != nil {
+		return fmt.Errorf("timestamp must be RFC3339 or epoch milliseconds: %w", err)
+	}
+	return t.setMillis(millis)
+}
+
+func (t *SensorTimestamp) UnmarshalCBOR(data []byte) error {
+	var value interface{}
+	if err := cbor.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return t.parseString(v)
+	case uint64:
+		return t.setMillis(float64(v))
+	case int64:
+		return t.setMillis(float64(v))
+	case float64:
+		return t.setMillis(v)
+	case time.Time:
+		t.Time = v
+		return nil
+	default:
+		return fmt.Errorf("unsupported timestamp type %T", value)
+	}
+}
+
+// parseString ignores unparseable strings so the receive time is used
+// instead, as older firmware sometimes sends local, zone-less timestamps
+func (t *SensorTimestamp) parseString(value string) error {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		t.Time = parsed
+	}
+	return nil
+}
+
+func (t *SensorTimestamp) setMillis(millis float64) error {
+	if millis <= 0 || math.IsInf(millis, 0) || math.IsNaN(millis) {
+		return fmt.Errorf("invalid epoch milliseconds %v", millis)
+	}
+	t.Time = time.UnixMilli(int64(millis)).UTC()
+	return nil
+}
+
+// SensorData represents a single incoming sensor reading. Channels other than
+// temperature and humidity are sent in metrics, keyed by metric type.
+type SensorData struct {
+	InstallCode string             `json:"install_code" cbor:"install_code"`
+	Suhu        *float64           `json:"suhu" cbor:"suhu"`
+	Kelembaban  *float64           `json:"kelembaban" cbor:"kelembaban"`
+	Metrics     map[string]float64 `json:"metrics,omitempty" cbor:"metrics,omitempty"`
+	Timestamp   SensorTimestamp    `json:"timestamp,omitempty" cbor:"timestamp,omitempty"`
+	Seq         *uint64            `json:"seq,omitempty" cbor:"seq,omitempty"`
+}
+
+// SensorBatch is the envelope sent by gateways that buffer readings. Readings
+// without their own install_code inherit the envelope's.
+type SensorBatch struct {
+	InstallCode string       `json:"install_code" cbor:"install_code"`
+	Readings    []SensorData `json:"readings" cbor:"readings"`
+}
+
+func (d SensorData) toReading(defaultInstallCode string) (DecodedReading, error) {
+	installCode := d.InstallCode
+	if installCode == "" {
+		installCode = defaultInstallCode
+	}
+	if installCode == "" {
+		return DecodedReading{}, errors.New("install_code is required")
+	}
+
+	values := make(map[string]float64, len(d.Metrics)+2)
+	for metric, value := range d.Metrics {
+		values[metric] = value
+	}
+	if d.Suhu != nil {
+		values[models.MetricSuhu] = *d.Suhu
+	}
+	if d.Kelembaban != nil {
+		values[models.MetricKelembaban] = *d.Kelembaban
+	}
+	if len(values) == 0 {
+		return DecodedReading{}, errors.New("reading has no values")
+	}
+
+	return DecodedReading{
+		InstallCode: installCode,
+		Values:      values,
+		Timestamp:   d.Timestamp.Time,
+		Seq:         d.Seq,
+	}, nil
+}
+
+func batchToReadings(installCode string, data []SensorData) ([]DecodedReading, error) {
+	if len(data) == 0 {
+		return nil, errors.New("batch contains no readings")
+	}
+
+	readings := make([]DecodedReading, 0, len(data))
+	for n, item := range data {
+		reading, err := item.toReading(installCode)
+		if err != nil {
+			return nil, fmt.Errorf("reading %d: %w", n, err)
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// JSONSingleDecoder decodes the original flat JSON object
+type JSONSingleDecoder struct{}
+
+func (JSONSingleDecoder) Name() string {
+	return DecoderJSON
+}
+
+func (JSONSingleDecoder) Decode(payload []byte) ([]DecodedReading, error) {
+	var data SensorData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+
+	reading, err := data.toReading("")
+	if err != nil {
+		return nil, err
+	}
+	return []DecodedReading{reading}, nil
+}
+
+// JSONBatchDecoder decodes either a JSON array of readings or a SensorBatch envelope
+type JSONBatchDecoder struct{}
+
+func (JSONBatchDecoder) Name() string {
+	return DecoderJSONBatch
+}
+
+func (JSONBatchDecoder) Decode(payload []byte) ([]DecodedReading, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var data []SensorData
+		if err := json.Unmarshal(trimmed, &data); err != nil {
+			return nil, err
+		}
+		return batchToReadings("", data)
+	}
+
+	var batch SensorBatch
+	if err := json.Unmarshal(trimmed, &batch); err != nil {
+		return nil, err
+	}
+	return batchToReadings(batch.InstallCode, batch.Readings)
+}
+
+// CBORDecoder decodes CBOR payloads holding a single reading, an array of
+// readings or a SensorBatch envelope
+type CBORDecoder struct{}
+
+func (CBORDecoder) Name() string {
+	return DecoderCBOR
+}
+
+func (CBORDecoder) Decode(payload []byte) ([]DecodedReading, error) {
+	var raw interface{}
+	if err := cbor.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+
+	switch value := raw.(type) {
+	case []interface{}:
+		var data []SensorData
+		if err := cbor.Unmarshal(payload, &data); err != nil {
+			return nil, err
+		}
+		return batchToReadings("", data)
+	case map[interface{}]interface{}:
+		if _, ok := value["readings"]; ok {
+			var batch SensorBatch
+			if err := cbor.Unmarshal(payload, &batch); err != nil {
+				return nil, err
+			}
+			return batchToReadings(batch.InstallCode, batch.Readings)
+		}
+
+		var data SensorData
+		if err := cbor.Unmarshal(payload, &data); err != nil {
+			return nil, err
+		}
+		reading, err := data.toReading("")
+		if err != nil {
+			return nil, err
+		}
+		return []DecodedReading{reading}, nil
+	default:
+		return nil, fmt.Errorf("unexpected CBOR payload type %T", raw)
+	}
+}
+
+type decoderRoute struct {
+	pattern string
+	decoder PayloadDecoder
+}
+
+// DecoderRegistry picks the decoder for a message. A content_type field in a
+// JSON object payload wins, then the first topic pattern that matches, and
+// finally the flat JSON decoder.
+type DecoderRegistry struct {
+	decoders map[string]PayloadDecoder
+	routes   []decoderRoute
+	fallback PayloadDecoder
+}
+
+func NewDecoderRegistry() *DecoderRegistry {
+	registry := &DecoderRegistry{
+		decoders: make(map[string]PayloadDecoder),
+		fallback: JSONSingleDecoder{},
+	}
+	registry.Register(JSONSingleDecoder{})
+	registry.Register(JSONBatchDecoder{})
+	registry.Register(CBORDecoder{})
+	return registry
+}
+
+// Register makes a decoder available by name
+func (r *DecoderRegistry) Register(decoder PayloadDecoder) {
+	r.decoders[decoder.Name()] = decoder
+}
+
+// AddRoute selects the named decoder for topics matching an MQTT topic filter
+func (r *DecoderRegistry) AddRoute(pattern, name string) error {
+	decoder, ok := r.decoders[name]
+	if !ok {
+		return fmt.Errorf("unknown payload decoder %q", name)
+	}
+	r.routes = append(r.routes, decoderRoute{pattern: pattern, decoder: decoder})
+	return nil
+}
+
+// ParseRoutes adds routes from a "pattern=decoder;pattern=decoder" list
+func (r *DecoderRegistry) ParseRoutes(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid decoder route %q, expected pattern=decoder", entry)
+		}
+		if err := r.AddRoute(strings.TrimSpace(pattern), strings.TrimSpace(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Patterns returns the topic filters that have a decoder route
+func (r *DecoderRegistry) Patterns() []string {
+	patterns := make([]string, 0, len(r.routes))
+	for _, route := range r.routes {
+		patterns = append(patterns, route.pattern)
+	}
+	return patterns
+}
+
+// Select returns the decoder for a message
+func (r *DecoderRegistry) Select(topic string, payload []byte) (PayloadDecoder, error) {
+	if contentType := payloadContentType(payload); contentType != "" {
+		decoder, ok := r.decoders[normalizeContentType(contentType)]
+		if !ok {
+			return nil, fmt.Errorf("unknown content_type %q", contentType)
+		}
+		return decoder, nil
+	}
+
+	for _, route := range r.routes {
+		if TopicMatches(route.pattern, topic) {
+			return route.decoder, nil
+		}
+	}
+
+	return r.fallback, nil
+}
+
+// Decode selects a decoder and decodes the payload
+func (r *DecoderRegistry) Decode(topic string, payload []byte) ([]DecodedReading, error) {
+	decoder, err := r.Select(topic, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	readings, err := decoder.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s decoder: %w", decoder.Name(), err)
+	}
+	return readings, nil
+}
+
+// payloadContentType reads the optional content_type field of a JSON object payload
+func payloadContentType(payload []byte) string {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return ""
+	}
+
+	var envelope struct {
+		ContentType string `json:"content_type"`
+	}
+	if err := json.Unmarshal(trimmed, &envelope); err != nil {
+		return ""
+	}
+	return envelope.ContentType
+}
+
+func normalizeContentType(contentType string) string {
+	switch strings.ToLower(strings.TrimSpace(contentType)) {
+	case "application/json", DecoderJSON:
+		return DecoderJSON
+	case "application/json+batch", DecoderJSONBatch:
+		return DecoderJSONBatch
+	case "application/cbor", DecoderCBOR:
+		return DecoderCBOR
+	default:
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+}
+
+// TopicMatches reports whether an MQTT topic matches a topic filter with + and # wildcards
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for n, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if n >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[n] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// TopicWildcardValue returns the topic level matched by the first + wildcard
+// of a topic filter, e.g. the install_code in devices/+/heartbeat
+func TopicWildcardValue(filter, topic string) string {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for n, level := range filterLevels {
+		if level == "+" && n < len(topicLevels) {
+			return topicLevels[n]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,439 @@
+package services
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func mustCBOR(t *testing.T, value interface{}) []byte {
+	t.Helper()
+	data, err := cbor.Marshal(value)
+	if err != nil {
+		t.Fatalf("failed to encode CBOR: %v", err)
+	}
+	return data
+}
+
+func climate(suhu, kelembaban float64) map[string]float64 {
+	return map[string]float64{"suhu": suhu, "kelembaban": kelembaban}
+}
+
+func assertReadings(t *testing.T, got, want []DecodedReading) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d readings, want %d: %+v", len(got), len(want), got)
+	}
+	for n := range want {
+		if got[n].InstallCode != want[n].InstallCode ||
+			!maps.Equal(got[n].Values, want[n].Values) ||
+			!got[n].Timestamp.Equal(want[n].Timestamp) ||
+			(got[n].Seq == nil) != (want[n].Seq == nil) ||
+			(got[n].Seq != nil && *got[n].Seq != *want[n].Seq) {
+			t.Errorf("reading %d = %+v, want %+v", n, got[n], want[n])
+		}
+	}
+}
+
+func TestJSONSingleDecoder(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	seq := uint64(42)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    []DecodedReading
+		wantErr bool
+	}{
+		{
+			name:    "RFC3339 timestamp",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"timestamp":"2024-05-01T10:30:00Z"}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.2), Timestamp: ts}},
+		},
+		{
+			name:    "epoch milliseconds timestamp",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"timestamp":1714559400000}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.2), Timestamp: ts}},
+		},
+		{
+			name:    "missing timestamp",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.2)}},
+		},
+		{
+			name:    "unparseable timestamp string is ignored",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"timestamp":"01/05/2024 10:30"}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.2)}},
+		},
+		{
+			name:    "negative epoch timestamp",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"timestamp":-1}`,
+			wantErr: true,
+		},
+		{
+			name:    "additional metrics",
+			payload: `{"install_code":"GW-01","suhu":27.5,"metrics":{"nh3":12.5,"co2":640}}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: map[string]float64{"suhu": 27.5, "nh3": 12.5, "co2": 640}}},
+		},
+		{
+			name:    "metrics only",
+			payload: `{"install_code":"GW-01","metrics":{"light":320}}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: map[string]float64{"light": 320}}},
+		},
+		{
+			name:    "sequence number",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"seq":42}`,
+			want:    []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.2), Seq: &seq}},
+		},
+		{
+			name:    "negative sequence number",
+			payload: `{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"seq":-1}`,
+			wantErr: true,
+		},
+		{
+			name:    "no values",
+			payload: `{"install_code":"GW-01"}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing install_code",
+			payload: `{"suhu":27.5,"kelembaban":85.2}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed JSON",
+			payload: `{"install_code":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JSONSingleDecoder{}.Decode([]byte(tt.payload))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertReadings(t, got, tt.want)
+		})
+	}
+}
+
+func TestJSONBatchDecoder(t *testing.T) {
+	ts1 := time.UnixMilli(1714559400000).UTC()
+	ts2 := time.UnixMilli(1714559460000).UTC()
+
+	tests := []struct {
+		name    string
+		payload string
+		want    []DecodedReading
+		wantErr bool
+	}{
+		{
+			name: "array of readings",
+			payload: `[
+				{"install_code":"GW-01","suhu":27.5,"kelembaban":85.2,"timestamp":1714559400000},
+				{"install_code":"GW-02","suhu":28.1,"kelembaban":83.0,"timestamp":1714559460000}
+			]`,
+			want: []DecodedReading{
+				{InstallCode: "GW-01", Values: climate(27.5, 85.2), Timestamp: ts1},
+				{InstallCode: "GW-02", Values: climate(28.1, 83.0), Timestamp: ts2},
+			},
+		},
+		{
+			name: "envelope inherits install_code",
+			payload: `{"install_code":"GW-01","readings":[
+				{"suhu":27.5,"kelembaban":85.2,"timestamp":1714559400000},
+				{"suhu":28.1,"kelembaban":83.0,"timestamp":1714559460000}
+			]}`,
+			want: []DecodedReading{
+				{InstallCode: "GW-01", Values: climate(27.5, 85.2), Timestamp: ts1},
+				{InstallCode: "GW-01", Values: climate(28.1, 83.0), Timestamp: ts2},
+			},
+		},
+		{
+			name:    "reading overrides envelope install_code",
+			payload: `{"install_code":"GW-01","readings":[{"install_code":"GW-09","suhu":27.5,"kelembaban":85.2}]}`,
+			want:    []DecodedReading{{InstallCode: "GW-09", Values: climate(27.5, 85.2)}},
+		},
+		{
+			name:    "empty batch",
+			payload: `[]`,
+			wantErr: true,
+		},
+		{
+			name:    "reading without install_code",
+			payload: `[{"suhu":27.5,"kelembaban":85.2}]`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed JSON",
+			payload: `[{"install_code":"GW-01"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JSONBatchDecoder{}.Decode([]byte(tt.payload))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertReadings(t, got, tt.want)
+		})
+	}
+}
+
+func TestCBORDecoder(t *testing.T) {
+	ts := time.UnixMilli(1714559400000).UTC()
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []DecodedReading
+		wantErr bool
+	}{
+		{
+			name: "single reading with epoch milliseconds",
+			payload: mustCBOR(t, map[string]interface{}{
+				"install_code": "GW-01", "suhu": 27.5, "kelembaban": 85.25, "timestamp": uint64(1714559400000),
+			}),
+			want: []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.25), Timestamp: ts}},
+		},
+		{
+			name: "single reading with RFC3339 string",
+			payload: mustCBOR(t, map[string]interface{}{
+				"install_code": "GW-01", "suhu": 27.5, "kelembaban": 85.25, "timestamp": "2024-05-01T10:30:00Z",
+			}),
+			want: []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.25), Timestamp: ts}},
+		},
+		{
+			name: "array of readings",
+			payload: mustCBOR(t, []map[string]interface{}{
+				{"install_code": "GW-01", "suhu": 27.5, "kelembaban": 85.25},
+				{"install_code": "GW-02", "suhu": 26, "kelembaban": 90},
+			}),
+			want: []DecodedReading{
+				{InstallCode: "GW-01", Values: climate(27.5, 85.25)},
+				{InstallCode: "GW-02", Values: climate(26, 90)},
+			},
+		},
+		{
+			name: "envelope inherits install_code",
+			payload: mustCBOR(t, map[string]interface{}{
+				"install_code": "GW-01",
+				"readings": []map[string]interface{}{
+					{"suhu": 27.5, "kelembaban": 85.25, "timestamp": uint64(1714559400000)},
+				},
+			}),
+			want: []DecodedReading{{InstallCode: "GW-01", Values: climate(27.5, 85.25), Timestamp: ts}},
+		},
+		{
+			name: "additional metrics",
+			payload: mustCBOR(t, map[string]interface{}{
+				"install_code": "GW-01", "kelembaban": 88.0,
+				"metrics": map[string]float64{"sound_player": 1},
+			}),
+			want: []DecodedReading{{InstallCode: "GW-01", Values: map[string]float64{"kelembaban": 88, "sound_player": 1}}},
+		},
+		{
+			name:    "scalar payload",
+			payload: mustCBOR(t, 42),
+			wantErr: true,
+		},
+		{
+			name:    "truncated payload",
+			payload: []byte{0xa3, 0x6c},
+			wantErr: true,
+		},
+		{
+			name:    "missing install_code",
+			payload: mustCBOR(t, map[string]interface{}{"suhu": 27.5, "kelembaban": 85.25}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CBORDecoder{}.Decode(tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertReadings(t, got, tt.want)
+		})
+	}
+}
+
+func TestDecoderRegistrySelect(t *testing.T) {
+	registry := NewDecoderRegistry()
+	if err := registry.ParseRoutes("sensors/+/batch=json-batch; sensors/+/cbor=cbor"); err != nil {
+		t.Fatalf("failed to parse routes: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "default topic uses flat JSON",
+			topic:   "sensors/GW-01/data",
+			payload: []byte(`{"install_code":"GW-01"}`),
+			want:    DecoderJSON,
+		},
+		{
+			name:    "batch topic route",
+			topic:   "sensors/GW-01/batch",
+			payload: []byte(`[]`),
+			want:    DecoderJSONBatch,
+		},
+		{
+			name:    "cbor topic route",
+			topic:   "sensors/GW-01/cbor",
+			payload: mustCBOR(t, map[string]interface{}{"install_code": "GW-01"}),
+			want:    DecoderCBOR,
+		},
+		{
+			name:    "content_type overrides topic route",
+			topic:   "sensors/GW-01/data",
+			payload: []byte(`{"content_type":"json-batch","install_code":"GW-01","readings":[]}`),
+			want:    DecoderJSONBatch,
+		},
+		{
+			name:    "MIME content_type",
+			topic:   "sensors/GW-01/data",
+			payload: []byte(`{"content_type":"application/json","install_code":"GW-01"}`),
+			want:    DecoderJSON,
+		},
+		{
+			name:    "unknown content_type",
+			topic:   "sensors/GW-01/data",
+			payload: []byte(`{"content_type":"protobuf"}`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder, err := registry.Select(tt.topic, tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got decoder %s", decoder.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decoder.Name() != tt.want {
+				t.Errorf("got decoder %s, want %s", decoder.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecoderRegistryParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", spec: "", want: []string{}},
+		{name: "single route", spec: "sensors/+/batch=json-batch", want: []string{"sensors/+/batch"}},
+		{name: "trailing separator", spec: "a/#=cbor;", want: []string{"a/#"}},
+		{name: "missing decoder", spec: "sensors/+/batch", wantErr: true},
+		{name: "unknown decoder", spec: "sensors/+/batch=xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewDecoderRegistry()
+			err := registry.ParseRoutes(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := registry.Patterns()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got patterns %v, want %v", got, tt.want)
+			}
+			for n := range tt.want {
+				if got[n] != tt.want[n] {
+					t.Errorf("got patterns %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/+/data", "sensors/GW-01/data", true},
+		{"sensors/+/data", "sensors/GW-01/batch", false},
+		{"sensors/+/data", "sensors/GW-01/data/extra", false},
+		{"sensors/#", "sensors/GW-01/data", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/+", "sensors", false},
+		{"control/GW-01/command", "control/GW-01/command", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := TopicMatches(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("TopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicWildcardValue(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   string
+	}{
+		{"devices/+/heartbeat", "devices/GW-01/heartbeat", "GW-01"},
+		{"devices/+/heartbeat", "devices", ""},
+		{"devices/heartbeat", "devices/heartbeat", ""},
+		{"+/heartbeat", "GW-02/heartbeat", "GW-02"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := TopicWildcardValue(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("TopicWildcardValue(%q, %q) = %q, want %q", tt.filter, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupCache remembers recently accepted readings so messages redelivered by
+// the broker or resent by a gateway are dropped before they reach the queue.
+// The storage layer backs it up with unique indexes on install_code and
+// timestamp, which also cover duplicates arriving after an entry expired or a
+// restart. Those indexes do not include seq, so readings of one device with
+// the same timestamp are only stored once even when their seq differs.
+type DedupCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+
+	dropped atomic.Uint64
+}
+
+func NewDedupCache(window time.Duration) *DedupCache {
+	return &DedupCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// dedupKey identifies a reading by its device timestamp and optional
+// sequence number. Readings without a device timestamp can only be matched by
+// sequence number, since the receive time differs between redeliveries; ok is
+// false when a reading has neither.
+func dedupKey(installCode string, deviceTimestamp time.Time, seq *uint64) (key string, ok bool) {
+	switch {
+	case !deviceTimestamp.IsZero() && seq != nil:
+		return fmt.Sprintf("%s\x00%d\x00%d", installCode, deviceTimestamp.UnixNano(), *seq), true
+	case !deviceTimestamp.IsZero():
+		return fmt.Sprintf("%s\x00%d", installCode, deviceTimestamp.UnixNano()), true
+	case seq != nil:
+		return fmt.Sprintf("%s\x00seq\x00%d", installCode, *seq), true
+	default:
+		return "", false
+	}
+}
+
+// Seen reports whether the key was recorded within the window, counting the
+// reading as dropped when it was. It does not record the key, so a reading
+// that is rejected later on can still be delivered again.
+func (d *DedupCache) Seen(key string, now time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seenAt, ok := d.seen[key]; ok && now.Sub(seenAt) < d.window {
+		d.dropped.Add(1)
+		return true
+	}
+	return false
+}
+
+// Record remembers the key of a reading that was queued
+func (d *DedupCache) Record(key string, now time.Time) {
+	if d.window <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) >= d.window {
+		for k, seenAt := range d.seen {
+			if now.Sub(seenAt) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastPrune = now
+	}
+	d.seen[key] = now
+}
+
+// Dropped returns how many readings were recognised as duplicates
+func (d *DedupCache) Dropped() uint64 {
+	return d.dropped.Load()
+}
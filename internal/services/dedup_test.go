@@ -0,0 +1,68 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	seq := uint64(7)
+	otherSeq := uint64(8)
+
+	if _, ok := dedupKey("GW-01", time.Time{}, nil); ok {
+		t.Error("reading without timestamp and seq must not have a key")
+	}
+
+	withTimestamp, _ := dedupKey("GW-01", ts, nil)
+	withSeq, _ := dedupKey("GW-01", time.Time{}, &seq)
+	withBoth, _ := dedupKey("GW-01", ts, &seq)
+	withOtherSeq, _ := dedupKey("GW-01", ts, &otherSeq)
+	otherDevice, _ := dedupKey("GW-02", ts, nil)
+
+	keys := []string{withTimestamp, withSeq, withBoth, withOtherSeq, otherDevice}
+	for n := range keys {
+		for m := n + 1; m < len(keys); m++ {
+			if keys[n] == keys[m] {
+				t.Errorf("keys %d and %d are equal: %q", n, m, keys[n])
+			}
+		}
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	cache := NewDedupCache(time.Minute)
+	now := time.Now()
+
+	if cache.Seen("a", now) {
+		t.Fatal("first delivery reported as duplicate")
+	}
+	// A reading that was not queued, e.g. because the queue was full, may
+	// be delivered again
+	if cache.Seen("a", now.Add(5*time.Second)) {
+		t.Fatal("unrecorded key reported as duplicate")
+	}
+	cache.Record("a", now.Add(5*time.Second))
+	if !cache.Seen("a", now.Add(10*time.Second)) {
+		t.Fatal("redelivery not reported as duplicate")
+	}
+	if cache.Seen("b", now.Add(10*time.Second)) {
+		t.Fatal("other key reported as duplicate")
+	}
+	if cache.Seen("a", now.Add(2*time.Minute)) {
+		t.Fatal("key should expire after the window")
+	}
+	if got := cache.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+}
+
+func TestDedupCacheDisabled(t *testing.T) {
+	cache := NewDedupCache(0)
+	now := time.Now()
+
+	cache.Record("a", now)
+	if cache.Seen("a", now) {
+		t.Fatal("disabled cache reported a duplicate")
+	}
+}
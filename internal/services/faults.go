@@ -0,0 +1,423 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+// faultGapLookback bounds how far back the last reading of a device is
+// searched; devices silent for longer keep their open gap fault but do not
+// get a new one
+const faultGapLookback = 30 * 24 * time.Hour
+
+// ParseDriftThresholds parses a "metric:threshold" list separated by commas
+func ParseDriftThresholds(spec string) (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		metric, value, ok := strings.Cut(entry, ":")
+		metric = strings.TrimSpace(metric)
+		if !ok || metric == "" {
+			return nil, fmt.Errorf("invalid drift threshold %q, expected metric:threshold", entry)
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid drift threshold %q, threshold must be positive", entry)
+		}
+		thresholds[metric] = threshold
+	}
+	return thresholds, nil
+}
+
+// faultKey identifies a fault of a device: one per kind and metric
+type faultKey struct {
+	deviceID int
+	kind     string
+	metric   string
+}
+
+type detectedFault struct {
+	value  *float64
+	detail string
+}
+
+// metricWindowStats summarizes the readings of a device's metric in the window
+type metricWindowStats struct {
+	count         int
+	min, max, avg float64
+}
+
+// faultCheck is the outcome of one detection run. Faults neither detected
+// nor cleared could not be judged, e.g. for lack of readings, and keep their
+// state.
+type faultCheck struct {
+	detected map[faultKey]detectedFault
+	cleared  map[faultKey]bool
+}
+
+// FaultDetector periodically looks for stuck, drifting and silent sensors in
+// TimescaleDB, records them in device_faults and flags the devices as needing
+// maintenance while faults are open. Faults resolve once their condition is
+// gone, or by hand.
+type FaultDetector struct {
+	db              *database.DB
+	registry        *DeviceRegistry
+	config          config.FaultConfig
+	driftThresholds map[string]float64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewFaultDetector(db *database.DB, registry *DeviceRegistry, cfg config.FaultConfig) (*FaultDetector, error) {
+	thresholds, err := ParseDriftThresholds(cfg.DriftThresholds)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 15 * time.Minute
+	}
+	if cfg.MinSamples < 2 {
+		cfg.MinSamples = 2
+	}
+
+	return &FaultDetector{
+		db:              db,
+		registry:        registry,
+		config:          cfg,
+		driftThresholds: thresholds,
+	}, nil
+}
+
+// Start runs a detection right away and then every check interval
+func (d *FaultDetector) Start() {
+	if d.stop != nil {
+		return
+	}
+
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.config.CheckInterval)
+		defer ticker.Stop()
+
+		now := time.Now()
+		for {
+			if err := d.Run(now); err != nil {
+				log.Printf("Sensor fault detection failed: %v", err)
+			}
+			select {
+			case now = <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the detection loop
+func (d *FaultDetector) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+}
+
+// Run checks every registered device once
+func (d *FaultDetector) Run(now time.Time) error {
+	stats, err := d.loadStats(now)
+	if err != nil {
+		return err
+	}
+	lastReadings, err := d.loadLastReadings(now)
+	if err != nil {
+		return err
+	}
+
+	check := d.detect(d.registry.Devices(), stats, lastReadings, now)
+	return d.apply(check, now)
+}
+
+// loadStats summarizes the readings of the window per device and metric. Only
+// readings taken where a device is installed now count, so a device that was
+// just moved is not compared with its new siblings on old readings.
+func (d *FaultDetector) loadStats(now time.Time) (map[string]map[string]metricWindowStats, error) {
+	rows, err := d.db.TimescaleDB.Query(`
+		SELECT install_code, id_swiflet_house, floor, metric, COUNT(*), MIN(value), MAX(value), AVG(value)
+		FROM sensor_readings
+		WHERE timestamp > $1 AND timestamp <= $2
+		GROUP BY install_code, id_swiflet_house, floor, metric
+	`, now.Add(-d.config.Window), now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reading statistics: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[string]map[string]metricWindowStats)
+	for rows.Next() {
+		var installCode, metric string
+		var houseID, floor sql.NullInt64
+		var s metricWindowStats
+		if err := rows.Scan(&installCode, &houseID, &floor, &metric, &s.count, &s.min, &s.max, &s.avg); err != nil {
+			return nil, err
+		}
+		device, ok := d.registry.Lookup(installCode)
+		if !ok || (houseID.Valid && (int(houseID.Int64) != device.SwifletHouseID || int(floor.Int64) != device.Floor)) {
+			continue
+		}
+		if stats[installCode] == nil {
+			stats[installCode] = make(map[string]metricWindowStats)
+		}
+		stats[installCode][metric] = s
+	}
+	return stats, rows.Err()
+}
+
+func (d *FaultDetector) loadLastReadings(now time.Time) (map[string]time.Time, error) {
+	rows, err := d.db.TimescaleDB.Query(`
+		SELECT install_code, MAX(timestamp)
+		FROM sensor_readings
+		WHERE timestamp > $1 AND timestamp <= $2
+		GROUP BY install_code
+	`, now.Add(-faultGapLookback), now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load last readings: %w", err)
+	}
+	defer rows.Close()
+
+	lastReadings := make(map[string]time.Time)
+	for rows.Next() {
+		var installCode string
+		var timestamp time.Time
+		if err := rows.Scan(&installCode, &timestamp); err != nil {
+			return nil, err
+		}
+		lastReadings[installCode] = timestamp
+	}
+	return lastReadings, rows.Err()
+}
+
+// detect judges every device against the fault conditions:
+//   - flat_line: a metric's values in the window spread by at most FlatLineRange
+//   - drift: a metric's mean is further than its threshold from the median
+//     mean of at least two other devices on the same floor
+//   - gap: no readings for longer than GapAfter
+func (d *FaultDetector) detect(devices []DeviceInfo, stats map[string]map[string]metricWindowStats,
+	lastReadings map[string]time.Time, now time.Time) faultCheck {
+	check := faultCheck{
+		detected: make(map[faultKey]detectedFault),
+		cleared:  make(map[faultKey]bool),
+	}
+
+	flat := make(map[string]map[string]bool)
+	for _, device := range devices {
+		for metric, s := range stats[device.InstallCode] {
+			if s.count < d.config.MinSamples {
+				continue
+			}
+			key := faultKey{deviceID: device.ID, kind: models.FaultFlatLine, metric: metric}
+			if s.max-s.min <= d.config.FlatLineRange {
+				value := s.avg
+				check.detected[key] = detectedFault{
+					value: &value,
+					detail: fmt.Sprintf("%s stayed at %g in %d readings over the last %g hours",
+						metric, s.avg, s.count, d.config.Window.Hours()),
+				}
+				if flat[device.InstallCode] == nil {
+					flat[device.InstallCode] = make(map[string]bool)
+				}
+				flat[device.InstallCode][metric] = true
+			} else {
+				check.cleared[key] = true
+			}
+		}
+
+		key := faultKey{deviceID: device.ID, kind: models.FaultGap}
+		if last, ok := lastReadings[device.InstallCode]; ok {
+			if silent := now.Sub(last); silent > d.config.GapAfter {
+				hours := math.Round(silent.Hours()*10) / 10
+				check.detected[key] = detectedFault{
+					value:  &hours,
+					detail: fmt.Sprintf("no readings since %s", last.UTC().Format(time.RFC3339)),
+				}
+			} else {
+				check.cleared[key] = true
+			}
+		}
+	}
+
+	// Compare each device with its siblings on the same floor; stuck sensors
+	// are left out of the reference
+	type floorKey struct{ house, floor int }
+	floors := make(map[floorKey][]DeviceInfo)
+	for _, device := range devices {
+		key := floorKey{device.SwifletHouseID, device.Floor}
+		floors[key] = append(floors[key], device)
+	}
+
+	for _, siblings := range floors {
+		for metric, threshold := range d.driftThresholds {
+			for _, device := range siblings {
+				own, ok := stats[device.InstallCode][metric]
+				if !ok || own.count < d.config.MinSamples || flat[device.InstallCode][metric] {
+					continue
+				}
+
+				var means []float64
+				for _, sibling := range siblings {
+					s, ok := stats[sibling.InstallCode][metric]
+					if sibling.ID == device.ID || !ok || s.count < d.config.MinSamples || flat[sibling.InstallCode][metric] {
+						continue
+					}
+					means = append(means, s.avg)
+				}
+				if len(means) < 2 {
+					continue
+				}
+
+				reference := median(means)
+				deviation := own.avg - reference
+				key := faultKey{deviceID: device.ID, kind: models.FaultDrift, metric: metric}
+				if math.Abs(deviation) > threshold {
+					value := math.Round(deviation*100) / 100
+					check.detected[key] = detectedFault{
+						value: &value,
+						detail: fmt.Sprintf("%s mean %.2f is %+.2f from the floor median %.2f (threshold %g)",
+							metric, own.avg, deviation, reference, threshold),
+					}
+				} else {
+					check.cleared[key] = true
+				}
+			}
+		}
+	}
+
+	return check
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// apply opens detected faults, refreshes open ones and resolves those that
+// cleared, then updates the maintenance flag of the affected devices. A fault
+// resolved by hand is not reopened until its readings have left the window.
+func (d *FaultDetector) apply(check faultCheck, now time.Time) error {
+	open := make(map[faultKey]int)
+	suppressed := make(map[faultKey]bool)
+
+	rows, err := d.db.PostgreSQL.Query(`
+		SELECT id, id_device, kind, metric, status
+		FROM device_faults
+		WHERE status = $1 OR (resolved_by IS NOT NULL AND resolved_at > $2)
+	`, models.FaultOpen, now.Add(-d.config.Window))
+	if err != nil {
+		return fmt.Errorf("failed to load open faults: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var key faultKey
+		var status string
+		if err := rows.Scan(&id, &key.deviceID, &key.kind, &key.metric, &status); err != nil {
+			rows.Close()
+			return err
+		}
+		if status == models.FaultOpen {
+			open[key] = id
+		} else {
+			suppressed[key] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	changed := make(map[int]bool)
+
+	for key, fault := range check.detected {
+		if id, ok := open[key]; ok {
+			_, err := d.db.PostgreSQL.Exec(`
+				UPDATE device_faults SET value = $1, detail = $2, last_detected_at = $3, updated_at = $3
+				WHERE id = $4
+			`, fault.value, fault.detail, now, id)
+			if err != nil {
+				return fmt.Errorf("failed to update fault %d: %w", id, err)
+			}
+			continue
+		}
+		if suppressed[key] {
+			continue
+		}
+
+		_, err := d.db.PostgreSQL.Exec(`
+			INSERT INTO device_faults (id_device, kind, metric, status, value, detail, detected_at, last_detected_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+			ON CONFLICT DO NOTHING
+		`, key.deviceID, key.kind, key.metric, models.FaultOpen, fault.value, fault.detail, now)
+		if err != nil {
+			return fmt.Errorf("failed to open %s fault of device %d: %w", key.kind, key.deviceID, err)
+		}
+		log.Printf("Opened %s fault of device %d: %s", key.kind, key.deviceID, fault.detail)
+		changed[key.deviceID] = true
+	}
+
+	for key, id := range open {
+		if !check.cleared[key] {
+			continue
+		}
+		_, err := d.db.PostgreSQL.Exec(`
+			UPDATE device_faults SET status = $1, resolved_at = $2, updated_at = $2
+			WHERE id = $3 AND status = $4
+		`, models.FaultResolved, now, id, models.FaultOpen)
+		if err != nil {
+			return fmt.Errorf("failed to resolve fault %d: %w", id, err)
+		}
+		log.Printf("Resolved %s fault %d of device %d", key.kind, id, key.deviceID)
+		changed[key.deviceID] = true
+	}
+
+	for deviceID := range changed {
+		if err := SyncMaintenanceFlag(d.db, deviceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncMaintenanceFlag sets maintenance_needed of a device to whether it has
+// open faults
+func SyncMaintenanceFlag(db *database.DB, deviceID int) error {
+	_, err := db.PostgreSQL.Exec(`
+		UPDATE iot_devices
+		SET maintenance_needed = EXISTS (SELECT 1 FROM device_faults WHERE id_device = $1 AND status = $2)
+		WHERE id = $1
+	`, deviceID, models.FaultOpen)
+	if err != nil {
+		return fmt.Errorf("failed to update maintenance flag of device %d: %w", deviceID, err)
+	}
+	return nil
+}
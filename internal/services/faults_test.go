@@ -0,0 +1,100 @@
+package services
+
+import (
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestParseDriftThresholds(t *testing.T) {
+	thresholds, err := ParseDriftThresholds("suhu:2, kelembaban:8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thresholds) != 2 || thresholds[models.MetricSuhu] != 2 || thresholds[models.MetricKelembaban] != 8 {
+		t.Errorf("thresholds = %v", thresholds)
+	}
+	for _, spec := range []string{"suhu", "suhu:0", "suhu:x", ":2"} {
+		if _, err := ParseDriftThresholds(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestFaultDetectorDetect(t *testing.T) {
+	detector, err := NewFaultDetector(nil, nil, config.FaultConfig{
+		Window:          24 * time.Hour,
+		MinSamples:      10,
+		FlatLineRange:   0.01,
+		DriftThresholds: "suhu:2",
+		GapAfter:        2 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	devices := []DeviceInfo{
+		{ID: 1, InstallCode: "A", SwifletHouseID: 1, Floor: 1},
+		{ID: 2, InstallCode: "B", SwifletHouseID: 1, Floor: 1},
+		{ID: 3, InstallCode: "C", SwifletHouseID: 1, Floor: 1},
+		{ID: 4, InstallCode: "D", SwifletHouseID: 1, Floor: 1},
+		{ID: 5, InstallCode: "E", SwifletHouseID: 1, Floor: 2},
+		{ID: 6, InstallCode: "F", SwifletHouseID: 1, Floor: 2},
+	}
+	stats := map[string]map[string]metricWindowStats{
+		"A": {
+			models.MetricSuhu:       {count: 100, min: 26, max: 29, avg: 27.5},
+			models.MetricKelembaban: {count: 100, min: 100, max: 100, avg: 100},
+		},
+		"B": {models.MetricSuhu: {count: 100, min: 26, max: 29, avg: 27.8}},
+		"C": {models.MetricSuhu: {count: 100, min: 29, max: 33, avg: 31}},
+		// A stuck sibling does not count as a reference
+		"D": {models.MetricSuhu: {count: 100, min: 20, max: 20, avg: 20}},
+		// Too few readings to judge, and floor 2 has too few siblings for drift
+		"E": {models.MetricSuhu: {count: 5, min: 20, max: 20, avg: 20}},
+		"F": {models.MetricSuhu: {count: 100, min: 20, max: 25, avg: 22}},
+	}
+	lastReadings := map[string]time.Time{
+		"A": now.Add(-time.Minute),
+		"B": now.Add(-3 * time.Hour),
+	}
+
+	check := detector.detect(devices, stats, lastReadings, now)
+
+	detected := func(id int, kind, metric string) bool {
+		_, ok := check.detected[faultKey{deviceID: id, kind: kind, metric: metric}]
+		return ok
+	}
+	cleared := func(id int, kind, metric string) bool {
+		return check.cleared[faultKey{deviceID: id, kind: kind, metric: metric}]
+	}
+
+	if !detected(1, models.FaultFlatLine, models.MetricKelembaban) || !detected(4, models.FaultFlatLine, models.MetricSuhu) {
+		t.Error("flat-lines not detected")
+	}
+	if !cleared(1, models.FaultFlatLine, models.MetricSuhu) || detected(5, models.FaultFlatLine, models.MetricSuhu) {
+		t.Error("flat-line judged wrongly")
+	}
+
+	// Floor 1 suhu means: A 27.5, B 27.8, C 31 (D is stuck)
+	if !detected(3, models.FaultDrift, models.MetricSuhu) {
+		t.Error("drift of C not detected")
+	}
+	if !cleared(1, models.FaultDrift, models.MetricSuhu) || !cleared(2, models.FaultDrift, models.MetricSuhu) {
+		t.Error("drift of A or B not cleared")
+	}
+	for _, id := range []int{4, 5, 6} {
+		if detected(id, models.FaultDrift, models.MetricSuhu) || cleared(id, models.FaultDrift, models.MetricSuhu) {
+			t.Errorf("drift of device %d judged without enough siblings", id)
+		}
+	}
+
+	if !cleared(1, models.FaultGap, "") || !detected(2, models.FaultGap, "") {
+		t.Error("gaps judged wrongly")
+	}
+	if detected(3, models.FaultGap, "") || cleared(3, models.FaultGap, "") {
+		t.Error("gap of a device without recent readings judged")
+	}
+}
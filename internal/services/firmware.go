@@ -0,0 +1,769 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrFirmwareNotFound       = errors.New("firmware release not found")
+	ErrRolloutNotFound        = errors.New("firmware rollout not found")
+	ErrRolloutHouseNotFound   = errors.New("swiflet house not found")
+	ErrRolloutDevicesNotFound = errors.New("devices not found")
+	ErrRolloutDevicesBusy     = errors.New("devices are already part of an active rollout")
+	ErrRolloutNoDevices       = errors.New("no active devices need this firmware version")
+	ErrRolloutState           = errors.New("firmware rollout cannot change from its current status")
+)
+
+// FirmwareUpdateCommand is the control command that asks a gateway to
+// download and flash a firmware image
+const FirmwareUpdateCommand = "firmware_update"
+
+// FirmwareUpdateParams are the params of a firmware_update command. The
+// device acks the command once the download is verified against SHA256 and
+// reports Version over MQTT after rebooting into it.
+type FirmwareUpdateParams struct {
+	RolloutID int    `json:"rollout_id"`
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+}
+
+var firmwareVersionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+-]{0,49}$`)
+
+// ValidFirmwareVersion reports whether a version can name a firmware release:
+// up to 50 letters, digits, dots, dashes, underscores and plus signs
+func ValidFirmwareVersion(version string) bool {
+	return firmwareVersionPattern.MatchString(version)
+}
+
+// ParseSHA256 normalizes a hex encoded SHA-256 checksum
+func ParseSHA256(checksum string) (string, bool) {
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if len(checksum) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return "", false
+	}
+	return checksum, true
+}
+
+// FirmwareURLSigner creates download links for firmware images. S3Service
+// implements it.
+type FirmwareURLSigner interface {
+	GeneratePresignedURL(key string, expiration time.Duration) (string, error)
+}
+
+// FirmwareObserver is notified of the firmware version devices report
+type FirmwareObserver interface {
+	FirmwareReported(device DeviceInfo, version string, reportedAt time.Time)
+}
+
+// ReleaseColumns selects a firmware release for ScanRelease
+const ReleaseColumns = `id, version, s3_key, size, sha256, notes, uploaded_by, created_at`
+
+func ScanRelease(row interface{ Scan(...interface{}) error }) (models.FirmwareRelease, error) {
+	var release models.FirmwareRelease
+	err := row.Scan(&release.ID, &release.Version, &release.S3Key, &release.Size, &release.SHA256,
+		&release.Notes, &release.UploadedBy, &release.CreatedAt)
+	return release, err
+}
+
+// RolloutColumns selects a rollout for ScanRollout, from firmware_rollouts r
+// joined with firmware_releases f
+const RolloutColumns = `r.id, r.id_firmware, f.version, r.id_swiflet_house, r.floor, r.status, r.batch_size,
+	r.max_failures, r.current_stage, r.error, r.scheduled_at, r.started_at, r.finished_at, r.created_by,
+	r.created_at, r.updated_at`
+
+func ScanRollout(row interface{ Scan(...interface{}) error }) (models.FirmwareRollout, error) {
+	var rollout models.FirmwareRollout
+	err := row.Scan(&rollout.ID, &rollout.FirmwareID, &rollout.Version, &rollout.SwifletHouseID, &rollout.Floor,
+		&rollout.Status, &rollout.BatchSize, &rollout.MaxFailures, &rollout.CurrentStage, &rollout.Error,
+		&rollout.ScheduledAt, &rollout.StartedAt, &rollout.FinishedAt, &rollout.CreatedBy,
+		&rollout.CreatedAt, &rollout.UpdatedAt)
+	return rollout, err
+}
+
+// RolloutDeviceColumns selects a device of a rollout for ScanRolloutDevice
+const RolloutDeviceColumns = `id, id_rollout, id_device, install_code, stage, status, from_version, id_command,
+	error, sent_at, finished_at, created_at, updated_at`
+
+func ScanRolloutDevice(row interface{ Scan(...interface{}) error }) (models.FirmwareRolloutDevice, error) {
+	var device models.FirmwareRolloutDevice
+	err := row.Scan(&device.ID, &device.RolloutID, &device.DeviceID, &device.InstallCode, &device.Stage,
+		&device.Status, &device.FromVersion, &device.CommandID, &device.Error, &device.SentAt,
+		&device.FinishedAt, &device.CreatedAt, &device.UpdatedAt)
+	return device, err
+}
+
+// Steps a running rollout can take after its sent devices were resolved
+const (
+	rolloutWait = iota
+	rolloutAdvance
+	rolloutHalt
+	rolloutComplete
+)
+
+// rolloutProgress summarizes the devices of a running rollout
+type rolloutProgress struct {
+	// Devices of the current stage still to be sent or to report back
+	stagePending int
+	stageSent    int
+	// Failed devices of the whole rollout
+	failed int
+	// laterStages is set while stages after the current one have pending devices
+	laterStages bool
+}
+
+// step decides what a running rollout does next. Too many failures halt it
+// right away; otherwise the next stage starts once every device of the
+// current one has finished.
+func (p rolloutProgress) step(maxFailures int) int {
+	switch {
+	case p.failed > maxFailures:
+		return rolloutHalt
+	case p.stagePending > 0 || p.stageSent > 0:
+		return rolloutWait
+	case p.laterStages:
+		return rolloutAdvance
+	default:
+		return rolloutComplete
+	}
+}
+
+// rolloutStage returns the stage of the device at index i of a rollout
+func rolloutStage(i, batchSize int) int {
+	return i/batchSize + 1
+}
+
+// FirmwareRollouts stages firmware updates of gateways. Devices of the
+// current stage of each running rollout are sent a firmware_update command on
+// the control topic; a device succeeds once it reports the new version and
+// fails when it rejects the command or no report arrives within the update
+// timeout.
+type FirmwareRollouts struct {
+	db       *database.DB
+	registry *DeviceRegistry
+	sender   CommandSender
+	signer   FirmwareURLSigner
+	config   config.FirmwareConfig
+
+	// versions caches the last version each device reported, so unchanged
+	// reports do not touch the database
+	versionsMu sync.Mutex
+	versions   map[int]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewFirmwareRollouts creates the rollout runner. Without a sender rollouts
+// can be created and scheduled, but no updates are sent.
+func NewFirmwareRollouts(db *database.DB, registry *DeviceRegistry, sender CommandSender, signer FirmwareURLSigner,
+	cfg config.FirmwareConfig) *FirmwareRollouts {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 30 * time.Second
+	}
+	if cfg.UpdateTimeout <= 0 {
+		cfg.UpdateTimeout = 30 * time.Minute
+	}
+	if cfg.URLTTL <= 0 {
+		cfg.URLTTL = 6 * time.Hour
+	}
+
+	return &FirmwareRollouts{
+		db:       db,
+		registry: registry,
+		sender:   sender,
+		signer:   signer,
+		config:   cfg,
+		versions: make(map[int]string),
+	}
+}
+
+// Start advances the rollouts right away and then every check interval
+func (f *FirmwareRollouts) Start() {
+	if f.stop != nil {
+		return
+	}
+
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+
+	go func() {
+		defer close(f.done)
+
+		ticker := time.NewTicker(f.config.CheckInterval)
+		defer ticker.Stop()
+
+		now := time.Now()
+		for {
+			if err := f.Run(now); err != nil {
+				log.Printf("Firmware rollout run failed: %v", err)
+			}
+			select {
+			case now = <-ticker.C:
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the rollout loop
+func (f *FirmwareRollouts) Stop() {
+	if f.stop == nil {
+		return
+	}
+	close(f.stop)
+	<-f.done
+	f.stop = nil
+}
+
+// FirmwareReported stores the version a device reported and completes its
+// pending update when it is the version of the rollout
+func (f *FirmwareRollouts) FirmwareReported(device DeviceInfo, version string, reportedAt time.Time) {
+	f.versionsMu.Lock()
+	unchanged := f.versions[device.ID] == version
+	f.versionsMu.Unlock()
+	if unchanged {
+		return
+	}
+
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE iot_devices SET firmware_version = $1, firmware_updated_at = $2
+		WHERE id = $3 AND firmware_version IS DISTINCT FROM $1
+	`, version, reportedAt, device.ID); err != nil {
+		log.Printf("Failed to store firmware version of %s: %v", device.InstallCode, err)
+		return
+	}
+
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollout_devices rd
+		SET status = $1, error = NULL, finished_at = $2, updated_at = $2
+		FROM firmware_rollouts r
+		JOIN firmware_releases fr ON fr.id = r.id_firmware
+		WHERE rd.id_rollout = r.id AND rd.id_device = $3 AND rd.status = $4 AND fr.version = $5
+	`, models.RolloutDeviceSucceeded, reportedAt, device.ID, models.RolloutDeviceSent, version); err != nil {
+		log.Printf("Failed to complete firmware update of %s: %v", device.InstallCode, err)
+		return
+	}
+
+	f.versionsMu.Lock()
+	f.versions[device.ID] = version
+	f.versionsMu.Unlock()
+}
+
+// Run starts scheduled rollouts that are due, resolves sent updates and moves
+// every running rollout forward
+func (f *FirmwareRollouts) Run(now time.Time) error {
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollouts
+		SET status = $1, started_at = $2, current_stage = 1, updated_at = $2
+		WHERE status = $3 AND scheduled_at <= $2
+	`, models.RolloutRunning, now, models.RolloutScheduled); err != nil {
+		return fmt.Errorf("failed to start scheduled rollouts: %w", err)
+	}
+
+	if err := f.resolveSent(now); err != nil {
+		return err
+	}
+
+	rows, err := f.db.PostgreSQL.Query(`
+		SELECT `+RolloutColumns+`
+		FROM firmware_rollouts r
+		JOIN firmware_releases f ON f.id = r.id_firmware
+		WHERE r.status = $1
+		ORDER BY r.id
+	`, models.RolloutRunning)
+	if err != nil {
+		return fmt.Errorf("failed to load running rollouts: %w", err)
+	}
+	var rollouts []models.FirmwareRollout
+	for rows.Next() {
+		rollout, err := ScanRollout(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to load running rollouts: %w", err)
+		}
+		rollouts = append(rollouts, rollout)
+	}
+	rows.Close()
+
+	for _, rollout := range rollouts {
+		if err := f.advance(rollout, now); err != nil {
+			log.Printf("Failed to advance firmware rollout %d: %v", rollout.ID, err)
+		}
+	}
+	return nil
+}
+
+// resolveSent settles sent updates of every rollout: devices already on the
+// new version succeeded, and devices that rejected the command or did not
+// report back within the update timeout failed. A command that timed out
+// without an ack is not a failure by itself, since downloading the image may
+// take longer than the ack timeout.
+func (f *FirmwareRollouts) resolveSent(now time.Time) error {
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollout_devices rd
+		SET status = $1, error = NULL, finished_at = $2, updated_at = $2
+		FROM firmware_rollouts r, firmware_releases fr, iot_devices d
+		WHERE rd.id_rollout = r.id AND fr.id = r.id_firmware AND d.id = rd.id_device
+			AND rd.status = $3 AND d.firmware_version = fr.version
+	`, models.RolloutDeviceSucceeded, now, models.RolloutDeviceSent); err != nil {
+		return fmt.Errorf("failed to resolve updated devices: %w", err)
+	}
+
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollout_devices rd
+		SET status = $1, error = COALESCE(c.error, 'update command failed'), finished_at = $2, updated_at = $2
+		FROM device_commands c
+		WHERE c.id = rd.id_command AND rd.status = $3 AND c.status = $4
+	`, models.RolloutDeviceFailed, now, models.RolloutDeviceSent, models.CommandFailed); err != nil {
+		return fmt.Errorf("failed to resolve failed updates: %w", err)
+	}
+
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollout_devices
+		SET status = $1, error = $2, finished_at = $3, updated_at = $3
+		WHERE status = $4 AND sent_at < $5
+	`, models.RolloutDeviceFailed, fmt.Sprintf("no report of the new version within %s", f.config.UpdateTimeout),
+		now, models.RolloutDeviceSent, now.Add(-f.config.UpdateTimeout)); err != nil {
+		return fmt.Errorf("failed to resolve timed out updates: %w", err)
+	}
+	return nil
+}
+
+// progress summarizes the devices of a rollout relative to its current stage
+func (f *FirmwareRollouts) progress(rollout models.FirmwareRollout) (rolloutProgress, error) {
+	var progress rolloutProgress
+	err := f.db.PostgreSQL.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE stage = $2 AND status = $3),
+			COUNT(*) FILTER (WHERE stage = $2 AND status = $4),
+			COUNT(*) FILTER (WHERE status = $5),
+			COUNT(*) FILTER (WHERE stage > $2 AND status = $3) > 0
+		FROM firmware_rollout_devices
+		WHERE id_rollout = $1
+	`, rollout.ID, rollout.CurrentStage, models.RolloutDevicePending, models.RolloutDeviceSent,
+		models.RolloutDeviceFailed).Scan(&progress.stagePending, &progress.stageSent, &progress.failed,
+		&progress.laterStages)
+	return progress, err
+}
+
+// advance halts, completes or moves a running rollout to its next stage and
+// sends the pending updates of the current stage
+func (f *FirmwareRollouts) advance(rollout models.FirmwareRollout, now time.Time) error {
+	progress, err := f.progress(rollout)
+	if err != nil {
+		return err
+	}
+
+	switch progress.step(rollout.MaxFailures) {
+	case rolloutHalt:
+		reason := fmt.Sprintf("%d devices failed to update, more than the %d allowed", progress.failed, rollout.MaxFailures)
+		log.Printf("Firmware rollout %d halted: %s", rollout.ID, reason)
+		return f.finish(rollout.ID, models.RolloutRunning, models.RolloutHalted, &reason, now)
+	case rolloutComplete:
+		return f.finish(rollout.ID, models.RolloutRunning, models.RolloutCompleted, nil, now)
+	case rolloutAdvance:
+		err := f.db.PostgreSQL.QueryRow(`
+			UPDATE firmware_rollouts
+			SET current_stage = (
+				SELECT MIN(stage) FROM firmware_rollout_devices
+				WHERE id_rollout = $1 AND stage > current_stage AND status = $2
+			), updated_at = $3
+			WHERE id = $1 AND status = $4
+			RETURNING current_stage
+		`, rollout.ID, models.RolloutDevicePending, now, models.RolloutRunning).Scan(&rollout.CurrentStage)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Paused or cancelled meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.sendStage(rollout, now)
+}
+
+// finish ends a rollout in a final status when it is still in from, and
+// cancels the updates that were never sent
+func (f *FirmwareRollouts) finish(rolloutID int, from, status string, reason *string, now time.Time) error {
+	tx, err := f.db.PostgreSQL.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE firmware_rollouts SET status = $1, error = $2, finished_at = $3, updated_at = $3
+		WHERE id = $4 AND status = $5
+	`, status, reason, now, rolloutID, from)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrRolloutState
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE firmware_rollout_devices SET status = $1, updated_at = $2
+		WHERE id_rollout = $3 AND status = $4
+	`, models.RolloutDeviceCancelled, now, rolloutID, models.RolloutDevicePending); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sendStage sends the firmware_update command to the pending devices of the
+// current stage of a rollout
+func (f *FirmwareRollouts) sendStage(rollout models.FirmwareRollout, now time.Time) error {
+	if f.sender == nil {
+		return nil
+	}
+
+	rows, err := f.db.PostgreSQL.Query(`
+		SELECT `+RolloutDeviceColumns+`
+		FROM firmware_rollout_devices
+		WHERE id_rollout = $1 AND stage = $2 AND status = $3
+		ORDER BY id
+	`, rollout.ID, rollout.CurrentStage, models.RolloutDevicePending)
+	if err != nil {
+		return err
+	}
+	var pending []models.FirmwareRolloutDevice
+	for rows.Next() {
+		device, err := ScanRolloutDevice(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, device)
+	}
+	rows.Close()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	release, err := ScanRelease(f.db.PostgreSQL.QueryRow(
+		"SELECT "+ReleaseColumns+" FROM firmware_releases WHERE id = $1", rollout.FirmwareID))
+	if err != nil {
+		return fmt.Errorf("failed to load firmware release: %w", err)
+	}
+	url, err := f.signer.GeneratePresignedURL(release.S3Key, f.config.URLTTL)
+	if err != nil {
+		return err
+	}
+	params, err := json.Marshal(FirmwareUpdateParams{
+		RolloutID: rollout.ID,
+		Version:   release.Version,
+		URL:       url,
+		SHA256:    release.SHA256,
+		Size:      release.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, target := range pending {
+		device, ok := f.registry.Lookup(target.InstallCode)
+		if !ok || device.ID != target.DeviceID {
+			f.markDevice(target.ID, models.RolloutDeviceFailed, nil, "device is no longer active", now)
+			continue
+		}
+
+		command, err := f.sender.SendCommand(device, rollout.CreatedBy, FirmwareUpdateCommand, params)
+		switch {
+		case command == nil:
+			// Nothing was stored, so the device stays pending for the next run
+			log.Printf("Failed to send firmware update to %s: %v", target.InstallCode, err)
+		case err != nil:
+			f.markDevice(target.ID, models.RolloutDeviceFailed, &command.ID, err.Error(), now)
+		default:
+			f.markDevice(target.ID, models.RolloutDeviceSent, &command.ID, "", now)
+		}
+	}
+	return nil
+}
+
+// markDevice records that an update was sent or failed
+func (f *FirmwareRollouts) markDevice(id int, status string, commandID *int, reason string, now time.Time) {
+	var storedReason *string
+	var finishedAt, sentAt *time.Time
+	if status == models.RolloutDeviceFailed {
+		storedReason = &reason
+		finishedAt = &now
+	}
+	if commandID != nil {
+		sentAt = &now
+	}
+
+	if _, err := f.db.PostgreSQL.Exec(`
+		UPDATE firmware_rollout_devices
+		SET status = $1, id_command = $2, error = $3, sent_at = $4, finished_at = $5, updated_at = $6
+		WHERE id = $7 AND status = $8
+	`, status, commandID, storedReason, sentAt, finishedAt, now, id, models.RolloutDevicePending); err != nil {
+		log.Printf("Failed to update firmware rollout device %d: %v", id, err)
+	}
+}
+
+// Get returns a rollout with the count of its devices per status
+func (f *FirmwareRollouts) Get(id int) (models.FirmwareRollout, error) {
+	rollout, err := ScanRollout(f.db.PostgreSQL.QueryRow(`
+		SELECT `+RolloutColumns+`
+		FROM firmware_rollouts r
+		JOIN firmware_releases f ON f.id = r.id_firmware
+		WHERE r.id = $1
+	`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return rollout, ErrRolloutNotFound
+		}
+		return rollout, err
+	}
+
+	rows, err := f.db.PostgreSQL.Query(`
+		SELECT status, COUNT(*) FROM firmware_rollout_devices WHERE id_rollout = $1 GROUP BY status
+	`, id)
+	if err != nil {
+		return rollout, err
+	}
+	defer rows.Close()
+
+	rollout.Devices = make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return rollout, err
+		}
+		rollout.Devices[status] = count
+	}
+	return rollout, rows.Err()
+}
+
+// Create schedules a rollout of a firmware release. Decommissioned devices
+// and devices already on the version are left out; devices that are part of
+// another active rollout are rejected.
+func (f *FirmwareRollouts) Create(request models.CreateFirmwareRolloutRequest, createdBy int) (models.FirmwareRollout, error) {
+	var rollout models.FirmwareRollout
+
+	release, err := ScanRelease(f.db.PostgreSQL.QueryRow(
+		"SELECT "+ReleaseColumns+" FROM firmware_releases WHERE id = $1", request.FirmwareID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return rollout, ErrFirmwareNotFound
+		}
+		return rollout, err
+	}
+
+	if request.SwifletHouseID != nil {
+		var exists bool
+		err := f.db.PostgreSQL.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM swiflet_houses WHERE id = $1 AND deleted_at IS NULL)
+		`, *request.SwifletHouseID).Scan(&exists)
+		if err != nil {
+			return rollout, err
+		}
+		if !exists {
+			return rollout, ErrRolloutHouseNotFound
+		}
+	}
+
+	var deviceIDs pq.Int64Array
+	if request.DeviceIDs != nil {
+		deviceIDs = make(pq.Int64Array, len(request.DeviceIDs))
+		for i, id := range request.DeviceIDs {
+			deviceIDs[i] = int64(id)
+		}
+		missing, err := f.ids(`
+			SELECT requested.id FROM unnest($1::INTEGER[]) AS requested(id)
+			WHERE NOT EXISTS (SELECT 1 FROM iot_devices d WHERE d.id = requested.id AND d.deleted_at IS NULL)
+		`, deviceIDs)
+		if err != nil {
+			return rollout, err
+		}
+		if len(missing) > 0 {
+			return rollout, fmt.Errorf("%w: %v", ErrRolloutDevicesNotFound, missing)
+		}
+	}
+
+	type target struct {
+		id          int
+		installCode string
+		version     *string
+	}
+	rows, err := f.db.PostgreSQL.Query(`
+		SELECT id, install_code, firmware_version
+		FROM iot_devices
+		WHERE deleted_at IS NULL AND decommissioned_at IS NULL
+			AND ($1::INTEGER IS NULL OR id_swiflet_house = $1) AND ($2::INTEGER IS NULL OR floor = $2)
+			AND ($3::INTEGER[] IS NULL OR id = ANY($3))
+			AND firmware_version IS DISTINCT FROM $4
+		ORDER BY id
+	`, request.SwifletHouseID, request.Floor, deviceIDs, release.Version)
+	if err != nil {
+		return rollout, err
+	}
+	var targets []target
+	var targetIDs pq.Int64Array
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.installCode, &t.version); err != nil {
+			rows.Close()
+			return rollout, err
+		}
+		targets = append(targets, t)
+		targetIDs = append(targetIDs, int64(t.id))
+	}
+	rows.Close()
+	if len(targets) == 0 {
+		return rollout, ErrRolloutNoDevices
+	}
+
+	busy, err := f.ids(`
+		SELECT DISTINCT rd.id_device
+		FROM firmware_rollout_devices rd
+		JOIN firmware_rollouts r ON r.id = rd.id_rollout
+		WHERE rd.id_device = ANY($1) AND rd.status IN ('pending', 'sent')
+			AND r.status IN ('scheduled', 'running', 'paused')
+	`, targetIDs)
+	if err != nil {
+		return rollout, err
+	}
+	if len(busy) > 0 {
+		return rollout, fmt.Errorf("%w: %v", ErrRolloutDevicesBusy, busy)
+	}
+
+	now := time.Now()
+	scheduledAt := now
+	if request.ScheduledAt != nil {
+		scheduledAt = *request.ScheduledAt
+	}
+
+	tx, err := f.db.PostgreSQL.Begin()
+	if err != nil {
+		return rollout, err
+	}
+	defer tx.Rollback()
+
+	var rolloutID int
+	err = tx.QueryRow(`
+		INSERT INTO firmware_rollouts (id_firmware, id_swiflet_house, floor, status, batch_size, max_failures,
+			scheduled_at, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)
+		RETURNING id
+	`, release.ID, request.SwifletHouseID, request.Floor, models.RolloutScheduled, request.BatchSize,
+		request.MaxFailures, scheduledAt, createdBy, now).Scan(&rolloutID)
+	if err != nil {
+		return rollout, err
+	}
+
+	for i, t := range targets {
+		if _, err := tx.Exec(`
+			INSERT INTO firmware_rollout_devices (id_rollout, id_device, install_code, stage, status, from_version,
+				created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		`, rolloutID, t.id, t.installCode, rolloutStage(i, request.BatchSize), models.RolloutDevicePending,
+			t.version, now); err != nil {
+			return rollout, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rollout, err
+	}
+	return f.Get(rolloutID)
+}
+
+// ids runs a query returning device IDs, sorted
+func (f *FirmwareRollouts) ids(query string, args ...interface{}) ([]int, error) {
+	rows, err := f.db.PostgreSQL.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, rows.Err()
+}
+
+// Pause stops a scheduled or running rollout from sending further updates.
+// Updates already sent are still resolved.
+func (f *FirmwareRollouts) Pause(id int) (models.FirmwareRollout, error) {
+	return f.transition(id, `
+		UPDATE firmware_rollouts SET status = $1, updated_at = $2
+		WHERE id = $3 AND status IN ('scheduled', 'running')
+	`, models.RolloutPaused)
+}
+
+// Resume continues a paused rollout; one paused before it started waits for
+// its schedule again
+func (f *FirmwareRollouts) Resume(id int) (models.FirmwareRollout, error) {
+	return f.transition(id, `
+		UPDATE firmware_rollouts
+		SET status = CASE WHEN started_at IS NULL THEN 'scheduled' ELSE $1 END, updated_at = $2
+		WHERE id = $3 AND status = 'paused'
+	`, models.RolloutRunning)
+}
+
+// transition applies a status change guarded by the current status
+func (f *FirmwareRollouts) transition(id int, query, status string) (models.FirmwareRollout, error) {
+	result, err := f.db.PostgreSQL.Exec(query, status, time.Now(), id)
+	if err != nil {
+		return models.FirmwareRollout{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if _, err := f.Get(id); err != nil {
+			return models.FirmwareRollout{}, err
+		}
+		return models.FirmwareRollout{}, ErrRolloutState
+	}
+	return f.Get(id)
+}
+
+// Cancel ends a rollout that has not finished. Updates already sent are
+// still resolved; pending ones are cancelled.
+func (f *FirmwareRollouts) Cancel(id int) (models.FirmwareRollout, error) {
+	rollout, err := f.Get(id)
+	if err != nil {
+		return rollout, err
+	}
+	switch rollout.Status {
+	case models.RolloutScheduled, models.RolloutRunning, models.RolloutPaused:
+	default:
+		return rollout, ErrRolloutState
+	}
+
+	if err := f.finish(id, rollout.Status, models.RolloutCancelled, nil, time.Now()); err != nil {
+		return rollout, err
+	}
+	return f.Get(id)
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidFirmwareVersion(t *testing.T) {
+	valid := []string{"1.4.0", "v2.0.0-rc.1", "1.0.0+build.7", "2024_05_01"}
+	for _, version := range valid {
+		if !ValidFirmwareVersion(version) {
+			t.Errorf("ValidFirmwareVersion(%q) = false, want true", version)
+		}
+	}
+
+	invalid := []string{"", ".1", "-rc", "1.0 beta", "1.0/../x", "1.0\n", strings.Repeat("1", 51)}
+	for _, version := range invalid {
+		if ValidFirmwareVersion(version) {
+			t.Errorf("ValidFirmwareVersion(%q) = true, want false", version)
+		}
+	}
+}
+
+func TestParseSHA256(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	if got, ok := ParseSHA256("  9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08 "); !ok || got != sum {
+		t.Errorf("ParseSHA256 = %q, %v, want %q", got, ok, sum)
+	}
+	for _, checksum := range []string{"", sum[:63], sum + "0", "z" + sum[1:]} {
+		if _, ok := ParseSHA256(checksum); ok {
+			t.Errorf("ParseSHA256(%q) accepted an invalid checksum", checksum)
+		}
+	}
+}
+
+func TestRolloutStage(t *testing.T) {
+	stages := make([]int, 7)
+	for i := range stages {
+		stages[i] = rolloutStage(i, 3)
+	}
+	want := []int{1, 1, 1, 2, 2, 2, 3}
+	for i := range want {
+		if stages[i] != want[i] {
+			t.Fatalf("stages = %v, want %v", stages, want)
+		}
+	}
+}
+
+func TestRolloutProgressStep(t *testing.T) {
+	cases := []struct {
+		name        string
+		progress    rolloutProgress
+		maxFailures int
+		want        int
+	}{
+		{"stage still sending", rolloutProgress{stagePending: 2}, 0, rolloutWait},
+		{"stage awaiting reports", rolloutProgress{stageSent: 1, laterStages: true}, 0, rolloutWait},
+		{"stage done", rolloutProgress{laterStages: true}, 0, rolloutAdvance},
+		{"last stage done", rolloutProgress{}, 0, rolloutComplete},
+		{"failures within limit", rolloutProgress{failed: 1, laterStages: true}, 1, rolloutAdvance},
+		{"too many failures", rolloutProgress{failed: 2, stageSent: 3}, 1, rolloutHalt},
+		{"failure without tolerance", rolloutProgress{failed: 1}, 0, rolloutHalt},
+	}
+
+	for _, tc := range cases {
+		if got := tc.progress.step(tc.maxFailures); got != tc.want {
+			t.Errorf("%s: step = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
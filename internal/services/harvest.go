@@ -0,0 +1,127 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"swiflet-backend/internal/models"
+)
+
+// minCorrelationPeriods is how many harvest periods with climate data a
+// correlation needs to be reported
+const minCorrelationPeriods = 3
+
+// HarvestPeriods orders harvests by floor and time and pairs each with the
+// period since the previous harvest of its floor, with its total yield. Yield
+// per day normalizes periods of different lengths.
+func HarvestPeriods(harvests []models.Harvest) []models.HarvestPeriod {
+	sorted := append([]models.Harvest(nil), harvests...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Floor != sorted[j].Floor {
+			return sorted[i].Floor < sorted[j].Floor
+		}
+		return sorted[i].CreatedAt.Before(sorted[j].CreatedAt)
+	})
+
+	periods := make([]models.HarvestPeriod, 0, len(sorted))
+	for i, harvest := range sorted {
+		period := models.HarvestPeriod{
+			Harvest:     harvest,
+			Floor:       harvest.Floor,
+			PeriodEnd:   harvest.CreatedAt,
+			TotalWeight: math.Round((harvest.BowlWeight+harvest.OvalWeight+harvest.CornerWeight+harvest.BrokenWeight)*100) / 100,
+			TotalPieces: harvest.BowlPieces + harvest.OvalPieces + harvest.CornerPieces + harvest.BrokenPieces,
+		}
+		if i > 0 && sorted[i-1].Floor == harvest.Floor && harvest.CreatedAt.After(sorted[i-1].CreatedAt) {
+			start := sorted[i-1].CreatedAt
+			days := round1(harvest.CreatedAt.Sub(start).Hours() / 24)
+			period.PeriodStart = &start
+			period.Days = &days
+			if days > 0 {
+				perDay := math.Round(period.TotalWeight/days*100) / 100
+				period.WeightPerDay = &perDay
+			}
+		}
+		periods = append(periods, period)
+	}
+	return periods
+}
+
+// HarvestClimateFromScore summarizes a period score for a harvest report
+func HarvestClimateFromScore(score models.ClimateScore) *models.HarvestClimate {
+	climate := &models.HarvestClimate{
+		Score:      score.Score,
+		TimeInBand: score.TimeInBand,
+		Coverage:   score.Coverage,
+		Metrics:    score.Metrics,
+	}
+	for _, metric := range score.Metrics {
+		avg := metric.Avg
+		switch metric.Metric {
+		case models.MetricSuhu:
+			climate.AvgSuhu = &avg
+		case models.MetricKelembaban:
+			climate.AvgKelembaban = &avg
+		}
+	}
+	return climate
+}
+
+// HarvestCorrelations returns the Pearson correlation between the weight per
+// day of the periods and their climate score, time in band and average of each
+// metric. A statistic is nil without enough periods or without variance.
+func HarvestCorrelations(periods []models.HarvestPeriod) map[string]*float64 {
+	yields := make(map[string][]float64)
+	stats := make(map[string][]float64)
+	add := func(name string, yield, value float64) {
+		yields[name] = append(yields[name], yield)
+		stats[name] = append(stats[name], value)
+	}
+
+	for _, period := range periods {
+		if period.WeightPerDay == nil || period.Climate == nil || period.Climate.Coverage == 0 {
+			continue
+		}
+		yield := *period.WeightPerDay
+		add("score", yield, period.Climate.Score)
+		add("time_in_band", yield, period.Climate.TimeInBand)
+		for _, metric := range period.Climate.Metrics {
+			add("avg_"+metric.Metric, yield, metric.Avg)
+		}
+	}
+
+	correlations := map[string]*float64{"score": nil, "time_in_band": nil}
+	for name := range stats {
+		correlations[name] = pearson(yields[name], stats[name])
+	}
+	return correlations
+}
+
+// pearson returns the correlation coefficient of two series, rounded to two
+// decimals
+func pearson(xs, ys []float64) *float64 {
+	n := float64(len(xs))
+	if len(xs) < minCorrelationPeriods {
+		return nil
+	}
+
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return nil
+	}
+	r := math.Round(cov/math.Sqrt(varX*varY)*100) / 100
+	return &r
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestHarvestPeriods(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	periods := HarvestPeriods([]models.Harvest{
+		{ID: 3, Floor: 1, BowlWeight: 2, BowlPieces: 200, CreatedAt: day(100)},
+		{ID: 2, Floor: 2, OvalWeight: 1, CreatedAt: day(10)},
+		{ID: 1, Floor: 1, BowlWeight: 1, CornerWeight: 0.5, BowlPieces: 90, CornerPieces: 20, CreatedAt: day(0)},
+	})
+
+	if len(periods) != 3 || periods[0].Harvest.ID != 1 || periods[1].Harvest.ID != 3 || periods[2].Harvest.ID != 2 {
+		t.Fatalf("periods = %+v", periods)
+	}
+	first := periods[0]
+	if first.PeriodStart != nil || first.Days != nil || first.WeightPerDay != nil ||
+		first.TotalWeight != 1.5 || first.TotalPieces != 110 {
+		t.Errorf("first period = %+v", first)
+	}
+	second := periods[1]
+	if second.PeriodStart == nil || !second.PeriodStart.Equal(day(0)) || *second.Days != 100 || *second.WeightPerDay != 0.02 {
+		t.Errorf("second period = %+v", second)
+	}
+	// The first harvest of another floor starts no period
+	if periods[2].PeriodStart != nil {
+		t.Errorf("floor 2 period = %+v", periods[2])
+	}
+}
+
+func TestHarvestCorrelations(t *testing.T) {
+	period := func(perDay, timeInBand, suhu float64) models.HarvestPeriod {
+		return models.HarvestPeriod{
+			WeightPerDay: &perDay,
+			Climate: &models.HarvestClimate{
+				Score:      50,
+				TimeInBand: timeInBand,
+				Coverage:   100,
+				Metrics:    []models.ClimateMetricScore{{Metric: models.MetricSuhu, Avg: suhu}},
+			},
+		}
+	}
+
+	correlations := HarvestCorrelations([]models.HarvestPeriod{
+		period(1, 50, 30),
+		period(2, 70, 29),
+		period(3, 90, 28),
+		{Harvest: models.Harvest{ID: 9}},
+	})
+	if r := correlations["time_in_band"]; r == nil || *r != 1 {
+		t.Errorf("time_in_band = %v", r)
+	}
+	if r := correlations["avg_suhu"]; r == nil || *r != -1 {
+		t.Errorf("avg_suhu = %v", r)
+	}
+	// A constant score has no correlation
+	if r, ok := correlations["score"]; !ok || r != nil {
+		t.Errorf("score = %v", r)
+	}
+
+	correlations = HarvestCorrelations([]models.HarvestPeriod{period(1, 50, 30), period(2, 70, 29)})
+	if correlations["time_in_band"] != nil {
+		t.Errorf("correlated two periods: %v", *correlations["time_in_band"])
+	}
+}
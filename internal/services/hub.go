@@ -0,0 +1,158 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"sync"
+	"sync/atomic"
+)
+
+// Types of events published to stream subscribers
+const (
+	StreamEventReading = "reading"
+	StreamEventAlert   = "alert"
+)
+
+// subscriptionBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it
+const subscriptionBuffer = 256
+
+// StreamEvent is an event fanned out to the subscribers of a house
+type StreamEvent struct {
+	Type           string
+	SwifletHouseID int
+	// InstallCode is set for readings; alerts cover a house or floor
+	InstallCode string
+	Data        interface{}
+}
+
+// StreamFilter selects the events of a subscription. With an install_code
+// only that device's readings are delivered, alongside the alerts of its house.
+type StreamFilter struct {
+	SwifletHouseID int
+	InstallCode    string
+}
+
+func (f StreamFilter) matches(event StreamEvent) bool {
+	if event.SwifletHouseID != f.SwifletHouseID {
+		return false
+	}
+	return f.InstallCode == "" || event.InstallCode == "" || event.InstallCode == f.InstallCode
+}
+
+// Subscription receives the events matching its filter until it is
+// unsubscribed, which closes Events
+type Subscription struct {
+	Events <-chan StreamEvent
+
+	events  chan StreamEvent
+	filter  StreamFilter
+	dropped uint64
+}
+
+// Dropped returns how many events were dropped because the subscriber was too slow
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Hub fans readings and alerts out to stream subscribers. Publishing never
+// blocks: events for a subscriber whose buffer is full are dropped.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[int]map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[int]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a subscriber for the events of a house
+func (h *Hub) Subscribe(filter StreamFilter) *Subscription {
+	events := make(chan StreamEvent, subscriptionBuffer)
+	subscription := &Subscription{Events: events, events: events, filter: filter}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	house, ok := h.subscribers[filter.SwifletHouseID]
+	if !ok {
+		house = make(map[*Subscription]struct{})
+		h.subscribers[filter.SwifletHouseID] = house
+	}
+	house[subscription] = struct{}{}
+
+	return subscription
+}
+
+// Unsubscribe removes a subscriber and closes its event channel
+func (h *Hub) Unsubscribe(subscription *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	house := h.subscribers[subscription.filter.SwifletHouseID]
+	if _, ok := house[subscription]; !ok {
+		return
+	}
+	delete(house, subscription)
+	if len(house) == 0 {
+		delete(h.subscribers, subscription.filter.SwifletHouseID)
+	}
+	close(subscription.events)
+}
+
+// Subscribers returns the number of active subscriptions
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	count := 0
+	for _, house := range h.subscribers {
+		count += len(house)
+	}
+	return count
+}
+
+// Publish delivers an event to every matching subscriber. A nil hub discards it.
+func (h *Hub) Publish(event StreamEvent) {
+	if h == nil {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for subscription := range h.subscribers[event.SwifletHouseID] {
+		if !subscription.filter.matches(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+// ObserveReadings publishes stored readings
+func (h *Hub) ObserveReadings(readings []SensorReading) {
+	for _, reading := range readings {
+		values := make(map[string]float64, len(reading.Values))
+		for metric, value := range reading.Values {
+			values[metric] = value
+		}
+
+		h.Publish(StreamEvent{
+			Type:           StreamEventReading,
+			SwifletHouseID: reading.SwifletHouseID,
+			InstallCode:    reading.InstallCode,
+			Data: models.StreamReading{
+				InstallCode:    reading.InstallCode,
+				SwifletHouseID: reading.SwifletHouseID,
+				Floor:          reading.Floor,
+				Values:         values,
+				Timestamp:      reading.Timestamp,
+			},
+		})
+	}
+}
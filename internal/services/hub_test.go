@@ -0,0 +1,60 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestHubFiltersByHouseAndDevice(t *testing.T) {
+	hub := NewHub()
+	house := hub.Subscribe(StreamFilter{SwifletHouseID: 1})
+	device := hub.Subscribe(StreamFilter{SwifletHouseID: 1, InstallCode: "GW-02"})
+	other := hub.Subscribe(StreamFilter{SwifletHouseID: 2})
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	hub.ObserveReadings([]SensorReading{
+		{InstallCode: "GW-01", SwifletHouseID: 1, Floor: 1, Values: map[string]float64{models.MetricSuhu: 28}, Timestamp: now},
+		{InstallCode: "GW-02", SwifletHouseID: 1, Floor: 2, Values: map[string]float64{models.MetricSuhu: 29}, Timestamp: now},
+	})
+	hub.Publish(StreamEvent{Type: StreamEventAlert, SwifletHouseID: 1, Data: models.Alert{ID: 5}})
+
+	if got := len(house.Events); got != 3 {
+		t.Errorf("house subscriber got %d events, want 3", got)
+	}
+	if got := len(device.Events); got != 2 {
+		t.Errorf("device subscriber got %d events, want 2", got)
+	}
+	if got := len(other.Events); got != 0 {
+		t.Errorf("other house subscriber got %d events, want 0", got)
+	}
+
+	event := <-device.Events
+	reading, ok := event.Data.(models.StreamReading)
+	if event.Type != StreamEventReading || !ok || reading.InstallCode != "GW-02" || reading.Values[models.MetricSuhu] != 29 {
+		t.Errorf("device subscriber got %+v", event)
+	}
+
+	// Unsubscribing closes the channel once buffered events are read
+	hub.Unsubscribe(house)
+	for range house.Events {
+	}
+	if got := hub.Subscribers(); got != 2 {
+		t.Errorf("subscribers = %d, want 2", got)
+	}
+	// Unsubscribing twice is harmless
+	hub.Unsubscribe(house)
+}
+
+func TestHubDropsEventsOfSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	subscription := hub.Subscribe(StreamFilter{SwifletHouseID: 1})
+
+	for i := 0; i < subscriptionBuffer+10; i++ {
+		hub.Publish(StreamEvent{Type: StreamEventAlert, SwifletHouseID: 1})
+	}
+
+	if got := subscription.Dropped(); got != 10 {
+		t.Errorf("dropped = %d, want 10", got)
+	}
+}
@@ -0,0 +1,406 @@
+package services
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// Sensor import file formats
+const (
+	ImportCSV    = "csv"
+	ImportNDJSON = "ndjson"
+)
+
+// maxImportErrors bounds the row errors listed in an import report
+const maxImportErrors = 1000
+
+// maxImportLine bounds the length of an NDJSON line
+const maxImportLine = 1 << 20
+
+// ErrInvalidImportFile is returned when an import file cannot be read any further
+var ErrInvalidImportFile = errors.New("invalid import file")
+
+// RejectHouseNotAllowed is the reason for import rows taken while the device
+// was in a swiflet house the uploader may not import into
+const RejectHouseNotAllowed = "house_not_allowed"
+
+// ImportObserver is notified of the time range of the readings an import
+// stored, so results derived from them can be computed again
+type ImportObserver interface {
+	ReadingsImported(start, end time.Time)
+}
+
+// SensorImporter backfills the readings of a device from an uploaded file,
+// e.g. the SD-card log of a gateway that was offline. Rows are validated like
+// live readings and stored in batches.
+type SensorImporter struct {
+	db          *database.DB
+	registry    *DeviceRegistry
+	spikeWindow time.Duration
+	batchSize   int
+
+	observersMu sync.RWMutex
+	observers   []ImportObserver
+}
+
+func NewSensorImporter(db *database.DB, registry *DeviceRegistry, cfg config.IngestConfig) *SensorImporter {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+
+	return &SensorImporter{
+		db:          db,
+		registry:    registry,
+		spikeWindow: cfg.SpikeWindow,
+		batchSize:   cfg.BatchSize,
+	}
+}
+
+// AddObserver registers an observer for imported readings
+func (im *SensorImporter) AddObserver(observer ImportObserver) {
+	im.observersMu.Lock()
+	im.observers = append(im.observers, observer)
+	im.observersMu.Unlock()
+}
+
+// Import reads the file and stores its readings for the device. Rows are only
+// stored in the swiflet houses in houses, or in any house when houses is nil.
+// Every batch is stored in its own transaction, so when an error is returned
+// the report still counts the rows stored before it. The rollups of the
+// imported period are refreshed and observers notified even then.
+func (im *SensorImporter) Import(device DeviceInfo, format string, r io.Reader, houses map[int]bool) (models.SensorImportReport, error) {
+	// Rows are attributed to the house and floor the device was on when they
+	// were taken
+	assignments, err := LoadAssignments(im.db, device.ID)
+	if err != nil {
+		return models.SensorImportReport{}, fmt.Errorf("failed to load device assignments: %w", err)
+	}
+
+	report := models.SensorImportReport{
+		InstallCode: device.InstallCode,
+		Format:      format,
+		Errors:      []models.SensorImportRowError{},
+	}
+
+	addError := func(rowError models.SensorImportRowError) {
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, rowError)
+		} else {
+			report.ErrorsTruncated = true
+		}
+	}
+
+	// Spikes are checked between the rows of the upload, which should be in
+	// time order
+	validator := NewReadingValidator(im.registry, im.spikeWindow)
+	receivedAt := time.Now()
+
+	// Period of the readings that stored new values
+	var first, last time.Time
+
+	batch := make([]SensorReading, 0, im.batchSize)
+	flush := func() error {
+		result, err := storeReadings(im.db, batch)
+		if err != nil {
+			return fmt.Errorf("failed to store readings: %w", err)
+		}
+		report.Inserted += result.inserted
+		report.Duplicates += result.skipped
+		for _, reading := range result.stored {
+			if first.IsZero() || reading.Timestamp.Before(first) {
+				first = reading.Timestamp
+			}
+			if reading.Timestamp.After(last) {
+				last = reading.Timestamp
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err = readImportRows(format, r, device.InstallCode, func(line int, reading DecodedReading, err error) error {
+		report.Rows++
+		if err != nil {
+			report.Rejected++
+			addError(models.SensorImportRowError{Row: line, Reason: RejectInvalidPayload, Error: err.Error()})
+			return nil
+		}
+
+		houseID, floor := device.SwifletHouseID, device.Floor
+		if assignment, ok := AssignmentAt(assignments, reading.Timestamp); ok {
+			houseID, floor = assignment.SwifletHouseID, assignment.Floor
+		}
+		if houses != nil && !houses[houseID] {
+			report.Rejected++
+			addError(models.SensorImportRowError{
+				Row: line, Reason: RejectHouseNotAllowed,
+				Error: fmt.Sprintf("device was in swiflet house %d, which you may not import into", houseID),
+			})
+			return nil
+		}
+
+		// Keep only metrics the device is registered for
+		values := make(map[string]float64, len(reading.Values))
+		for metric, value := range reading.Values {
+			if im.registry.AcceptsMetric(device, metric) {
+				values[metric] = value
+				continue
+			}
+			addError(models.SensorImportRowError{
+				Row: line, Metric: metric, Value: &value,
+				Reason: RejectUnregisteredMetric, Error: "metric is not registered for the device",
+			})
+		}
+		if len(values) == 0 {
+			report.Rejected++
+			return nil
+		}
+
+		// Out-of-range values and spikes are quarantined like live readings
+		accepted, quarantined := validator.Validate(device.InstallCode, values, reading.Timestamp)
+		for _, value := range quarantined {
+			addError(models.SensorImportRowError{
+				Row: line, Metric: value.Metric, Value: &value.Value,
+				Reason: value.Reason, Error: value.Detail,
+			})
+		}
+		report.Quarantined += len(quarantined)
+		if len(accepted) > 0 {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+
+		batch = append(batch, SensorReading{
+			InstallCode:    device.InstallCode,
+			SwifletHouseID: houseID,
+			Floor:          floor,
+			Values:         accepted,
+			Quarantined:    quarantined,
+			Timestamp:      reading.Timestamp,
+			ReceivedAt:     receivedAt,
+		})
+		if len(batch) >= im.batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if first.IsZero() {
+		return report, err
+	}
+
+	// The refresh policies only cover the last days, so rollups of older
+	// imported readings are refreshed here
+	if refreshErr := RefreshRollups(im.db, first, last); refreshErr != nil {
+		log.Printf("Failed to refresh rollups after importing readings of %s: %v", device.InstallCode, refreshErr)
+		if err == nil {
+			err = refreshErr
+		}
+	}
+
+	im.observersMu.RLock()
+	defer im.observersMu.RUnlock()
+	for _, observer := range im.observers {
+		observer.ReadingsImported(first, last)
+	}
+
+	return report, err
+}
+
+// readImportRows parses an import file and calls fn for every data row with
+// its line number. A row that cannot be parsed is passed to fn with its error;
+// errors that make the rest of the file unreadable wrap ErrInvalidImportFile.
+// Rows without an install_code belong to installCode; rows of another device
+// are errors.
+func readImportRows(format string, r io.Reader, installCode string, fn func(line int, reading DecodedReading, err error) error) error {
+	switch format {
+	case ImportCSV:
+		return readCSVRows(r, installCode, fn)
+	case ImportNDJSON:
+		return readNDJSONRows(r, installCode, fn)
+	}
+	return fmt.Errorf("%w: unsupported format %q", ErrInvalidImportFile, format)
+}
+
+// readCSVRows reads a header row naming a timestamp column, an optional
+// install_code column and one column per metric, followed by one reading per
+// row. Empty metric cells are skipped.
+func readCSVRows(r io.Reader, installCode string, fn func(line int, reading DecodedReading, err error) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("%w: file is empty", ErrInvalidImportFile)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidImportFile, err)
+	}
+
+	timestampColumn, installCodeColumn := -1, -1
+	metrics := make(map[int]string)
+	seen := make(map[string]bool)
+	for i, name := range header {
+		// Spreadsheet exports often start with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if name == "" {
+			return fmt.Errorf("%w: column %d has no name", ErrInvalidImportFile, i+1)
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: duplicate column %q", ErrInvalidImportFile, name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "timestamp":
+			timestampColumn = i
+		case "install_code":
+			installCodeColumn = i
+		default:
+			metrics[i] = name
+		}
+	}
+	if timestampColumn < 0 {
+		return fmt.Errorf("%w: timestamp column is required", ErrInvalidImportFile)
+	}
+	if len(metrics) == 0 {
+		return fmt.Errorf("%w: no metric columns", ErrInvalidImportFile)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidImportFile, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(record) != len(header) {
+			err = fmt.Errorf("row has %d fields, header has %d", len(record), len(header))
+			if err := fn(line, DecodedReading{}, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		reading, err := parseCSVRecord(record, timestampColumn, installCodeColumn, metrics, installCode)
+		if err := fn(line, reading, err); err != nil {
+			return err
+		}
+	}
+}
+
+func parseCSVRecord(record []string, timestampColumn, installCodeColumn int, metrics map[int]string, installCode string) (DecodedReading, error) {
+	if installCodeColumn >= 0 {
+		if code := strings.TrimSpace(record[installCodeColumn]); code != "" && code != installCode {
+			return DecodedReading{}, fmt.Errorf("install_code %q does not match %q", code, installCode)
+		}
+	}
+
+	timestamp, err := parseImportTimestamp(strings.TrimSpace(record[timestampColumn]))
+	if err != nil {
+		return DecodedReading{}, err
+	}
+
+	values := make(map[string]float64, len(metrics))
+	for i, metric := range metrics {
+		cell := strings.TrimSpace(record[i])
+		if cell == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return DecodedReading{}, fmt.Errorf("%s: invalid number %q", metric, cell)
+		}
+		values[metric] = value
+	}
+	if len(values) == 0 {
+		return DecodedReading{}, errors.New("reading has no values")
+	}
+
+	return DecodedReading{InstallCode: installCode, Values: values, Timestamp: timestamp}, nil
+}
+
+// parseImportTimestamp accepts an RFC3339 timestamp or epoch milliseconds.
+// Unlike live messages there is no receive time to fall back to, so a
+// timestamp is required.
+func parseImportTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("timestamp is required")
+	}
+	if millis, err := strconv.ParseFloat(value, 64); err == nil {
+		var timestamp SensorTimestamp
+		if err := timestamp.setMillis(millis); err != nil {
+			return time.Time{}, err
+		}
+		return timestamp.Time, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q must be RFC3339 or epoch milliseconds", value)
+	}
+	return timestamp, nil
+}
+
+// readNDJSONRows reads one JSON object per line in the format of a single
+// MQTT reading. Blank lines are skipped.
+func readNDJSONRows(r io.Reader, installCode string, fn func(line int, reading DecodedReading, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		reading, err := parseNDJSONLine([]byte(text), installCode)
+		if err := fn(line, reading, err); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: line %d: %w", ErrInvalidImportFile, line+1, err)
+	}
+	return nil
+}
+
+func parseNDJSONLine(text []byte, installCode string) (DecodedReading, error) {
+	var data SensorData
+	if err := json.Unmarshal(text, &data); err != nil {
+		return DecodedReading{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	reading, err := data.toReading(installCode)
+	if err != nil {
+		return DecodedReading{}, err
+	}
+	if reading.InstallCode != installCode {
+		return DecodedReading{}, fmt.Errorf("install_code %q does not match %q", reading.InstallCode, installCode)
+	}
+	// Unparseable timestamp strings decode as zero
+	if reading.Timestamp.IsZero() {
+		return DecodedReading{}, errors.New("timestamp is required, as RFC3339 or epoch milliseconds")
+	}
+	return reading, nil
+}
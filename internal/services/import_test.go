@@ -0,0 +1,119 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+type importedRow struct {
+	line    int
+	reading DecodedReading
+	err     error
+}
+
+func readAllImportRows(t *testing.T, format, file string) ([]importedRow, error) {
+	t.Helper()
+	var rows []importedRow
+	err := readImportRows(format, strings.NewReader(file), "GW-01", func(line int, reading DecodedReading, err error) error {
+		rows = append(rows, importedRow{line: line, reading: reading, err: err})
+		return nil
+	})
+	return rows, err
+}
+
+func TestReadImportRowsCSV(t *testing.T) {
+	file := "\ufeffTimestamp,install_code,suhu,kelembaban,nh3\n" +
+		"2024-05-01T10:00:00Z,GW-01,28.5,81,\n" +
+		"1714557660000,,28.6,,3.5\n" +
+		"2024-05-01T10:02:00Z,GW-02,28.7,80,\n" +
+		"yesterday,GW-01,28.7,80,\n" +
+		"2024-05-01T10:04:00Z,GW-01,warm,80,\n" +
+		"2024-05-01T10:05:00Z,GW-01,,,\n" +
+		"2024-05-01T10:06:00Z,GW-01\n"
+
+	rows, err := readAllImportRows(t, ImportCSV, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 {
+		t.Fatalf("got %d rows, want 7", len(rows))
+	}
+
+	first := rows[0]
+	if first.err != nil || first.line != 2 {
+		t.Fatalf("row 1 = %+v", first)
+	}
+	if first.reading.InstallCode != "GW-01" || len(first.reading.Values) != 2 ||
+		first.reading.Values[models.MetricSuhu] != 28.5 || first.reading.Values[models.MetricKelembaban] != 81 {
+		t.Errorf("row 1 reading = %+v", first.reading)
+	}
+
+	second := rows[1]
+	if second.err != nil || !second.reading.Timestamp.Equal(time.Date(2024, 5, 1, 10, 1, 0, 0, time.UTC)) ||
+		second.reading.Values["nh3"] != 3.5 || len(second.reading.Values) != 2 {
+		t.Errorf("row 2 = %+v", second)
+	}
+
+	for _, row := range rows[2:] {
+		if row.err == nil {
+			t.Errorf("line %d accepted: %+v", row.line, row.reading)
+		}
+	}
+	if rows[6].line != 8 {
+		t.Errorf("last row line = %d, want 8", rows[6].line)
+	}
+}
+
+func TestReadImportRowsCSVHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{name: "empty", file: ""},
+		{name: "no timestamp", file: "suhu,kelembaban\n28,80\n"},
+		{name: "no metrics", file: "timestamp,install_code\n"},
+		{name: "duplicate column", file: "timestamp,suhu,suhu\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readAllImportRows(t, ImportCSV, tt.file); !errors.Is(err, ErrInvalidImportFile) {
+				t.Errorf("got %v, want ErrInvalidImportFile", err)
+			}
+		})
+	}
+}
+
+func TestReadImportRowsNDJSON(t *testing.T) {
+	file := `{"suhu": 28.5, "kelembaban": 81, "timestamp": "2024-05-01T10:00:00Z"}
+
+{"install_code": "GW-01", "metrics": {"nh3": 3.5}, "timestamp": 1714557660000}
+{"install_code": "GW-02", "suhu": 28.7, "timestamp": "2024-05-01T10:02:00Z"}
+{"suhu": 28.7, "kelembaban": 80}
+{"suhu": 28.7, "timestamp": "05/01/2024 10:04"}
+not json
+`
+
+	rows, err := readAllImportRows(t, ImportNDJSON, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("got %d rows, want 6", len(rows))
+	}
+
+	if rows[0].err != nil || rows[0].line != 1 || rows[0].reading.Values[models.MetricKelembaban] != 81 {
+		t.Errorf("row 1 = %+v", rows[0])
+	}
+	if rows[1].err != nil || rows[1].line != 3 || rows[1].reading.Values["nh3"] != 3.5 {
+		t.Errorf("row 2 = %+v", rows[1])
+	}
+	for _, row := range rows[2:] {
+		if row.err == nil {
+			t.Errorf("line %d accepted: %+v", row.line, row.reading)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIngestQueueFull is returned when a reading could not be queued before the enqueue timeout
+var ErrIngestQueueFull = errors.New("ingest queue is full")
+
+// ErrIngestStopped is returned when a reading is submitted after the ingestor was stopped
+var ErrIngestStopped = errors.New("ingestor is stopped")
+
+// PostgreSQL accepts at most 65535 bind parameters per statement
+const maxBindParams = 65535
+
+// SensorReading is a validated reading waiting to be written to TimescaleDB
+type SensorReading struct {
+	InstallCode    string
+	SwifletHouseID int
+	Floor          int
+	// Values holds every accepted metric of the reading keyed by metric type
+	Values map[string]float64
+	// Quarantined holds values that failed validation
+	Quarantined []QuarantinedValue
+	Timestamp   time.Time
+
+	// Original message, kept so failed inserts can be dead-lettered
+	Topic      string
+	Payload    []byte
+	ReceivedAt time.Time
+}
+
+// ReadingObserver is notified of readings after they were stored, reduced to
+// the values that were not already in the database. Observers run on the
+// ingest workers and must not block; the slice is reused once ObserveReadings
+// returns.
+type ReadingObserver interface {
+	ObserveReadings(readings []SensorReading)
+}
+
+// IngestStats reports the state of the ingestion pipeline
+type IngestStats struct {
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Workers       int    `json:"workers"`
+	Enqueued      uint64 `json:"enqueued"`
+	Inserted      uint64 `json:"inserted"`
+	Dropped       uint64 `json:"dropped"`
+	Quarantined   uint64 `json:"quarantined"`
+	// Duplicates counts readings dropped as redeliveries before queueing,
+	// DuplicateRows rows skipped by the unique indexes in TimescaleDB
+	Duplicates    uint64 `json:"duplicates"`
+	DuplicateRows uint64 `json:"duplicate_rows"`
+	FailedBatches uint64 `json:"failed_batches"`
+}
+
+// SensorIngestor buffers sensor readings in a bounded queue and writes them
+// to TimescaleDB in batches from a pool of workers
+type SensorIngestor struct {
+	db          *database.DB
+	config      config.IngestConfig
+	deadLetters *DeadLetterStore
+	queue       chan SensorReading
+	wg          sync.WaitGroup
+
+	mu      sync.RWMutex
+	started bool
+	stopped bool
+
+	observersMu sync.RWMutex
+	observers   []ReadingObserver
+
+	enqueued      atomic.Uint64
+	inserted      atomic.Uint64
+	dropped       atomic.Uint64
+	quarantined   atomic.Uint64
+	duplicateRows atomic.Uint64
+	failedBatches atomic.Uint64
+}
+
+func NewSensorIngestor(cfg config.IngestConfig, db *database.DB, deadLetters *DeadLetterStore) *SensorIngestor {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = 1
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	return &SensorIngestor{
+		db:          db,
+		config:      cfg,
+		deadLetters: deadLetters,
+		queue:       make(chan SensorReading, cfg.QueueSize),
+	}
+}
+
+// Start launches the worker pool
+func (i *SensorIngestor) Start() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.started || i.stopped {
+		return
+	}
+	i.started = true
+
+	for w := 0; w < i.config.Workers; w++ {
+		i.wg.Add(1)
+		go i.worker()
+	}
+
+	log.Printf("Sensor ingestor started: %d workers, queue %d, batch %d, flush every %v",
+		i.config.Workers, i.config.QueueSize, i.config.BatchSize, i.config.FlushInterval)
+}
+
+// Enqueue queues a reading for insertion. When the queue is full it blocks
+// for up to the enqueue timeout, which slows the MQTT callback down and
+// pushes back on the broker, before dropping the reading.
+func (i *SensorIngestor) Enqueue(reading SensorReading) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.stopped {
+		i.dropped.Add(1)
+		return ErrIngestStopped
+	}
+
+	select {
+	case i.queue <- reading:
+		i.enqueued.Add(1)
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(i.config.EnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case i.queue <- reading:
+		i.enqueued.Add(1)
+		return nil
+	case <-timer.C:
+		i.dropped.Add(1)
+		return ErrIngestQueueFull
+	}
+}
+
+// AddObserver registers an observer for stored readings
+func (i *SensorIngestor) AddObserver(observer ReadingObserver) {
+	i.observersMu.Lock()
+	i.observers = append(i.observers, observer)
+	i.observersMu.Unlock()
+}
+
+// Stop stops accepting readings and waits until the queue is drained
+func (i *SensorIngestor) Stop() {
+	i.mu.Lock()
+	if i.stopped {
+		i.mu.Unlock()
+		return
+	}
+	i.stopped = true
+	close(i.queue)
+	started := i.started
+	i.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	log.Printf("Draining sensor ingest queue (%d pending)...", len(i.queue))
+	i.wg.Wait()
+	log.Println("Sensor ingestor stopped")
+}
+
+// Stats returns a snapshot of the pipeline counters
+func (i *SensorIngestor) Stats() IngestStats {
+	return IngestStats{
+		QueueDepth:    len(i.queue),
+		QueueCapacity: cap(i.queue),
+		Workers:       i.config.Workers,
+		Enqueued:      i.enqueued.Load(),
+		Inserted:      i.inserted.Load(),
+		Dropped:       i.dropped.Load(),
+		Quarantined:   i.quarantined.Load(),
+		DuplicateRows: i.duplicateRows.Load(),
+		FailedBatches: i.failedBatches.Load(),
+	}
+}
+
+func (i *SensorIngestor) worker() {
+	defer i.wg.Done()
+
+	batch := make([]SensorReading, 0, i.config.BatchSize)
+	ticker := time.NewTicker(i.config.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		i.flush(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case reading, ok := <-i.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, reading)
+			if len(batch) >= i.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (i *SensorIngestor) flush(batch []SensorReading) {
+	stored, err := i.insertBatch(batch)
+	if err != nil {
+		i.failedBatches.Add(1)
+		log.Printf("Failed to insert batch of %d sensor readings: %v", len(batch), err)
+		// Batched payloads produce several readings; dead-letter each message once
+		recorded := make(map[string]bool)
+		for _, reading := range batch {
+			key := reading.Topic + "\x00" + string(reading.Payload)
+			if recorded[key] {
+				continue
+			}
+			recorded[key] = true
+			i.deadLetters.Record(reading.Topic, reading.Payload, reject(RejectInsertFailed, err), reading.ReceivedAt)
+		}
+		return
+	}
+	for _, reading := range batch {
+		i.quarantined.Add(uint64(len(reading.Quarantined)))
+	}
+	// Observers only hear of values stored for the first time, so redelivered
+	// readings do not fire automations or alerts twice
+	if len(stored) == 0 {
+		return
+	}
+	i.inserted.Add(uint64(len(stored)))
+
+	i.observersMu.RLock()
+	defer i.observersMu.RUnlock()
+	for _, observer := range i.observers {
+		observer.ObserveReadings(stored)
+	}
+}
+
+// insertBatch writes the readings in one transaction, counts the rows
+// skipped as duplicates and returns the readings that stored new values
+func (i *SensorIngestor) insertBatch(batch []SensorReading) ([]SensorReading, error) {
+	result, err := storeReadings(i.db, batch)
+	if err != nil {
+		return nil, err
+	}
+	if result.skipped > 0 {
+		i.duplicateRows.Add(uint64(result.skipped))
+	}
+	return result.stored, nil
+}
+
+// storedValue identifies a sensor value by the unique indexes of sensors and
+// sensor_measurements
+type storedValue struct {
+	installCode string
+	metric      string
+	timestamp   int64
+}
+
+func newStoredValue(installCode, metric string, timestamp time.Time) storedValue {
+	return storedValue{installCode: installCode, metric: metric, timestamp: timestamp.UnixMicro()}
+}
+
+// storeResult counts the sensor rows of a batch and holds its readings
+// reduced to the values that were actually inserted
+type storeResult struct {
+	inserted int64
+	skipped  int64
+	stored   []SensorReading
+}
+
+// storedReadings reduces the readings of a batch to the values in inserted.
+// Readings none of whose values were inserted are left out. A value is matched
+// to the first reading of the batch carrying it, since later ones with the
+// same install_code and timestamp were skipped; inserted is emptied in the
+// process.
+func storedReadings(batch []SensorReading, inserted map[storedValue]bool) []SensorReading {
+	var stored []SensorReading
+	for _, reading := range batch {
+		values := make(map[string]float64, len(reading.Values))
+		for metric, value := range reading.Values {
+			key := newStoredValue(reading.InstallCode, metric, reading.Timestamp)
+			if inserted[key] {
+				values[metric] = value
+				delete(inserted, key)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if len(values) < len(reading.Values) {
+			reading.Values = values
+		}
+		stored = append(stored, reading)
+	}
+	return stored
+}
+
+// storeReadings writes the readings in one transaction. Readings carrying the
+// full temperature/humidity pair go to sensors; every other value goes to
+// sensor_measurements, one row per metric. Quarantined values go to
+// sensor_quarantine. Rows already stored for the same install_code and
+// timestamp are skipped, and left out of the stored readings of the result.
+// The device sequence number is not stored: two readings with the same
+// timestamp are duplicates here even when their seq differs.
+func storeReadings(db *database.DB, batch []SensorReading) (storeResult, error) {
+	var sensorRows, measurementRows, quarantineRows [][]interface{}
+	for _, reading := range batch {
+		// TimescaleDB keeps microseconds; truncating here lets inserted rows be
+		// matched back to their readings
+		timestamp := reading.Timestamp.Truncate(time.Microsecond)
+
+		for _, value := range reading.Quarantined {
+			quarantineRows = append(quarantineRows, []interface{}{
+				reading.InstallCode, reading.SwifletHouseID, reading.Floor, value.Metric, value.Value,
+				value.Reason, value.Detail, timestamp, reading.ReceivedAt,
+			})
+		}
+
+		suhu, hasSuhu := reading.Values[models.MetricSuhu]
+		kelembaban, hasKelembaban := reading.Values[models.MetricKelembaban]
+		climatePair := hasSuhu && hasKelembaban
+
+		if climatePair {
+			sensorRows = append(sensorRows, []interface{}{
+				reading.InstallCode, reading.SwifletHouseID, reading.Floor, suhu, kelembaban, timestamp,
+			})
+		}
+
+		for metric, value := range reading.Values {
+			if climatePair && (metric == models.MetricSuhu || metric == models.MetricKelembaban) {
+				continue
+			}
+			measurementRows = append(measurementRows, []interface{}{
+				reading.InstallCode, reading.SwifletHouseID, reading.Floor, metric, value, timestamp,
+			})
+		}
+	}
+
+	tx, err := db.TimescaleDB.Begin()
+	if err != nil {
+		return storeResult{}, err
+	}
+	defer tx.Rollback()
+
+	inserted := make(map[storedValue]bool)
+
+	sensorsInserted, err := insertRows(tx, "sensors",
+		[]string{"install_code", "id_swiflet_house", "floor", "suhu", "kelembaban", "timestamp"}, sensorRows,
+		"install_code, timestamp", func(rows *sql.Rows) error {
+			var installCode string
+			var timestamp time.Time
+			if err := rows.Scan(&installCode, &timestamp); err != nil {
+				return err
+			}
+			inserted[newStoredValue(installCode, models.MetricSuhu, timestamp)] = true
+			inserted[newStoredValue(installCode, models.MetricKelembaban, timestamp)] = true
+			return nil
+		})
+	if err != nil {
+		return storeResult{}, err
+	}
+
+	measurementsInserted, err := insertRows(tx, "sensor_measurements",
+		[]string{"install_code", "id_swiflet_house", "floor", "metric", "value", "timestamp"}, measurementRows,
+		"install_code, metric, timestamp", func(rows *sql.Rows) error {
+			var installCode, metric string
+			var timestamp time.Time
+			if err := rows.Scan(&installCode, &metric, &timestamp); err != nil {
+				return err
+			}
+			inserted[newStoredValue(installCode, metric, timestamp)] = true
+			return nil
+		})
+	if err != nil {
+		return storeResult{}, err
+	}
+
+	_, err = insertRows(tx, "sensor_quarantine",
+		[]string{"install_code", "id_swiflet_house", "floor", "metric", "value", "reason", "detail", "timestamp", "received_at"},
+		quarantineRows, "", nil)
+	if err != nil {
+		return storeResult{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storeResult{}, err
+	}
+
+	rowsInserted := sensorsInserted + measurementsInserted
+	return storeResult{
+		inserted: rowsInserted,
+		skipped:  int64(len(sensorRows)+len(measurementRows)) - rowsInserted,
+		stored:   storedReadings(batch, inserted),
+	}, nil
+}
+
+// insertRows writes rows with multi-row INSERT statements, split so no
+// statement exceeds the bind parameter limit, and returns the number of rows
+// inserted. With returning set, rows violating a unique index are skipped and
+// the returning columns of every inserted row are passed to scan.
+func insertRows(tx *sql.Tx, table string, columns []string, rows [][]interface{},
+	returning string, scan func(*sql.Rows) error) (int64, error) {
+	rowsPerStatement := maxBindParams / len(columns)
+
+	var inserted int64
+
+	for start := 0; start < len(rows); start += rowsPerStatement {
+		end := min(start+rowsPerStatement, len(rows))
+
+		var query strings.Builder
+		fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for n, row := range rows[start:end] {
+			if n > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for col := range columns {
+				if col > 0 {
+					query.WriteString(", ")
+				}
+				fmt.Fprintf(&query, "$%d", n*len(columns)+col+1)
+			}
+			query.WriteString(")")
+			args = append(args, row...)
+		}
+
+		if returning == "" {
+			result, err := tx.Exec(query.String(), args...)
+			if err != nil {
+				return inserted, fmt.Errorf("failed to insert into %s: %w", table, err)
+			}
+			affected, _ := result.RowsAffected()
+			inserted += affected
+			continue
+		}
+
+		query.WriteString(" ON CONFLICT DO NOTHING RETURNING " + returning)
+		n, err := queryInserted(tx, query.String(), args, scan)
+		if err != nil {
+			return inserted, fmt.Errorf("failed to insert into %s: %w", table, err)
+		}
+		inserted += n
+	}
+
+	return inserted, nil
+}
+
+// queryInserted runs an INSERT ... RETURNING statement and scans its rows
+func queryInserted(tx *sql.Tx, query string, args []interface{}, scan func(*sql.Rows) error) (int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestStoredReadings(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 1500, time.UTC)
+	// As read back from TimescaleDB, with the nanoseconds dropped
+	stored := ts.Truncate(time.Microsecond).In(time.FixedZone("WIB", 7*3600))
+
+	batch := []SensorReading{
+		{InstallCode: "GW-01", Timestamp: ts, Values: map[string]float64{
+			models.MetricSuhu: 28.5, models.MetricKelembaban: 85, "nh3": 12,
+		}},
+		{InstallCode: "GW-02", Timestamp: ts, Values: map[string]float64{"nh3": 9}},
+		{InstallCode: "GW-03", Timestamp: ts, Values: map[string]float64{"co2": 450}},
+	}
+	inserted := map[storedValue]bool{
+		newStoredValue("GW-01", models.MetricSuhu, stored):       true,
+		newStoredValue("GW-01", models.MetricKelembaban, stored): true,
+		newStoredValue("GW-02", "nh3", stored):                   true,
+	}
+
+	got := storedReadings(batch, inserted)
+	if len(got) != 2 {
+		t.Fatalf("got %d readings, want 2", len(got))
+	}
+
+	if got[0].InstallCode != "GW-01" || len(got[0].Values) != 2 {
+		t.Errorf("GW-01 values = %v, want only the climate pair", got[0].Values)
+	}
+	if _, ok := got[0].Values["nh3"]; ok {
+		t.Error("duplicate nh3 value of GW-01 should be left out")
+	}
+	if len(batch[0].Values) != 3 {
+		t.Error("values of the batch must not be modified")
+	}
+
+	if got[1].InstallCode != "GW-02" || got[1].Values["nh3"] != 9 {
+		t.Errorf("second reading = %+v, want GW-02 with nh3", got[1])
+	}
+}
+
+// Storage dedup is by install_code and timestamp only: readings that the dedup
+// cache keeps apart by seq collapse into one stored row
+func TestStoredReadingsIgnoreSeq(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	seq, otherSeq := uint64(7), uint64(8)
+	first, _ := dedupKey("GW-01", ts, &seq)
+	second, _ := dedupKey("GW-01", ts, &otherSeq)
+	if first == second {
+		t.Fatal("dedup cache should keep readings with another seq apart")
+	}
+
+	batch := []SensorReading{
+		{InstallCode: "GW-01", Timestamp: ts, Values: map[string]float64{"nh3": 12}},
+		{InstallCode: "GW-01", Timestamp: ts, Values: map[string]float64{"nh3": 13}},
+	}
+	// The unique index skips the second row
+	inserted := map[storedValue]bool{newStoredValue("GW-01", "nh3", ts): true}
+
+	got := storedReadings(batch, inserted)
+	if len(got) != 1 || got[0].Values["nh3"] != 12 {
+		t.Errorf("stored readings = %+v, want only the first", got)
+	}
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrDeviceRetired is returned when a decommissioned device is changed
+var ErrDeviceRetired = errors.New("device is decommissioned")
+
+// RuleLoader is a rule engine whose rules are reloaded after devices or
+// houses are retired
+type RuleLoader interface {
+	Load() error
+}
+
+// AssignmentColumns selects an assignment for ScanAssignment
+const AssignmentColumns = `id, id_device, id_swiflet_house, floor, assigned_at, unassigned_at, end_reason,
+	assigned_by, created_at`
+
+func ScanAssignment(row interface{ Scan(...interface{}) error }) (models.DeviceAssignment, error) {
+	var assignment models.DeviceAssignment
+	err := row.Scan(&assignment.ID, &assignment.DeviceID, &assignment.SwifletHouseID, &assignment.Floor,
+		&assignment.AssignedAt, &assignment.UnassignedAt, &assignment.EndReason, &assignment.AssignedBy,
+		&assignment.CreatedAt)
+	return assignment, err
+}
+
+// LoadAssignments returns the assignment history of a device, oldest first
+func LoadAssignments(db *database.DB, deviceID int) ([]models.DeviceAssignment, error) {
+	rows, err := db.PostgreSQL.Query(`
+		SELECT `+AssignmentColumns+`
+		FROM device_assignments
+		WHERE id_device = $1
+		ORDER BY assigned_at ASC, id ASC
+	`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignments := []models.DeviceAssignment{}
+	for rows.Next() {
+		assignment, err := ScanAssignment(rows)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment)
+	}
+	return assignments, rows.Err()
+}
+
+// AssignmentAt returns the assignment in effect at a time from a history
+// ordered by assigned_at. Readings from before the first assignment belong to
+// it, and readings after a device was retired to the last one.
+func AssignmentAt(assignments []models.DeviceAssignment, at time.Time) (models.DeviceAssignment, bool) {
+	if len(assignments) == 0 {
+		return models.DeviceAssignment{}, false
+	}
+
+	// The last assignment that started at or before the time
+	n := sort.Search(len(assignments), func(i int) bool { return assignments[i].AssignedAt.After(at) })
+	if n == 0 {
+		return assignments[0], true
+	}
+	return assignments[n-1], true
+}
+
+// openAssignment records that a device was installed on a floor
+func openAssignment(tx *sql.Tx, deviceID, houseID, floor int, userID *int, at time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO device_assignments (id_device, id_swiflet_house, floor, assigned_at, assigned_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $4)
+	`, deviceID, houseID, floor, at, userID)
+	return err
+}
+
+// closeAssignment ends the current assignment of a device
+func closeAssignment(tx *sql.Tx, deviceID int, reason string, at time.Time) error {
+	_, err := tx.Exec(`
+		UPDATE device_assignments SET unassigned_at = $1, end_reason = $2
+		WHERE id_device = $3 AND unassigned_at IS NULL
+	`, at, reason, deviceID)
+	return err
+}
+
+// DeviceLifecycle moves, decommissions and deletes devices and houses. It
+// keeps the assignment history that attributes readings to the house and
+// floor they were taken on, and the in-memory caches in step. Sensor readings
+// are never deleted: they stay attributed to their house and floor.
+type DeviceLifecycle struct {
+	db       *database.DB
+	registry *DeviceRegistry
+	presence *PresenceTracker
+	live     *LiveCache
+	rules    []RuleLoader
+}
+
+func NewDeviceLifecycle(db *database.DB, registry *DeviceRegistry, presence *PresenceTracker, live *LiveCache,
+	rules ...RuleLoader) *DeviceLifecycle {
+	return &DeviceLifecycle{
+		db:       db,
+		registry: registry,
+		presence: presence,
+		live:     live,
+		rules:    rules,
+	}
+}
+
+// Move re-assigns a device to a floor of a house. Readings already stored
+// keep the house and floor they were taken on; new ones get the new place.
+// Automation rules of the old house that drive the device are disabled.
+func (l *DeviceLifecycle) Move(device models.IoTDevice, houseID, floor, userID int) (models.IoTDevice, error) {
+	if device.DecommissionedAt != nil {
+		return device, ErrDeviceRetired
+	}
+	if device.SwifletHouseID == houseID && device.Floor == floor {
+		return device, nil
+	}
+
+	tx, err := l.db.PostgreSQL.Begin()
+	if err != nil {
+		return device, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if err := closeAssignment(tx, device.ID, models.AssignmentMoved, now); err != nil {
+		return device, fmt.Errorf("failed to close assignment: %w", err)
+	}
+	if err := openAssignment(tx, device.ID, houseID, floor, &userID, now); err != nil {
+		return device, fmt.Errorf("failed to open assignment: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE iot_devices SET id_swiflet_house = $1, floor = $2, updated_at = $3 WHERE id = $4
+	`, houseID, floor, now, device.ID)
+	if err != nil {
+		return device, fmt.Errorf("failed to move device: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE automation_rules SET enabled = FALSE, updated_at = $1
+		WHERE id_device = $2 AND id_swiflet_house <> $3 AND enabled
+	`, now, device.ID, houseID)
+	if err != nil {
+		return device, fmt.Errorf("failed to disable automation rules: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return device, err
+	}
+
+	device.SwifletHouseID = houseID
+	device.Floor = floor
+	device.UpdatedAt = now
+
+	if err := l.registry.Refresh(device.InstallCode); err != nil {
+		log.Printf("Failed to refresh device registry: %v", err)
+	}
+	l.live.Forget(device.InstallCode)
+	if disabled, _ := result.RowsAffected(); disabled > 0 {
+		l.reloadRules()
+	}
+	return device, nil
+}
+
+// Retire decommissions (reason decommissioned) or soft-deletes (reason
+// deleted) a device. Its readings are rejected from then on, its MQTT
+// credentials are revoked and automation rules driving it are disabled.
+func (l *DeviceLifecycle) Retire(device models.IoTDevice, reason string) error {
+	tx, err := l.db.PostgreSQL.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if err := retireDevices(tx, []int{device.ID}, reason, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.forget([]string{device.InstallCode})
+	l.reloadRules()
+	return nil
+}
+
+// DeleteHouse soft-deletes a house with its devices and disables its
+// automation and alert rules. Its readings, climate scores and harvests are
+// kept.
+func (l *DeviceLifecycle) DeleteHouse(houseID int) error {
+	tx, err := l.db.PostgreSQL.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(`
+		UPDATE swiflet_houses SET deleted_at = $1, updated_at = $1 WHERE id = $2 AND deleted_at IS NULL
+	`, now, houseID)
+	if err != nil {
+		return fmt.Errorf("failed to delete house: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, install_code FROM iot_devices WHERE id_swiflet_house = $1 AND deleted_at IS NULL
+	`, houseID)
+	if err != nil {
+		return err
+	}
+	var deviceIDs []int
+	var installCodes []string
+	for rows.Next() {
+		var deviceID int
+		var installCode string
+		if err := rows.Scan(&deviceID, &installCode); err != nil {
+			rows.Close()
+			return err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+		installCodes = append(installCodes, installCode)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := retireDevices(tx, deviceIDs, models.AssignmentDeleted, now); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"automation_rules", "alert_rules"} {
+		_, err := tx.Exec(`UPDATE `+table+` SET enabled = FALSE, updated_at = $1 WHERE id_swiflet_house = $2 AND enabled`,
+			now, houseID)
+		if err != nil {
+			return fmt.Errorf("failed to disable %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.forget(installCodes)
+	l.reloadRules()
+	return nil
+}
+
+// retireDevices closes the assignments of devices, marks them decommissioned
+// or deleted and revokes their credentials
+func retireDevices(tx *sql.Tx, deviceIDs []int, reason string, now time.Time) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(deviceIDs))
+	for i, id := range deviceIDs {
+		ids[i] = int64(id)
+	}
+
+	_, err := tx.Exec(`
+		UPDATE device_assignments SET unassigned_at = $1, end_reason = $2
+		WHERE id_device = ANY($3) AND unassigned_at IS NULL
+	`, now, reason, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to close assignments: %w", err)
+	}
+
+	column := "decommissioned_at"
+	if reason == models.AssignmentDeleted {
+		column = "deleted_at"
+	}
+	_, err = tx.Exec(`UPDATE iot_devices SET `+column+` = $1, updated_at = $1 WHERE id = ANY($2)`, now, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to retire devices: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE device_provisions SET status = $1, updated_at = $2 WHERE id_device = ANY($3)
+	`, models.ProvisionRevoked, now, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to revoke credentials: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE automation_rules SET enabled = FALSE, updated_at = $1 WHERE id_device = ANY($2) AND enabled
+	`, now, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to disable automation rules: %w", err)
+	}
+	return nil
+}
+
+// forget drops retired devices from the caches so their readings are rejected
+func (l *DeviceLifecycle) forget(installCodes []string) {
+	for _, installCode := range installCodes {
+		l.registry.Remove(installCode)
+		l.presence.Remove(installCode)
+		l.live.Forget(installCode)
+	}
+}
+
+func (l *DeviceLifecycle) reloadRules() {
+	for _, rules := range l.rules {
+		if err := rules.Load(); err != nil {
+			log.Printf("Failed to reload rules: %v", err)
+		}
+	}
+}
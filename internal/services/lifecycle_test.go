@@ -0,0 +1,40 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestAssignmentAt(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	moved := day(10)
+	assignments := []models.DeviceAssignment{
+		{ID: 1, SwifletHouseID: 1, Floor: 1, AssignedAt: day(0), UnassignedAt: &moved},
+		{ID: 2, SwifletHouseID: 1, Floor: 3, AssignedAt: day(10)},
+		{ID: 3, SwifletHouseID: 2, Floor: 2, AssignedAt: day(20)},
+	}
+
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		{day(-5), 1}, // imported history from before the device was registered
+		{day(0), 1},
+		{day(9), 1},
+		{day(10), 2},
+		{day(19), 2},
+		{day(20), 3},
+		{day(400), 3},
+	}
+	for _, test := range tests {
+		assignment, ok := AssignmentAt(assignments, test.at)
+		if !ok || assignment.ID != test.want {
+			t.Errorf("%s: got assignment %d, want %d", test.at.Format(time.DateOnly), assignment.ID, test.want)
+		}
+	}
+
+	if _, ok := AssignmentAt(nil, day(0)); ok {
+		t.Error("found an assignment in an empty history")
+	}
+}
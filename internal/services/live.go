@@ -0,0 +1,123 @@
+package services
+
+import (
+	"fmt"
+	"swiflet-backend/internal/database"
+	"sync"
+	"time"
+)
+
+// liveSeedWindow is how far back Load looks for the latest readings
+const liveSeedWindow = 24 * time.Hour
+
+// LiveValue is the latest value of one metric of a device
+type LiveValue struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// LiveDevice is the latest reading of a device, per metric
+type LiveDevice struct {
+	InstallCode string
+	Values      map[string]LiveValue
+	// Timestamp is the time of the most recent value
+	Timestamp time.Time
+}
+
+// LiveCache keeps the latest value of every metric of every device in memory,
+// so current conditions can be served without querying TimescaleDB
+type LiveCache struct {
+	mu      sync.RWMutex
+	devices map[string]*LiveDevice
+}
+
+func NewLiveCache() *LiveCache {
+	return &LiveCache{
+		devices: make(map[string]*LiveDevice),
+	}
+}
+
+// Load seeds the cache with the latest stored value of each device and metric
+func (l *LiveCache) Load(db *database.DB) error {
+	rows, err := db.TimescaleDB.Query(`
+		SELECT DISTINCT ON (install_code, metric) install_code, metric, value, timestamp
+		FROM sensor_readings
+		WHERE timestamp > $1
+		ORDER BY install_code, metric, timestamp DESC
+	`, time.Now().Add(-liveSeedWindow))
+	if err != nil {
+		return fmt.Errorf("failed to load latest readings: %w", err)
+	}
+	defer rows.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for rows.Next() {
+		var installCode, metric string
+		var value LiveValue
+		if err := rows.Scan(&installCode, &metric, &value.Value, &value.Timestamp); err != nil {
+			return fmt.Errorf("failed to scan latest reading: %w", err)
+		}
+		l.set(installCode, metric, value)
+	}
+	return rows.Err()
+}
+
+// ObserveReadings updates the cache with stored readings
+func (l *LiveCache) ObserveReadings(readings []SensorReading) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, reading := range readings {
+		for metric, value := range reading.Values {
+			l.set(reading.InstallCode, metric, LiveValue{Value: value, Timestamp: reading.Timestamp})
+		}
+	}
+}
+
+// set stores a value unless a newer one is cached; the caller holds the lock
+func (l *LiveCache) set(installCode, metric string, value LiveValue) {
+	device, ok := l.devices[installCode]
+	if !ok {
+		device = &LiveDevice{InstallCode: installCode, Values: make(map[string]LiveValue)}
+		l.devices[installCode] = device
+	}
+
+	if current, ok := device.Values[metric]; ok && current.Timestamp.After(value.Timestamp) {
+		return
+	}
+	device.Values[metric] = value
+	if value.Timestamp.After(device.Timestamp) {
+		device.Timestamp = value.Timestamp
+	}
+}
+
+// Forget drops the cached values of a device, e.g. after it was moved and
+// they no longer describe its floor
+func (l *LiveCache) Forget(installCode string) {
+	l.mu.Lock()
+	delete(l.devices, installCode)
+	l.mu.Unlock()
+}
+
+// Device returns a copy of the latest reading of a device
+func (l *LiveCache) Device(installCode string) (LiveDevice, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	device, ok := l.devices[installCode]
+	if !ok {
+		return LiveDevice{}, false
+	}
+
+	snapshot := LiveDevice{
+		InstallCode: device.InstallCode,
+		Values:      make(map[string]LiveValue, len(device.Values)),
+		Timestamp:   device.Timestamp,
+	}
+	for metric, value := range device.Values {
+		snapshot.Values[metric] = value
+	}
+	return snapshot, true
+}
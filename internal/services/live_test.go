@@ -0,0 +1,45 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestLiveCacheKeepsLatestValuePerMetric(t *testing.T) {
+	cache := NewLiveCache()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	cache.ObserveReadings([]SensorReading{
+		{InstallCode: "GW-01", Values: map[string]float64{models.MetricSuhu: 28, models.MetricKelembaban: 80}, Timestamp: now},
+		{InstallCode: "GW-01", Values: map[string]float64{models.MetricSuhu: 29}, Timestamp: now.Add(time.Minute)},
+	})
+	// A late reading does not replace newer values
+	cache.ObserveReadings([]SensorReading{
+		{InstallCode: "GW-01", Values: map[string]float64{models.MetricSuhu: 27}, Timestamp: now.Add(-time.Minute)},
+	})
+
+	device, ok := cache.Device("GW-01")
+	if !ok {
+		t.Fatal("device not cached")
+	}
+	if got := device.Values[models.MetricSuhu]; got.Value != 29 || !got.Timestamp.Equal(now.Add(time.Minute)) {
+		t.Errorf("suhu = %+v, want 29 at +1m", got)
+	}
+	if got := device.Values[models.MetricKelembaban]; got.Value != 80 {
+		t.Errorf("kelembaban = %+v, want 80", got)
+	}
+	if !device.Timestamp.Equal(now.Add(time.Minute)) {
+		t.Errorf("timestamp = %s, want %s", device.Timestamp, now.Add(time.Minute))
+	}
+
+	// Snapshots are copies
+	device.Values[models.MetricSuhu] = LiveValue{Value: 0}
+	if again, _ := cache.Device("GW-01"); again.Values[models.MetricSuhu].Value != 29 {
+		t.Error("snapshot shares its values with the cache")
+	}
+
+	if _, ok := cache.Device("GW-02"); ok {
+		t.Error("unknown device reported as cached")
+	}
+}
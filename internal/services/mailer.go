@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"swiflet-backend/internal/config"
+	"time"
+)
+
+// ErrMailDisabled is returned when mail is sent without an SMTP server
+var ErrMailDisabled = errors.New("mail is not configured")
+
+// Mailer sends plain text email through an SMTP server
+type Mailer struct {
+	cfg config.MailConfig
+}
+
+func NewMailer(cfg config.MailConfig) *Mailer {
+	return &Mailer{cfg: cfg}
+}
+
+// Enabled reports whether an SMTP server is configured
+func (m *Mailer) Enabled() bool {
+	return m.cfg.Host != ""
+}
+
+// Send delivers a plain text message to one recipient
+func (m *Mailer) Send(to, subject, body string) error {
+	if !m.Enabled() {
+		return ErrMailDisabled
+	}
+
+	from, err := mail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	message, err := buildMessage(from, recipient, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+	addr := fmt.Sprintf("%s:%d", m.cfg.Host, m.cfg.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{recipient.Address}, message)
+}
+
+// buildMessage formats a plain text message. Line breaks in the subject are
+// rejected so it cannot add headers.
+func buildMessage(from, to *mail.Address, subject, body string, date time.Time) ([]byte, error) {
+	if strings.ContainsAny(subject, "\r\n") {
+		return nil, errors.New("subject must be a single line")
+	}
+
+	var message strings.Builder
+	message.WriteString("From: " + from.String() + "\r\n")
+	message.WriteString("To: " + to.String() + "\r\n")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	message.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(message.String()), nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMessage(t *testing.T) {
+	from := &mail.Address{Name: "Swiftlead", Address: "no-reply@swiftlead.id"}
+	to := &mail.Address{Address: "worker@example.com"}
+	date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	message, err := buildMessage(from, to, "Undangan rumah walet", "Halo,\nKlik tautan ini.\r\nTerima kasih", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := string(message)
+	header, body, found := strings.Cut(text, "\r\n\r\n")
+	if !found {
+		t.Fatalf("message has no header separator: %q", text)
+	}
+	for _, want := range []string{
+		`From: "Swiftlead" <no-reply@swiftlead.id>`,
+		"To: <worker@example.com>",
+		"Subject: Undangan rumah walet",
+		"Date: Wed, 01 May 2024 10:00:00 +0000",
+		"Content-Type: text/plain; charset=utf-8",
+	} {
+		if !strings.Contains(header+"\r\n", want+"\r\n") {
+			t.Errorf("header is missing %q:\n%s", want, header)
+		}
+	}
+	if want := "Halo,\r\nKlik tautan ini.\r\nTerima kasih"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestBuildMessageRejectsHeaderInjection(t *testing.T) {
+	from := &mail.Address{Address: "no-reply@swiftlead.id"}
+	to := &mail.Address{Address: "worker@example.com"}
+
+	if _, err := buildMessage(from, to, "Hello\r\nBcc: attacker@example.com", "body", time.Now()); err == nil {
+		t.Error("expected a subject with a line break to be rejected")
+	}
+}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+var (
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrInvitationExpired  = errors.New("invitation has expired")
+	ErrInvitationClosed   = errors.New("invitation was already accepted or revoked")
+	ErrInvitationEmail    = errors.New("invitation was sent to another email address")
+	ErrAlreadyMember      = errors.New("user already has access to this house")
+	ErrMemberNotFound     = errors.New("house member not found")
+)
+
+// houseRoleRanks orders the house roles; each role can do everything the
+// roles below it can
+var houseRoleRanks = map[string]int{
+	models.HouseRoleViewer:  1,
+	models.HouseRoleWorker:  2,
+	models.HouseRoleManager: 3,
+	models.HouseRoleOwner:   4,
+}
+
+// HouseRoleAtLeast reports whether a role grants at least the access of min.
+// An empty or unknown role grants nothing.
+func HouseRoleAtLeast(role, min string) bool {
+	rank, ok := houseRoleRanks[role]
+	need, known := houseRoleRanks[min]
+	return ok && known && rank >= need
+}
+
+// HouseRole returns the role of a user in a house: owner for its id_user,
+// the member role otherwise, or "" without access. It returns sql.ErrNoRows
+// when the house does not exist or was deleted.
+func HouseRole(db *database.DB, houseID, userID int) (string, error) {
+	var role string
+	err := db.PostgreSQL.QueryRow(`
+		SELECT CASE WHEN h.id_user = $2 THEN $3 ELSE COALESCE(m.role, '') END
+		FROM swiflet_houses h
+		LEFT JOIN house_members m ON m.id_swiflet_house = h.id AND m.id_user = $2
+		WHERE h.id = $1 AND h.deleted_at IS NULL
+	`, houseID, userID, models.HouseRoleOwner).Scan(&role)
+	return role, err
+}
+
+// NormalizeEmail makes invitation addresses comparable with account emails
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// InvitationLink adds an invitation token to the accept page of the app
+func InvitationLink(acceptURL, token string) (string, error) {
+	link, err := url.Parse(acceptURL)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// InvitationColumns selects an invitation for ScanInvitation
+const InvitationColumns = `id, id_swiflet_house, email, role, status, invited_by, expires_at, accepted_by,
+	accepted_at, created_at, updated_at`
+
+// ScanInvitation reads an invitation. Pending invitations past their expiry
+// are reported as expired.
+func ScanInvitation(row interface{ Scan(...interface{}) error }) (models.HouseInvitation, error) {
+	var invitation models.HouseInvitation
+	err := row.Scan(&invitation.ID, &invitation.SwifletHouseID, &invitation.Email, &invitation.Role,
+		&invitation.Status, &invitation.InvitedBy, &invitation.ExpiresAt, &invitation.AcceptedBy,
+		&invitation.AcceptedAt, &invitation.CreatedAt, &invitation.UpdatedAt)
+	if err == nil && invitation.Status == models.InvitationPending && time.Now().After(invitation.ExpiresAt) {
+		invitation.Status = models.InvitationExpired
+	}
+	return invitation, err
+}
+
+// memberQuery lists the owner and the members of the house in $1, most
+// privileged first
+const memberQuery = `
+	SELECT id_swiflet_house, id_user, name, email, role, invited_by, created_at, updated_at FROM (
+		SELECT h.id AS id_swiflet_house, u.id AS id_user, u.name, u.email, 'owner' AS role,
+			NULL::INTEGER AS invited_by, h.created_at, COALESCE(h.updated_at, h.created_at) AS updated_at, 0 AS rank
+		FROM swiflet_houses h
+		JOIN users u ON u.id = h.id_user
+		WHERE h.id = $1
+		UNION ALL
+		SELECT m.id_swiflet_house, u.id, u.name, u.email, m.role, m.invited_by, m.created_at, m.updated_at,
+			CASE m.role WHEN 'manager' THEN 1 WHEN 'worker' THEN 2 ELSE 3 END
+		FROM house_members m
+		JOIN users u ON u.id = m.id_user
+		WHERE m.id_swiflet_house = $1
+	) members`
+
+func scanMember(row interface{ Scan(...interface{}) error }) (models.HouseMember, error) {
+	var member models.HouseMember
+	err := row.Scan(&member.SwifletHouseID, &member.UserID, &member.Name, &member.Email, &member.Role,
+		&member.InvitedBy, &member.CreatedAt, &member.UpdatedAt)
+	return member, err
+}
+
+// Memberships manages who besides the owner may access a swiflet house, and
+// the email invitations that grant it
+type Memberships struct {
+	db        *database.DB
+	mailer    *Mailer
+	ttl       time.Duration
+	acceptURL string
+}
+
+func NewMemberships(db *database.DB, mailer *Mailer, cfg config.InvitationConfig) *Memberships {
+	return &Memberships{
+		db:        db,
+		mailer:    mailer,
+		ttl:       cfg.TTL,
+		acceptURL: cfg.AcceptURL,
+	}
+}
+
+// MailEnabled reports whether invitations are sent by email. Without mail
+// the token is handed to the inviting owner to share.
+func (m *Memberships) MailEnabled() bool {
+	return m.mailer.Enabled()
+}
+
+// ListMembers returns the owner and members of a house
+func (m *Memberships) ListMembers(houseID int) ([]models.HouseMember, error) {
+	rows, err := m.db.PostgreSQL.Query(memberQuery+` ORDER BY rank ASC, name ASC`, houseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.HouseMember{}
+	for rows.Next() {
+		member, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Member returns one member of a house, including its owner
+func (m *Memberships) Member(houseID, userID int) (models.HouseMember, error) {
+	member, err := scanMember(m.db.PostgreSQL.QueryRow(memberQuery+` WHERE id_user = $2`, houseID, userID))
+	if err == sql.ErrNoRows {
+		return member, ErrMemberNotFound
+	}
+	return member, err
+}
+
+// Invite invites an email address to a house with a role. A pending
+// invitation of the same address is replaced. The invitation is revoked
+// again when its email cannot be sent.
+func (m *Memberships) Invite(houseID int, request models.InviteMemberRequest, invitedBy int) (models.HouseInvitation, string, error) {
+	email := NormalizeEmail(request.Email)
+
+	var houseName, inviterName string
+	var existing int
+	err := m.db.PostgreSQL.QueryRow(`
+		SELECT h.name, u.name, (
+			SELECT COUNT(*) FROM users invitee
+			WHERE LOWER(invitee.email) = $3 AND (invitee.id = h.id_user OR EXISTS (
+				SELECT 1 FROM house_members hm WHERE hm.id_swiflet_house = h.id AND hm.id_user = invitee.id))
+		)
+		FROM swiflet_houses h, users u
+		WHERE h.id = $1 AND h.deleted_at IS NULL AND u.id = $2
+	`, houseID, invitedBy, email).Scan(&houseName, &inviterName, &existing)
+	if err != nil {
+		return models.HouseInvitation{}, "", err
+	}
+	if existing > 0 {
+		return models.HouseInvitation{}, "", ErrAlreadyMember
+	}
+
+	token, err := GenerateDeviceSecret()
+	if err != nil {
+		return models.HouseInvitation{}, "", err
+	}
+	link, err := InvitationLink(m.acceptURL, token)
+	if err != nil {
+		return models.HouseInvitation{}, "", fmt.Errorf("invalid HOUSE_INVITATION_URL: %w", err)
+	}
+
+	tx, err := m.db.PostgreSQL.Begin()
+	if err != nil {
+		return models.HouseInvitation{}, "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE house_invitations SET status = $1, updated_at = $2
+		WHERE id_swiflet_house = $3 AND email = $4 AND status = $5
+	`, models.InvitationRevoked, now, houseID, email, models.InvitationPending)
+	if err != nil {
+		return models.HouseInvitation{}, "", fmt.Errorf("failed to replace invitation: %w", err)
+	}
+
+	invitation, err := ScanInvitation(tx.QueryRow(`
+		INSERT INTO house_invitations (id_swiflet_house, email, role, token_hash, status, invited_by, expires_at,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		RETURNING `+InvitationColumns,
+		houseID, email, request.Role, HashDeviceSecret(token), models.InvitationPending, invitedBy,
+		now.Add(m.ttl), now))
+	if err != nil {
+		return invitation, "", fmt.Errorf("failed to store invitation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return invitation, "", err
+	}
+
+	// The mail goes out only once the invitation is stored, so its link always
+	// works; an invitation whose mail failed is revoked again
+	if m.mailer.Enabled() {
+		subject := fmt.Sprintf("%s invited you to %s", inviterName, houseName)
+		body := fmt.Sprintf("%s invited you to join the swiflet house %q as %s.\n\n"+
+			"Accept the invitation here:\n%s\n\nThe link expires on %s.\n",
+			inviterName, houseName, request.Role, link, invitation.ExpiresAt.Format("2 January 2006 15:04 MST"))
+		if err := m.mailer.Send(email, subject, body); err != nil {
+			if _, revokeErr := m.RevokeInvitation(houseID, invitation.ID); revokeErr != nil {
+				log.Printf("Failed to revoke unsent invitation %d: %v", invitation.ID, revokeErr)
+			}
+			return invitation, "", fmt.Errorf("failed to send invitation: %w", err)
+		}
+	}
+
+	return invitation, token, nil
+}
+
+// Accept adds the user to the house of the invitation with its role. The
+// user's account email must be the invited address.
+func (m *Memberships) Accept(token string, userID int) (models.HouseMember, error) {
+	tx, err := m.db.PostgreSQL.Begin()
+	if err != nil {
+		return models.HouseMember{}, err
+	}
+	defer tx.Rollback()
+
+	invitation, err := ScanInvitation(tx.QueryRow(`
+		SELECT `+InvitationColumns+`
+		FROM house_invitations
+		WHERE token_hash = $1
+			AND EXISTS (SELECT 1 FROM swiflet_houses h WHERE h.id = id_swiflet_house AND h.deleted_at IS NULL)
+		FOR UPDATE
+	`, HashDeviceSecret(strings.TrimSpace(token))))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.HouseMember{}, ErrInvitationNotFound
+		}
+		return models.HouseMember{}, err
+	}
+
+	switch invitation.Status {
+	case models.InvitationPending:
+	case models.InvitationExpired:
+		return models.HouseMember{}, ErrInvitationExpired
+	default:
+		return models.HouseMember{}, ErrInvitationClosed
+	}
+
+	var email string
+	var owner bool
+	err = tx.QueryRow(`
+		SELECT u.email, h.id_user = u.id
+		FROM users u, swiflet_houses h
+		WHERE u.id = $1 AND h.id = $2
+	`, userID, invitation.SwifletHouseID).Scan(&email, &owner)
+	if err != nil {
+		return models.HouseMember{}, err
+	}
+	if NormalizeEmail(email) != invitation.Email {
+		return models.HouseMember{}, ErrInvitationEmail
+	}
+	if owner {
+		return models.HouseMember{}, ErrAlreadyMember
+	}
+
+	// Accepting again with another role changes the role
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO house_members (id_swiflet_house, id_user, role, invited_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (id_swiflet_house, id_user) DO UPDATE SET role = EXCLUDED.role, updated_at = EXCLUDED.updated_at
+	`, invitation.SwifletHouseID, userID, invitation.Role, invitation.InvitedBy, now)
+	if err != nil {
+		return models.HouseMember{}, fmt.Errorf("failed to add member: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE house_invitations SET status = $1, accepted_by = $2, accepted_at = $3, updated_at = $3
+		WHERE id = $4
+	`, models.InvitationAccepted, userID, now, invitation.ID)
+	if err != nil {
+		return models.HouseMember{}, fmt.Errorf("failed to close invitation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.HouseMember{}, err
+	}
+	return m.Member(invitation.SwifletHouseID, userID)
+}
+
+// RevokeInvitation cancels a pending invitation of a house
+func (m *Memberships) RevokeInvitation(houseID, invitationID int) (models.HouseInvitation, error) {
+	invitation, err := ScanInvitation(m.db.PostgreSQL.QueryRow(`
+		UPDATE house_invitations SET status = $1, updated_at = $2
+		WHERE id = $3 AND id_swiflet_house = $4 AND status = $5
+		RETURNING `+InvitationColumns,
+		models.InvitationRevoked, time.Now(), invitationID, houseID, models.InvitationPending))
+	if err != sql.ErrNoRows {
+		return invitation, err
+	}
+
+	var count int
+	err = m.db.PostgreSQL.QueryRow(`
+		SELECT COUNT(*) FROM house_invitations WHERE id = $1 AND id_swiflet_house = $2
+	`, invitationID, houseID).Scan(&count)
+	if err != nil {
+		return invitation, err
+	}
+	if count == 0 {
+		return invitation, ErrInvitationNotFound
+	}
+	return invitation, ErrInvitationClosed
+}
+
+// UpdateRole changes the role of a member. The owner has no member row and
+// cannot be changed.
+func (m *Memberships) UpdateRole(houseID, userID int, role string) (models.HouseMember, error) {
+	result, err := m.db.PostgreSQL.Exec(`
+		UPDATE house_members SET role = $1, updated_at = $2 WHERE id_swiflet_house = $3 AND id_user = $4
+	`, role, time.Now(), houseID, userID)
+	if err != nil {
+		return models.HouseMember{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return models.HouseMember{}, ErrMemberNotFound
+	}
+	return m.Member(houseID, userID)
+}
+
+// RemoveMember takes away a member's access to a house
+func (m *Memberships) RemoveMember(houseID, userID int) error {
+	result, err := m.db.PostgreSQL.Exec(`
+		DELETE FROM house_members WHERE id_swiflet_house = $1 AND id_user = $2
+	`, houseID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
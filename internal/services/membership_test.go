@@ -0,0 +1,87 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestHouseRoleAtLeast(t *testing.T) {
+	cases := []struct {
+		role, min string
+		want      bool
+	}{
+		{models.HouseRoleOwner, models.HouseRoleManager, true},
+		{models.HouseRoleManager, models.HouseRoleManager, true},
+		{models.HouseRoleWorker, models.HouseRoleManager, false},
+		{models.HouseRoleWorker, models.HouseRoleViewer, true},
+		{models.HouseRoleViewer, models.HouseRoleWorker, false},
+		{models.HouseRoleManager, models.HouseRoleOwner, false},
+		{"", models.HouseRoleViewer, false},
+		{"admin", models.HouseRoleViewer, false},
+		{models.HouseRoleOwner, "superuser", false},
+	}
+
+	for _, tc := range cases {
+		if got := HouseRoleAtLeast(tc.role, tc.min); got != tc.want {
+			t.Errorf("HouseRoleAtLeast(%q, %q) = %v, want %v", tc.role, tc.min, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	if got := NormalizeEmail("  Worker@Example.COM "); got != "worker@example.com" {
+		t.Errorf("NormalizeEmail = %q", got)
+	}
+}
+
+func TestInvitationLink(t *testing.T) {
+	link, err := InvitationLink("https://app.swiftlead.id/invitations?lang=id", "a+b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://app.swiftlead.id/invitations?lang=id&token=a%2Bb%2Fc"; link != want {
+		t.Errorf("InvitationLink = %q, want %q", link, want)
+	}
+
+	if _, err := InvitationLink("://missing-scheme", "token"); err == nil {
+		t.Error("expected an error for an invalid accept URL")
+	}
+}
+
+// invitationRow fills the status and expiry of a scanned invitation
+type invitationRow struct {
+	status    string
+	expiresAt time.Time
+}
+
+func (r invitationRow) Scan(dest ...interface{}) error {
+	*dest[4].(*string) = r.status
+	*dest[6].(*time.Time) = r.expiresAt
+	return nil
+}
+
+func TestScanInvitationExpiry(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		row  invitationRow
+		want string
+	}{
+		{invitationRow{models.InvitationPending, future}, models.InvitationPending},
+		{invitationRow{models.InvitationPending, past}, models.InvitationExpired},
+		{invitationRow{models.InvitationAccepted, past}, models.InvitationAccepted},
+		{invitationRow{models.InvitationRevoked, past}, models.InvitationRevoked},
+	}
+
+	for _, tc := range cases {
+		invitation, err := ScanInvitation(tc.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invitation.Status != tc.want {
+			t.Errorf("status %s expiring %v: got %s, want %s", tc.row.status, tc.row.expiresAt, invitation.Status, tc.want)
+		}
+	}
+}
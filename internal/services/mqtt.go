@@ -1,31 +1,50 @@
 package services
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"swiflet-backend/internal/config"
 	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type MQTTService struct {
-	client mqtt.Client
-	db     *database.DB
-	config *config.Config
-}
+	client      mqtt.Client
+	db          *database.DB
+	config      *config.Config
+	ingestor    *SensorIngestor
+	registry    *DeviceRegistry
+	deadLetters *DeadLetterStore
+	decoders    *DecoderRegistry
+	validator   *ReadingValidator
+	dedup       *DedupCache
+	presence    *PresenceTracker
+	commands    *CommandStore
+
+	commandTimeoutStop chan struct{}
+	commandTimeoutDone chan struct{}
 
-// SensorData represents incoming sensor data from MQTT
-type SensorData struct {
-	InstallCode string  `json:"install_code"`
-	Suhu        float64 `json:"suhu"`
-	Kelembaban  float64 `json:"kelembaban"`
-	Timestamp   string  `json:"timestamp,omitempty"`
+	firmwareMu        sync.RWMutex
+	firmwareObservers []FirmwareObserver
 }
 
-func NewMQTTService(cfg *config.Config, db *database.DB) (*MQTTService, error) {
+// ErrCommandPublish is returned when a stored command could not be published
+var ErrCommandPublish = errors.New("failed to publish command")
+
+func NewMQTTService(cfg *config.Config, db *database.DB, registry *DeviceRegistry, presence *PresenceTracker) (*MQTTService, error) {
+	decoders := NewDecoderRegistry()
+	if err := decoders.ParseRoutes(cfg.MQTT.DecoderRoutes); err != nil {
+		return nil, fmt.Errorf("invalid MQTT decoder routes: %w", err)
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(cfg.MQTT.Broker)
 	opts.SetClientID(cfg.MQTT.ClientID)
@@ -46,9 +65,23 @@ func NewMQTTService(cfg *config.Config, db *database.DB) (*MQTTService, error) {
 	opts.SetConnectRetryInterval(5 * time.Second)
 	opts.SetConnectRetry(true)
 
+	validator := NewReadingValidator(registry, cfg.Ingest.SpikeWindow)
+	if err := validator.Load(db); err != nil {
+		log.Printf("Spike detection starts without reference values: %v", err)
+	}
+
+	deadLetters := NewDeadLetterStore(db)
 	service := &MQTTService{
-		config: cfg,
-		db:     db,
+		config:      cfg,
+		db:          db,
+		ingestor:    NewSensorIngestor(cfg.Ingest, db, deadLetters),
+		registry:    registry,
+		deadLetters: deadLetters,
+		decoders:    decoders,
+		validator:   validator,
+		dedup:       NewDedupCache(cfg.Ingest.DedupWindow),
+		presence:    presence,
+		commands:    NewCommandStore(db),
 	}
 
 	// Set connection lost handler
@@ -70,6 +103,9 @@ func NewMQTTService(cfg *config.Config, db *database.DB) (*MQTTService, error) {
 	client := mqtt.NewClient(opts)
 	service.client = client
 
+	service.ingestor.Start()
+	service.startCommandTimeouts()
+
 	return service, nil
 }
 
@@ -111,66 +147,306 @@ func (s *MQTTService) ConnectWithRetry(maxRetries int) error {
 	return fmt.Errorf("failed to connect to MQTT after %d attempts: %w", maxRetries, lastErr)
 }
 
-// Disconnect from MQTT broker
+// Disconnect from MQTT broker and drain the ingest queue
 func (s *MQTTService) Disconnect() {
 	s.client.Disconnect(250)
+	s.ingestor.Stop()
+	s.stopCommandTimeouts()
 }
 
-// Subscribe to sensor data topics
+// AddReadingObserver registers an observer for readings stored by ingestion
+func (s *MQTTService) AddReadingObserver(observer ReadingObserver) {
+	s.ingestor.AddObserver(observer)
+}
+
+// AddFirmwareObserver registers an observer for firmware versions reported by devices
+func (s *MQTTService) AddFirmwareObserver(observer FirmwareObserver) {
+	s.firmwareMu.Lock()
+	s.firmwareObservers = append(s.firmwareObservers, observer)
+	s.firmwareMu.Unlock()
+}
+
+// IngestStats returns the current ingestion pipeline counters
+func (s *MQTTService) IngestStats() IngestStats {
+	stats := s.ingestor.Stats()
+	stats.Duplicates = s.dedup.Dropped()
+	return stats
+}
+
+// Subscribe to sensor data topics, including topics routed to a specific decoder
 func (s *MQTTService) subscribe() {
-	topic := s.config.MQTT.TopicSensor
-	token := s.client.Subscribe(topic, 1, s.handleSensorData)
-	if token.Wait() && token.Error() != nil {
-		log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
-	} else {
-		log.Printf("Subscribed to topic: %s", topic)
+	topics := []string{s.config.MQTT.TopicSensor}
+	for _, pattern := range s.decoders.Patterns() {
+		if !slices.Contains(topics, pattern) {
+			topics = append(topics, pattern)
+		}
+	}
+
+	for _, topic := range topics {
+		token := s.client.Subscribe(topic, 1, s.handleSensorData)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
+		} else {
+			log.Printf("Subscribed to topic: %s", topic)
+		}
+	}
+
+	if s.config.MQTT.TopicCommandAck != "" {
+		token := s.client.Subscribe(s.config.MQTT.TopicCommandAck, 1, s.handleCommandAck)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to subscribe to topic %s: %v", s.config.MQTT.TopicCommandAck, token.Error())
+		} else {
+			log.Printf("Subscribed to topic: %s", s.config.MQTT.TopicCommandAck)
+		}
+	}
+
+	if s.config.MQTT.TopicHeartbeat != "" {
+		token := s.client.Subscribe(s.config.MQTT.TopicHeartbeat, 1, s.handleHeartbeat)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to subscribe to topic %s: %v", s.config.MQTT.TopicHeartbeat, token.Error())
+		} else {
+			log.Printf("Subscribed to topic: %s", s.config.MQTT.TopicHeartbeat)
+		}
+	}
+
+	if s.config.MQTT.TopicFirmware != "" {
+		token := s.client.Subscribe(s.config.MQTT.TopicFirmware, 1, s.handleFirmware)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to subscribe to topic %s: %v", s.config.MQTT.TopicFirmware, token.Error())
+		} else {
+			log.Printf("Subscribed to topic: %s", s.config.MQTT.TopicFirmware)
+		}
 	}
 }
 
 // Handle incoming sensor data
 func (s *MQTTService) handleSensorData(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received sensor data from topic %s: %s", msg.Topic(), string(msg.Payload()))
+	log.Printf("Received %d bytes of sensor data from topic %s", len(msg.Payload()), msg.Topic())
+
+	receivedAt := time.Now()
+	if rejectErr := s.processMessage(msg.Topic(), msg.Payload(), receivedAt, true); rejectErr != nil {
+		log.Printf("Rejected sensor data from topic %s: %v", msg.Topic(), rejectErr)
+		s.deadLetters.Record(msg.Topic(), msg.Payload(), rejectErr, receivedAt)
+	}
+}
+
+// handleHeartbeat marks a device as seen. The install_code is taken from the
+// payload when it is a JSON object carrying one, otherwise from the topic
+// level matched by the + wildcard of the heartbeat topic. A firmware_version
+// in the payload is reported like a message on the firmware topic.
+func (s *MQTTService) handleHeartbeat(client mqtt.Client, msg mqtt.Message) {
+	var heartbeat struct {
+		InstallCode     string `json:"install_code"`
+		FirmwareVersion string `json:"firmware_version"`
+	}
+	_ = json.Unmarshal(msg.Payload(), &heartbeat)
 
-	var data SensorData
-	if err := json.Unmarshal(msg.Payload(), &data); err != nil {
-		log.Printf("Failed to unmarshal sensor data: %v", err)
+	device, ok := s.reportingDevice(s.config.MQTT.TopicHeartbeat, msg.Topic(), heartbeat.InstallCode, "heartbeat")
+	if !ok {
 		return
 	}
 
-	// Parse timestamp or use current time
-	timestamp := time.Now()
-	if data.Timestamp != "" {
-		if parsedTime, err := time.Parse(time.RFC3339, data.Timestamp); err == nil {
-			timestamp = parsedTime
-		}
+	now := time.Now()
+	s.presence.Seen(device, now)
+	if heartbeat.FirmwareVersion != "" {
+		s.reportFirmware(device, heartbeat.FirmwareVersion, now)
 	}
+}
 
-	// Validate install_code exists in iot_devices table
-	var count int
-	err := s.db.PostgreSQL.QueryRow("SELECT COUNT(*) FROM iot_devices WHERE install_code = $1", data.InstallCode).Scan(&count)
-	if err != nil {
-		log.Printf("Failed to validate install_code: %v", err)
+// handleFirmware records the firmware version a device runs, sent as
+// {"version": "1.4.0"} after boot and after every update
+func (s *MQTTService) handleFirmware(client mqtt.Client, msg mqtt.Message) {
+	var report struct {
+		InstallCode string `json:"install_code"`
+		Version     string `json:"version"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &report); err != nil || report.Version == "" {
+		log.Printf("Ignoring invalid firmware report on topic %s: %s", msg.Topic(), string(msg.Payload()))
 		return
 	}
 
-	if count == 0 {
-		log.Printf("Invalid install_code: %s", data.InstallCode)
+	device, ok := s.reportingDevice(s.config.MQTT.TopicFirmware, msg.Topic(), report.InstallCode, "firmware report")
+	if !ok {
 		return
 	}
 
-	// Insert sensor data into TimescaleDB
-	_, err = s.db.TimescaleDB.Exec(`
-		INSERT INTO sensors (install_code, suhu, kelembaban, timestamp)
-		VALUES ($1, $2, $3, $4)
-	`, data.InstallCode, data.Suhu, data.Kelembaban, timestamp)
+	now := time.Now()
+	s.presence.Seen(device, now)
+	s.reportFirmware(device, report.Version, now)
+}
 
-	if err != nil {
-		log.Printf("Failed to insert sensor data: %v", err)
+// reportingDevice finds the device of a heartbeat or firmware report. The
+// install_code of the payload wins over the + level of the topic filter, but
+// a device may not report for another one.
+func (s *MQTTService) reportingDevice(filter, topic, installCode, kind string) (DeviceInfo, bool) {
+	topicCode := TopicWildcardValue(filter, topic)
+	if installCode == "" {
+		installCode = topicCode
+	} else if topicCode != "" && installCode != topicCode {
+		log.Printf("Ignoring %s for install_code %q on topic %s of another device", kind, installCode, topic)
+		return DeviceInfo{}, false
+	}
+
+	device, ok := s.registry.Lookup(installCode)
+	if !ok {
+		log.Printf("Ignoring %s from unknown install_code %q on topic %s", kind, installCode, topic)
+	}
+	return device, ok
+}
+
+// reportFirmware passes a reported firmware version on to the observers
+func (s *MQTTService) reportFirmware(device DeviceInfo, version string, reportedAt time.Time) {
+	if !ValidFirmwareVersion(version) {
+		log.Printf("Ignoring invalid firmware version %q from %s", version, device.InstallCode)
 		return
 	}
 
-	log.Printf("Sensor data saved: %s - Suhu: %.2f, Kelembaban: %.2f", 
-		data.InstallCode, data.Suhu, data.Kelembaban)
+	s.firmwareMu.RLock()
+	defer s.firmwareMu.RUnlock()
+	for _, observer := range s.firmwareObservers {
+		observer.FirmwareReported(device, version, reportedAt)
+	}
+}
+
+// processMessage decodes, validates and queues a sensor message. Live
+// messages come from the broker: they mark devices as seen and readings
+// already accepted within the dedup window are dropped. Replayed dead letters
+// skip both.
+func (s *MQTTService) processMessage(topic string, payload []byte, receivedAt time.Time, live bool) *RejectError {
+	decoded, err := s.decoders.Decode(topic, payload)
+	if err != nil {
+		return reject(RejectInvalidPayload, err)
+	}
+
+	// Validate every install_code against the device registry before queueing
+	topicCode := s.topicInstallCode(topic)
+	readings := make([]SensorReading, 0, len(decoded))
+	// Dedup keys of the readings, recorded once they are queued
+	keys := make([]string, 0, len(decoded))
+	for _, data := range decoded {
+		// A device may only report readings under its own topic
+		if topicCode != "" && data.InstallCode != topicCode {
+			return reject(RejectInstallCodeMismatch, fmt.Errorf("install_code %q does not match topic %s", data.InstallCode, topic))
+		}
+
+		device, ok := s.registry.Lookup(data.InstallCode)
+		if !ok {
+			return reject(RejectUnknownInstallCode, fmt.Errorf("install_code %q is not registered", data.InstallCode))
+		}
+		if live {
+			s.presence.Seen(device, receivedAt)
+		}
+
+		// Keep only metrics the device is registered for
+		values := make(map[string]float64, len(data.Values))
+		for metric, value := range data.Values {
+			if s.registry.AcceptsMetric(device, metric) {
+				values[metric] = value
+			} else {
+				log.Printf("Ignoring unregistered metric %q from %s", metric, data.InstallCode)
+			}
+		}
+		if len(values) == 0 {
+			return reject(RejectUnregisteredMetric, fmt.Errorf("no registered metrics in reading from %s", data.InstallCode))
+		}
+
+		// Drop redeliveries of readings that were already queued
+		key := ""
+		if live {
+			if k, ok := dedupKey(data.InstallCode, data.Timestamp, data.Seq); ok {
+				if s.dedup.Seen(k, receivedAt) || slices.Contains(keys, k) {
+					log.Printf("Dropping duplicate reading from %s", data.InstallCode)
+					continue
+				}
+				key = k
+			}
+		}
+
+		// Fall back to the time the message arrived when the device sent no timestamp
+		timestamp := data.Timestamp
+		if timestamp.IsZero() {
+			timestamp = receivedAt
+		}
+
+		// Out-of-range values and spikes are quarantined instead of stored
+		accepted, quarantined := s.validator.Validate(data.InstallCode, values, timestamp)
+		for _, value := range quarantined {
+			log.Printf("Quarantined %s=%g from %s: %s (%s)", value.Metric, value.Value, data.InstallCode, value.Reason, value.Detail)
+		}
+
+		// A replayed reading may predate a move of its device
+		houseID, floor := device.SwifletHouseID, device.Floor
+		if !live {
+			assignments, err := LoadAssignments(s.db, device.ID)
+			if err != nil {
+				return reject(RejectInsertFailed, fmt.Errorf("failed to load device assignments: %w", err))
+			}
+			if assignment, ok := AssignmentAt(assignments, timestamp); ok {
+				houseID, floor = assignment.SwifletHouseID, assignment.Floor
+			}
+		}
+
+		readings = append(readings, SensorReading{
+			InstallCode:    data.InstallCode,
+			SwifletHouseID: houseID,
+			Floor:          floor,
+			Values:         accepted,
+			Quarantined:    quarantined,
+			Timestamp:      timestamp,
+			Topic:          topic,
+			Payload:        payload,
+			ReceivedAt:     receivedAt,
+		})
+		keys = append(keys, key)
+	}
+
+	// Queue sensor data for batched insertion into TimescaleDB
+	for i, reading := range readings {
+		if err := s.ingestor.Enqueue(reading); err != nil {
+			return reject(RejectQueueFull, err)
+		}
+		if keys[i] != "" {
+			s.dedup.Record(keys[i], receivedAt)
+		}
+	}
+
+	return nil
+}
+
+// topicInstallCode returns the install_code at the + level of the sensor
+// topic filter a topic matches, or "" when the topic names no device
+func (s *MQTTService) topicInstallCode(topic string) string {
+	filters := append([]string{s.config.MQTT.TopicSensor}, s.decoders.Patterns()...)
+	for _, filter := range filters {
+		if TopicMatches(filter, topic) {
+			return TopicWildcardValue(filter, topic)
+		}
+	}
+	return ""
+}
+
+// ReplayDeadLetter runs a stored dead letter through ingestion again. The
+// dead letter is removed once the message is accepted; otherwise the new
+// rejection reason is saved and returned.
+func (s *MQTTService) ReplayDeadLetter(id int) error {
+	letter, err := s.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+
+	// A dead letter was never stored, but its readings may already be marked
+	// as seen; the unique indexes still keep replays idempotent
+	if rejectErr := s.processMessage(letter.Topic, letter.Payload, letter.ReceivedAt, false); rejectErr != nil {
+		if err := s.deadLetters.MarkReplayFailed(id, rejectErr); err != nil {
+			return fmt.Errorf("failed to update dead letter: %w", err)
+		}
+		return rejectErr
+	}
+
+	if err := s.deadLetters.Delete(id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	return nil
 }
 
 // PublishControlCommand publishes control commands to devices
@@ -189,4 +465,100 @@ func (s *MQTTService) PublishControlCommand(installCode string, command interfac
 
 	log.Printf("Control command sent to %s: %s", installCode, string(payload))
 	return nil
-}
\ No newline at end of file
+}
+
+// SendCommand stores a control command for a device and publishes it. When
+// publishing fails the command is kept as failed and ErrCommandPublish is
+// returned along with it.
+func (s *MQTTService) SendCommand(device DeviceInfo, userID *int, command string, params json.RawMessage) (*models.DeviceCommand, error) {
+	stored, err := s.commands.Create(device, userID, command, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store command: %w", err)
+	}
+
+	message := ControlMessage{ID: stored.ID, Command: stored.Command, Params: stored.Params}
+	if err := s.PublishControlCommand(device.InstallCode, message); err != nil {
+		if markErr := s.commands.MarkFailed(stored.ID, err.Error()); markErr != nil {
+			log.Printf("Failed to mark command %d as failed: %v", stored.ID, markErr)
+		}
+		reason := err.Error()
+		stored.Status = models.CommandFailed
+		stored.Error = &reason
+		return stored, fmt.Errorf("%w: %v", ErrCommandPublish, err)
+	}
+
+	sentAt := time.Now()
+	if err := s.commands.MarkSent(stored.ID, sentAt); err != nil {
+		log.Printf("Failed to mark command %d as sent: %v", stored.ID, err)
+	}
+	stored.Status = models.CommandSent
+	stored.SentAt = &sentAt
+
+	return stored, nil
+}
+
+// handleCommandAck updates the status of a command acknowledged by a device.
+// The install_code is the topic level matched by the + wildcard of the ack topic.
+func (s *MQTTService) handleCommandAck(client mqtt.Client, msg mqtt.Message) {
+	installCode := TopicWildcardValue(s.config.MQTT.TopicCommandAck, msg.Topic())
+
+	var ack CommandAck
+	if err := json.Unmarshal(msg.Payload(), &ack); err != nil || ack.ID == 0 {
+		log.Printf("Ignoring invalid command ack on topic %s: %s", msg.Topic(), string(msg.Payload()))
+		return
+	}
+
+	if device, ok := s.registry.Lookup(installCode); ok {
+		s.presence.Seen(device, time.Now())
+	}
+
+	if err := s.commands.Acknowledge(installCode, ack, time.Now()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Ignoring ack for unknown command %d from %s", ack.ID, installCode)
+			return
+		}
+		log.Printf("Failed to store ack of command %d from %s: %v", ack.ID, installCode, err)
+	}
+}
+
+// startCommandTimeouts periodically marks commands that were never
+// acknowledged as timed out
+func (s *MQTTService) startCommandTimeouts() {
+	timeout := s.config.MQTT.CommandAckTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	s.commandTimeoutStop = make(chan struct{})
+	s.commandTimeoutDone = make(chan struct{})
+
+	go func() {
+		defer close(s.commandTimeoutDone)
+
+		ticker := time.NewTicker(min(timeout, 30*time.Second))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				expired, err := s.commands.ExpireUnacked(now.Add(-timeout))
+				if err != nil {
+					log.Printf("Failed to expire unacknowledged commands: %v", err)
+				} else if expired > 0 {
+					log.Printf("%d control commands timed out without acknowledgement", expired)
+				}
+			case <-s.commandTimeoutStop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *MQTTService) stopCommandTimeouts() {
+	if s.commandTimeoutStop == nil {
+		return
+	}
+	close(s.commandTimeoutStop)
+	<-s.commandTimeoutDone
+	s.commandTimeoutStop = nil
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// DevicePresence is the last-seen state of a device
+type DevicePresence struct {
+	DeviceID int
+	LastSeen time.Time
+	Status   string
+}
+
+type statusTransition struct {
+	deviceID int
+	previous string
+	status   string
+	lastSeen time.Time
+}
+
+// PresenceTracker keeps the last-seen time of every device in memory. Devices
+// go online as soon as they report and offline once they were silent for the
+// offline window. Transitions are written to PostgreSQL right away, while
+// last-seen times are flushed on every check.
+type PresenceTracker struct {
+	db            *database.DB
+	offlineAfter  time.Duration
+	checkInterval time.Duration
+
+	mu       sync.Mutex
+	devices  map[string]*DevicePresence
+	unsynced map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewPresenceTracker(db *database.DB, offlineAfter, checkInterval time.Duration) *PresenceTracker {
+	if checkInterval <= 0 {
+		checkInterval = 30 * time.Second
+	}
+
+	return &PresenceTracker{
+		db:            db,
+		offlineAfter:  offlineAfter,
+		checkInterval: checkInterval,
+		devices:       make(map[string]*DevicePresence),
+		unsynced:      make(map[string]bool),
+	}
+}
+
+// Load reads the stored last-seen times and statuses
+func (p *PresenceTracker) Load() error {
+	rows, err := p.db.PostgreSQL.Query(`
+		SELECT id, install_code, last_seen_at, connection_status
+		FROM iot_devices
+		WHERE deleted_at IS NULL AND decommissioned_at IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to load device presence: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make(map[string]*DevicePresence)
+	for rows.Next() {
+		var installCode string
+		var lastSeen sql.NullTime
+		presence := &DevicePresence{}
+		if err := rows.Scan(&presence.DeviceID, &installCode, &lastSeen, &presence.Status); err != nil {
+			return fmt.Errorf("failed to scan device presence: %w", err)
+		}
+		if lastSeen.Valid {
+			presence.LastSeen = lastSeen.Time
+		}
+		devices[installCode] = presence
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load device presence: %w", err)
+	}
+
+	p.mu.Lock()
+	p.devices = devices
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Seen records a message from a device and brings it online
+func (p *PresenceTracker) Seen(device DeviceInfo, at time.Time) {
+	p.mu.Lock()
+	presence, ok := p.devices[device.InstallCode]
+	if !ok {
+		presence = &DevicePresence{DeviceID: device.ID, Status: models.DeviceStatusUnknown}
+		p.devices[device.InstallCode] = presence
+	}
+	presence.DeviceID = device.ID
+	if at.After(presence.LastSeen) {
+		presence.LastSeen = at
+		p.unsynced[device.InstallCode] = true
+	}
+
+	var transition *statusTransition
+	if presence.Status != models.DeviceStatusOnline {
+		transition = &statusTransition{
+			deviceID: device.ID,
+			previous: presence.Status,
+			status:   models.DeviceStatusOnline,
+			lastSeen: presence.LastSeen,
+		}
+		presence.Status = models.DeviceStatusOnline
+		delete(p.unsynced, device.InstallCode)
+	}
+	p.mu.Unlock()
+
+	if transition != nil {
+		p.recordTransition(*transition)
+	}
+}
+
+// Get returns the presence of a device. Devices the tracker has not seen
+// since they were created are unknown.
+func (p *PresenceTracker) Get(installCode string) DevicePresence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if presence, ok := p.devices[installCode]; ok {
+		return *presence
+	}
+	return DevicePresence{Status: models.DeviceStatusUnknown}
+}
+
+// Remove stops tracking a retired device
+func (p *PresenceTracker) Remove(installCode string) {
+	p.mu.Lock()
+	delete(p.devices, installCode)
+	p.mu.Unlock()
+}
+
+// Check flips online devices that were silent for the offline window to
+// offline and flushes last-seen times
+func (p *PresenceTracker) Check(now time.Time) {
+	var transitions []statusTransition
+	lastSeen := make(map[int]time.Time)
+
+	p.mu.Lock()
+	for installCode, presence := range p.devices {
+		if presence.Status == models.DeviceStatusOnline && now.Sub(presence.LastSeen) > p.offlineAfter {
+			transitions = append(transitions, statusTransition{
+				deviceID: presence.DeviceID,
+				previous: presence.Status,
+				status:   models.DeviceStatusOffline,
+				lastSeen: presence.LastSeen,
+			})
+			presence.Status = models.DeviceStatusOffline
+			delete(p.unsynced, installCode)
+			continue
+		}
+		if p.unsynced[installCode] {
+			lastSeen[presence.DeviceID] = presence.LastSeen
+		}
+	}
+	p.unsynced = make(map[string]bool)
+	p.mu.Unlock()
+
+	for _, transition := range transitions {
+		p.recordTransition(transition)
+	}
+
+	for deviceID, seen := range lastSeen {
+		_, err := p.db.PostgreSQL.Exec(`
+			UPDATE iot_devices SET last_seen_at = $1 WHERE id = $2 AND (last_seen_at IS NULL OR last_seen_at < $1)
+		`, seen, deviceID)
+		if err != nil {
+			log.Printf("Failed to store last-seen time of device %d: %v", deviceID, err)
+		}
+	}
+}
+
+// recordTransition stores the new status together with the history entry
+func (p *PresenceTracker) recordTransition(transition statusTransition) {
+	log.Printf("Device %d is now %s (was %s)", transition.deviceID, transition.status, transition.previous)
+
+	err := func() error {
+		tx, err := p.db.PostgreSQL.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`
+			UPDATE iot_devices
+			SET connection_status = $1, last_seen_at = GREATEST(last_seen_at, $2)
+			WHERE id = $3
+		`, transition.status, transition.lastSeen, transition.deviceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO device_status_history (id_device, previous_status, status, last_seen_at, changed_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, transition.deviceID, transition.previous, transition.status, transition.lastSeen, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}()
+	if err != nil {
+		log.Printf("Failed to record status change of device %d: %v", transition.deviceID, err)
+	}
+}
+
+// Start runs the offline checker in the background
+func (p *PresenceTracker) Start() {
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				p.Check(now)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the offline checker and flushes pending last-seen times
+func (p *PresenceTracker) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+
+	p.Check(time.Now())
+}
@@ -0,0 +1,463 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+// codeAlphabet leaves out characters that are easily confused on a label
+const codeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// installCodePrefix marks install codes generated by the backend
+const installCodePrefix = "SWF"
+
+// maxCodeAttempts bounds the retries after a generated install code collides
+const maxCodeAttempts = 5
+
+var (
+	ErrProvisionNotFound = errors.New("provisioned device not found")
+	ErrInvalidClaimCode  = errors.New("invalid claim code")
+	ErrAlreadyClaimed    = errors.New("device is already claimed")
+	ErrProvisionRevoked  = errors.New("device credentials are revoked")
+	ErrInstallCodeTaken  = errors.New("install_code is already registered")
+)
+
+// randomCode returns groups of random characters from codeAlphabet joined by dashes
+func randomCode(groups, size int) (string, error) {
+	raw := make([]byte, groups*size)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	parts := make([]string, groups)
+	for g := range parts {
+		part := make([]byte, size)
+		for i := range part {
+			// 256 is a multiple of the alphabet size, so there is no bias
+			part[i] = codeAlphabet[int(raw[g*size+i])%len(codeAlphabet)]
+		}
+		parts[g] = string(part)
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// GenerateInstallCode returns a new install code such as SWF-7K3M-Q9XD-2HPA
+func GenerateInstallCode() (string, error) {
+	code, err := randomCode(3, 4)
+	if err != nil {
+		return "", err
+	}
+	return installCodePrefix + "-" + code, nil
+}
+
+// GenerateClaimCode returns a claim code such as 4KQ8-ZX2M for the label of a gateway
+func GenerateClaimCode() (string, error) {
+	return randomCode(2, 4)
+}
+
+// GenerateDeviceSecret returns a new MQTT password for a device
+func GenerateDeviceSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// HashDeviceSecret hashes a device secret or claim code for storage. Both are
+// random, so a fast hash is enough.
+func HashDeviceSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeClaimCode accepts claim codes typed in lower case or without dashes
+func normalizeClaimCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashMatches compares a value with a stored hash in constant time
+func hashMatches(value, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashDeviceSecret(value)), []byte(hash)) == 1
+}
+
+// DeviceTopicAllowed reports whether a device may use a topic: the topic must
+// match one of the filters with the device's install_code at the + level
+func DeviceTopicAllowed(filters []string, installCode, topic string) bool {
+	for _, filter := range filters {
+		if filter == "" || !strings.Contains(filter, "+") {
+			continue
+		}
+		if TopicMatches(filter, topic) && TopicWildcardValue(filter, topic) == installCode {
+			return true
+		}
+	}
+	return false
+}
+
+// SensorTopics returns the topic filters devices publish readings on: the
+// sensor topic and the topics with a decoder route
+func SensorTopics(cfg config.MQTTConfig) ([]string, error) {
+	decoders := NewDecoderRegistry()
+	if err := decoders.ParseRoutes(cfg.DecoderRoutes); err != nil {
+		return nil, fmt.Errorf("invalid MQTT decoder routes: %w", err)
+	}
+	return append([]string{cfg.TopicSensor}, decoders.Patterns()...), nil
+}
+
+// Provisioner issues install codes and per-device MQTT credentials, binds
+// provisioned gateways to houses and answers the broker's authentication
+// hooks
+type Provisioner struct {
+	db             *database.DB
+	brokerUser     string
+	brokerPassword string
+	publishes      []string
+	subscribes     []string
+}
+
+func NewProvisioner(db *database.DB, cfg config.MQTTConfig) (*Provisioner, error) {
+	publishes, err := SensorTopics(cfg)
+	if err != nil {
+		return nil, err
+	}
+	publishes = append(publishes, cfg.TopicHeartbeat, cfg.TopicCommandAck, cfg.TopicFirmware)
+
+	return &Provisioner{
+		db:             db,
+		brokerUser:     cfg.Username,
+		brokerPassword: cfg.Password,
+		publishes:      publishes,
+		subscribes:     []string{cfg.TopicControl},
+	}, nil
+}
+
+// ProvisionColumns selects a provision for ScanProvision
+const ProvisionColumns = `id, install_code, status, id_device, created_by, claimed_by, claimed_at,
+	secret_rotated_at, created_at, updated_at`
+
+func ScanProvision(row interface{ Scan(...interface{}) error }) (models.DeviceProvision, error) {
+	var provision models.DeviceProvision
+	err := row.Scan(&provision.ID, &provision.InstallCode, &provision.Status, &provision.DeviceID,
+		&provision.CreatedBy, &provision.ClaimedBy, &provision.ClaimedAt, &provision.SecretRotatedAt,
+		&provision.CreatedAt, &provision.UpdatedAt)
+	return provision, err
+}
+
+// insertProvision stores a provision under a fresh install code, retrying
+// when the code is already used by a provision or a device
+func insertProvision(tx *sql.Tx, secretHash string, claimCodeHash *string, status string, createdBy *int, now time.Time) (models.DeviceProvision, error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		installCode, err := GenerateInstallCode()
+		if err != nil {
+			return models.DeviceProvision{}, err
+		}
+
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM iot_devices WHERE install_code = $1)", installCode).Scan(&taken); err != nil {
+			return models.DeviceProvision{}, err
+		}
+		if taken {
+			continue
+		}
+
+		provision, err := ScanProvision(tx.QueryRow(`
+			INSERT INTO device_provisions (install_code, secret_hash, claim_code_hash, status, created_by, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6)
+			ON CONFLICT (install_code) DO NOTHING
+			RETURNING `+ProvisionColumns, installCode, secretHash, claimCodeHash, status, createdBy, now))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		return provision, err
+	}
+	return models.DeviceProvision{}, errors.New("failed to generate a unique install code")
+}
+
+// Provision creates unclaimed gateways. The secrets and claim codes are
+// returned once and only their hashes are stored.
+func (p *Provisioner) Provision(count int, createdBy int) ([]models.ProvisionedDevice, error) {
+	tx, err := p.db.PostgreSQL.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	devices := make([]models.ProvisionedDevice, 0, count)
+	for i := 0; i < count; i++ {
+		secret, err := GenerateDeviceSecret()
+		if err != nil {
+			return nil, err
+		}
+		claimCode, err := GenerateClaimCode()
+		if err != nil {
+			return nil, err
+		}
+		claimCodeHash := HashDeviceSecret(normalizeClaimCode(claimCode))
+
+		provision, err := insertProvision(tx, HashDeviceSecret(secret), &claimCodeHash, models.ProvisionUnclaimed, &createdBy, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store provision: %w", err)
+		}
+		devices = append(devices, models.ProvisionedDevice{
+			DeviceProvision: provision,
+			Secret:          secret,
+			ClaimCode:       claimCode,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Claim binds an unclaimed gateway to a floor of a house after checking the
+// claim code from its label, and creates its device
+func (p *Provisioner) Claim(request models.ClaimDeviceRequest, userID int) (models.IoTDevice, error) {
+	tx, err := p.db.PostgreSQL.Begin()
+	if err != nil {
+		return models.IoTDevice{}, err
+	}
+	defer tx.Rollback()
+
+	var provisionID int
+	var status string
+	var claimCodeHash sql.NullString
+	err = tx.QueryRow(`
+		SELECT id, status, claim_code_hash FROM device_provisions WHERE install_code = $1 FOR UPDATE
+	`, request.InstallCode).Scan(&provisionID, &status, &claimCodeHash)
+	if err == sql.ErrNoRows {
+		return models.IoTDevice{}, ErrProvisionNotFound
+	}
+	if err != nil {
+		return models.IoTDevice{}, err
+	}
+	// Check the claim code first so the state of a device is not revealed
+	// without it
+	if !claimCodeHash.Valid || !hashMatches(normalizeClaimCode(request.ClaimCode), claimCodeHash.String) {
+		return models.IoTDevice{}, ErrInvalidClaimCode
+	}
+	switch status {
+	case models.ProvisionClaimed:
+		return models.IoTDevice{}, ErrAlreadyClaimed
+	case models.ProvisionRevoked:
+		return models.IoTDevice{}, ErrProvisionRevoked
+	}
+
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM iot_devices WHERE install_code = $1)", request.InstallCode).Scan(&taken); err != nil {
+		return models.IoTDevice{}, err
+	}
+	if taken {
+		return models.IoTDevice{}, ErrInstallCodeTaken
+	}
+
+	now := time.Now()
+	device := models.IoTDevice{
+		SwifletHouseID:   request.SwifletHouseID,
+		Floor:            request.Floor,
+		InstallCode:      request.InstallCode,
+		ConnectionStatus: models.DeviceStatusUnknown,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO iot_devices (id_swiflet_house, floor, install_code, status, created_at, updated_at)
+		VALUES ($1, $2, $3, 0, $4, $4)
+		RETURNING id
+	`, device.SwifletHouseID, device.Floor, device.InstallCode, now).Scan(&device.ID)
+	if err != nil {
+		return models.IoTDevice{}, fmt.Errorf("failed to create device: %w", err)
+	}
+	if err := openAssignment(tx, device.ID, device.SwifletHouseID, device.Floor, &userID, now); err != nil {
+		return models.IoTDevice{}, fmt.Errorf("failed to record assignment: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE device_provisions SET status = $1, id_device = $2, claimed_by = $3, claimed_at = $4, updated_at = $4
+		WHERE id = $5
+	`, models.ProvisionClaimed, device.ID, userID, now, provisionID)
+	if err != nil {
+		return models.IoTDevice{}, fmt.Errorf("failed to claim device: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.IoTDevice{}, err
+	}
+	return device, nil
+}
+
+// Register creates a device directly on a floor of a house, with a generated
+// install code unless one is given, and returns its credentials
+func (p *Provisioner) Register(device models.IoTDevice, userID int) (models.IoTDevice, models.DeviceCredentials, error) {
+	tx, err := p.db.PostgreSQL.Begin()
+	if err != nil {
+		return device, models.DeviceCredentials{}, err
+	}
+	defer tx.Rollback()
+
+	secret, err := GenerateDeviceSecret()
+	if err != nil {
+		return device, models.DeviceCredentials{}, err
+	}
+
+	now := time.Now()
+	var provision models.DeviceProvision
+	if device.InstallCode == "" {
+		provision, err = insertProvision(tx, HashDeviceSecret(secret), nil, models.ProvisionClaimed, &userID, now)
+		if err != nil {
+			return device, models.DeviceCredentials{}, fmt.Errorf("failed to store provision: %w", err)
+		}
+		device.InstallCode = provision.InstallCode
+	} else {
+		var taken bool
+		err := tx.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM iot_devices WHERE install_code = $1)
+				OR EXISTS(SELECT 1 FROM device_provisions WHERE install_code = $1)
+		`, device.InstallCode).Scan(&taken)
+		if err != nil {
+			return device, models.DeviceCredentials{}, err
+		}
+		if taken {
+			return device, models.DeviceCredentials{}, ErrInstallCodeTaken
+		}
+		provision, err = ScanProvision(tx.QueryRow(`
+			INSERT INTO device_provisions (install_code, secret_hash, status, created_by, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $5)
+			RETURNING `+ProvisionColumns, device.InstallCode, HashDeviceSecret(secret), models.ProvisionClaimed, userID, now))
+		if err != nil {
+			return device, models.DeviceCredentials{}, fmt.Errorf("failed to store provision: %w", err)
+		}
+	}
+
+	device.ConnectionStatus = models.DeviceStatusUnknown
+	device.CreatedAt = now
+	device.UpdatedAt = now
+	err = tx.QueryRow(`
+		INSERT INTO iot_devices (id_swiflet_house, floor, install_code, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING id
+	`, device.SwifletHouseID, device.Floor, device.InstallCode, device.Status, now).Scan(&device.ID)
+	if err != nil {
+		return device, models.DeviceCredentials{}, fmt.Errorf("failed to create device: %w", err)
+	}
+	if err := openAssignment(tx, device.ID, device.SwifletHouseID, device.Floor, &userID, now); err != nil {
+		return device, models.DeviceCredentials{}, fmt.Errorf("failed to record assignment: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE device_provisions SET id_device = $1, claimed_by = $2, claimed_at = $3 WHERE id = $4
+	`, device.ID, userID, now, provision.ID)
+	if err != nil {
+		return device, models.DeviceCredentials{}, fmt.Errorf("failed to link provision: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return device, models.DeviceCredentials{}, err
+	}
+	return device, models.DeviceCredentials{InstallCode: device.InstallCode, Secret: secret}, nil
+}
+
+// RotateSecret issues a new secret for a device; the old one stops working
+// at the next connection. Devices registered before provisioning existed get
+// their first credentials this way.
+func (p *Provisioner) RotateSecret(device models.IoTDevice, userID int) (models.DeviceCredentials, error) {
+	secret, err := GenerateDeviceSecret()
+	if err != nil {
+		return models.DeviceCredentials{}, err
+	}
+
+	// Revoked credentials stay revoked, so no row is returned for them
+	now := time.Now()
+	var provisionID int
+	err = p.db.PostgreSQL.QueryRow(`
+		INSERT INTO device_provisions (install_code, secret_hash, status, id_device, created_by, claimed_by,
+			claimed_at, secret_rotated_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $5, $6, $6, $6, $6)
+		ON CONFLICT (install_code) DO UPDATE SET secret_hash = EXCLUDED.secret_hash,
+			id_device = EXCLUDED.id_device, secret_rotated_at = EXCLUDED.secret_rotated_at, updated_at = EXCLUDED.updated_at
+		WHERE device_provisions.status <> $7
+		RETURNING id
+	`, device.InstallCode, HashDeviceSecret(secret), models.ProvisionClaimed, device.ID, userID, now,
+		models.ProvisionRevoked).Scan(&provisionID)
+	if err == sql.ErrNoRows {
+		return models.DeviceCredentials{}, ErrProvisionRevoked
+	}
+	if err != nil {
+		return models.DeviceCredentials{}, err
+	}
+
+	return models.DeviceCredentials{InstallCode: device.InstallCode, Secret: secret}, nil
+}
+
+// Revoke disables the credentials of a provisioned device for good
+func (p *Provisioner) Revoke(id int) (models.DeviceProvision, error) {
+	provision, err := ScanProvision(p.db.PostgreSQL.QueryRow(`
+		UPDATE device_provisions SET status = $1, updated_at = $2
+		WHERE id = $3
+		RETURNING `+ProvisionColumns, models.ProvisionRevoked, time.Now(), id))
+	if err == sql.ErrNoRows {
+		return provision, ErrProvisionNotFound
+	}
+	return provision, err
+}
+
+// IsSuperuser reports whether a broker user is the backend itself
+func (p *Provisioner) IsSuperuser(username string) bool {
+	return p.brokerUser != "" && username == p.brokerUser
+}
+
+// Authenticate checks MQTT credentials. Devices use their install_code and
+// secret; the backend uses MQTT_USERNAME and MQTT_PASSWORD.
+func (p *Provisioner) Authenticate(username, password string) (bool, error) {
+	if username == "" || password == "" {
+		return false, nil
+	}
+	if p.IsSuperuser(username) {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(p.brokerPassword)) == 1, nil
+	}
+
+	var secretHash, status string
+	err := p.db.PostgreSQL.QueryRow(`
+		SELECT secret_hash, status FROM device_provisions WHERE install_code = $1
+	`, username).Scan(&secretHash, &status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status != models.ProvisionRevoked && hashMatches(password, secretHash), nil
+}
+
+// Authorize checks a device may publish to or subscribe to a topic. Devices
+// only publish readings, heartbeats, acks and firmware reports under their
+// own install_code and only subscribe to their own control topic.
+func (p *Provisioner) Authorize(username, topic string, publish bool) bool {
+	if p.IsSuperuser(username) {
+		return true
+	}
+	if publish {
+		return DeviceTopicAllowed(p.publishes, username, topic)
+	}
+	return DeviceTopicAllowed(p.subscribes, username, topic)
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerateCodes(t *testing.T) {
+	installCode := regexp.MustCompile(`^SWF-[2-9A-HJ-NP-Z]{4}-[2-9A-HJ-NP-Z]{4}-[2-9A-HJ-NP-Z]{4}$`)
+	claimCode := regexp.MustCompile(`^[2-9A-HJ-NP-Z]{4}-[2-9A-HJ-NP-Z]{4}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := GenerateInstallCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !installCode.MatchString(code) || seen[code] {
+			t.Fatalf("install code %q", code)
+		}
+		seen[code] = true
+
+		claim, err := GenerateClaimCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !claimCode.MatchString(claim) {
+			t.Fatalf("claim code %q", claim)
+		}
+	}
+
+	secret, err := GenerateDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 43 {
+		t.Errorf("secret %q has %d characters", secret, len(secret))
+	}
+}
+
+func TestClaimCodeMatching(t *testing.T) {
+	hash := HashDeviceSecret(normalizeClaimCode("4KQ8-ZX2M"))
+	for _, typed := range []string{"4KQ8-ZX2M", "4kq8zx2m", " 4KQ8 ZX2M "} {
+		if !hashMatches(normalizeClaimCode(typed), hash) {
+			t.Errorf("%q rejected", typed)
+		}
+	}
+	if hashMatches(normalizeClaimCode("4KQ8-ZX2N"), hash) {
+		t.Error("wrong claim code accepted")
+	}
+}
+
+func TestDeviceTopicAllowed(t *testing.T) {
+	filters := []string{"sensors/+/data", "sensors/+/batch", "devices/+/heartbeat", "sensors/all", ""}
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"sensors/SWF-AAAA/data", true},
+		{"sensors/SWF-AAAA/batch", true},
+		{"devices/SWF-AAAA/heartbeat", true},
+		{"sensors/SWF-BBBB/data", false},
+		{"sensors/SWF-AAAA/cbor", false},
+		{"sensors/all", false},
+		{"sensors/SWF-AAAA/data/extra", false},
+	}
+	for _, test := range tests {
+		if got := DeviceTopicAllowed(filters, "SWF-AAAA", test.topic); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.topic, got, test.want)
+		}
+	}
+}
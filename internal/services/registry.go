@@ -0,0 +1,287 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// DeviceInfo is the cached identity of a registered IoT device
+type DeviceInfo struct {
+	ID             int
+	InstallCode    string
+	SwifletHouseID int
+	Floor          int
+	// Metrics registered for the device; empty means the default climate pair
+	Metrics map[string]bool
+}
+
+// defaultDeviceMetrics are accepted from devices without registered metrics
+var defaultDeviceMetrics = map[string]bool{
+	models.MetricSuhu:       true,
+	models.MetricKelembaban: true,
+}
+
+// DeviceRegistry keeps an in-memory map of install_code to device so the
+// ingestion path does not need to query PostgreSQL for every message
+type DeviceRegistry struct {
+	db             *database.DB
+	resyncInterval time.Duration
+
+	mu          sync.RWMutex
+	devices     map[string]DeviceInfo
+	metricTypes map[string]models.MetricType
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewDeviceRegistry(db *database.DB, resyncInterval time.Duration) *DeviceRegistry {
+	return &DeviceRegistry{
+		db:             db,
+		resyncInterval: resyncInterval,
+		devices:        make(map[string]DeviceInfo),
+		metricTypes:    make(map[string]models.MetricType),
+	}
+}
+
+// Load replaces the cache with every device and metric type currently stored in PostgreSQL
+func (r *DeviceRegistry) Load() error {
+	metricTypes, err := r.loadMetricTypes()
+	if err != nil {
+		return err
+	}
+
+	rows, err := r.db.PostgreSQL.Query(`
+		SELECT d.id, d.install_code, d.id_swiflet_house, d.floor, dm.metric_key
+		FROM iot_devices d
+		LEFT JOIN device_metrics dm ON dm.id_device = d.id
+		WHERE d.deleted_at IS NULL AND d.decommissioned_at IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to load devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make(map[string]DeviceInfo)
+	for rows.Next() {
+		var device DeviceInfo
+		var metric sql.NullString
+		if err := rows.Scan(&device.ID, &device.InstallCode, &device.SwifletHouseID, &device.Floor, &metric); err != nil {
+			return fmt.Errorf("failed to scan device: %w", err)
+		}
+		if existing, ok := devices[device.InstallCode]; ok {
+			device = existing
+		}
+		if metric.Valid {
+			if device.Metrics == nil {
+				device.Metrics = make(map[string]bool)
+			}
+			device.Metrics[metric.String] = true
+		}
+		devices[device.InstallCode] = device
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load devices: %w", err)
+	}
+
+	r.mu.Lock()
+	r.devices = devices
+	r.metricTypes = metricTypes
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *DeviceRegistry) loadMetricTypes() (map[string]models.MetricType, error) {
+	rows, err := r.db.PostgreSQL.Query(`
+		SELECT id, key, name, unit, min_value, max_value, max_change_per_minute, created_at, updated_at
+		FROM metric_types
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metric types: %w", err)
+	}
+	defer rows.Close()
+
+	metricTypes := make(map[string]models.MetricType)
+	for rows.Next() {
+		var metricType models.MetricType
+		err := rows.Scan(&metricType.ID, &metricType.Key, &metricType.Name, &metricType.Unit,
+			&metricType.MinValue, &metricType.MaxValue, &metricType.MaxChangePerMinute, &metricType.CreatedAt, &metricType.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan metric type: %w", err)
+		}
+		metricTypes[metricType.Key] = metricType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load metric types: %w", err)
+	}
+
+	return metricTypes, nil
+}
+
+// Refresh reloads a single device after it was created or changed, and
+// drops it from the cache when it no longer exists or was retired
+func (r *DeviceRegistry) Refresh(installCode string) error {
+	var device DeviceInfo
+	err := r.db.PostgreSQL.QueryRow(`
+		SELECT id, install_code, id_swiflet_house, floor
+		FROM iot_devices WHERE install_code = $1 AND deleted_at IS NULL AND decommissioned_at IS NULL
+	`, installCode).Scan(&device.ID, &device.InstallCode, &device.SwifletHouseID, &device.Floor)
+
+	if err == sql.ErrNoRows {
+		r.Remove(installCode)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to refresh device %s: %w", installCode, err)
+	}
+
+	rows, err := r.db.PostgreSQL.Query("SELECT metric_key FROM device_metrics WHERE id_device = $1", device.ID)
+	if err != nil {
+		return fmt.Errorf("failed to refresh metrics of device %s: %w", installCode, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var metric string
+		if err := rows.Scan(&metric); err != nil {
+			return fmt.Errorf("failed to scan metric of device %s: %w", installCode, err)
+		}
+		if device.Metrics == nil {
+			device.Metrics = make(map[string]bool)
+		}
+		device.Metrics[metric] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to refresh metrics of device %s: %w", installCode, err)
+	}
+
+	r.mu.Lock()
+	r.devices[installCode] = device
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Remove evicts a device from the cache
+func (r *DeviceRegistry) Remove(installCode string) {
+	r.mu.Lock()
+	delete(r.devices, installCode)
+	r.mu.Unlock()
+}
+
+// Lookup returns the cached device for an install_code
+func (r *DeviceRegistry) Lookup(installCode string) (DeviceInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	device, ok := r.devices[installCode]
+	return device, ok
+}
+
+// HouseDevices returns the cached devices of a swiflet house ordered by floor and install_code
+func (r *DeviceRegistry) HouseDevices(houseID int) []DeviceInfo {
+	r.mu.RLock()
+	var devices []DeviceInfo
+	for _, device := range r.devices {
+		if device.SwifletHouseID == houseID {
+			devices = append(devices, device)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Floor != devices[j].Floor {
+			return devices[i].Floor < devices[j].Floor
+		}
+		return devices[i].InstallCode < devices[j].InstallCode
+	})
+	return devices
+}
+
+// Devices returns every cached device ordered by house, floor and install_code
+func (r *DeviceRegistry) Devices() []DeviceInfo {
+	r.mu.RLock()
+	devices := make([]DeviceInfo, 0, len(r.devices))
+	for _, device := range r.devices {
+		devices = append(devices, device)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].SwifletHouseID != devices[j].SwifletHouseID {
+			return devices[i].SwifletHouseID < devices[j].SwifletHouseID
+		}
+		if devices[i].Floor != devices[j].Floor {
+			return devices[i].Floor < devices[j].Floor
+		}
+		return devices[i].InstallCode < devices[j].InstallCode
+	})
+	return devices
+}
+
+// MetricType returns the registered metric type for a key
+func (r *DeviceRegistry) MetricType(key string) (models.MetricType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricType, ok := r.metricTypes[key]
+	return metricType, ok
+}
+
+// AcceptsMetric reports whether a device may report the given metric. The
+// metric must be a registered type and, for devices with registered metrics,
+// one of them.
+func (r *DeviceRegistry) AcceptsMetric(device DeviceInfo, key string) bool {
+	if _, ok := r.MetricType(key); !ok {
+		return false
+	}
+	if len(device.Metrics) == 0 {
+		return defaultDeviceMetrics[key]
+	}
+	return device.Metrics[key]
+}
+
+// Start periodically resyncs the cache with PostgreSQL
+func (r *DeviceRegistry) Start() {
+	if r.resyncInterval <= 0 || r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.resyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Load(); err != nil {
+					log.Printf("Device registry resync failed: %v", err)
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic resync
+func (r *DeviceRegistry) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
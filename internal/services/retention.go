@@ -0,0 +1,111 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"swiflet-backend/internal/config"
+	"swiflet-backend/internal/database"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The rollup refresh policies recompute the last 3 days from raw readings
+// (migrations/014_sensor_rollups.sql). Dropping raw chunks inside that window
+// would erase rollups, so shorter raw retention is refused.
+const minRawRetention = 7 * 24 * time.Hour
+
+// ApplyRetentionPolicies brings the TimescaleDB retention policies of the raw
+// sensor hypertables and their rollups in line with the configuration
+func ApplyRetentionPolicies(db *database.DB, cfg config.RetentionConfig) error {
+	raw := cfg.Raw
+	if raw > 0 && raw < minRawRetention {
+		log.Printf("Warning: raw sensor retention %s is shorter than %s, using %s", raw, minRawRetention, minRawRetention)
+		raw = minRawRetention
+	}
+
+	policies := []struct {
+		relation  string
+		dropAfter time.Duration
+	}{
+		{"sensors", raw},
+		{"sensor_measurements", raw},
+		{"sensors_hourly", cfg.Hourly},
+		{"sensor_measurements_hourly", cfg.Hourly},
+		{"sensors_daily", cfg.Daily},
+		{"sensor_measurements_daily", cfg.Daily},
+	}
+
+	for _, policy := range policies {
+		if err := applyRetentionPolicy(db, policy.relation, policy.dropAfter); err != nil {
+			return fmt.Errorf("retention policy of %s: %w", policy.relation, err)
+		}
+	}
+	return nil
+}
+
+// applyRetentionPolicy replaces the retention policy of a hypertable or
+// continuous aggregate unless it already drops data after the given duration
+func applyRetentionPolicy(db *database.DB, relation string, dropAfter time.Duration) error {
+	interval := fmt.Sprintf("%d seconds", int64(dropAfter/time.Second))
+
+	var current bool
+	err := db.TimescaleDB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM timescaledb_information.jobs
+			WHERE proc_name = 'policy_retention'
+				AND hypertable_name = COALESCE((
+					SELECT materialization_hypertable_name FROM timescaledb_information.continuous_aggregates
+					WHERE view_name = $1
+				), $1)
+				AND (config->>'drop_after')::interval = $2::interval
+		)
+	`, relation, interval).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current && dropAfter > 0 {
+		return nil
+	}
+
+	if _, err := db.TimescaleDB.Exec("SELECT remove_retention_policy($1, if_exists => TRUE)", relation); err != nil {
+		return err
+	}
+	if dropAfter <= 0 {
+		return nil
+	}
+
+	if _, err := db.TimescaleDB.Exec("SELECT add_retention_policy($1, drop_after => $2::interval)", relation, interval); err != nil {
+		return err
+	}
+	log.Printf("Retention policy of %s set to %s", relation, dropAfter)
+	return nil
+}
+
+// rollupViews are the continuous aggregates of migrations/014_sensor_rollups.sql
+var rollupViews = []string{"sensors_hourly", "sensor_measurements_hourly", "sensors_daily", "sensor_measurements_daily"}
+
+// RefreshRollups recomputes the rollups of the readings between start and
+// end, which the refresh policies skip when they are older than 3 days, e.g.
+// after an import
+func RefreshRollups(db *database.DB, start, end time.Time) error {
+	windowStart, windowEnd := rollupWindow(start, end)
+	for _, view := range rollupViews {
+		// refresh_continuous_aggregate refuses to run inside a transaction
+		// block, so the call is sent as a simple query without parameters
+		_, err := db.TimescaleDB.Exec(fmt.Sprintf("CALL refresh_continuous_aggregate(%s, %s, %s)",
+			pq.QuoteLiteral(view), pq.QuoteLiteral(windowStart.Format(time.RFC3339)),
+			pq.QuoteLiteral(windowEnd.Format(time.RFC3339))))
+		if err != nil {
+			return fmt.Errorf("failed to refresh %s: %w", view, err)
+		}
+	}
+	return nil
+}
+
+// rollupWindow widens a time range to whole UTC days, the buckets of the
+// daily rollups, so the buckets holding start and end are refreshed as well
+func rollupWindow(start, end time.Time) (time.Time, time.Time) {
+	const day = 24 * time.Hour
+	return start.UTC().Truncate(day), end.UTC().Truncate(day).Add(day)
+}
@@ -0,0 +1,21 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupWindow(t *testing.T) {
+	jakarta := time.FixedZone("WIB", 7*3600)
+	start := time.Date(2024, 3, 10, 5, 30, 0, 0, jakarta) // 2024-03-09 22:30 UTC
+	end := time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC)
+
+	windowStart, windowEnd := rollupWindow(start, end)
+	if want := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC); !windowStart.Equal(want) {
+		t.Errorf("start = %v, want %v", windowStart, want)
+	}
+	// A reading at midnight belongs to the bucket starting then
+	if want := time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC); !windowEnd.Equal(want) {
+		t.Errorf("end = %v, want %v", windowEnd, want)
+	}
+}
@@ -1,7 +1,10 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"path/filepath"
 	"strings"
@@ -149,6 +152,38 @@ func (s *S3Service) UploadHarvestProof(file multipart.File, header *multipart.Fi
 	return s.UploadFile(file, header, folder)
 }
 
+// UploadFirmware uploads a gateway firmware image and returns the hex encoded
+// SHA-256 of the uploaded bytes
+func (s *S3Service) UploadFirmware(file multipart.File, header *multipart.FileHeader, version string) (*UploadResult, string, error) {
+	// Validate file size (16MB limit for firmware images)
+	maxSize := int64(16 * 1024 * 1024)
+	if header.Size > maxSize {
+		return nil, "", fmt.Errorf("file size %d exceeds maximum allowed size %d", header.Size, maxSize)
+	}
+
+	filename := s.generateUniqueFilename(header.Filename, "firmware/"+version)
+
+	// Hash the image while it is streamed to S3
+	hash := sha256.New()
+	result, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.config.S3.Bucket),
+		Key:         aws.String(filename),
+		Body:        io.TeeReader(file, hash),
+		ContentType: aws.String("application/octet-stream"),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	return &UploadResult{
+		URL:      result.Location,
+		Key:      filename,
+		Bucket:   s.config.S3.Bucket,
+		Size:     header.Size,
+		MimeType: "application/octet-stream",
+	}, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // DeleteFile deletes a file from S3
 func (s *S3Service) DeleteFile(key string) error {
 	_, err := s.s3Client.DeleteObject(&s3.DeleteObjectInput{
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"time"
+)
+
+// sensorContextTables are the raw sensor hypertables that store the house and
+// floor of each reading
+var sensorContextTables = []string{"sensors", "sensor_measurements"}
+
+// assignmentRange is the period in which readings of a device belong to one
+// assignment; a zero From or To leaves that side open
+type assignmentRange struct {
+	From, To       time.Time
+	SwifletHouseID int
+	Floor          int
+}
+
+// assignmentRanges splits time between the assignments of a device, oldest
+// first, the way AssignmentAt attributes readings: readings before the first
+// assignment belong to it and readings after the last one started to that one
+func assignmentRanges(assignments []models.DeviceAssignment) []assignmentRange {
+	ranges := make([]assignmentRange, len(assignments))
+	for i, assignment := range assignments {
+		ranges[i] = assignmentRange{SwifletHouseID: assignment.SwifletHouseID, Floor: assignment.Floor}
+		if i > 0 {
+			ranges[i].From = assignment.AssignedAt
+		}
+		if i < len(assignments)-1 {
+			ranges[i].To = assignments[i+1].AssignedAt
+		}
+	}
+	return ranges
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// BackfillSensorContext fills in the house and floor of readings stored before
+// devices reported them (migrations/003_sensor_device_context.sql) from the
+// assignment history of their device, so they are visible to the house's
+// members, and refreshes the rollups of the period they cover
+func BackfillSensorContext(db *database.DB) error {
+	var installCodes []string
+	var first, last sql.NullTime
+	for _, table := range sensorContextTables {
+		rows, err := db.TimescaleDB.Query(fmt.Sprintf(`
+			SELECT install_code, MIN(timestamp), MAX(timestamp)
+			FROM %s WHERE id_swiflet_house IS NULL
+			GROUP BY install_code
+		`, table))
+		if err != nil {
+			return fmt.Errorf("failed to find readings of %s without a house: %w", table, err)
+		}
+		for rows.Next() {
+			var installCode string
+			var from, to time.Time
+			if err := rows.Scan(&installCode, &from, &to); err != nil {
+				rows.Close()
+				return err
+			}
+			installCodes = append(installCodes, installCode)
+			if !first.Valid || from.Before(first.Time) {
+				first = sql.NullTime{Time: from, Valid: true}
+			}
+			if to.After(last.Time) {
+				last = sql.NullTime{Time: to, Valid: true}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(installCodes) == 0 {
+		return nil
+	}
+
+	var updated int64
+	done := make(map[string]bool)
+	for _, installCode := range installCodes {
+		if done[installCode] {
+			continue
+		}
+		done[installCode] = true
+
+		// Deleted devices keep their history
+		var deviceID int
+		err := db.PostgreSQL.QueryRow("SELECT id FROM iot_devices WHERE install_code = $1", installCode).Scan(&deviceID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		assignments, err := LoadAssignments(db, deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to load assignments of %s: %w", installCode, err)
+		}
+
+		for _, r := range assignmentRanges(assignments) {
+			for _, table := range sensorContextTables {
+				result, err := db.TimescaleDB.Exec(fmt.Sprintf(`
+					UPDATE %s SET id_swiflet_house = $1, floor = $2
+					WHERE install_code = $3 AND id_swiflet_house IS NULL
+						AND ($4::TIMESTAMPTZ IS NULL OR timestamp >= $4)
+						AND ($5::TIMESTAMPTZ IS NULL OR timestamp < $5)
+				`, table), r.SwifletHouseID, r.Floor, installCode, nullTime(r.From), nullTime(r.To))
+				if err != nil {
+					return fmt.Errorf("failed to fill in readings of %s: %w", installCode, err)
+				}
+				affected, _ := result.RowsAffected()
+				updated += affected
+			}
+		}
+	}
+
+	if updated == 0 {
+		return nil
+	}
+	log.Printf("Filled in the house and floor of %d readings stored without them", updated)
+	return RefreshRollups(db, first.Time, last.Time)
+}
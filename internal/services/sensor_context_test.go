@@ -0,0 +1,47 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestAssignmentRanges(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	assignments := []models.DeviceAssignment{
+		{ID: 1, SwifletHouseID: 1, Floor: 1, AssignedAt: day(0)},
+		{ID: 2, SwifletHouseID: 1, Floor: 3, AssignedAt: day(10)},
+		{ID: 3, SwifletHouseID: 2, Floor: 2, AssignedAt: day(20)},
+	}
+
+	ranges := assignmentRanges(assignments)
+	if len(ranges) != len(assignments) {
+		t.Fatalf("got %d ranges, want %d", len(ranges), len(assignments))
+	}
+	if !ranges[0].From.IsZero() || !ranges[len(ranges)-1].To.IsZero() {
+		t.Errorf("outer ranges are not open: %+v", ranges)
+	}
+
+	// Every reading falls in the range of the assignment AssignmentAt picks
+	for _, d := range []int{-5, 0, 9, 10, 19, 20, 400} {
+		at := day(d)
+		want, _ := AssignmentAt(assignments, at)
+		matched := 0
+		for _, r := range ranges {
+			if (r.From.IsZero() || !at.Before(r.From)) && (r.To.IsZero() || at.Before(r.To)) {
+				matched++
+				if r.SwifletHouseID != want.SwifletHouseID || r.Floor != want.Floor {
+					t.Errorf("%s: got house %d floor %d, want house %d floor %d", at.Format(time.DateOnly),
+						r.SwifletHouseID, r.Floor, want.SwifletHouseID, want.Floor)
+				}
+			}
+		}
+		if matched != 1 {
+			t.Errorf("%s: matched %d ranges, want 1", at.Format(time.DateOnly), matched)
+		}
+	}
+
+	if len(assignmentRanges(nil)) != 0 {
+		t.Error("got ranges for an empty history")
+	}
+}
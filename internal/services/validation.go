@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"swiflet-backend/internal/database"
+	"swiflet-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// QuarantinedValue is a sensor value that failed validation
+type QuarantinedValue struct {
+	Metric string
+	Value  float64
+	Reason string
+	Detail string
+}
+
+type lastValue struct {
+	value     float64
+	timestamp time.Time
+}
+
+// ReadingValidator checks sensor values against the physical range of their
+// metric type and against the device's last accepted value of the metric.
+// Only accepted values become the reference for the spike check, so a glitch
+// does not make the following good reading look like a spike.
+type ReadingValidator struct {
+	registry *DeviceRegistry
+	// spikeWindow bounds how old the last value may be to still be compared
+	spikeWindow time.Duration
+
+	mu   sync.Mutex
+	last map[string]map[string]lastValue
+}
+
+func NewReadingValidator(registry *DeviceRegistry, spikeWindow time.Duration) *ReadingValidator {
+	return &ReadingValidator{
+		registry:    registry,
+		spikeWindow: spikeWindow,
+		last:        make(map[string]map[string]lastValue),
+	}
+}
+
+// Validate splits the values of a reading into accepted and quarantined ones
+func (v *ReadingValidator) Validate(installCode string, values map[string]float64, timestamp time.Time) (map[string]float64, []QuarantinedValue) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	deviceLast := v.last[installCode]
+	if deviceLast == nil {
+		deviceLast = make(map[string]lastValue)
+		v.last[installCode] = deviceLast
+	}
+
+	accepted := make(map[string]float64, len(values))
+	var quarantined []QuarantinedValue
+
+	for metric, value := range values {
+		metricType, ok := v.registry.MetricType(metric)
+		if !ok {
+			accepted[metric] = value
+			continue
+		}
+
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < metricType.MinValue || value > metricType.MaxValue {
+			quarantined = append(quarantined, QuarantinedValue{
+				Metric: metric,
+				Value:  value,
+				Reason: models.QuarantineOutOfRange,
+				Detail: fmt.Sprintf("outside valid range %g to %g %s", metricType.MinValue, metricType.MaxValue, metricType.Unit),
+			})
+			continue
+		}
+
+		previous, hasPrevious := deviceLast[metric]
+		if hasPrevious && metricType.MaxChangePerMinute != nil {
+			elapsed := timestamp.Sub(previous.timestamp)
+			if elapsed > 0 && (v.spikeWindow <= 0 || elapsed <= v.spikeWindow) {
+				// Readings less than a minute apart may still change by a full minute's limit
+				allowed := *metricType.MaxChangePerMinute * math.Max(elapsed.Minutes(), 1)
+				if change := math.Abs(value - previous.value); change > allowed {
+					quarantined = append(quarantined, QuarantinedValue{
+						Metric: metric,
+						Value:  value,
+						Reason: models.QuarantineSpike,
+						Detail: fmt.Sprintf("changed by %g %s in %v from %g, limit %g", change, metricType.Unit,
+							elapsed.Round(time.Second), previous.value, allowed),
+					})
+					continue
+				}
+			}
+		}
+
+		accepted[metric] = value
+		// Late readings must not replace a newer reference value
+		if !hasPrevious || timestamp.After(previous.timestamp) {
+			deviceLast[metric] = lastValue{value: value, timestamp: timestamp}
+		}
+	}
+
+	return accepted, quarantined
+}
+
+// Load seeds the reference values from readings stored within the spike
+// window, so spikes are also caught right after a restart
+func (v *ReadingValidator) Load(db *database.DB) error {
+	if v.spikeWindow <= 0 {
+		return nil
+	}
+
+	rows, err := db.TimescaleDB.Query(`
+		SELECT DISTINCT ON (install_code, metric) install_code, metric, value, timestamp
+		FROM sensor_readings
+		WHERE timestamp > $1
+		ORDER BY install_code, metric, timestamp DESC
+	`, time.Now().Add(-v.spikeWindow))
+	if err != nil {
+		return fmt.Errorf("failed to load last sensor values: %w", err)
+	}
+	defer rows.Close()
+
+	last := make(map[string]map[string]lastValue)
+	for rows.Next() {
+		var installCode, metric string
+		var value lastValue
+		if err := rows.Scan(&installCode, &metric, &value.value, &value.timestamp); err != nil {
+			return fmt.Errorf("failed to scan last sensor value: %w", err)
+		}
+		if last[installCode] == nil {
+			last[installCode] = make(map[string]lastValue)
+		}
+		last[installCode][metric] = value
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load last sensor values: %w", err)
+	}
+
+	v.mu.Lock()
+	v.last = last
+	v.mu.Unlock()
+
+	return nil
+}
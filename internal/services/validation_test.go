@@ -0,0 +1,81 @@
+package services
+
+import (
+	"swiflet-backend/internal/models"
+	"testing"
+	"time"
+)
+
+func testValidator() *ReadingValidator {
+	limit := 2.0
+	registry := NewDeviceRegistry(nil, 0)
+	registry.metricTypes = map[string]models.MetricType{
+		models.MetricSuhu:       {Key: models.MetricSuhu, MinValue: -10, MaxValue: 60, MaxChangePerMinute: &limit},
+		models.MetricKelembaban: {Key: models.MetricKelembaban, MinValue: 0, MaxValue: 100},
+	}
+	return NewReadingValidator(registry, 30*time.Minute)
+}
+
+func TestReadingValidatorRange(t *testing.T) {
+	validator := testValidator()
+	now := time.Now()
+
+	accepted, quarantined := validator.Validate("DEV1", map[string]float64{
+		models.MetricSuhu:       -127,
+		models.MetricKelembaban: 250,
+	}, now)
+
+	if len(accepted) != 0 {
+		t.Fatalf("expected no accepted values, got %v", accepted)
+	}
+	if len(quarantined) != 2 {
+		t.Fatalf("expected 2 quarantined values, got %d", len(quarantined))
+	}
+	for _, value := range quarantined {
+		if value.Reason != models.QuarantineOutOfRange {
+			t.Errorf("%s: expected reason %s, got %s", value.Metric, models.QuarantineOutOfRange, value.Reason)
+		}
+	}
+}
+
+func TestReadingValidatorSpike(t *testing.T) {
+	validator := testValidator()
+	now := time.Now()
+
+	if _, quarantined := validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 28}, now); len(quarantined) != 0 {
+		t.Fatalf("first reading should be accepted, got %v", quarantined)
+	}
+
+	_, quarantined := validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 45}, now.Add(time.Minute))
+	if len(quarantined) != 1 || quarantined[0].Reason != models.QuarantineSpike {
+		t.Fatalf("expected a spike, got %v", quarantined)
+	}
+
+	// The spike must not become the reference value
+	accepted, quarantined := validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 29}, now.Add(2*time.Minute))
+	if len(quarantined) != 0 || accepted[models.MetricSuhu] != 29 {
+		t.Fatalf("expected 29 to be accepted, got accepted %v quarantined %v", accepted, quarantined)
+	}
+
+	// A large change is plausible over a long enough period
+	accepted, _ = validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 39}, now.Add(10*time.Minute))
+	if _, ok := accepted[models.MetricSuhu]; !ok {
+		t.Fatal("expected gradual change to be accepted")
+	}
+
+	// Other devices have their own reference values
+	if _, quarantined := validator.Validate("DEV2", map[string]float64{models.MetricSuhu: 20}, now); len(quarantined) != 0 {
+		t.Fatalf("expected reading of another device to be accepted, got %v", quarantined)
+	}
+}
+
+func TestReadingValidatorSpikeWindow(t *testing.T) {
+	validator := testValidator()
+	now := time.Now()
+
+	validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 20}, now)
+	_, quarantined := validator.Validate("DEV1", map[string]float64{models.MetricSuhu: 59}, now.Add(time.Hour))
+	if len(quarantined) != 0 {
+		t.Fatalf("expected value after the spike window to be accepted, got %v", quarantined)
+	}
+}
@@ -20,5 +20,4 @@ CREATE INDEX IF NOT EXISTS idx_sensors_install_code ON sensors(install_code);
 CREATE INDEX IF NOT EXISTS idx_sensors_timestamp ON sensors(timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_sensors_install_code_timestamp ON sensors(install_code, timestamp DESC);
 
--- Create retention policy (optional: keep data for 1 year)
--- SELECT add_retention_policy('sensors', INTERVAL '1 year');
\ No newline at end of file
+-- Retention policies are applied by the backend at startup, see SENSOR_RAW_RETENTION
\ No newline at end of file
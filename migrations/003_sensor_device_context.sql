@@ -0,0 +1,7 @@
+-- TimescaleDB schema update
+-- Store the house and floor a reading was taken on alongside the install_code
+
+ALTER TABLE sensors ADD COLUMN IF NOT EXISTS id_swiflet_house INTEGER;
+ALTER TABLE sensors ADD COLUMN IF NOT EXISTS floor INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_sensors_house_floor_timestamp ON sensors(id_swiflet_house, floor, timestamp DESC);
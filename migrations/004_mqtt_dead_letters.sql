@@ -0,0 +1,16 @@
+-- PostgreSQL schema update
+-- Dead-letter store for MQTT sensor messages rejected by ingestion
+
+CREATE TABLE IF NOT EXISTS mqtt_dead_letters (
+    id SERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    payload BYTEA NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    error TEXT,
+    replay_count INTEGER DEFAULT 0,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_mqtt_dead_letters_reason ON mqtt_dead_letters(reason);
+CREATE INDEX IF NOT EXISTS idx_mqtt_dead_letters_received_at ON mqtt_dead_letters(received_at DESC);
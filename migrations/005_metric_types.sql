@@ -0,0 +1,30 @@
+-- PostgreSQL schema update
+-- Registered sensor metric types and the metrics each device reports
+
+CREATE TABLE IF NOT EXISTS metric_types (
+    id SERIAL PRIMARY KEY,
+    key VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    unit VARCHAR(50) NOT NULL,
+    min_value DOUBLE PRECISION NOT NULL,
+    max_value DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (min_value < max_value)
+);
+
+CREATE TABLE IF NOT EXISTS device_metrics (
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    metric_key VARCHAR(50) NOT NULL REFERENCES metric_types(key) ON UPDATE CASCADE ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id_device, metric_key)
+);
+
+INSERT INTO metric_types (key, name, unit, min_value, max_value) VALUES
+    ('suhu', 'Temperature', '°C', -10, 60),
+    ('kelembaban', 'Relative humidity', '%', 0, 100),
+    ('nh3', 'Ammonia', 'ppm', 0, 500),
+    ('co2', 'Carbon dioxide', 'ppm', 0, 10000),
+    ('light', 'Light level', 'lux', 0, 100000),
+    ('sound_player', 'Sound player status', 'state', 0, 1)
+ON CONFLICT (key) DO NOTHING;
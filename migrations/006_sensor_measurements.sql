@@ -0,0 +1,27 @@
+-- TimescaleDB schema update
+-- Narrow measurements table for sensor channels other than the temperature/humidity pair
+
+CREATE TABLE IF NOT EXISTS sensor_measurements (
+    install_code VARCHAR(255) NOT NULL,
+    id_swiflet_house INTEGER,
+    floor INTEGER,
+    metric VARCHAR(50) NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+SELECT create_hypertable('sensor_measurements', 'timestamp', if_not_exists => TRUE);
+
+CREATE INDEX IF NOT EXISTS idx_sensor_measurements_install_code_metric ON sensor_measurements(install_code, metric, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_sensor_measurements_house_floor ON sensor_measurements(id_swiflet_house, floor, metric, timestamp DESC);
+
+-- Every reading, one row per metric, whichever table it is stored in
+CREATE OR REPLACE VIEW sensor_readings AS
+    SELECT install_code, id_swiflet_house, floor, 'suhu'::VARCHAR(50) AS metric, suhu::DOUBLE PRECISION AS value, timestamp
+    FROM sensors
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, 'kelembaban'::VARCHAR(50) AS metric, kelembaban::DOUBLE PRECISION AS value, timestamp
+    FROM sensors
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, metric, value, timestamp
+    FROM sensor_measurements;
@@ -0,0 +1,10 @@
+-- PostgreSQL schema update
+-- Maximum plausible rate of change per metric, used to detect spikes
+
+ALTER TABLE metric_types ADD COLUMN IF NOT EXISTS max_change_per_minute DOUBLE PRECISION
+    CHECK (max_change_per_minute IS NULL OR max_change_per_minute > 0);
+
+UPDATE metric_types SET max_change_per_minute = 2 WHERE key = 'suhu' AND max_change_per_minute IS NULL;
+UPDATE metric_types SET max_change_per_minute = 10 WHERE key = 'kelembaban' AND max_change_per_minute IS NULL;
+UPDATE metric_types SET max_change_per_minute = 50 WHERE key = 'nh3' AND max_change_per_minute IS NULL;
+UPDATE metric_types SET max_change_per_minute = 1000 WHERE key = 'co2' AND max_change_per_minute IS NULL;
@@ -0,0 +1,19 @@
+-- TimescaleDB schema update
+-- Sensor values rejected by range or spike validation
+
+CREATE TABLE IF NOT EXISTS sensor_quarantine (
+    install_code VARCHAR(255) NOT NULL,
+    id_swiflet_house INTEGER,
+    floor INTEGER,
+    metric VARCHAR(50) NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    detail TEXT,
+    timestamp TIMESTAMPTZ NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+SELECT create_hypertable('sensor_quarantine', 'timestamp', if_not_exists => TRUE);
+
+CREATE INDEX IF NOT EXISTS idx_sensor_quarantine_install_code ON sensor_quarantine(install_code, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_sensor_quarantine_reason ON sensor_quarantine(reason, timestamp DESC);
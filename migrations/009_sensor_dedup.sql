@@ -0,0 +1,19 @@
+-- TimescaleDB schema update
+-- One reading per install_code and timestamp, so redelivered MQTT messages are not stored twice
+
+-- Remove duplicates stored before the unique indexes existed
+DELETE FROM sensors a
+USING sensors b
+WHERE a.install_code = b.install_code
+  AND a.timestamp = b.timestamp
+  AND a.id > b.id;
+
+DELETE FROM sensor_measurements a
+USING sensor_measurements b
+WHERE a.install_code = b.install_code
+  AND a.metric = b.metric
+  AND a.timestamp = b.timestamp
+  AND a.ctid > b.ctid;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sensors_install_code_timestamp_unique ON sensors(install_code, timestamp);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sensor_measurements_install_code_metric_timestamp_unique ON sensor_measurements(install_code, metric, timestamp);
@@ -0,0 +1,16 @@
+-- PostgreSQL schema update
+-- Last-seen time and online/offline status of IoT devices, with transition history
+
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP;
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS connection_status VARCHAR(20) NOT NULL DEFAULT 'unknown';
+
+CREATE TABLE IF NOT EXISTS device_status_history (
+    id SERIAL PRIMARY KEY,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    previous_status VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    last_seen_at TIMESTAMP,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_status_history_device ON device_status_history(id_device, changed_at DESC);
@@ -0,0 +1,20 @@
+-- PostgreSQL schema update
+-- Control commands sent to IoT devices and their acknowledgement status
+
+CREATE TABLE IF NOT EXISTS device_commands (
+    id SERIAL PRIMARY KEY,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    install_code VARCHAR(255) NOT NULL,
+    id_user INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    command VARCHAR(100) NOT NULL,
+    params JSONB,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    error TEXT,
+    sent_at TIMESTAMP,
+    acked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_commands_device ON device_commands(id_device, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_device_commands_status ON device_commands(status, sent_at);
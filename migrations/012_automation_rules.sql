@@ -0,0 +1,40 @@
+-- PostgreSQL schema update
+-- Automation rules that send control commands when sensor readings cross a threshold
+
+CREATE TABLE IF NOT EXISTS automation_rules (
+    id SERIAL PRIMARY KEY,
+    id_user INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    floor INTEGER,
+    name VARCHAR(255) NOT NULL,
+    metric VARCHAR(50) NOT NULL REFERENCES metric_types(key) ON UPDATE CASCADE,
+    operator VARCHAR(10) NOT NULL CHECK (operator IN ('below', 'above')),
+    threshold DOUBLE PRECISION NOT NULL,
+    duration_seconds INTEGER NOT NULL DEFAULT 0 CHECK (duration_seconds >= 0),
+    hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (hysteresis >= 0),
+    cooldown_seconds INTEGER NOT NULL DEFAULT 0 CHECK (cooldown_seconds >= 0),
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    command VARCHAR(100) NOT NULL,
+    params JSONB,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    last_triggered_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_automation_rules_house ON automation_rules(id_swiflet_house);
+
+CREATE TABLE IF NOT EXISTS automation_audit_log (
+    id SERIAL PRIMARY KEY,
+    id_rule INTEGER NOT NULL REFERENCES automation_rules(id) ON DELETE CASCADE,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    id_command INTEGER REFERENCES device_commands(id) ON DELETE SET NULL,
+    metric VARCHAR(50) NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    threshold DOUBLE PRECISION NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    triggered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_automation_audit_log_rule ON automation_audit_log(id_rule, triggered_at DESC);
@@ -0,0 +1,41 @@
+-- PostgreSQL schema update
+-- Threshold alert rules per house or floor and the alerts they raise
+
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id SERIAL PRIMARY KEY,
+    id_user INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    floor INTEGER,
+    name VARCHAR(255) NOT NULL,
+    metric VARCHAR(50) NOT NULL REFERENCES metric_types(key) ON UPDATE CASCADE,
+    operator VARCHAR(10) NOT NULL CHECK (operator IN ('below', 'above')),
+    warning_threshold DOUBLE PRECISION NOT NULL,
+    critical_threshold DOUBLE PRECISION NOT NULL,
+    hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (hysteresis >= 0),
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_alert_rules_house ON alert_rules(id_swiflet_house);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id SERIAL PRIMARY KEY,
+    id_rule INTEGER NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    floor INTEGER,
+    metric VARCHAR(50) NOT NULL,
+    severity VARCHAR(20) NOT NULL CHECK (severity IN ('warning', 'critical')),
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'acknowledged', 'resolved')),
+    value DOUBLE PRECISION NOT NULL,
+    peak_value DOUBLE PRECISION NOT NULL,
+    opened_at TIMESTAMP NOT NULL,
+    acknowledged_at TIMESTAMP,
+    acknowledged_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_house_status ON alerts(id_swiflet_house, status, opened_at DESC);
+CREATE INDEX IF NOT EXISTS idx_alerts_rule_status ON alerts(id_rule, status);
@@ -0,0 +1,77 @@
+-- TimescaleDB schema update
+-- Hourly and daily continuous aggregates of sensor readings with refresh policies.
+-- Retention of raw readings and rollups is applied by the backend at startup (SENSOR_*_RETENTION).
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS sensors_hourly
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT time_bucket(INTERVAL '1 hour', timestamp) AS timestamp, install_code, id_swiflet_house, floor,
+        MIN(suhu::DOUBLE PRECISION) AS suhu_min, MAX(suhu::DOUBLE PRECISION) AS suhu_max, AVG(suhu::DOUBLE PRECISION) AS suhu_avg,
+        MIN(kelembaban::DOUBLE PRECISION) AS kelembaban_min, MAX(kelembaban::DOUBLE PRECISION) AS kelembaban_max,
+        AVG(kelembaban::DOUBLE PRECISION) AS kelembaban_avg,
+        COUNT(*) AS sample_count
+    FROM sensors
+    GROUP BY 1, install_code, id_swiflet_house, floor;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS sensor_measurements_hourly
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT time_bucket(INTERVAL '1 hour', timestamp) AS timestamp, install_code, id_swiflet_house, floor, metric,
+        MIN(value) AS min_value, MAX(value) AS max_value, AVG(value) AS avg_value, COUNT(*) AS sample_count
+    FROM sensor_measurements
+    GROUP BY 1, install_code, id_swiflet_house, floor, metric;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS sensors_daily
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT time_bucket(INTERVAL '1 day', timestamp) AS timestamp, install_code, id_swiflet_house, floor,
+        MIN(suhu::DOUBLE PRECISION) AS suhu_min, MAX(suhu::DOUBLE PRECISION) AS suhu_max, AVG(suhu::DOUBLE PRECISION) AS suhu_avg,
+        MIN(kelembaban::DOUBLE PRECISION) AS kelembaban_min, MAX(kelembaban::DOUBLE PRECISION) AS kelembaban_max,
+        AVG(kelembaban::DOUBLE PRECISION) AS kelembaban_avg,
+        COUNT(*) AS sample_count
+    FROM sensors
+    GROUP BY 1, install_code, id_swiflet_house, floor;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS sensor_measurements_daily
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+    SELECT time_bucket(INTERVAL '1 day', timestamp) AS timestamp, install_code, id_swiflet_house, floor, metric,
+        MIN(value) AS min_value, MAX(value) AS max_value, AVG(value) AS avg_value, COUNT(*) AS sample_count
+    FROM sensor_measurements
+    GROUP BY 1, install_code, id_swiflet_house, floor, metric;
+
+-- Refresh the last 3 days; older buckets stay as materialized, so raw
+-- retention must be longer than the refresh window
+SELECT add_continuous_aggregate_policy('sensors_hourly',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE);
+SELECT add_continuous_aggregate_policy('sensor_measurements_hourly',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE);
+SELECT add_continuous_aggregate_policy('sensors_daily',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE);
+SELECT add_continuous_aggregate_policy('sensor_measurements_daily',
+    start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE);
+
+-- Every rollup, one row per metric, like the sensor_readings view
+CREATE OR REPLACE VIEW sensor_readings_hourly AS
+    SELECT install_code, id_swiflet_house, floor, 'suhu'::VARCHAR(50) AS metric,
+        suhu_min AS min_value, suhu_max AS max_value, suhu_avg AS avg_value, sample_count, timestamp
+    FROM sensors_hourly
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, 'kelembaban'::VARCHAR(50) AS metric,
+        kelembaban_min AS min_value, kelembaban_max AS max_value, kelembaban_avg AS avg_value, sample_count, timestamp
+    FROM sensors_hourly
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, metric, min_value, max_value, avg_value, sample_count, timestamp
+    FROM sensor_measurements_hourly;
+
+CREATE OR REPLACE VIEW sensor_readings_daily AS
+    SELECT install_code, id_swiflet_house, floor, 'suhu'::VARCHAR(50) AS metric,
+        suhu_min AS min_value, suhu_max AS max_value, suhu_avg AS avg_value, sample_count, timestamp
+    FROM sensors_daily
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, 'kelembaban'::VARCHAR(50) AS metric,
+        kelembaban_min AS min_value, kelembaban_max AS max_value, kelembaban_avg AS avg_value, sample_count, timestamp
+    FROM sensors_daily
+    UNION ALL
+    SELECT install_code, id_swiflet_house, floor, metric, min_value, max_value, avg_value, sample_count, timestamp
+    FROM sensor_measurements_daily;
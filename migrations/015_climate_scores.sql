@@ -0,0 +1,19 @@
+-- PostgreSQL schema update
+-- Daily climate suitability score of every house floor
+
+CREATE TABLE IF NOT EXISTS climate_scores (
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    floor INTEGER NOT NULL,
+    day DATE NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    time_in_band DOUBLE PRECISION NOT NULL,
+    coverage DOUBLE PRECISION NOT NULL,
+    sample_count INTEGER NOT NULL,
+    metrics JSONB NOT NULL,
+    excursions JSONB NOT NULL,
+    final BOOLEAN NOT NULL DEFAULT FALSE,
+    computed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id_swiflet_house, floor, day)
+);
+
+CREATE INDEX IF NOT EXISTS idx_climate_scores_day ON climate_scores(day);
@@ -0,0 +1,25 @@
+-- PostgreSQL schema update
+-- Sensor faults found by the anomaly detector and the maintenance flag they raise
+
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS maintenance_needed BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS device_faults (
+    id SERIAL PRIMARY KEY,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('flat_line', 'drift', 'gap')),
+    -- Empty for faults of the whole device
+    metric VARCHAR(50) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved')),
+    value DOUBLE PRECISION,
+    detail TEXT NOT NULL,
+    detected_at TIMESTAMP NOT NULL,
+    last_detected_at TIMESTAMP NOT NULL,
+    resolved_at TIMESTAMP,
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A device has at most one open fault of a kind per metric
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_faults_open ON device_faults(id_device, kind, metric) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_device_faults_device ON device_faults(id_device, detected_at DESC);
@@ -0,0 +1,23 @@
+-- PostgreSQL schema update
+-- Provisioned gateways with generated install codes, per-device MQTT secrets
+-- and the claim codes that bind them to a swiflet house
+
+CREATE TABLE IF NOT EXISTS device_provisions (
+    id SERIAL PRIMARY KEY,
+    install_code VARCHAR(255) NOT NULL UNIQUE,
+    -- SHA-256 of the MQTT secret; the secret itself is only shown once
+    secret_hash VARCHAR(64) NOT NULL,
+    -- SHA-256 of the normalized claim code; NULL for devices registered directly
+    claim_code_hash VARCHAR(64),
+    status VARCHAR(20) NOT NULL DEFAULT 'unclaimed' CHECK (status IN ('unclaimed', 'claimed', 'revoked')),
+    id_device INTEGER REFERENCES iot_devices(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    claimed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    claimed_at TIMESTAMP,
+    secret_rotated_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_provisions_status ON device_provisions (status, created_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_provisions_device ON device_provisions (id_device) WHERE id_device IS NOT NULL;
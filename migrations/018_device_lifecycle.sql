@@ -0,0 +1,31 @@
+-- PostgreSQL schema update
+-- Soft delete of houses and devices, decommissioning, and the history of
+-- which house and floor each device was installed on
+
+ALTER TABLE swiflet_houses ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE swiflet_houses ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS decommissioned_at TIMESTAMP;
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS device_assignments (
+    id SERIAL PRIMARY KEY,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    floor INTEGER NOT NULL,
+    assigned_at TIMESTAMP NOT NULL,
+    -- NULL while the device is still installed there
+    unassigned_at TIMESTAMP,
+    end_reason VARCHAR(20) CHECK (end_reason IN ('moved', 'decommissioned', 'deleted')),
+    assigned_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_assignments_device ON device_assignments (id_device, assigned_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_assignments_current ON device_assignments (id_device) WHERE unassigned_at IS NULL;
+
+-- Existing devices have been where they are since they were created
+INSERT INTO device_assignments (id_device, id_swiflet_house, floor, assigned_at)
+SELECT d.id, d.id_swiflet_house, d.floor, COALESCE(d.created_at, CURRENT_TIMESTAMP)
+FROM iot_devices d
+WHERE NOT EXISTS (SELECT 1 FROM device_assignments a WHERE a.id_device = d.id);
@@ -0,0 +1,35 @@
+-- PostgreSQL schema update
+-- Shared access to swiflet houses: members with a role and the email
+-- invitations that add them. The owner stays in swiflet_houses.id_user.
+
+CREATE TABLE IF NOT EXISTS house_members (
+    id SERIAL PRIMARY KEY,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    id_user INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('manager', 'worker', 'viewer')),
+    invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (id_swiflet_house, id_user)
+);
+
+CREATE INDEX IF NOT EXISTS idx_house_members_user ON house_members (id_user);
+
+CREATE TABLE IF NOT EXISTS house_invitations (
+    id SERIAL PRIMARY KEY,
+    id_swiflet_house INTEGER NOT NULL REFERENCES swiflet_houses(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('manager', 'worker', 'viewer')),
+    -- SHA-256 of the token sent by email; the token itself is never stored
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'revoked')),
+    invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    accepted_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_house_invitations_house ON house_invitations (id_swiflet_house, status);
+CREATE INDEX IF NOT EXISTS idx_house_invitations_email ON house_invitations (email) WHERE status = 'pending';
@@ -0,0 +1,63 @@
+-- PostgreSQL schema update
+-- Firmware images of the Node Gateways, the version each device reports and
+-- staged over-the-air rollouts
+
+CREATE TABLE IF NOT EXISTS firmware_releases (
+    id SERIAL PRIMARY KEY,
+    version VARCHAR(50) NOT NULL UNIQUE,
+    s3_key VARCHAR(500) NOT NULL,
+    size BIGINT NOT NULL,
+    -- Hex encoded SHA-256 of the image, checked by the device before flashing
+    sha256 CHAR(64) NOT NULL,
+    notes TEXT,
+    uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS firmware_version VARCHAR(50);
+-- When the device last reported a different firmware version
+ALTER TABLE iot_devices ADD COLUMN IF NOT EXISTS firmware_updated_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS firmware_rollouts (
+    id SERIAL PRIMARY KEY,
+    id_firmware INTEGER NOT NULL REFERENCES firmware_releases(id) ON DELETE RESTRICT,
+    -- The house the devices were selected from, NULL for a list of devices
+    id_swiflet_house INTEGER REFERENCES swiflet_houses(id) ON DELETE SET NULL,
+    floor INTEGER,
+    status VARCHAR(20) NOT NULL DEFAULT 'scheduled'
+        CHECK (status IN ('scheduled', 'running', 'paused', 'completed', 'halted', 'cancelled')),
+    batch_size INTEGER NOT NULL CHECK (batch_size > 0),
+    max_failures INTEGER NOT NULL DEFAULT 0 CHECK (max_failures >= 0),
+    current_stage INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    scheduled_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_firmware_rollouts_status ON firmware_rollouts (status, scheduled_at);
+
+CREATE TABLE IF NOT EXISTS firmware_rollout_devices (
+    id SERIAL PRIMARY KEY,
+    id_rollout INTEGER NOT NULL REFERENCES firmware_rollouts(id) ON DELETE CASCADE,
+    id_device INTEGER NOT NULL REFERENCES iot_devices(id) ON DELETE CASCADE,
+    install_code VARCHAR(255) NOT NULL,
+    stage INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'sent', 'succeeded', 'failed', 'cancelled')),
+    -- The version the device reported when the rollout was created
+    from_version VARCHAR(50),
+    id_command INTEGER REFERENCES device_commands(id) ON DELETE SET NULL,
+    error TEXT,
+    sent_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (id_rollout, id_device)
+);
+
+CREATE INDEX IF NOT EXISTS idx_firmware_rollout_devices_stage ON firmware_rollout_devices (id_rollout, stage, status);
+CREATE INDEX IF NOT EXISTS idx_firmware_rollout_devices_device ON firmware_rollout_devices (id_device, status);
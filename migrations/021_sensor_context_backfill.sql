@@ -0,0 +1,10 @@
+-- TimescaleDB schema update
+-- Readings stored before 003_sensor_device_context.sql have no house and floor.
+-- The devices and their assignment history live in PostgreSQL, so the backend
+-- fills them in at startup; these indexes find the rows left to fill and stay
+-- empty afterwards.
+
+CREATE INDEX IF NOT EXISTS idx_sensors_missing_context ON sensors(install_code, timestamp)
+    WHERE id_swiflet_house IS NULL;
+CREATE INDEX IF NOT EXISTS idx_sensor_measurements_missing_context ON sensor_measurements(install_code, timestamp)
+    WHERE id_swiflet_house IS NULL;